@@ -0,0 +1,438 @@
+package xixi_kv
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	// 备份清单文件名称
+	backupManifestName = "backup-manifest"
+	// 备份数据文件存放目录
+	backupObjectDirName = "objects"
+	// 恢复时的临时目录
+	restoreTempDirName = "restore-temp"
+	// 复制数据文件的缓冲区大小
+	backupCopyBufferSize = 1024 * 1024
+)
+
+// BackupManifest 备份清单, 记录备份目录中的全部备份
+type BackupManifest struct {
+	Backups []*BackupEntry `json:"backups"`
+}
+
+// BackupEntry 单次备份, 记录备份时刻组成数据库的全部数据文件
+type BackupEntry struct {
+	Id        uint32        `json:"id"`
+	Timestamp int64         `json:"timestamp"` // 备份时刻, 单位纳秒时间戳
+	SeqNo     uint64        `json:"seq_no"`    // 备份时刻的日志序列号, 备份包含不超过该序列号的全部写入
+	Files     []*BackupFile `json:"files"`
+}
+
+// BackupFile 备份的数据文件
+type BackupFile struct {
+	FileId   uint32 `json:"file_id"`
+	Object   string `json:"object"`              // 备份目录中对应的文件名称
+	Size     int64  `json:"size"`                // 备份的数据量, 活跃文件为备份时刻的写入偏移
+	ModTime  int64  `json:"mod_time"`            // 已封存文件的修改时间, 用于判断是否已备份
+	Sealed   bool   `json:"sealed"`              // 是否为已封存的旧数据文件
+	Checksum string `json:"checksum"`            // sha256 校验和
+	ValueLog bool   `json:"value_log,omitempty"` // 是否为 value log 文件
+}
+
+// 已封存数据文件的标识, merge 重写的同 id 文件大小或修改时间不同
+type sealedFileKey struct {
+	fileId   uint32
+	size     int64
+	modTime  int64
+	valueLog bool
+}
+
+// IncrementalBackup 增量备份到指定目录
+// 仅复制上次备份后新增或被 merge 重写的旧数据文件, 以及活跃文件当前已写入的部分
+// 备份通过快照读取数据文件, 复制期间不阻塞写入和 merge
+func (db *DB) IncrementalBackup(backupDir string) (*BackupEntry, error) {
+	if err := os.MkdirAll(filepath.Join(backupDir, backupObjectDirName), os.ModePerm); err != nil {
+		return nil, err
+	}
+	manifest, err := LoadBackupManifest(backupDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// 已备份的旧数据文件
+	backedUp := make(map[sealedFileKey]*BackupFile)
+	for _, entry := range manifest.Backups {
+		for _, file := range entry.Files {
+			if file.Sealed {
+				backedUp[sealedFileKey{file.FileId, file.Size, file.ModTime, file.ValueLog}] = file
+			}
+		}
+	}
+
+	// 加锁创建快照并获取旧数据文件信息, 此时数据文件与文件路径一一对应
+	db.mu.Lock()
+	snap := db.newFileSnapshot()
+	sealedKeys := make(map[uint32]sealedFileKey, len(db.getOlderFiles()))
+	for fileId := range db.getOlderFiles() {
+		info, err := os.Stat(data.GetDataFileName(db.options.DirPath, fileId))
+		if err != nil {
+			db.mu.Unlock()
+			_ = snap.Close()
+			return nil, err
+		}
+		sealedKeys[fileId] = sealedFileKey{fileId, info.Size(), info.ModTime().UnixNano(), false}
+	}
+	// 数据文件引用的 value 均已写入 value log, 仅需备份当前已写入的部分
+	valueSizes, err := db.vlog.sizes()
+	if err != nil {
+		db.mu.Unlock()
+		_ = snap.Close()
+		return nil, err
+	}
+	valueKeys := make(map[uint32]sealedFileKey, len(snap.valueFiles))
+	for fileId := range snap.valueFiles {
+		key := sealedFileKey{fileId: fileId, size: valueSizes[fileId], valueLog: true}
+		if !db.vlog.isActive(fileId) {
+			info, err := os.Stat(data.GetValueLogFileName(db.options.DirPath, fileId))
+			if err != nil {
+				db.mu.Unlock()
+				_ = snap.Close()
+				return nil, err
+			}
+			key.modTime = info.ModTime().UnixNano()
+		}
+		valueKeys[fileId] = key
+	}
+	db.mu.Unlock()
+	defer func() {
+		_ = snap.Close()
+	}()
+
+	entry := &BackupEntry{
+		Id:        uint32(len(manifest.Backups) + 1),
+		Timestamp: snap.timestamp,
+		SeqNo:     snap.seqNo,
+	}
+	fileIds := make([]uint32, 0, len(snap.dataFiles))
+	for fileId := range snap.dataFiles {
+		fileIds = append(fileIds, fileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+
+	for _, fileId := range fileIds {
+		key, sealed := sealedKeys[fileId]
+		if file, ok := backedUp[key]; sealed && ok {
+			entry.Files = append(entry.Files, file)
+			continue
+		}
+
+		// 活跃文件仅复制快照创建时刻已写入的部分
+		size := snap.activeOff
+		if sealed {
+			size = key.size
+		}
+		file, err := copyBackupObject(snap.dataFiles[fileId], size, backupDir, false)
+		if err != nil {
+			return nil, err
+		}
+		file.Sealed = sealed
+		file.ModTime = key.modTime
+		entry.Files = append(entry.Files, file)
+	}
+
+	// value log 旧文件仅会被 GC 删除, 不会被重写
+	valueFileIds := make([]uint32, 0, len(valueKeys))
+	for fileId := range valueKeys {
+		valueFileIds = append(valueFileIds, fileId)
+	}
+	sort.Slice(valueFileIds, func(i, j int) bool { return valueFileIds[i] < valueFileIds[j] })
+	for _, fileId := range valueFileIds {
+		key := valueKeys[fileId]
+		sealed := key.modTime != 0
+		if file, ok := backedUp[key]; sealed && ok {
+			entry.Files = append(entry.Files, file)
+			continue
+		}
+		file, err := copyBackupObject(snap.valueFiles[fileId], key.size, backupDir, true)
+		if err != nil {
+			return nil, err
+		}
+		file.Sealed = sealed
+		file.ModTime = key.modTime
+		entry.Files = append(entry.Files, file)
+	}
+
+	manifest.Backups = append(manifest.Backups, entry)
+	if err := writeBackupManifest(backupDir, manifest); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// LoadBackupManifest 读取备份目录中的备份清单, 不存在时返回空清单
+func LoadBackupManifest(backupDir string) (*BackupManifest, error) {
+	manifest := &BackupManifest{}
+	content, err := os.ReadFile(filepath.Join(backupDir, backupManifestName))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBackupCorrupted, err)
+	}
+	return manifest, nil
+}
+
+// LatestBackupSeqNoBefore 获取不晚于指定时刻的最近一次备份的日志序列号, 供 Restore 恢复到该次备份
+// 备份清单仅记录每次备份的时刻, 不记录单条日志记录的写入时刻, 按时间恢复的粒度为一次备份
+func LatestBackupSeqNoBefore(backupDir string, t time.Time) (uint64, error) {
+	manifest, err := LoadBackupManifest(backupDir)
+	if err != nil {
+		return 0, err
+	}
+	var seqNo uint64
+	var found bool
+	for _, entry := range manifest.Backups {
+		if entry.Timestamp <= t.UnixNano() {
+			seqNo = max(seqNo, entry.SeqNo)
+			found = true
+		}
+	}
+	if !found {
+		return 0, ErrBackupNotFound
+	}
+	return seqNo, nil
+}
+
+// Restore 从备份目录恢复数据库到 targetDir, 恢复后的数据库包含不超过 uptoSeqNo 的全部写入
+// uptoSeqNo 为 0 时恢复最近一次备份, 目标目录需不存在或为空
+// 恢复的数据目录不包含索引文件, 以 B+ 树索引打开时读取数据文件重建索引
+func Restore(backupDir, targetDir string, uptoSeqNo uint64) error {
+	options := DefaultOptions
+	options.DirPath = targetDir
+	return RestoreWithOptions(backupDir, options, uptoSeqNo)
+}
+
+// RestoreWithOptions 使用指定配置项从备份目录恢复数据库到 options.DirPath
+// 备份数据已加密时需配置对应的密钥提供者
+// 选择日志序列号不小于 uptoSeqNo 的最早一次备份, 并丢弃其中序列号更大的日志记录
+// 被 merge 清理的历史版本无法恢复
+func RestoreWithOptions(backupDir string, options Options, uptoSeqNo uint64) error {
+	if err := checkOptions(options); err != nil {
+		return err
+	}
+	manifest, err := LoadBackupManifest(backupDir)
+	if err != nil {
+		return err
+	}
+	if len(manifest.Backups) == 0 {
+		return ErrBackupNotFound
+	}
+
+	// 选择恢复使用的备份
+	entry := manifest.Backups[len(manifest.Backups)-1]
+	if uptoSeqNo > 0 {
+		for _, e := range manifest.Backups {
+			if e.SeqNo >= uptoSeqNo && e.SeqNo < entry.SeqNo {
+				entry = e
+			}
+		}
+	}
+
+	targetDir := options.DirPath
+	if entries, err := os.ReadDir(targetDir); err == nil && len(entries) > 0 {
+		return ErrDirectoryNotEmpty
+	}
+	tempDir := filepath.Join(targetDir, restoreTempDirName)
+	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	var encryptor *data.Encryptor
+	if options.KeyProvider != nil {
+		encryptor = data.NewEncryptor(options.Cipher, options.KeyProvider)
+	}
+	needFilter := uptoSeqNo > 0 && uptoSeqNo < entry.SeqNo
+	for _, file := range entry.Files {
+		// value log 文件无需过滤, 超出恢复范围的 value 不再被引用, 由 GC 回收
+		if file.ValueLog {
+			targetName := data.GetValueLogFileName(targetDir, file.FileId)
+			if err := restoreBackupObject(backupDir, file, targetName); err != nil {
+				return err
+			}
+			continue
+		}
+		// 校验并复制备份的数据文件
+		tempName := data.GetDataFileName(tempDir, file.FileId)
+		if err := restoreBackupObject(backupDir, file, tempName); err != nil {
+			return err
+		}
+		targetName := data.GetDataFileName(targetDir, file.FileId)
+		if !needFilter {
+			if err := os.Rename(tempName, targetName); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := filterDataFile(tempDir, targetDir, file.FileId, uptoSeqNo, encryptor); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将快照中的数据文件复制到备份目录, 以校验和命名, 相同内容仅保存一份
+func copyBackupObject(dataFile *data.DataFile, size int64, backupDir string, valueLog bool) (*BackupFile, error) {
+	objectDir := filepath.Join(backupDir, backupObjectDirName)
+	tempFile, err := os.CreateTemp(objectDir, "tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+	}()
+
+	hash := sha256.New()
+	if err := copyDataFile(dataFile, size, io.MultiWriter(tempFile, hash)); err != nil {
+		return nil, err
+	}
+	if err := tempFile.Sync(); err != nil {
+		return nil, err
+	}
+
+	file := &BackupFile{
+		FileId:   dataFile.FileId,
+		Size:     size,
+		Checksum: hex.EncodeToString(hash.Sum(nil)),
+		ValueLog: valueLog,
+	}
+	suffix := data.DataFileNameSuffix
+	if valueLog {
+		suffix = data.ValueLogFileNameSuffix
+	}
+	file.Object = fmt.Sprintf("%09d-%s%s", file.FileId, file.Checksum[:16], suffix)
+	objectName := filepath.Join(objectDir, file.Object)
+	if _, err := os.Stat(objectName); err == nil {
+		return file, nil
+	}
+	if err := os.Rename(tempFile.Name(), objectName); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// 通过已打开的数据文件读取前 size 字节写入 w
+// 数据文件被 merge 删除后仍可读取
+func copyDataFile(dataFile *data.DataFile, size int64, w io.Writer) error {
+	buf := make([]byte, backupCopyBufferSize)
+	for offset := int64(0); offset < size; {
+		n := min(int64(len(buf)), size-offset)
+		if _, err := dataFile.ReadWriter.Read(buf[:n], offset); err != nil {
+			return err
+		}
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		offset += n
+	}
+	return nil
+}
+
+// 从备份目录复制数据文件到 dest 并校验
+func restoreBackupObject(backupDir string, file *BackupFile, dest string) error {
+	src, err := os.Open(filepath.Join(backupDir, backupObjectDirName, file.Object))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = src.Close()
+	}()
+	dst, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = dst.Close()
+	}()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(dst, hash), src)
+	if err != nil {
+		return err
+	}
+	if n != file.Size || hex.EncodeToString(hash.Sum(nil)) != file.Checksum {
+		return fmt.Errorf("%w: checksum mismatch of %s", ErrBackupCorrupted, file.Object)
+	}
+	return dst.Sync()
+}
+
+// 将数据文件中日志序列号不超过 uptoSeqNo 的日志记录写入目标目录
+// 事务完成标识被丢弃的事务在加载时自动忽略
+func filterDataFile(srcDir, destDir string, fileId uint32, uptoSeqNo uint64, encryptor *data.Encryptor) error {
+	srcFile, err := data.OpenDataFile(srcDir, fileId, fio.StandardFIO, encryptor)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = srcFile.Close()
+	}()
+	destFile, err := data.OpenDataFile(destDir, fileId, fio.StandardFIO, encryptor)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = destFile.Close()
+	}()
+
+	var offset int64 = 0
+	for {
+		logRecord, size, err := srcFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+		offset += size
+		if logRecord.LogSeqNo > uptoSeqNo {
+			continue
+		}
+		encRecord, _, err := encryptor.EncodeLogRecord(logRecord)
+		if err != nil {
+			return err
+		}
+		if err := destFile.Write(encRecord); err != nil {
+			return err
+		}
+	}
+	return destFile.Sync()
+}
+
+// 写入备份清单, 先写入临时文件再重命名, 避免清单损坏
+func writeBackupManifest(backupDir string, manifest *BackupManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tempName := filepath.Join(backupDir, backupManifestName+".tmp")
+	if err := os.WriteFile(tempName, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempName, filepath.Join(backupDir, backupManifestName))
+}
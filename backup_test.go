@@ -0,0 +1,202 @@
+package xixi_kv
+
+import (
+	"bytes"
+	"errors"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_IncrementalBackup(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+
+	// 1. 首次备份复制全部数据文件
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	entry1, err := db.IncrementalBackup(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(1), entry1.Id)
+	assert.Equal(t, int(db.Stat().DataFileNum), len(entry1.Files))
+
+	// 2. 再次备份仅复制新增的数据文件和活跃文件
+	for i := 0; i < 500; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	middleSeqNo := db.logSeqNo
+	for i := 1000; i < 1500; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	entry2, err := db.IncrementalBackup(backupDir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), entry2.Id)
+	for i, file := range entry1.Files[:len(entry1.Files)-1] {
+		assert.Equal(t, file.Object, entry2.Files[i].Object)
+	}
+	objects, err := os.ReadDir(filepath.Join(backupDir, backupObjectDirName))
+	assert.Nil(t, err)
+	assert.True(t, len(objects) < len(entry1.Files)+len(entry2.Files))
+
+	// 按时间点获取日志序列号
+	seqNo, err := LatestBackupSeqNoBefore(backupDir, time.Unix(0, entry1.Timestamp))
+	assert.Nil(t, err)
+	assert.Equal(t, entry1.SeqNo, seqNo)
+	_, err = LatestBackupSeqNoBefore(backupDir, time.Unix(0, entry1.Timestamp-1))
+	assert.Equal(t, ErrBackupNotFound, err)
+
+	// 3. 恢复最近一次备份
+	checkRestore := func(uptoSeqNo uint64, keyNum int, deleted bool) {
+		targetDir, _ := os.MkdirTemp("", "bitcask-go-restore")
+		defer func() {
+			_ = os.RemoveAll(targetDir)
+		}()
+		err := Restore(backupDir, targetDir, uptoSeqNo)
+		assert.Nil(t, err)
+		restoreOpts := opts
+		restoreOpts.DirPath = targetDir
+		restored, err := Open(restoreOpts)
+		assert.Nil(t, err)
+		defer func() {
+			_ = restored.Close()
+		}()
+		assert.Equal(t, keyNum, len(restored.ListKeys()))
+		_, err = restored.Get(utils.GetTestKey(100))
+		assert.Equal(t, deleted, err == ErrKeyNotFound)
+	}
+	checkRestore(0, 1000, true)
+	// 4. 恢复到指定日志序列号
+	checkRestore(entry1.SeqNo, 1000, false)
+	checkRestore(middleSeqNo, 500, true)
+
+	// 以 B+ 树索引打开恢复的数据目录时读取数据文件重建索引, 重启后直接使用索引文件
+	bptreeDir, _ := os.MkdirTemp("", "bitcask-go-restore-bptree")
+	defer func() {
+		_ = os.RemoveAll(bptreeDir)
+	}()
+	assert.Nil(t, Restore(backupDir, bptreeDir, 0))
+	bptreeOpts := opts
+	bptreeOpts.DirPath = bptreeDir
+	bptreeOpts.IndexType = index.BPTree
+	for n := 0; n < 2; n++ {
+		restored, err := Open(bptreeOpts)
+		assert.Nil(t, err)
+		assert.Equal(t, 1000, len(restored.ListKeys()))
+		_, err = restored.Get(utils.GetTestKey(100))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = restored.Get(utils.GetTestKey(1200))
+		assert.Nil(t, err)
+		assert.Nil(t, restored.Close())
+	}
+
+	// 5. 备份文件损坏时恢复失败
+	err = os.WriteFile(filepath.Join(backupDir, backupObjectDirName, entry2.Files[0].Object), []byte("broken"), 0644)
+	assert.Nil(t, err)
+	targetDir, _ := os.MkdirTemp("", "bitcask-go-restore")
+	defer func() {
+		_ = os.RemoveAll(targetDir)
+	}()
+	err = Restore(backupDir, targetDir, 0)
+	assert.True(t, errors.Is(err, ErrBackupCorrupted))
+}
+
+func TestDB_BackupTo(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.BTree, index.BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-backup-stream")
+		opts.DirPath = dir
+		opts.DataFileSize = 32 * 1024
+		opts.EnableBackgroundMerge = false
+		opts.DataFileMergeRatio = 0
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for i := 0; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(t, err)
+		}
+		for i := 0; i < 200; i++ {
+			err := db.Delete(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		err = db.Merge()
+		assert.Nil(t, err)
+		wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, err)
+		for i := 1000; i < 1100; i++ {
+			_ = wb.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		}
+		err = wb.Commit()
+		assert.Nil(t, err)
+
+		// 1. 备份流恢复后可直接打开, 包含 hint 文件
+		// 等待已封存数据文件的 hint 文件写入完成, 恢复后通过 hint 文件加载索引
+		db.hints.Wait()
+		buf := new(bytes.Buffer)
+		err = db.BackupTo(buf)
+		assert.Nil(t, err)
+		content := buf.Bytes()
+		targetDir, _ := os.MkdirTemp("", "bitcask-go-restore-stream")
+		err = RestoreFrom(bytes.NewReader(content), targetDir)
+		assert.Nil(t, err)
+		_, err = os.Stat(filepath.Join(targetDir, data.HintFileName))
+		assert.Nil(t, err)
+		restoreOpts := opts
+		restoreOpts.DirPath = targetDir
+		var openStat OpenStat
+		restoreOpts.OnOpen = func(stat OpenStat) {
+			openStat = stat
+		}
+		restored, err := Open(restoreOpts)
+		assert.Nil(t, err)
+		if indexType == index.BTree {
+			assert.Greater(t, openStat.HintFileNum, 0)
+		}
+		assert.Equal(t, 900, len(restored.ListKeys()))
+		_, err = restored.Get(utils.GetTestKey(100))
+		assert.Equal(t, ErrKeyNotFound, err)
+		_, err = restored.Get(utils.GetTestKey(1050))
+		assert.Nil(t, err)
+		_ = restored.Close()
+		_ = os.RemoveAll(targetDir)
+
+		// 2. 备份流损坏时恢复失败
+		content[len(content)/2] ^= 0xff
+		targetDir, _ = os.MkdirTemp("", "bitcask-go-restore-stream")
+		err = RestoreFrom(bytes.NewReader(content), targetDir)
+		assert.True(t, errors.Is(err, ErrBackupCorrupted))
+		entries, _ := os.ReadDir(targetDir)
+		assert.Equal(t, 0, len(entries))
+		_ = os.RemoveAll(targetDir)
+
+		// 3. 备份流不完整时恢复失败
+		targetDir, _ = os.MkdirTemp("", "bitcask-go-restore-stream")
+		err = RestoreFrom(bytes.NewReader(content[:len(content)/2]), targetDir)
+		assert.True(t, errors.Is(err, ErrBackupCorrupted))
+		_ = os.RemoveAll(targetDir)
+
+		destroyDB(db)
+	}
+}
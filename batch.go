@@ -3,40 +3,121 @@ package xixi_kv
 import (
 	"encoding/binary"
 	"github.com/XiXi-2024/xixi-kv/data"
-	"github.com/XiXi-2024/xixi-kv/index"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 // 非事务 key 前缀标识
 const nonTransactionSeqNo uint64 = 0
 
+// Update 方法遇到事务冲突时的最大重试次数
+const maxUpdateRetries = 16
+
+// B+ 树索引每次预分配并持久化的事务序列号数量
+const seqNoReserveSize uint64 = 1000
+
 // 事务完成标识 key
 var txnFinKey = []byte("txn-fin")
 
 // WriteBatch 事务客户端
-// todo 优化点：新增方法结束自动提交的事务形式
-// todo 优化点：新增 Get 方法
+// 采用乐观并发控制, 读取时记录 key 的索引位置, 提交时校验是否被其它写入修改
 type WriteBatch struct {
+	*writeBatchState
+	bucket uint32 // 读写操作所属的 bucket 编号
+}
+
+// 事务状态, 由同一事务中读写不同 bucket 的 WriteBatch 实例共享
+// 暂存数据和读集合的 key 均为 bucket 编号与 key 的合并编码
+type writeBatchState struct {
 	options       WriteBatchOptions
 	mu            *sync.Mutex
 	db            *DB
-	pendingWrites map[string]*data.LogRecord // 暂存数据
+	pendingWrites map[string]*data.LogRecord    // 暂存数据
+	readSet       map[string]*data.LogRecordPos // 已读取 key 在读取时刻的索引位置, nil 表示不存在
+	discarded     bool                          // 事务已丢弃标识
 }
 
-// NewWriteBatch 创建新 WriteBatch 实例
-func (db *DB) NewWriteBatch(opts WriteBatchOptions) *WriteBatch {
-	// 如果选择 B+ 树索引实现、事务序列号未加载、非首次加载数据目录, 则禁用事务提交功能
-	// 首次加载时事务序列号为 0, 但无法加载得到, 故进行特殊判断
-	if db.options.IndexType == index.BPTree && !db.seqNoFileExists && !db.isInitial {
-		panic("cannot use write batch, seq no file not exists")
+// NewWriteBatch 创建新 WriteBatch 实例, 数据库已关闭时返回 ErrDatabaseClosed
+func (db *DB) NewWriteBatch(opts WriteBatchOptions) (*WriteBatch, error) {
+	select {
+	case <-db.closedChan:
+		return nil, ErrDatabaseClosed
+	default:
 	}
 	return &WriteBatch{
-		options:       opts,
-		mu:            new(sync.Mutex),
-		db:            db,
-		pendingWrites: make(map[string]*data.LogRecord),
+		writeBatchState: &writeBatchState{
+			options:       opts,
+			mu:            new(sync.Mutex),
+			db:            db,
+			pendingWrites: make(map[string]*data.LogRecord),
+			readSet:       make(map[string]*data.LogRecordPos),
+		},
+	}, nil
+}
+
+// Bucket 获取在同一事务中读写指定 bucket 的 WriteBatch 实例
+// 返回的实例与原实例共享暂存数据, 通过任一实例提交即可原子提交全部 bucket 的写入
+func (wb *WriteBatch) Bucket(b *Bucket) *WriteBatch {
+	return &WriteBatch{writeBatchState: wb.writeBatchState, bucket: b.id}
+}
+
+// Update 在事务中执行 fn, 结束时自动提交
+// fn 返回错误时回滚事务并返回该错误, 提交遇到冲突时自动重试
+func (db *DB) Update(fn func(wb *WriteBatch) error) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+		if err != nil {
+			return err
+		}
+		if err := fn(wb); err != nil {
+			wb.Discard()
+			return err
+		}
+		err = wb.Commit()
+		if err == ErrTxnConflict {
+			continue
+		}
+		return err
+	}
+	return ErrTxnConflict
+}
+
+// Get 在事务中读取数据
+// 优先读取当前事务的暂存数据, 否则读取数据库中的数据并记录到读集合
+func (wb *WriteBatch) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	if wb.discarded {
+		return nil, ErrTxnDiscarded
+	}
+
+	// 读取当前事务的暂存数据
+	batchKey := batchKey(wb.bucket, key)
+	if record := wb.pendingWrites[batchKey]; record != nil {
+		if record.Type == data.LogRecordDeleted {
+			return nil, ErrKeyNotFound
+		}
+		return record.Value, nil
 	}
+
+	wb.db.mu.RLock()
+	defer wb.db.mu.RUnlock()
+
+	// 记录首次读取时的索引位置, 用于提交时的冲突检测
+	logRecordPos := wb.db.indexOf(wb.bucket).Get(key)
+	if _, ok := wb.readSet[batchKey]; !ok {
+		wb.readSet[batchKey] = logRecordPos
+	}
+
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		return nil, ErrKeyNotFound
+	}
+	return wb.db.getValueByPosition(logRecordPos)
 }
 
 func (wb *WriteBatch) Put(key, value []byte) error {
@@ -46,10 +127,13 @@ func (wb *WriteBatch) Put(key, value []byte) error {
 
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
+	if wb.discarded {
+		return ErrTxnDiscarded
+	}
 
 	// 仅暂存
-	logRecord := &data.LogRecord{Key: key, Value: value}
-	wb.pendingWrites[string(key)] = logRecord
+	logRecord := &data.LogRecord{Key: key, Value: value, Bucket: wb.bucket}
+	wb.pendingWrites[batchKey(wb.bucket, key)] = logRecord
 	return nil
 }
 
@@ -61,31 +145,61 @@ func (wb *WriteBatch) Delete(key []byte) error {
 
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
+	if wb.discarded {
+		return ErrTxnDiscarded
+	}
 
-	logRecordPos := wb.db.index.Get(key)
+	wb.db.mu.RLock()
+	logRecordPos := wb.db.indexOf(wb.bucket).Get(key)
+	wb.db.mu.RUnlock()
 
 	// 待删除元素未提交, 删除缓存即可
+	batchKey := batchKey(wb.bucket, key)
 	if logRecordPos == nil {
-		if wb.pendingWrites[string(key)] != nil {
-			delete(wb.pendingWrites, string(key))
+		if wb.pendingWrites[batchKey] != nil {
+			delete(wb.pendingWrites, batchKey)
 		}
 		return nil
 	}
 
 	// 待删除元素已持久化, 追加墓碑值
-	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted}
-	wb.pendingWrites[string(key)] = logRecord
+	logRecord := &data.LogRecord{Key: key, Type: data.LogRecordDeleted, Bucket: wb.bucket}
+	wb.pendingWrites[batchKey] = logRecord
 	return nil
 }
 
+// Rollback 回滚事务, 丢弃暂存数据和读集合, 回滚后允许继续使用
+func (wb *WriteBatch) Rollback() {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.reset()
+}
+
+// Discard 丢弃事务, 之后的读写和提交操作均返回 ErrTxnDiscarded
+// 允许重复调用或在提交后调用, 便于通过 defer 释放
+func (wb *WriteBatch) Discard() {
+	wb.mu.Lock()
+	defer wb.mu.Unlock()
+	wb.reset()
+	wb.discarded = true
+}
+
 // Commit 事务提交, 将暂存数据持久化并更新索引
+// 如果已读取的 key 在读取后被其它写入修改, 则丢弃暂存数据并返回 ErrTxnConflict
 func (wb *WriteBatch) Commit() error {
 	// 对 WB 实例加锁
 	wb.mu.Lock()
 	defer wb.mu.Unlock()
+	if wb.discarded {
+		return ErrTxnDiscarded
+	}
+	if wb.db.readOnly {
+		return ErrDatabaseReadOnly
+	}
 
 	// 缓存为空
 	if len(wb.pendingWrites) == 0 {
+		wb.reset()
 		return nil
 	}
 
@@ -95,70 +209,122 @@ func (wb *WriteBatch) Commit() error {
 		return ErrExceedMaxBatchNum
 	}
 
-	// 对 DB 实例加锁, 串行化实现隔离性
-	wb.db.mu.Lock()
-	defer wb.db.mu.Unlock()
-
-	// 获取当前最新的事务序列号
+	// 获取当前最新的事务序列号, 写入日志记录前确保其不会在崩溃后被重复分配
 	seqNo := atomic.AddUint64(&wb.db.seqNo, 1)
+	if err := wb.db.reserveSeqNo(seqNo); err != nil {
+		return err
+	}
 
 	// 遍历当前事务客户端的写入缓存, 依次进行写入
 	// 由于缓存包含最新数据, 故允许无序遍历
-	positions := make(map[string]*data.LogRecordPos)
+	records := make([]*data.LogRecord, 0, len(wb.pendingWrites)+1)
+	pendings := make([]*data.LogRecord, 0, len(wb.pendingWrites))
 	for _, record := range wb.pendingWrites {
-		// 无需重复加锁, 使用不加锁的 appendLogRecord 方法
-		logRecordPos, err := wb.db.appendLogRecord(&data.LogRecord{
+		records = append(records, &data.LogRecord{
 			// 将 key 和 seqNo 进行合并, 节省空间
-			Key:   logRecordKeyWithSeq(record.Key, seqNo),
-			Value: record.Value,
-			Type:  record.Type,
+			Key:    logRecordKeyWithSeq(record.Key, seqNo),
+			Value:  record.Value,
+			Type:   record.Type,
+			Bucket: record.Bucket,
 		})
-
-		if err != nil {
-			return err
-		}
-
-		// 暂存索引信息, 所有数据写入完成后统一更新索引
-		positions[string(record.Key)] = logRecordPos
+		pendings = append(pendings, record)
 	}
 
 	// 事务成功, 追加带事务完成标识的日志记录
-	finishedRecord := &data.LogRecord{
+	records = append(records, &data.LogRecord{
 		Key:  logRecordKeyWithSeq(txnFinKey, seqNo),
 		Type: data.LogRecordTxnFinished,
+	})
+
+	// 写入队列串行化全部写入, 冲突检测在此前的写入生效后执行, 实现隔离性
+	err := wb.db.submit(&commitRequest{
+		records: records,
+		// 根据配置项决定是否立即持久化
+		sync: wb.options.SyncWrites,
+		// 冲突检测, 校验读集合中的 key 是否已被修改
+		check: func() error {
+			if wb.hasConflict() {
+				return ErrTxnConflict
+			}
+			return nil
+		},
+		apply: func(positions []*data.LogRecordPos) error {
+			wb.applyCommit(pendings, records, positions)
+			return nil
+		},
+	})
+	if err == ErrTxnConflict {
+		wb.reset()
+		return err
 	}
-	if _, err := wb.db.appendLogRecord(finishedRecord); err != nil {
+	if err != nil {
 		return err
 	}
 
-	// 根据配置项决定是否立即持久化
-	if wb.options.SyncWrites && wb.db.activeFile != nil {
-		if err := wb.db.activeFile.Sync(); err != nil {
-			return err
-		}
-	}
+	// 清空暂存数据
+	wb.reset()
 
-	// 数据持久化完成 更新内存索引
-	for _, record := range wb.pendingWrites {
-		pos := positions[string(record.Key)]
+	return nil
+}
+
+// 数据持久化完成后更新内存索引并通知变更订阅者
+// pendings 为暂存数据, records 和 positions 为对应实际写入的日志记录及其位置
+func (wb *writeBatchState) applyCommit(pendings, records []*data.LogRecord, positions []*data.LogRecordPos) {
+	events := make([]*ChangeEvent, 0, len(pendings))
+	for i, record := range pendings {
+		pos := positions[i]
+		idx := wb.db.indexOf(record.Bucket)
 		var oldPos *data.LogRecordPos
 		if record.Type == data.LogRecordNormal {
-			oldPos = wb.db.index.Put(record.Key, pos)
+			oldPos = idx.Put(record.Key, pos)
 		}
 		// 追加形式, 遇到删除状态的日志记录同样更新索引
-		// todo bug：未统计 pos 本身的字节数
+		// 墓碑值本身可视为无效数据
+		var reclaim int64 = 0
 		if record.Type == data.LogRecordDeleted {
-			oldPos, _ = wb.db.index.Delete(record.Key)
+			oldPos, _ = idx.Delete(record.Key)
+			reclaim += wb.db.addFileReclaim(pos)
 		}
 		if oldPos != nil {
-			wb.db.reclaimSize += int64(oldPos.Size)
+			reclaim += wb.db.addFileReclaim(oldPos)
 		}
+		wb.db.addBucketSize(record.Bucket, int64(pos.Size), reclaim)
+
+		events = append(events, &ChangeEvent{
+			Key:     record.Key,
+			Value:   record.Value,
+			Deleted: record.Type == data.LogRecordDeleted,
+			SeqNo:   records[i].LogSeqNo,
+			InBatch: true,
+			Bucket:  wb.db.bucketName(record.Bucket),
+		})
 	}
 
-	// 清空暂存数据
+	// 写入成功后通知变更订阅者
+	wb.db.publish(events...)
+}
+
+// 清空暂存数据和读集合
+func (wb *writeBatchState) reset() {
 	wb.pendingWrites = make(map[string]*data.LogRecord)
+	wb.readSet = make(map[string]*data.LogRecordPos)
+}
 
-	return nil
+// 判断读集合中是否存在已被修改的 key, 调用方需持有 DB 锁
+// 以索引位置判断是否修改, merge 重写数据文件后可能误判为冲突, 由调用方重试即可
+func (wb *writeBatchState) hasConflict() bool {
+	for batchKey, readPos := range wb.readSet {
+		key, bucketId := parseLogRecordKey([]byte(batchKey))
+		curPos := wb.db.indexOf(uint32(bucketId)).Get(key)
+		if readPos == nil && curPos == nil {
+			continue
+		}
+		if readPos == nil || curPos == nil ||
+			readPos.Fid != curPos.Fid || readPos.Offset != curPos.Offset {
+			return true
+		}
+	}
+	return false
 }
 
 // 将 key 和事务ID seqNo 合并编码
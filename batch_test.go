@@ -1,9 +1,15 @@
 package xixi_kv
 
 import (
+	"errors"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
 	"github.com/XiXi-2024/xixi-kv/utils"
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -17,7 +23,8 @@ func TestDB_WriteBatch1(t *testing.T) {
 	assert.NotNil(t, db)
 
 	// 写数据后不提交
-	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
 	err = wb.Put(utils.GetTestKey(1), utils.RandomValue(10))
 	assert.Nil(t, err)
 	err = wb.Delete(utils.GetTestKey(2))
@@ -34,7 +41,8 @@ func TestDB_WriteBatch1(t *testing.T) {
 	assert.Nil(t, err)
 
 	// 删除有效的数据
-	wb2 := db.NewWriteBatch(DefaultWriteBatchOptions)
+	wb2, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
 	err = wb2.Delete(utils.GetTestKey(1))
 	assert.Nil(t, err)
 	err = wb2.Commit()
@@ -56,7 +64,8 @@ func TestDB_WriteBatch2(t *testing.T) {
 	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
 	assert.Nil(t, err)
 
-	wb := db.NewWriteBatch(DefaultWriteBatchOptions)
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
 	err = wb.Put(utils.GetTestKey(2), utils.RandomValue(10))
 	assert.Nil(t, err)
 	err = wb.Delete(utils.GetTestKey(1))
@@ -108,3 +117,376 @@ func TestDB_WriteBatch3(t *testing.T) {
 	//err = wb.Commit()
 	//assert.Nil(t, err)
 }
+
+// 事务内读取
+func TestDB_WriteBatch_Get(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-get")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value1 := utils.RandomValue(10)
+	err = db.Put(utils.GetTestKey(1), value1)
+	assert.Nil(t, err)
+
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	// 读取已提交数据
+	val, err := wb.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value1, val)
+
+	// 读取暂存数据
+	value2 := utils.RandomValue(10)
+	err = wb.Put(utils.GetTestKey(2), value2)
+	assert.Nil(t, err)
+	val, err = wb.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value2, val)
+
+	// 读取暂存删除的数据
+	err = wb.Delete(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = wb.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 未提交时数据库不可见
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	val, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, value2, val)
+}
+
+// 事务冲突检测
+func TestDB_WriteBatch_Conflict(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-conflict")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+
+	// 1. 已读取的 key 被其它写入修改
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_, err = wb.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Put(utils.GetTestKey(2), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2. 读取时不存在的 key 被其它写入新增
+	wb, err = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_, err = wb.Get(utils.GetTestKey(3))
+	assert.Equal(t, ErrKeyNotFound, err)
+	err = db.Put(utils.GetTestKey(3), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Put(utils.GetTestKey(2), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Equal(t, ErrTxnConflict, err)
+
+	// 3. 仅写入未读取的 key 不冲突
+	wb, err = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	err = wb.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+}
+
+// 事务回滚和丢弃
+func TestDB_WriteBatch_Rollback(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-rollback")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 回滚后允许继续使用
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	err = wb.Put(utils.GetTestKey(1), utils.RandomValue(10))
+	assert.Nil(t, err)
+	wb.Rollback()
+	err = wb.Put(utils.GetTestKey(2), utils.RandomValue(10))
+	assert.Nil(t, err)
+	err = wb.Commit()
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+
+	// 丢弃后不允许继续使用
+	wb.Discard()
+	wb.Discard()
+	err = wb.Put(utils.GetTestKey(3), utils.RandomValue(10))
+	assert.Equal(t, ErrTxnDiscarded, err)
+	_, err = wb.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrTxnDiscarded, err)
+	err = wb.Commit()
+	assert.Equal(t, ErrTxnDiscarded, err)
+}
+
+// 自动提交的事务, 并发读改写不丢失更新
+func TestDB_Update(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-update")
+	opts.DirPath = dir
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	key := utils.GetTestKey(1)
+	err = db.Put(key, []byte("0"))
+	assert.Nil(t, err)
+
+	// fn 返回错误时不提交
+	errAbort := errors.New("abort")
+	err = db.Update(func(wb *WriteBatch) error {
+		_ = wb.Put(key, []byte("-1"))
+		return errAbort
+	})
+	assert.Equal(t, errAbort, err)
+
+	// 读取计数并加一
+	incr := func(wb *WriteBatch) error {
+		val, err := wb.Get(key)
+		if err != nil {
+			return err
+		}
+		num, _ := strconv.Atoi(string(val))
+		return wb.Put(key, []byte(strconv.Itoa(num+1)))
+	}
+
+	workers, times := 4, 50
+	wg := new(sync.WaitGroup)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < times; j++ {
+				// 超过最大重试次数时继续重试
+				err := db.Update(incr)
+				for err == ErrTxnConflict {
+					err = db.Update(incr)
+				}
+				assert.Nil(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	val, err := db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, strconv.Itoa(workers*times), string(val))
+}
+
+// B+ 树索引崩溃后仍可使用事务, 事务序列号不重复
+func TestDB_WriteBatch_BPTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-bptree")
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	commit := func(db *DB, key []byte) uint64 {
+		wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, err)
+		assert.Nil(t, wb.Put(key, utils.RandomValue(10)))
+		assert.Nil(t, wb.Commit())
+		return db.seqNo
+	}
+	seqNo := commit(db, utils.GetTestKey(1))
+	assert.Nil(t, db.Close())
+
+	// 关闭后不允许创建事务
+	_, err = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Equal(t, ErrDatabaseClosed, err)
+
+	// 模拟崩溃, 关闭时写入的事务序列号文件不存在
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.SeqNoFileName)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, db.seqNo, seqNo)
+	seqNo = commit(db, utils.GetTestKey(2))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// 索引文件和事务序列号文件中均不存在事务序列号时, 读取数据文件获取
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.SeqNoFileName)))
+	assert.Nil(t, os.Remove(filepath.Join(dir, index.BPTreeIndexFileName)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, db.seqNo)
+	assert.Nil(t, db.Close())
+
+	// 索引文件中不存在事务序列号时, 过期的事务序列号文件不覆盖数据文件中更大的事务序列号
+	staleSeqNoFile, err := os.ReadFile(filepath.Join(dir, data.SeqNoFileName))
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	seqNo = commit(db, utils.GetTestKey(3))
+	assert.Nil(t, db.Close())
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, data.SeqNoFileName), staleSeqNoFile, 0644))
+	assert.Nil(t, os.Remove(filepath.Join(dir, index.BPTreeIndexFileName)))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, db.seqNo)
+	assert.Nil(t, db.Close())
+}
+
+// 重启时丢弃未完成提交的事务记录, 并计入无效数据量
+// 事务序列号文件与 merge 完成标识文件名称不同, 兼容读取旧版本以追加方式写入的事务序列号文件
+func TestDB_WriteBatch_LegacySeqNoFile(t *testing.T) {
+	assert.NotEqual(t, data.MergeFinishedFileName, data.SeqNoFileName)
+
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-legacy-seq-no")
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Nil(t, wb.Commit())
+	// 索引文件中持久化的事务序列号上限不小于已使用的事务序列号
+	seqNo := db.seqNoLimit
+	assert.Nil(t, db.Close())
+
+	// 关闭时写入事务序列号文件, 不残留临时文件
+	_, err = os.Stat(filepath.Join(dir, data.SeqNoFileName))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, seqNoTempFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	// 模拟旧版本多次关闭后追加写入的事务序列号文件
+	assert.Nil(t, os.Remove(filepath.Join(dir, data.SeqNoFileName)))
+	legacyFile, err := data.OpenMergeFinishedFile(dir, nil)
+	assert.Nil(t, err)
+	for _, n := range []uint64{seqNo + 10, seqNo + 5} {
+		encRecord, _ := data.EncodeLogRecord(&data.LogRecord{
+			Key:   []byte(seqNoKey),
+			Value: []byte(strconv.FormatUint(n, 10)),
+		})
+		assert.Nil(t, legacyFile.Write(encRecord))
+	}
+	assert.Nil(t, legacyFile.Close())
+
+	// 读取旧版本文件中的最大事务序列号, 关闭后旧版本文件被替换
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo+10, db.seqNo)
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, legacySeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo+10, db.seqNo)
+}
+
+func TestDB_WriteBatch_DiscardUncommitted(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-discard")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	// 模拟提交过程中崩溃, 仅写入事务记录而未写入事务完成标识
+	var size int64
+	err = db.submit(&commitRequest{
+		records: []*data.LogRecord{{
+			Key:   logRecordKeyWithSeq(utils.GetTestKey(2), 100),
+			Value: utils.RandomValue(10),
+		}},
+		apply: func(positions []*data.LogRecordPos) error {
+			size = int64(positions[0].Size)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	db.options.EnableIndexCheckpoint = false
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Nil(t, db.pendingTxns)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	stat := db.Stat()
+	assert.Equal(t, size, stat.ReclaimableSize)
+	assert.Equal(t, size, stat.DataFiles[0].ReclaimableSize)
+
+	// 此后分配的事务序列号大于未完成的事务, 其事务完成标识不会使丢弃的记录生效
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(3), utils.RandomValue(10)))
+	assert.Nil(t, wb.Commit())
+	assert.Greater(t, db.seqNo, uint64(100))
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+}
+
+// 事务中的墓碑值计入无效数据量, 与重启后读取数据文件的统计结果一致
+func TestDB_WriteBatch_ReclaimableSize(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-reclaim")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	opts.EnableIndexCheckpoint = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, stat.ReclaimableSize, db.Stat().ReclaimableSize)
+	assert.Nil(t, db.Close())
+}
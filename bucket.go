@@ -0,0 +1,249 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"math"
+	"strconv"
+	"sync/atomic"
+)
+
+const (
+	// 默认 bucket 编号, 其日志记录不携带 bucket 字段, 兼容旧版本数据文件
+	defaultBucketId uint32 = 0
+	// 元数据 bucket 编号, key 为 bucket 名称, value 为 bucket 编号, 不对外暴露
+	metaBucketId uint32 = math.MaxUint32
+)
+
+// Bucket 命名的独立 key 空间, 拥有独立的内存索引
+// 全部 bucket 共享数据文件和 merge, WriteBatch 可跨 bucket 原子提交
+type Bucket struct {
+	db          *DB
+	id          uint32        // bucket 编号, 写入日志记录头部
+	name        string        // bucket 名称
+	index       index.Indexer // 内存索引
+	reclaimSize atomic.Int64  // 无效数据量, 单位字节
+	totalSize   atomic.Int64  // 数据量, 单位字节
+}
+
+// BucketStat bucket 统计信息
+type BucketStat struct {
+	KeyNum          uint  // 当前 key 的数量
+	ReclaimableSize int64 // 当前 merge 可回收的数据量, 单位字节
+	DiskSize        int64 // 数据文件中属于该 bucket 的数据量, 单位字节
+}
+
+// Bucket 获取指定名称的 bucket, 不存在时创建
+// bucket 元数据以日志记录的形式写入数据文件, 重启后自动恢复
+func (db *DB) Bucket(name string) (*Bucket, error) {
+	if name == "" {
+		return nil, ErrBucketNameIsEmpty
+	}
+	// B+ 树索引持久化在单个索引文件中, 无法为每个 bucket 创建独立索引
+	if db.options.IndexType == index.BPTree {
+		return nil, ErrBucketIndexUnsupported
+	}
+
+	// 串行化 bucket 的创建, 写入元数据期间不持有 DB 锁
+	db.bucketMu.Lock()
+	defer db.bucketMu.Unlock()
+
+	db.mu.Lock()
+	if b, ok := db.buckets[name]; ok {
+		db.mu.Unlock()
+		return b, nil
+	}
+	// 只读实例仅能访问已存在的 bucket
+	if db.readOnly {
+		db.mu.Unlock()
+		return nil, ErrBucketNotFound
+	}
+
+	// 分配未使用的最小编号
+	var id uint32 = 1
+	for bucketId := range db.bucketIds {
+		if bucketId != metaBucketId && bucketId >= id {
+			id = bucketId + 1
+		}
+	}
+	// 写入者仅持有读锁, 需提前创建元数据 bucket
+	db.bucketOf(metaBucketId)
+	db.mu.Unlock()
+
+	// 先写入元数据, 保证 bucket 的日志记录均位于元数据之后
+	logRecord := &data.LogRecord{
+		Key:    logRecordKeyWithSeq([]byte(name), nonTransactionSeqNo),
+		Value:  []byte(strconv.FormatUint(uint64(id), 10)),
+		Bucket: metaBucketId,
+	}
+	err := db.submit(&commitRequest{records: []*data.LogRecord{logRecord}, apply: func(positions []*data.LogRecordPos) error {
+		db.indexOf(metaBucketId).Put([]byte(name), positions[0])
+		db.addBucketSize(metaBucketId, int64(positions[0].Size), 0)
+		// 唤醒等待新写入的复制会话
+		db.publish()
+		return nil
+	}})
+	if err != nil {
+		return nil, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.registerBucket(name, id), nil
+}
+
+// Name 获取 bucket 名称
+func (b *Bucket) Name() string {
+	return b.name
+}
+
+// Put 在 bucket 中新增元素
+func (b *Bucket) Put(key []byte, value []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	return b.db.put(b.id, key, value, 0)
+}
+
+// Get 根据 key 读取 bucket 中的数据
+func (b *Bucket) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	return b.db.get(b.id, key)
+}
+
+// Delete 根据 key 删除 bucket 中的数据
+func (b *Bucket) Delete(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	return b.db.delete(b.id, key)
+}
+
+// NewIterator 创建遍历 bucket 的迭代器
+func (b *Bucket) NewIterator(opts IteratorOptions) *Iterator {
+	b.db.mu.RLock()
+	defer b.db.mu.RUnlock()
+	return b.db.newIterator(b.index, opts)
+}
+
+// NewWriteBatch 创建读写 bucket 的 WriteBatch 实例
+// 可通过 WriteBatch.Bucket 在同一事务中读写其它 bucket
+func (b *Bucket) NewWriteBatch(opts WriteBatchOptions) (*WriteBatch, error) {
+	wb, err := b.db.NewWriteBatch(opts)
+	if err != nil {
+		return nil, err
+	}
+	return wb.Bucket(b), nil
+}
+
+// 注册 bucket, 已存在时更新名称, 调用方需持有写锁
+func (db *DB) registerBucket(name string, id uint32) *Bucket {
+	b := db.bucketOf(id)
+	if b.name != name {
+		delete(db.buckets, b.name)
+		b.name = name
+		db.buckets[name] = b
+	}
+	return b
+}
+
+// 获取 bucket 编号对应的 bucket, 不存在时创建未命名的 bucket, 默认 bucket 返回 nil
+// 加载数据文件时元数据可能已损坏, 未命名的 bucket 仍保留其数据以维护统计信息
+func (db *DB) bucketOf(bucketId uint32) *Bucket {
+	if bucketId == defaultBucketId {
+		return nil
+	}
+	if b, ok := db.bucketIds[bucketId]; ok {
+		return b
+	}
+	if db.bucketIds == nil {
+		db.buckets = make(map[string]*Bucket)
+		db.bucketIds = make(map[uint32]*Bucket)
+	}
+	b := &Bucket{
+		db:    db,
+		id:    bucketId,
+		index: index.NewIndexer(db.options.IndexType, db.options.DirPath, false),
+	}
+	db.bucketIds[bucketId] = b
+	return b
+}
+
+// 获取 bucket 编号对应的内存索引
+func (db *DB) indexOf(bucketId uint32) index.Indexer {
+	if bucketId == defaultBucketId {
+		return db.index
+	}
+	return db.bucketOf(bucketId).index
+}
+
+// 获取 bucket 编号对应的名称, 默认 bucket 为空
+func (db *DB) bucketName(bucketId uint32) string {
+	if b := db.bucketOf(bucketId); b != nil {
+		return b.name
+	}
+	return ""
+}
+
+// 维护 bucket 的数据量和无效数据量, 默认 bucket 仅维护全局统计信息
+func (db *DB) addBucketSize(bucketId uint32, total, reclaim int64) {
+	if b := db.bucketOf(bucketId); b != nil {
+		b.totalSize.Add(total)
+		b.reclaimSize.Add(reclaim)
+	}
+}
+
+// 加载元数据 bucket 中的日志记录时注册对应的 bucket
+func (db *DB) loadBucketMeta(name []byte, value []byte) {
+	id, err := strconv.ParseUint(string(value), 10, 32)
+	// 元数据无效时忽略, 对应 bucket 的数据保留在未命名的 bucket 中
+	if err != nil || id == uint64(defaultBucketId) || id == uint64(metaBucketId) {
+		return
+	}
+	db.registerBucket(string(name), uint32(id))
+}
+
+// 获取 bucket 统计信息, 不包含默认 bucket 和元数据 bucket, 调用方需持有锁
+func (db *DB) bucketStats() map[string]BucketStat {
+	stats := make(map[string]BucketStat, len(db.buckets))
+	for name, b := range db.buckets {
+		stats[name] = BucketStat{
+			KeyNum:          uint(b.index.Size()),
+			ReclaimableSize: b.reclaimSize.Load(),
+			DiskSize:        b.totalSize.Load(),
+		}
+	}
+	return stats
+}
+
+// 重置全部 bucket 的内存索引和统计信息, 保留已注册的 bucket 实例, 调用方需持有写锁
+func (db *DB) resetBuckets() error {
+	for _, b := range db.bucketIds {
+		if err := b.index.Close(); err != nil {
+			return err
+		}
+		b.index = index.NewIndexer(db.options.IndexType, db.options.DirPath, false)
+		b.totalSize.Store(0)
+		b.reclaimSize.Store(0)
+	}
+	return nil
+}
+
+// 获取全部 bucket 编号及其内存索引的副本, 调用方需持有锁
+func (db *DB) bucketIndexes() map[uint32]index.Indexer {
+	indexes := map[uint32]index.Indexer{defaultBucketId: db.index}
+	for id, b := range db.bucketIds {
+		indexes[id] = b.index
+	}
+	return indexes
+}
+
+// 将 bucket 编号和 key 合并编码, 作为事务暂存数据的 key
+func batchKey(bucketId uint32, key []byte) string {
+	return string(logRecordKeyWithSeq(key, uint64(bucketId)))
+}
@@ -0,0 +1,238 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestDB_Bucket(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bucket")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Bucket("")
+	assert.Equal(t, ErrBucketNameIsEmpty, err)
+
+	// 1. 不同 bucket 的 key 空间相互隔离
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	orders, err := db.Bucket("orders")
+	assert.Nil(t, err)
+	assert.Equal(t, "users", users.Name())
+	same, err := db.Bucket("users")
+	assert.Nil(t, err)
+	assert.Equal(t, users, same)
+
+	key := utils.GetTestKey(1)
+	assert.Nil(t, db.Put(key, []byte("default")))
+	assert.Nil(t, users.Put(key, []byte("users")))
+	val, err := users.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	_, err = orders.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	val, err = db.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+
+	assert.Nil(t, users.Delete(key))
+	_, err = users.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(key)
+	assert.Nil(t, err)
+
+	// 2. 迭代器仅遍历 bucket 自身的 key
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, orders.Put(utils.GetTestKey(i), utils.RandomValue(10)))
+	}
+	iterator := orders.NewIterator(DefaultIteratorOptions)
+	var count int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		_, err := iterator.Value()
+		assert.Nil(t, err)
+		count++
+	}
+	iterator.Close()
+	assert.Equal(t, 10, count)
+
+	stat := db.Stat()
+	assert.Equal(t, uint(1), stat.KeyNum)
+	assert.Equal(t, 2, len(stat.Buckets))
+	assert.Equal(t, uint(0), stat.Buckets["users"].KeyNum)
+	assert.Equal(t, uint(10), stat.Buckets["orders"].KeyNum)
+	assert.Greater(t, stat.Buckets["users"].ReclaimableSize, int64(0))
+
+	// 3. 重启后恢复 bucket 元数据和统计信息
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, stat, db2.Stat())
+	orders2, err := db2.Bucket("orders")
+	assert.Nil(t, err)
+	val, err = orders2.Get(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 新建的 bucket 不复用已有编号
+	items, err := db2.Bucket("items")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(3), items.id)
+
+	// 4. 只读模式下仅能访问已存在的 bucket
+	roOpts := opts
+	roOpts.ReadOnly = true
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	roOrders, err := ro.Bucket("orders")
+	assert.Nil(t, err)
+	_, err = roOrders.Get(utils.GetTestKey(5))
+	assert.Nil(t, err)
+	_, err = ro.Bucket("not-exist")
+	assert.Equal(t, ErrBucketNotFound, err)
+	assert.Nil(t, ro.Close())
+}
+
+func TestDB_Bucket_BPTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bucket-bptree")
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	_, err = db.Bucket("users")
+	assert.Equal(t, ErrBucketIndexUnsupported, err)
+}
+
+func TestDB_Bucket_WriteBatch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bucket-batch")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	orders, err := db.Bucket("orders")
+	assert.Nil(t, err)
+
+	// 1. 跨 bucket 原子提交, 相同 key 在不同 bucket 中互不覆盖
+	key := utils.GetTestKey(1)
+	wb, err := users.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(key, []byte("users")))
+	assert.Nil(t, wb.Bucket(orders).Put(key, []byte("orders")))
+	val, err := wb.Bucket(orders).Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("orders"), val)
+	_, err = users.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, wb.Commit())
+
+	val, err = users.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users"), val)
+	val, err = orders.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("orders"), val)
+	_, err = db.Get(key)
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2. 冲突检测区分 bucket
+	wb, err = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_, err = wb.Bucket(users).Get(key)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(key, []byte("default")))
+	assert.Nil(t, orders.Put(key, []byte("orders2")))
+	assert.Nil(t, wb.Commit())
+
+	wb, err = db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_, err = wb.Bucket(users).Get(key)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Bucket(orders).Delete(key))
+	assert.Nil(t, users.Put(key, []byte("users2")))
+	assert.Equal(t, ErrTxnConflict, wb.Commit())
+	_, err = orders.Get(key)
+	assert.Nil(t, err)
+
+	// 3. 重启后事务数据生效
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	users2, err := db2.Bucket("users")
+	assert.Nil(t, err)
+	val, err = users2.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("users2"), val)
+	val, err = db2.Get(key)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("default"), val)
+}
+
+func TestDB_Bucket_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bucket-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, users.Delete(utils.GetTestKey(i)))
+	}
+	before := db.Stat().Buckets["users"]
+	assert.Greater(t, before.ReclaimableSize, int64(0))
+
+	// 1. merge 回收 bucket 中的无效数据
+	assert.Nil(t, db.Merge())
+	after := db.Stat().Buckets["users"]
+	assert.Equal(t, uint(500), after.KeyNum)
+	assert.Equal(t, int64(0), after.ReclaimableSize)
+	assert.Less(t, after.DiskSize, before.DiskSize)
+	val, err := users.Get(utils.GetTestKey(600))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	_, err = users.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2. 重启后通过 hint 文件恢复 bucket 元数据和索引
+	assert.Nil(t, users.Put(utils.GetTestKey(2000), utils.RandomValue(64)))
+	stat := db.Stat()
+	// merge 执行统计信息不持久化
+	stat.Merge = MergeStat{}
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, stat, db2.Stat())
+	users2, err := db2.Bucket("users")
+	assert.Nil(t, err)
+	_, err = users2.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+	_, err = db2.Get(utils.GetTestKey(100))
+	assert.Nil(t, err)
+}
@@ -0,0 +1,405 @@
+package xixi_kv
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// 备份流中的校验和文件名称, 位于备份流末尾
+const backupChecksumsName = "backup-checksums"
+
+// 备份检查点, 持有全部数据文件及与之一致的索引副本
+// 活跃文件不封存, 仅包含创建时刻已写入的部分
+type checkpoint struct {
+	snap        *Snapshot
+	fileIds     []uint32            // 数据文件 id, 从小到大排列, 包含已写入数据的活跃文件
+	linked      map[uint32]struct{} // 已硬链接到备份目录的数据文件
+	valueSizes  map[uint32]int64    // value log 文件 id 及需备份的数据量
+	valueLinked map[uint32]struct{} // 已硬链接到备份目录的 value log 文件
+	hintFile    *os.File            // hint 文件, 不存在时为 nil
+	fileHints   map[uint32]*os.File // 旧数据文件对应的 hint 文件, 不包含不存在或已硬链接的文件
+	index       *index.BPTreeBackup // B+ 树索引副本, 其余索引类型为 nil
+	seqNoRecord []byte              // 事务序列号文件内容
+}
+
+// 创建备份检查点, linkDir 不为空时尝试将旧数据文件硬链接到该目录
+// 仅在加锁期间获取文件引用和活跃文件的写入偏移, 之后的读取不阻塞写入
+// 不封存活跃文件, 频繁备份或从节点反复同步检查点时不会产生大量小数据文件
+func (db *DB) newCheckpoint(linkDir string) (*checkpoint, error) {
+	// 只读实例不持有文件锁, 数据文件可能被写入进程 merge 替换
+	if db.options.ReadOnly {
+		return nil, ErrDatabaseReadOnly
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 通过快照持有数据文件, 避免读取期间被 merge 关闭
+	cp := &checkpoint{
+		snap:        db.newFileSnapshot(),
+		linked:      make(map[uint32]struct{}),
+		valueLinked: make(map[uint32]struct{}),
+		fileHints:   make(map[uint32]*os.File),
+	}
+	for fileId := range db.getOlderFiles() {
+		cp.fileIds = append(cp.fileIds, fileId)
+	}
+	sort.Slice(cp.fileIds, func(i, j int) bool { return cp.fileIds[i] < cp.fileIds[j] })
+	sealedFileIds := cp.fileIds
+	// 活跃文件 id 大于全部旧数据文件
+	if cp.snap.activeOff > 0 {
+		cp.fileIds = append(cp.fileIds[:len(cp.fileIds):len(cp.fileIds)], cp.snap.activeFid)
+	}
+
+	// 内存映射 IO 打开文件时会修改文件大小, 不能共享存储
+	// 活跃文件仍在追加写入, 需复制
+	// 打开备份时 id 最大的数据文件作为活跃文件追加写入, 需复制, 避免修改原数据文件
+	if linkDir != "" && db.options.FileIOType == fio.StandardFIO && len(cp.fileIds) > 0 {
+		for _, fileId := range cp.fileIds[:len(cp.fileIds)-1] {
+			src := data.GetDataFileName(db.options.DirPath, fileId)
+			if os.Link(src, data.GetDataFileName(linkDir, fileId)) == nil {
+				cp.linked[fileId] = struct{}{}
+			}
+		}
+	}
+
+	// 数据文件引用的 value 均已写入 value log, 仅需备份当前已写入的部分
+	// value log 旧文件不可变, 可硬链接, 活跃文件仍在追加写入, 需复制
+	valueSizes, err := db.vlog.sizes()
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+	// 快照创建后新建的 value log 文件不被已封存的数据文件引用
+	for fileId := range valueSizes {
+		if _, ok := cp.snap.valueFiles[fileId]; !ok {
+			delete(valueSizes, fileId)
+		}
+	}
+	cp.valueSizes = valueSizes
+	if linkDir != "" {
+		for fileId := range cp.valueSizes {
+			if db.vlog.isActive(fileId) {
+				continue
+			}
+			src := data.GetValueLogFileName(db.options.DirPath, fileId)
+			if os.Link(src, data.GetValueLogFileName(linkDir, fileId)) == nil {
+				cp.valueLinked[fileId] = struct{}{}
+			}
+		}
+	}
+
+	// hint 文件仅在 merge 安装时替换, 加锁期间打开即可保证与数据文件一致
+	hintFile, err := os.Open(filepath.Join(db.options.DirPath, data.HintFileName))
+	if err == nil {
+		cp.hintFile = hintFile
+	} else if !os.IsNotExist(err) {
+		cp.close()
+		return nil, err
+	}
+
+	// 旧数据文件对应的 hint 文件, 恢复后无需读取数据文件即可加载索引
+	// hint 文件写入完成后不再修改, 仍在写入或已过期的 hint 文件在加载时因尾部记录校验失败而被忽略
+	// 活跃文件和刚封存的数据文件尚未写入 hint 文件, 加载时读取数据文件
+	for _, fileId := range sealedFileIds {
+		src := data.GetHintFileName(db.options.DirPath, fileId)
+		if linkDir != "" && os.Link(src, data.GetHintFileName(linkDir, fileId)) == nil {
+			continue
+		}
+		hintFile, err := os.Open(src)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			cp.close()
+			return nil, err
+		}
+		cp.fileHints[fileId] = hintFile
+	}
+
+	// B+ 树索引开启只读事务, 获取与数据文件一致的索引副本
+	if bpt, ok := db.index.(*index.BPlusTreeIndex); ok {
+		if cp.index, err = bpt.BeginBackup(); err != nil {
+			cp.close()
+			return nil, err
+		}
+	}
+
+	cp.seqNoRecord, _, err = db.encryptor.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(seqNoKey),
+		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
+	})
+	if err != nil {
+		cp.close()
+		return nil, err
+	}
+	return cp, nil
+}
+
+// 依次输出检查点中未硬链接的文件
+func (cp *checkpoint) walk(fn func(name string, size int64, write func(w io.Writer) error) error) error {
+	for _, fileId := range cp.fileIds {
+		if hintFile := cp.fileHints[fileId]; hintFile != nil {
+			name := filepath.Base(data.GetHintFileName("", fileId))
+			if err := walkFile(hintFile, name, fn); err != nil {
+				return err
+			}
+		}
+		if _, ok := cp.linked[fileId]; ok {
+			continue
+		}
+		dataFile := cp.snap.dataFiles[fileId]
+		size, err := cp.dataFileSize(dataFile)
+		if err != nil {
+			return err
+		}
+		name := filepath.Base(data.GetDataFileName("", fileId))
+		if err := fn(name, size, func(w io.Writer) error {
+			return copyDataFile(dataFile, size, w)
+		}); err != nil {
+			return err
+		}
+	}
+
+	valueFileIds := make([]uint32, 0, len(cp.valueSizes))
+	for fileId := range cp.valueSizes {
+		if _, ok := cp.valueLinked[fileId]; !ok {
+			valueFileIds = append(valueFileIds, fileId)
+		}
+	}
+	sort.Slice(valueFileIds, func(i, j int) bool { return valueFileIds[i] < valueFileIds[j] })
+	for _, fileId := range valueFileIds {
+		valueFile, size := cp.snap.valueFiles[fileId], cp.valueSizes[fileId]
+		name := filepath.Base(data.GetValueLogFileName("", fileId))
+		if err := fn(name, size, func(w io.Writer) error {
+			return copyDataFile(valueFile, size, w)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if cp.hintFile != nil {
+		if err := walkFile(cp.hintFile, data.HintFileName, fn); err != nil {
+			return err
+		}
+	}
+
+	if cp.index != nil {
+		if err := fn(cp.index.FileName(), cp.index.Size(), func(w io.Writer) error {
+			_, err := cp.index.WriteTo(w)
+			return err
+		}); err != nil {
+			return err
+		}
+	}
+
+	return fn(data.SeqNoFileName, int64(len(cp.seqNoRecord)), func(w io.Writer) error {
+		_, err := w.Write(cp.seqNoRecord)
+		return err
+	})
+}
+
+// 获取数据文件需备份的数据量, 活跃文件为检查点创建时刻的写入偏移
+func (cp *checkpoint) dataFileSize(dataFile *data.DataFile) (int64, error) {
+	if dataFile.FileId == cp.snap.activeFid {
+		return cp.snap.activeOff, nil
+	}
+	return dataFile.ReadWriter.Size()
+}
+
+// 以 name 输出已打开的文件在当前时刻的全部内容
+func walkFile(file *os.File, name string, fn func(name string, size int64, write func(w io.Writer) error) error) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	return fn(name, info.Size(), func(w io.Writer) error {
+		_, err := io.Copy(w, io.NewSectionReader(file, 0, info.Size()))
+		return err
+	})
+}
+
+// 释放检查点持有的文件
+func (cp *checkpoint) close() {
+	for _, hintFile := range cp.fileHints {
+		_ = hintFile.Close()
+	}
+	if cp.index != nil {
+		_ = cp.index.Close()
+	}
+	if cp.hintFile != nil {
+		_ = cp.hintFile.Close()
+	}
+	_ = cp.snap.Close()
+}
+
+// Backup 数据库备份, 在指定目录生成可直接打开的一致性检查点
+// 仅在加锁期间获取文件引用并创建硬链接, 复制数据时不阻塞写入
+// 使用标准文件 IO 时优先硬链接旧数据文件, 与原数据文件共享存储, 否则复制
+func (db *DB) Backup(dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	cp, err := db.newCheckpoint(dir)
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	return cp.walk(func(name string, size int64, write func(w io.Writer) error) error {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			_ = file.Close()
+		}()
+		if err := write(file); err != nil {
+			return err
+		}
+		return file.Sync()
+	})
+}
+
+// BackupTo 将一致性检查点以 tar 流的形式写入 w, 不依赖临时目录
+// 流末尾包含全部文件的 sha256 校验和, 供 RestoreFrom 校验
+func (db *DB) BackupTo(w io.Writer) error {
+	cp, err := db.newCheckpoint("")
+	if err != nil {
+		return err
+	}
+	defer cp.close()
+
+	tw := tar.NewWriter(w)
+	checksums := make(map[string]string)
+	modTime := time.Now()
+	err = cp.walk(func(name string, size int64, write func(w io.Writer) error) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    fio.DataFilePerm,
+			Size:    size,
+			ModTime: modTime,
+		}); err != nil {
+			return err
+		}
+		hash := sha256.New()
+		if err := write(io.MultiWriter(tw, hash)); err != nil {
+			return err
+		}
+		checksums[name] = hex.EncodeToString(hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	content, err := json.Marshal(checksums)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    backupChecksumsName,
+		Mode:    fio.DataFilePerm,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(content); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// RestoreFrom 从 BackupTo 生成的 tar 流恢复数据目录, 校验全部文件后写入 dir
+// 目标目录需不存在或为空
+func RestoreFrom(r io.Reader, dir string) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return ErrDirectoryNotEmpty
+	}
+	tempDir := filepath.Join(dir, restoreTempDirName)
+	if err := os.MkdirAll(tempDir, os.ModePerm); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+
+	// 解压到临时目录, 同时计算校验和
+	tr := tar.NewReader(r)
+	actual := make(map[string]string)
+	var expected map[string]string
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrBackupCorrupted, err)
+		}
+		// 仅允许数据目录下的普通文件
+		if header.Typeflag != tar.TypeReg || header.Name != filepath.Base(header.Name) ||
+			header.Name == "." || header.Name == ".." {
+			return fmt.Errorf("%w: unexpected entry %q", ErrBackupCorrupted, header.Name)
+		}
+
+		if header.Name == backupChecksumsName {
+			if err := json.NewDecoder(tr).Decode(&expected); err != nil {
+				return fmt.Errorf("%w: %v", ErrBackupCorrupted, err)
+			}
+			continue
+		}
+		checksum, err := restoreStreamFile(tr, filepath.Join(tempDir, header.Name))
+		if err != nil {
+			return err
+		}
+		actual[header.Name] = checksum
+	}
+
+	// 校验文件完整性
+	if expected == nil || len(expected) != len(actual) {
+		return fmt.Errorf("%w: missing files or checksums", ErrBackupCorrupted)
+	}
+	for name, checksum := range expected {
+		if actual[name] != checksum {
+			return fmt.Errorf("%w: checksum mismatch of %s", ErrBackupCorrupted, name)
+		}
+	}
+
+	for name := range actual {
+		if err := os.Rename(filepath.Join(tempDir, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将 r 中的数据写入文件 name, 返回 sha256 校验和
+func restoreStreamFile(r io.Reader, name string) (string, error) {
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, fio.DataFilePerm)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), r); err != nil {
+		return "", fmt.Errorf("%w: %v", ErrBackupCorrupted, err)
+	}
+	if err := file.Sync(); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
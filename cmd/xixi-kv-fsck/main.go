@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	bitcask "github.com/XiXi-2024/xixi-kv"
+	"os"
+	"sort"
+)
+
+// 离线检查数据目录完整性, 可选将有效数据重写到新目录
+//
+//	xixi-kv-fsck -dir /path/to/db
+//	xixi-kv-fsck -dir /path/to/db -repair -out /path/to/new-db
+func main() {
+	dir := flag.String("dir", "", "data directory to check")
+	repair := flag.Bool("repair", false, "rewrite all valid data into a clean directory")
+	out := flag.String("out", "", "target directory of repair, defaults to <dir>-repaired")
+	flag.Parse()
+
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	options := bitcask.DefaultOptions
+	options.DirPath = *dir
+
+	var report *bitcask.CheckReport
+	var err error
+	if *repair {
+		target := *out
+		if target == "" {
+			target = *dir + "-repaired"
+		}
+		report, err = bitcask.Repair(options, target)
+		if err == nil {
+			defer fmt.Printf("repaired data written to %s\n", target)
+		}
+	} else {
+		report, err = bitcask.Check(options)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "xixi-kv-fsck: %v\n", err)
+		os.Exit(1)
+	}
+
+	printReport(*dir, report)
+	if !report.Healthy() && !*repair {
+		os.Exit(1)
+	}
+}
+
+// 打印检查结果
+func printReport(dir string, report *bitcask.CheckReport) {
+	fmt.Printf("data directory:    %s\n", dir)
+	fmt.Printf("key num:           %d\n", report.KeyNum)
+	fmt.Printf("data file num:     %d\n", report.DataFileNum)
+	fmt.Printf("reclaimable size:  %d\n", report.ReclaimableSize)
+	fmt.Printf("disk size:         %d\n", report.DiskSize)
+
+	fmt.Printf("corrupted records: %d\n", len(report.Corruptions))
+	for _, corruption := range report.Corruptions {
+		fmt.Printf("  %v\n", corruption)
+	}
+
+	fmt.Printf("hint errors:       %d\n", len(report.HintErrors))
+	for _, err := range report.HintErrors {
+		fmt.Printf("  %v\n", err)
+	}
+
+	fmt.Printf("unfinished txns:   %d\n", len(report.UnfinishedTxns))
+	seqNos := make([]uint64, 0, len(report.UnfinishedTxns))
+	for seqNo := range report.UnfinishedTxns {
+		seqNos = append(seqNos, seqNo)
+	}
+	sort.Slice(seqNos, func(i, j int) bool { return seqNos[i] < seqNos[j] })
+	for _, seqNo := range seqNos {
+		fmt.Printf("  txn %d: %d records without finished marker\n", seqNo, report.UnfinishedTxns[seqNo])
+	}
+
+	if report.MergeDir != "" {
+		state := "unfinished, will be discarded on next open"
+		if report.MergeFinished {
+			state = "finished, will be installed on next open"
+		}
+		fmt.Printf("leftover merge:    %s (%s)\n", report.MergeDir, state)
+	}
+
+	if report.Healthy() {
+		fmt.Println("status:            ok")
+	} else {
+		fmt.Println("status:            problems found")
+	}
+}
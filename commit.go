@@ -0,0 +1,283 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"sync"
+	"sync/atomic"
+)
+
+// 写入请求, 包含一次写入操作的全部日志记录
+type commitRequest struct {
+	records []*data.LogRecord
+	sync    bool // 写入后立即持久化, 不受持久化策略影响
+	// 写入前执行的校验, 返回错误时不写入, 用于事务冲突检测
+	// 执行时此前提交的请求均已生效
+	check func() error
+	// 日志记录写入后按写入顺序执行, 用于更新内存索引和通知变更订阅者
+	apply func(positions []*data.LogRecordPos) error
+	err   error // 写入结果
+	done  bool  // 请求已处理标识
+}
+
+// 写入队列, 保证同一时刻仅有一个写入者追加日志记录
+// 并发的写入请求排队, 由队首请求作为 leader 将已排队的请求合并为一次写入, 至多持久化一次
+type commitQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*commitRequest // 等待写入的请求
+	leading bool             // 是否存在正在写入的 leader
+}
+
+func newCommitQueue() *commitQueue {
+	q := &commitQueue{}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// 提交写入请求, 写入成功后执行 apply, 调用方不能持有 DB 锁
+// 全部写入由 leader 串行追加, 追加期间仅持有读锁, 不阻塞读取
+func (db *DB) submit(req *commitRequest) error {
+	q := db.commits
+	q.mu.Lock()
+	q.pending = append(q.pending, req)
+	// 等待被其它 leader 处理, 或成为队首后作为 leader
+	for !req.done && (q.leading || q.pending[0] != req) {
+		q.cond.Wait()
+	}
+	if req.done {
+		q.mu.Unlock()
+		return req.err
+	}
+
+	// 作为 leader 处理当前已排队的请求
+	// 带校验的请求需在此前的请求生效后执行校验, 故作为新一组的起点
+	q.leading = true
+	n := 1
+	for n < len(q.pending) && q.pending[n].check == nil {
+		n++
+	}
+	group := q.pending[:n]
+	q.pending = append([]*commitRequest(nil), q.pending[n:]...)
+	q.mu.Unlock()
+
+	db.writeGroup(group)
+
+	q.mu.Lock()
+	for _, r := range group {
+		r.done = true
+	}
+	q.leading = false
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	return req.err
+}
+
+// 暂停写入, 返回时此前开始写入的请求均已生效, 恢复前不会有新的请求开始写入
+// 同一时刻至多一个调用方暂停写入, 调用方不能持有 DB 锁
+func (q *commitQueue) pause() {
+	q.mu.Lock()
+	for q.leading {
+		q.cond.Wait()
+	}
+	q.leading = true
+	q.mu.Unlock()
+}
+
+// 恢复写入, 唤醒排队的写入请求
+func (q *commitQueue) resume() {
+	q.mu.Lock()
+	q.leading = false
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// 将一组请求的日志记录合并写入活跃文件, 再按写入顺序执行各请求的 apply
+// 活跃文件剩余空间足够时仅持有读锁, 需要切换活跃文件或包含多条日志记录的请求时持有写锁
+func (db *DB) writeGroup(group []*commitRequest) {
+	// 带校验的请求先于写入 value log 执行校验, 校验失败时不写入任何数据
+	// 写入者由写入队列串行化, 校验后至追加前不会有其它写入生效
+	if req := group[0]; req.check != nil {
+		db.mu.RLock()
+		req.err = req.check()
+		db.mu.RUnlock()
+	}
+
+	// 按写入顺序分配日志序列号并编码, 编码失败的请求不写入任何日志记录
+	encRecords := make([][][]byte, len(group))
+	var size int64
+	var syncWrites = db.options.SyncStrategy == Always
+	var exclusive bool
+	for i, req := range group {
+		if req.err != nil {
+			continue
+		}
+		syncWrites = syncWrites || req.sync
+		exclusive = exclusive || len(req.records) > 1
+		encRecords[i] = make([][]byte, len(req.records))
+		for j, record := range req.records {
+			record.LogSeqNo = atomic.AddUint64(&db.logSeqNo, 1)
+			// 按当前配置压缩 value
+			record.Compression = db.options.Compression
+			// value 超过阈值时先写入 value log, 数据文件中仅保存位置信息
+			stored := record
+			if db.separable(record) {
+				var err error
+				if stored, err = db.writeValue(record); err != nil {
+					req.err = err
+					break
+				}
+			}
+			encRecord, _, err := db.encryptor.EncodeLogRecord(stored)
+			if err != nil {
+				req.err = err
+				break
+			}
+			encRecords[i][j] = encRecord
+			size += int64(len(encRecord))
+		}
+	}
+	// 需立即持久化时, value log 先于数据文件持久化, 避免位置信息指向未持久化的 value
+	if syncWrites {
+		if err := db.syncValueLog(); err != nil {
+			failGroup(group, err)
+			return
+		}
+	}
+
+	// 写入者由写入队列串行化, 活跃文件仅会被 merge 切换为新文件, 剩余空间不会减少
+	// WriteBatch 的索引更新需对读取者整体可见, 持有写锁避免读取到部分生效的 WriteBatch
+	db.mu.RLock()
+	if !exclusive && db.activeFile != nil && db.activeFile.WriteOff+size <= db.options.DataFileSize {
+		defer db.mu.RUnlock()
+	} else {
+		db.mu.RUnlock()
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+	db.appendGroup(group, encRecords)
+}
+
+// 追加写入已编码的日志记录, 调用方需持有锁, 切换活跃文件时需持有写锁
+func (db *DB) appendGroup(group []*commitRequest, encRecords [][][]byte) {
+	// 如果数据库为空, 先创建数据文件并设置为活跃文件
+	if db.activeFile == nil {
+		if err := db.setActiveDataFile(); err != nil {
+			failGroup(group, err)
+			return
+		}
+	}
+
+	// 本组写入过的文件及写入前的偏移, 中途失败时截断已写入的日志记录
+	// 中途封存的数据文件在本组结束后再写入 hint 文件, 避免 hint 文件包含截断前的日志记录
+	// 切换活跃文件时持有写锁, 本组结束前其它协程无法访问封存的数据文件中未生效的日志记录
+	var written []fileOffset
+	var sealedFiles []*data.DataFile
+	defer func() {
+		for _, sealedFile := range sealedFiles {
+			db.scheduleFileHint(sealedFile)
+		}
+	}()
+	write := func(buf []byte) error {
+		if len(written) == 0 || written[len(written)-1].file != db.activeFile {
+			written = append(written, fileOffset{file: db.activeFile, offset: db.activeFile.WriteOff})
+		}
+		return db.activeFile.Write(buf)
+	}
+	fail := func(err error) {
+		truncateWritten(written)
+		failGroup(group, err)
+	}
+
+	positions := make([][]*data.LogRecordPos, len(group))
+	var buf []byte
+	var syncWrites bool
+	for i, req := range group {
+		if req.err != nil {
+			continue
+		}
+		syncWrites = syncWrites || req.sync
+		positions[i] = make([]*data.LogRecordPos, len(req.records))
+		for j, encRecord := range encRecords[i] {
+			size := int64(len(encRecord))
+			// 活跃文件剩余空间不足, 写入已合并的数据后切换活跃文件
+			if db.activeFile.WriteOff+int64(len(buf))+size > db.options.DataFileSize {
+				if err := write(buf); err != nil {
+					fail(err)
+					return
+				}
+				buf = buf[:0]
+				sealedFile, err := db.sealActiveFile()
+				if err != nil {
+					fail(err)
+					return
+				}
+				sealedFiles = append(sealedFiles, sealedFile)
+			}
+			positions[i][j] = &data.LogRecordPos{
+				Fid:    db.activeFile.FileId,
+				Offset: db.activeFile.WriteOff + int64(len(buf)),
+				Size:   uint32(size),
+				Expire: req.records[j].Expire,
+			}
+			buf = append(buf, encRecord...)
+		}
+	}
+
+	// 一次写入
+	if err := write(buf); err != nil {
+		fail(err)
+		return
+	}
+	db.bytesWrite += uint(len(buf))
+	db.writtenBytes.Add(uint64(len(buf)))
+
+	// 执行配置的持久化策略, 至多持久化一次
+	syncStrategy := db.options.SyncStrategy
+	if syncWrites || syncStrategy == Always || (syncStrategy == Threshold && db.bytesWrite >= db.options.BytesPerSync) {
+		if err := db.syncValueLog(); err != nil {
+			fail(err)
+			return
+		}
+		if err := db.activeFile.Sync(); err != nil {
+			fail(err)
+			return
+		}
+		db.bytesWrite = 0
+	}
+
+	// 写入成功后维护总数据量
+	for _, filePositions := range positions {
+		for _, pos := range filePositions {
+			db.addFileSize(pos.Fid, int64(pos.Size))
+		}
+	}
+
+	for i, req := range group {
+		if req.err == nil {
+			req.err = req.apply(positions[i])
+		}
+	}
+}
+
+// 将组内尚未失败的请求标记为失败
+func failGroup(group []*commitRequest, err error) {
+	for _, req := range group {
+		if req.err == nil {
+			req.err = err
+		}
+	}
+}
+
+// 文件及其写入前的偏移
+type fileOffset struct {
+	file   *data.DataFile
+	offset int64
+}
+
+// 将本组写入过的文件截断回写入前的偏移, 丢弃未生效的日志记录
+// 截断失败时忽略错误, 不影响请求已返回的失败结果
+func truncateWritten(written []fileOffset) {
+	for i := len(written) - 1; i >= 0; i-- {
+		_ = written[i].file.Truncate(written[i].offset)
+	}
+}
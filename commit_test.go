@@ -0,0 +1,530 @@
+package xixi_kv
+
+import (
+	"bytes"
+	"errors"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDB_GroupCommit(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.SyncStrategy = Always
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1. 并发写入、删除和事务提交
+	value := utils.RandomValue(128)
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := utils.GetTestKey(g*1000 + i)
+				assert.Nil(t, db.Put(key, value))
+				if i%10 == 0 {
+					assert.Nil(t, db.Delete(key))
+				}
+				if i%25 == 0 {
+					wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+					assert.Nil(t, err)
+					assert.Nil(t, wb.Put(utils.GetTestKey(g*1000+500+i), value))
+					assert.Nil(t, wb.Commit())
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	stat := db.Stat()
+	assert.Equal(t, uint(8*(90+4)), stat.KeyNum)
+	assert.Greater(t, stat.DataFileNum, uint(1))
+
+	// 2. 数据文件中的日志序列号按写入顺序严格递增
+	var lastSeqNo uint64 = 0
+	fileIds, err := db.dataFileIds()
+	assert.Nil(t, err)
+	for _, fileId := range fileIds {
+		dataFile := db.getOlderFiles()[fileId]
+		if fileId == db.activeFile.FileId {
+			dataFile = db.activeFile
+		}
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			assert.Greater(t, logRecord.LogSeqNo, lastSeqNo)
+			lastSeqNo = logRecord.LogSeqNo
+			offset += size
+		}
+	}
+
+	// 3. 重启后数据一致
+	val, err := db.Get(utils.GetTestKey(3005))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	assert.Equal(t, stat.KeyNum, db2.Stat().KeyNum)
+	val2, err := db2.Get(utils.GetTestKey(3005))
+	assert.Nil(t, err)
+	assert.Equal(t, val, val2)
+	_, err = db2.Get(utils.GetTestKey(3010))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_ConcurrentReadWrite(t *testing.T) {
+	for _, strategy := range []SyncStrategy{No, Threshold, Always} {
+		t.Run(strconv.Itoa(int(strategy)), func(t *testing.T) {
+			testConcurrentReadWrite(t, strategy)
+		})
+	}
+}
+
+// 并发读写、事务、迭代、merge 和 bucket 操作, 配合 -race 检测数据竞争
+func testConcurrentReadWrite(t *testing.T, strategy SyncStrategy) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-concurrent")
+	opts.DirPath = dir
+	// 较小的数据文件触发频繁的活跃文件切换
+	opts.DataFileSize = 16 * 1024
+	opts.SyncStrategy = strategy
+	opts.BytesPerSync = 4 * 1024
+	opts.EnableBackgroundMerge = false
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+
+	// value 由 key 派生, 读取时校验数据完整性
+	const writers, keysPerWriter = 4, 200
+	valueOf := func(key []byte, round int) []byte {
+		return bytes.Repeat(append(key, byte(round)), 4)
+	}
+	counterKey := []byte("counter")
+
+	var stop atomic.Bool
+	var increments atomic.Int64
+	var wg, readers sync.WaitGroup
+
+	// 1. 写入者, 各自写入和删除互不重叠的 key
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for round := 0; round < 3; round++ {
+				for i := 0; i < keysPerWriter; i++ {
+					key := utils.GetTestKey(w*keysPerWriter + i)
+					assert.Nil(t, db.Put(key, valueOf(key, round)))
+					assert.Nil(t, users.Put(key, valueOf(key, round)))
+					if i%5 == 0 {
+						assert.Nil(t, db.Delete(key))
+					}
+					if i%50 == 0 {
+						assert.Nil(t, db.PutWithTTL(key, valueOf(key, round), time.Hour))
+						assert.Nil(t, db.Persist(key))
+					}
+				}
+			}
+		}(w)
+	}
+
+	// 2. 事务写入者, 并发自增同一计数器
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				err := db.Update(func(wb *WriteBatch) error {
+					var n int
+					val, err := wb.Get(counterKey)
+					if err == nil {
+						n, _ = strconv.Atoi(string(val))
+					}
+					return wb.Put(counterKey, []byte(strconv.Itoa(n+1)))
+				})
+				if err == nil {
+					increments.Add(1)
+				} else {
+					assert.Equal(t, ErrTxnConflict, err)
+				}
+			}
+		}()
+	}
+
+	// 3. 读取者, 校验读取到的数据与 key 一致
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for i := 0; !stop.Load(); i++ {
+			key := utils.GetTestKey(i % (writers * keysPerWriter))
+			if val, err := db.Get(key); err == nil {
+				assert.True(t, bytes.HasPrefix(val, key))
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+			if val, err := users.Get(key); err == nil {
+				assert.True(t, bytes.HasPrefix(val, key))
+			} else {
+				assert.Equal(t, ErrKeyNotFound, err)
+			}
+		}
+	}()
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for !stop.Load() {
+			iterator := db.NewIterator(DefaultIteratorOptions)
+			for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+				if _, err := iterator.Value(); err != nil {
+					// 迭代期间 key 可能已被删除
+					assert.Equal(t, ErrKeyNotFound, err)
+				}
+			}
+			iterator.Close()
+			stat := db.Stat()
+			assert.GreaterOrEqual(t, stat.DiskSize, stat.ReclaimableSize)
+		}
+	}()
+
+	// 4. 并发执行 merge
+	readers.Add(1)
+	go func() {
+		defer readers.Done()
+		for !stop.Load() {
+			if err := db.Merge(); err != nil {
+				assert.Equal(t, ErrMergeIsProgress, err)
+			}
+		}
+	}()
+
+	wg.Wait()
+	stop.Store(true)
+	readers.Wait()
+
+	// 5. 校验最终状态, 重启后保持一致
+	check := func(db *DB) {
+		users, err := db.Bucket("users")
+		assert.Nil(t, err)
+		for i := 0; i < writers*keysPerWriter; i++ {
+			key := utils.GetTestKey(i)
+			val, err := db.Get(key)
+			if n := i % keysPerWriter; n%5 == 0 && n%50 != 0 {
+				assert.Equal(t, ErrKeyNotFound, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, valueOf(key, 2), val)
+			}
+			val, err = users.Get(key)
+			assert.Nil(t, err)
+			assert.Equal(t, valueOf(key, 2), val)
+		}
+		val, err := db.Get(counterKey)
+		assert.Nil(t, err)
+		assert.Equal(t, strconv.Itoa(int(increments.Load())), string(val))
+	}
+	check(db)
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+	db2, err := Open(opts)
+	defer destroyDB(db2)
+	assert.Nil(t, err)
+	check(db2)
+	assert.Equal(t, stat.KeyNum, db2.Stat().KeyNum)
+}
+
+// 并发写入时每次写入均持久化
+func TestDB_LockFreeRead(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-lock-free-read")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 1000; i++ {
+		values[i] = utils.RandomValue(128)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	assert.Greater(t, len(db.getOlderFiles()), 1)
+
+	// 1. 写入者持有读锁时读取统计信息不被阻塞
+	db.mu.RLock()
+	statDone := make(chan *Stat)
+	go func() {
+		statDone <- db.Stat()
+	}()
+	select {
+	case stat := <-statDone:
+		assert.Equal(t, uint(1000), stat.KeyNum)
+	case <-time.After(time.Second):
+		t.Fatal("stat blocked by readers")
+	}
+	db.mu.RUnlock()
+
+	// 2. 存在无锁读取者时 merge 替换的旧数据文件延迟关闭, 读取者仍可读取
+	db.readers.RLock()
+	assert.Nil(t, db.Merge())
+	db.mu.RLock()
+	assert.NotEmpty(t, db.retiredFiles)
+	db.mu.RUnlock()
+	db.readers.RUnlock()
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	// 3. 并发读取旧数据文件期间执行 merge
+	var wg sync.WaitGroup
+	var stop atomic.Bool
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; !stop.Load(); i++ {
+				val, err := db.Get(utils.GetTestKey(i % 1000))
+				assert.Nil(t, err)
+				assert.Equal(t, values[i%1000], val)
+			}
+		}()
+	}
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Merge())
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+// 读取者观察到 WriteBatch 的部分写入后, 之后的读取可观察到全部写入
+func TestDB_WriteBatchAtomicVisibility(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-batch-visibility")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	const keyNum = 1000
+	var stop atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; !stop.Load(); round++ {
+			wb, err := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: keyNum})
+			assert.Nil(t, err)
+			for i := 0; i < keyNum; i++ {
+				assert.Nil(t, wb.Put(utils.GetTestKey(i), []byte(strconv.Itoa(round))))
+			}
+			assert.Nil(t, wb.Commit())
+		}
+	}()
+
+	roundOf := func(i int) int {
+		val, err := db.Get(utils.GetTestKey(i))
+		if err == ErrKeyNotFound {
+			return -1
+		}
+		assert.Nil(t, err)
+		round, _ := strconv.Atoi(string(val))
+		return round
+	}
+	for n := 0; n < 200; n++ {
+		for i := 0; i < keyNum; i += 97 {
+			round := roundOf(i)
+			for j := 0; j < keyNum; j += 89 {
+				assert.GreaterOrEqual(t, roundOf(j), round)
+			}
+		}
+	}
+	stop.Store(true)
+	wg.Wait()
+}
+
+// 持久化失败的 IO 实现, 用于模拟写入成功但持久化失败
+type failSyncReadWriter struct {
+	fio.ReadWriter
+}
+
+func (rw *failSyncReadWriter) Sync() error {
+	return errSyncFailed
+}
+
+var errSyncFailed = errors.New("sync failed")
+
+func TestDB_GroupCommit_Failure(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-failure")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 64
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1. 冲突的事务不写入 value log
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(16)))
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_, err = wb.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.RandomValue(1024)))
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(16)))
+	valueLogSize := db.Stat().ValueLogSize
+	assert.Equal(t, ErrTxnConflict, wb.Commit())
+	assert.Equal(t, valueLogSize, db.Stat().ValueLogSize)
+
+	// 2. 写入成功但持久化失败时截断已写入的日志记录
+	activeFile := db.activeFile
+	writeOff := activeFile.WriteOff
+	diskSize := db.Stat().DiskSize
+	readWriter := activeFile.ReadWriter
+	activeFile.ReadWriter = &failSyncReadWriter{ReadWriter: readWriter}
+	wb, err = db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: 100, SyncWrites: true})
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(2), utils.RandomValue(16)))
+	assert.Equal(t, errSyncFailed, wb.Commit())
+	assert.Equal(t, writeOff, activeFile.WriteOff)
+	size, err := readWriter.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, size)
+	assert.Equal(t, diskSize, db.Stat().DiskSize)
+	activeFile.ReadWriter = readWriter
+
+	// 3. 失败的写入重启后不可见, 后续写入不受影响
+	assert.Nil(t, db.Put(utils.GetTestKey(3), utils.RandomValue(16)))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(2))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(3))
+	assert.Nil(t, err)
+}
+
+// 组内切换活跃文件后失败, 截断封存的数据文件, 其 hint 文件与截断后的内容一致
+func TestDB_GroupCommit_FailureAfterRotation(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-group-commit-rotation")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.ValueThreshold = 64
+	opts.SyncStrategy = Threshold
+	opts.BytesPerSync = 1
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 活跃文件接近写满, 部分 value 写入 value log
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(80)))
+	var keyNum int
+	for keyNum = 1; db.activeFile.WriteOff < opts.DataFileSize-512; keyNum++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(keyNum), utils.RandomValue(16)))
+	}
+	sealedFile := db.activeFile
+	writeOff := sealedFile.WriteOff
+
+	// 写入超过活跃文件剩余空间的事务, 切换活跃文件后持久化 value log 失败
+	valueFile := db.vlog.activeFile
+	readWriter := valueFile.ReadWriter
+	valueFile.ReadWriter = &failSyncReadWriter{ReadWriter: readWriter}
+	wb, err := db.NewWriteBatch(WriteBatchOptions{MaxBatchNum: 100})
+	assert.Nil(t, err)
+	for i := 1000; i < 1020; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(80)))
+	}
+	assert.Equal(t, errSyncFailed, wb.Commit())
+	valueFile.ReadWriter = readWriter
+
+	assert.NotEqual(t, sealedFile, db.activeFile)
+	assert.Equal(t, sealedFile, db.getOlderFiles()[sealedFile.FileId])
+	size, err := sealedFile.ReadWriter.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, writeOff, size)
+	assert.Equal(t, int64(0), db.activeFile.WriteOff)
+
+	// hint 文件在截断后写入, 重启后从 hint 文件加载的索引不包含失败的写入
+	db.hints.Wait()
+	assert.Equal(t, keyNum, len(db.readFileHint(sealedFile)))
+	assert.Nil(t, db.Put(utils.GetTestKey(keyNum), utils.RandomValue(16)))
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(keyNum+1), db.Stat().KeyNum)
+	_, err = db.Get(utils.GetTestKey(1000))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func benchmarkSyncPut(b *testing.B, strategy SyncStrategy, syncEachPut bool) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-bench-sync")
+	opts.DirPath = dir
+	opts.SyncStrategy = strategy
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer destroyDB(db)
+
+	value := utils.RandomValue(128)
+	var mu sync.Mutex
+	var i int
+	b.SetParallelism(16)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			mu.Lock()
+			key := utils.GetTestKey(i)
+			i++
+			mu.Unlock()
+			if err := db.Put(key, value); err != nil {
+				b.Error(err)
+			}
+			if syncEachPut {
+				if err := db.Sync(); err != nil {
+					b.Error(err)
+				}
+			}
+		}
+	})
+}
+
+// 组提交, 并发写入合并为一次持久化
+func BenchmarkDB_Put_GroupCommit(b *testing.B) {
+	benchmarkSyncPut(b, Always, false)
+}
+
+// 每次写入后单独持久化
+func BenchmarkDB_Put_SyncPerWrite(b *testing.B) {
+	benchmarkSyncPut(b, No, true)
+}
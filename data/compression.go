@@ -0,0 +1,95 @@
+package data
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"errors"
+	"io"
+)
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported compression type")
+)
+
+// CompressionType value 压缩算法枚举
+type CompressionType = byte
+
+const (
+	// NoCompression 不压缩
+	NoCompression CompressionType = iota
+	// Flate DEFLATE 压缩, 优先压缩速度
+	Flate
+	// Zlib zlib 压缩, 优先压缩率
+	Zlib
+)
+
+// 小于该长度的 value 压缩收益较低, 不进行压缩
+const minCompressValueSize = 128
+
+// 按指定算法压缩 value
+// 返回首字节为压缩算法的字节数组, 压缩后未变小时返回 false
+func compressValue(typ CompressionType, value []byte) ([]byte, bool) {
+	if typ == NoCompression || len(value) < minCompressValueSize {
+		return nil, false
+	}
+
+	buf := new(bytes.Buffer)
+	buf.WriteByte(typ)
+	var writer io.WriteCloser
+	var err error
+	switch typ {
+	case Flate:
+		writer, err = flate.NewWriter(buf, flate.BestSpeed)
+	case Zlib:
+		writer, err = zlib.NewWriterLevel(buf, zlib.DefaultCompression)
+	default:
+		return nil, false
+	}
+	if err != nil {
+		return nil, false
+	}
+	if _, err := writer.Write(value); err != nil {
+		return nil, false
+	}
+	if err := writer.Close(); err != nil {
+		return nil, false
+	}
+
+	// 压缩无收益时保存原始数据
+	if buf.Len() >= len(value) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// 解压 value, buf 首字节为压缩算法
+func decompressValue(buf []byte) (CompressionType, []byte, error) {
+	if len(buf) == 0 {
+		return NoCompression, nil, ErrUnsupportedCompression
+	}
+
+	typ := buf[0]
+	var reader io.ReadCloser
+	var err error
+	switch typ {
+	case Flate:
+		reader = flate.NewReader(bytes.NewReader(buf[1:]))
+	case Zlib:
+		reader, err = zlib.NewReader(bytes.NewReader(buf[1:]))
+	default:
+		return typ, nil, ErrUnsupportedCompression
+	}
+	if err != nil {
+		return typ, nil, err
+	}
+	defer func() {
+		_ = reader.Close()
+	}()
+
+	value, err := io.ReadAll(reader)
+	if err != nil {
+		return typ, nil, err
+	}
+	return typ, value, nil
+}
@@ -17,14 +17,26 @@ const (
 	// DataFileNameSuffix 数据文件后缀
 	DataFileNameSuffix = ".data"
 
+	// ValueLogFileNameSuffix value log 文件后缀
+	ValueLogFileNameSuffix = ".vlog"
+
 	// HintFileName Hint文件全名
 	HintFileName = "hint-index"
 
+	// HintFileNameSuffix 单个数据文件对应的 hint 文件后缀
+	HintFileNameSuffix = ".hint"
+
 	// MergeFinishedFileName merge完成标识文件全名
 	MergeFinishedFileName = "merge-finished"
 
 	// SeqNoFileName 事务序列号文件全名
-	SeqNoFileName = "merge-finished"
+	SeqNoFileName = "seq-no"
+
+	// IndexCheckpointFileName 索引检查点文件全名
+	IndexCheckpointFileName = "index-checkpoint"
+
+	// MergeRecordsFileName merge 重写记录文件全名, 仅位于 merge 临时目录中
+	MergeRecordsFileName = "merge-records"
 )
 
 // DataFile 数据文件
@@ -32,31 +44,75 @@ type DataFile struct {
 	FileId     uint32         // 文件 id
 	WriteOff   int64          // 文件数据末尾偏移量, 供活跃文件执行写入操作
 	ReadWriter fio.ReadWriter // IO 实现
+	encryptor  *Encryptor     // 日志记录加解密, nil 表示不加密
 }
 
 // OpenDataFile 打开数据文件
 // todo 优化点：重构除去不是必须的
-func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func OpenDataFile(dirPath string, fileId uint32, ioType fio.FileIOType, encryptor *Encryptor) (*DataFile, error) {
 	fileName := GetDataFileName(dirPath, fileId)
-	return newDataFile(fileName, fileId, ioType)
+	return newDataFile(fileName, fileId, ioType, encryptor)
+}
+
+// OpenDataFileReadOnly 以只读方式打开已存在的数据文件
+func OpenDataFileReadOnly(dirPath string, fileId uint32, encryptor *Encryptor) (*DataFile, error) {
+	return newReadOnlyDataFile(GetDataFileName(dirPath, fileId), fileId, encryptor)
+}
+
+// OpenValueLogFile 打开 value log 文件
+// value log 文件与数据文件使用相同的日志记录格式, 文件 id 独立编号
+func OpenValueLogFile(dirPath string, fileId uint32, ioType fio.FileIOType, encryptor *Encryptor) (*DataFile, error) {
+	fileName := GetValueLogFileName(dirPath, fileId)
+	return newDataFile(fileName, fileId, ioType, encryptor)
+}
+
+// OpenValueLogFileReadOnly 以只读方式打开已存在的 value log 文件
+func OpenValueLogFileReadOnly(dirPath string, fileId uint32, encryptor *Encryptor) (*DataFile, error) {
+	return newReadOnlyDataFile(GetValueLogFileName(dirPath, fileId), fileId, encryptor)
 }
 
 // OpenHintFile 打开 Hint 索引文件
-func OpenHintFile(dirPath string) (*DataFile, error) {
+func OpenHintFile(dirPath string, encryptor *Encryptor) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, HintFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fileName, 0, fio.StandardFIO, encryptor)
+}
+
+// OpenDataHintFile 打开数据文件对应的 hint 文件, 与数据文件使用相同的文件 id
+func OpenDataHintFile(dirPath string, fileId uint32, encryptor *Encryptor) (*DataFile, error) {
+	return newDataFile(GetHintFileName(dirPath, fileId), fileId, fio.StandardFIO, encryptor)
+}
+
+// OpenDataHintFileReadOnly 以只读方式打开数据文件对应的 hint 文件
+func OpenDataHintFileReadOnly(dirPath string, fileId uint32, encryptor *Encryptor) (*DataFile, error) {
+	return newReadOnlyDataFile(GetHintFileName(dirPath, fileId), fileId, encryptor)
 }
 
 // OpenMergeFinishedFile 打开 merge 完成标识文件
-func OpenMergeFinishedFile(dirPath string) (*DataFile, error) {
+func OpenMergeFinishedFile(dirPath string, encryptor *Encryptor) (*DataFile, error) {
 	fileName := filepath.Join(dirPath, MergeFinishedFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+	return newDataFile(fileName, 0, fio.StandardFIO, encryptor)
+}
+
+// OpenMergeRecordsFile 打开 merge 重写记录文件
+func OpenMergeRecordsFile(dirPath string, encryptor *Encryptor) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, MergeRecordsFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO, encryptor)
+}
+
+// OpenSeqNoFileReadOnly 以只读方式打开事务序列号文件, fileName 为文件全名, 用于兼容旧版本的文件名称
+func OpenSeqNoFileReadOnly(dirPath, fileName string, encryptor *Encryptor) (*DataFile, error) {
+	return newReadOnlyDataFile(filepath.Join(dirPath, fileName), 0, encryptor)
+}
+
+// OpenIndexCheckpointFile 打开索引检查点文件
+func OpenIndexCheckpointFile(dirPath string, encryptor *Encryptor) (*DataFile, error) {
+	fileName := filepath.Join(dirPath, IndexCheckpointFileName)
+	return newDataFile(fileName, 0, fio.StandardFIO, encryptor)
 }
 
-// OpenSeqNoFile 打开事务序列号文件并构造 DataFile 实例
-func OpenSeqNoFile(dirPath string) (*DataFile, error) {
-	fileName := filepath.Join(dirPath, SeqNoFileName)
-	return newDataFile(fileName, 0, fio.StandardFIO)
+// OpenIndexCheckpointFileReadOnly 以只读方式打开索引检查点文件
+func OpenIndexCheckpointFileReadOnly(dirPath string, encryptor *Encryptor) (*DataFile, error) {
+	return newReadOnlyDataFile(filepath.Join(dirPath, IndexCheckpointFileName), 0, encryptor)
 }
 
 // GetDataFileName 获取完整数据文件名称
@@ -64,8 +120,18 @@ func GetDataFileName(dirPath string, fileId uint32) string {
 	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+DataFileNameSuffix)
 }
 
+// GetValueLogFileName 获取完整 value log 文件名称
+func GetValueLogFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+ValueLogFileNameSuffix)
+}
+
+// GetHintFileName 获取数据文件对应的完整 hint 文件名称
+func GetHintFileName(dirPath string, fileId uint32) string {
+	return filepath.Join(dirPath, fmt.Sprintf("%09d", fileId)+HintFileNameSuffix)
+}
+
 // 根据完整文件名称打开文件并构造 DataFile 实例
-func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFile, error) {
+func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType, encryptor *Encryptor) (*DataFile, error) {
 	// 根据配置的类型和路径创建新 IO 管理器实例
 	readWriter, err := fio.NewReadWriter(fileName, ioType)
 	if err != nil {
@@ -77,16 +143,22 @@ func newDataFile(fileName string, fileId uint32, ioType fio.FileIOType) (*DataFi
 		FileId:     fileId,
 		WriteOff:   0,
 		ReadWriter: readWriter,
+		encryptor:  encryptor,
 	}, nil
 }
 
 // ReadLogRecord 从偏移量 offset 开始读取一条日志记录
+// 已读取到文件末尾时返回 io.EOF, 日志记录不完整时返回 io.ErrUnexpectedEOF
+// 校验失败时返回 ErrInvalidCRC 和头部记录的日志记录长度
 func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 获取当前文件总长度
 	fileSize, err := df.ReadWriter.Size()
 	if err != nil {
 		return nil, 0, err
 	}
+	if offset >= fileSize {
+		return nil, 0, io.EOF
+	}
 	// 以固定最大长度读取 Header 头部, 只需保证完整包括一条日志记录即可
 	var headerBytes int64 = maxLogRecordHeaderSize
 	// 如果固定最大长度超过文件剩余长度则读取剩余长度数据, 避免 EOF
@@ -100,22 +172,28 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 
 	// 解码
 	header, headerSize := decodeLogRecordHeader(headerBuf)
-	// 解码失败, 读取的字节不包含新的reader头部, 表示已读取到文件末尾
-	// todo 优化点：根据写入偏移量判断, 避免额外的磁盘IO
+	// 解码失败, 剩余字节不足一个完整头部
 	if header == nil {
-		return nil, 0, io.EOF
-	}
-	if header.crc == 0 && header.keySize == 0 && header.valueSize == 0 {
-		return nil, 0, io.EOF
+		return nil, 0, io.ErrUnexpectedEOF
 	}
 
 	// 获取 key 和 value 长度
 	keySize, valueSize := int64(header.keySize), int64(header.valueSize)
 	// 计算日志记录总长度
 	var recordSize = headerSize + keySize + valueSize
+	// 日志记录超出文件末尾, 通常为写入过程中崩溃导致
+	if offset+recordSize > fileSize {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
 
 	// 读取数据部分, 构建 logRecord 实例
-	logRecord := &LogRecord{Type: header.recordType}
+	logRecord := &LogRecord{
+		Type:         header.recordType,
+		Expire:       header.expire,
+		LogSeqNo:     header.logSeqNo,
+		Bucket:       header.bucket,
+		ValuePointer: header.pointer,
+	}
 	kvBuf, err := df.readNBytes(keySize+valueSize, offset+headerSize)
 	if err != nil {
 		return nil, 0, err
@@ -126,12 +204,45 @@ func (df *DataFile) ReadLogRecord(offset int64) (*LogRecord, int64, error) {
 	// 校验数据完整性, 生成 CRC 值进行比较
 	crc := getLogRecordCRC(logRecord, headerBuf[crc32.Size:headerSize])
 	if crc != header.crc {
-		return nil, 0, ErrInvalidCRC
+		return nil, recordSize, ErrInvalidCRC
+	}
+
+	// 透明解密 key 和 value
+	if header.encrypted {
+		if df.encryptor == nil {
+			return nil, 0, ErrEncryptorRequired
+		}
+		plaintext, err := df.encryptor.open(header.keyId, kvBuf, headerBuf[crc32.Size:headerSize])
+		if err != nil {
+			return nil, 0, err
+		}
+		if int64(len(plaintext)) < keySize {
+			return nil, 0, ErrDecryptFailed
+		}
+		logRecord.Key = plaintext[:keySize]
+		logRecord.Value = plaintext[keySize:]
+	}
+
+	// 透明解压 value
+	if header.compressed {
+		logRecord.Compression, logRecord.Value, err = decompressValue(logRecord.Value)
+		if err != nil {
+			return nil, 0, err
+		}
 	}
 
 	return logRecord, recordSize, nil
 }
 
+// Truncate 将文件截断至指定长度, 用于丢弃尾部损坏的日志记录
+func (df *DataFile) Truncate(size int64) error {
+	if err := df.ReadWriter.Truncate(size); err != nil {
+		return err
+	}
+	df.WriteOff = size
+	return nil
+}
+
 // Write 文件写入
 func (df *DataFile) Write(buf []byte) error {
 	n, err := df.ReadWriter.Write(buf)
@@ -144,13 +255,19 @@ func (df *DataFile) Write(buf []byte) error {
 }
 
 // WriteHintRecord 写入构建索引所需的相关数据
-func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos) error {
+// 同时记录原日志记录的日志序列号和所属 bucket, 供启动时恢复最大日志序列号和 bucket 索引
+func (df *DataFile) WriteHintRecord(key []byte, pos *LogRecordPos, logSeqNo uint64, bucket uint32) error {
 	// 转换为对应的 LogRecord 实例进行写入
 	record := &LogRecord{
-		Key:   key,
-		Value: EncodeLogRecordPos(pos),
+		Key:      key,
+		Value:    EncodeLogRecordPos(pos),
+		LogSeqNo: logSeqNo,
+		Bucket:   bucket,
+	}
+	encRecord, _, err := encodeLogRecord(record, df.encryptor)
+	if err != nil {
+		return err
 	}
-	encRecord, _ := EncodeLogRecord(record)
 	return df.Write(encRecord)
 }
 
@@ -164,6 +281,19 @@ func (df *DataFile) Close() error {
 	return df.ReadWriter.Close()
 }
 
+// 以只读方式打开已存在的文件并构造 DataFile 实例
+func newReadOnlyDataFile(fileName string, fileId uint32, encryptor *Encryptor) (*DataFile, error) {
+	readWriter, err := fio.NewReadOnlyFileIO(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &DataFile{
+		FileId:     fileId,
+		ReadWriter: readWriter,
+		encryptor:  encryptor,
+	}, nil
+}
+
 // 从偏移量 offset 开始读取 n 个字节
 func (df *DataFile) readNBytes(n int64, offset int64) (b []byte, err error) {
 	b = make([]byte, n)
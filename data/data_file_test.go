@@ -1,6 +1,7 @@
 package data
 
 import (
+	"bytes"
 	"github.com/XiXi-2024/xixi-kv/fio"
 	"github.com/stretchr/testify/assert"
 	"os"
@@ -12,15 +13,15 @@ func TestOpenDataFile(t *testing.T) {
 	dir := os.TempDir()
 	t.Log(dir)
 	// 打开文件
-	dataFile1, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	dataFile1, err := OpenDataFile(dir, 0, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile1)
 
 	// 重复打开相同文件
-	dataFile2, err := OpenDataFile(dir, 111, fio.StandardFIO)
+	dataFile2, err := OpenDataFile(dir, 111, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile2)
-	dataFile3, err := OpenDataFile(dir, 111, fio.StandardFIO)
+	dataFile3, err := OpenDataFile(dir, 111, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile3)
 }
@@ -29,7 +30,7 @@ func TestOpenDataFile(t *testing.T) {
 func TestDataFile_Write(t *testing.T) {
 	dir := os.TempDir()
 	t.Log(dir)
-	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO)
+	dataFile, err := OpenDataFile(dir, 0, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -46,7 +47,7 @@ func TestDataFile_Write(t *testing.T) {
 func TestDataFile_Close(t *testing.T) {
 	dir := os.TempDir()
 	t.Log(dir)
-	dataFile, err := OpenDataFile(dir, 123, fio.StandardFIO)
+	dataFile, err := OpenDataFile(dir, 123, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -61,7 +62,7 @@ func TestDataFile_Close(t *testing.T) {
 func TestDataFile_Sync(t *testing.T) {
 	dir := os.TempDir()
 	t.Log(dir)
-	dataFile, err := OpenDataFile(dir, 456, fio.StandardFIO)
+	dataFile, err := OpenDataFile(dir, 456, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -76,7 +77,7 @@ func TestDataFile_Sync(t *testing.T) {
 func TestDataFile_ReadLogRecord(t *testing.T) {
 	dir := os.TempDir()
 	t.Log(dir)
-	dataFile, err := OpenDataFile(dir, 6666, fio.StandardFIO)
+	dataFile, err := OpenDataFile(dir, 6666, fio.StandardFIO, nil)
 	assert.Nil(t, err)
 	assert.NotNil(t, dataFile)
 
@@ -123,3 +124,45 @@ func TestDataFile_ReadLogRecord(t *testing.T) {
 	assert.Equal(t, size3, readSize3)
 	t.Log(string(readRec3.Key))
 }
+
+// 读取压缩的日志记录
+func TestDataFile_ReadLogRecord_Compression(t *testing.T) {
+	dir := os.TempDir()
+	dataFile, err := OpenDataFile(dir, 6667, fio.StandardFIO, nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(GetDataFileName(dir, 6667))
+	}()
+
+	var offset int64
+	value := bytes.Repeat([]byte("bitcask kv go "), 100)
+	for _, typ := range []CompressionType{Flate, Zlib} {
+		rec := &LogRecord{Key: []byte("name"), Value: value, Compression: typ}
+		res, size := EncodeLogRecord(rec)
+		// 压缩后体积变小并设置标识位
+		assert.Less(t, size, int64(len(value)))
+		assert.Equal(t, logRecordFlagCompressed, res[4]&logRecordFlagCompressed)
+		err = dataFile.Write(res)
+		assert.Nil(t, err)
+
+		readRec, readSize, err := dataFile.ReadLogRecord(offset)
+		assert.Nil(t, err)
+		assert.Equal(t, rec, readRec)
+		assert.Equal(t, size, readSize)
+		offset += size
+	}
+
+	// value 较短时不压缩
+	rec := &LogRecord{Key: []byte("name"), Value: []byte("short"), Compression: Flate}
+	res, size := EncodeLogRecord(rec)
+	assert.Equal(t, byte(0), res[4]&logRecordFlagCompressed)
+	err = dataFile.Write(res)
+	assert.Nil(t, err)
+	readRec, readSize, err := dataFile.ReadLogRecord(offset)
+	assert.Nil(t, err)
+	assert.Equal(t, NoCompression, readRec.Compression)
+	assert.Equal(t, rec.Value, readRec.Value)
+	assert.Equal(t, size, readSize)
+}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"sync"
+)
+
+var (
+	ErrEncryptorRequired     = errors.New("log record is encrypted, but no key provider is configured")
+	ErrDecryptFailed         = errors.New("failed to decrypt log record, the key maybe wrong")
+	ErrEncryptionKeyNotFound = errors.New("encryption key not found")
+)
+
+// Cipher 加密算法, 根据密钥创建 AEAD 实例
+type Cipher func(key []byte) (cipher.AEAD, error)
+
+// AESGCM AES-GCM 加密算法, 密钥长度为 16、24 或 32 字节
+func AESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// KeyProvider 密钥提供者
+// 同一编号对应的密钥不可变更, 轮换密钥时应使用新的编号
+type KeyProvider interface {
+	// CurrentKey 获取当前用于加密的密钥编号和密钥
+	CurrentKey() (uint32, []byte, error)
+	// Key 根据编号获取密钥, 用于解密历史数据
+	Key(id uint32) ([]byte, error)
+}
+
+// KeyRing 基于内存的密钥提供者
+type KeyRing struct {
+	mu      sync.RWMutex
+	current uint32
+	keys    map[uint32][]byte
+}
+
+// NewKeyRing 创建密钥提供者并设置当前密钥
+func NewKeyRing(id uint32, key []byte) *KeyRing {
+	return &KeyRing{
+		current: id,
+		keys:    map[uint32][]byte{id: key},
+	}
+}
+
+// AddKey 添加历史密钥, 仅用于解密
+func (kr *KeyRing) AddKey(id uint32, key []byte) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[id] = key
+}
+
+// Rotate 切换当前密钥, 历史密钥仍保留用于解密
+// 已写入的数据在 merge 重写后使用新密钥加密
+func (kr *KeyRing) Rotate(id uint32, key []byte) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	kr.keys[id] = key
+	kr.current = id
+}
+
+func (kr *KeyRing) CurrentKey() (uint32, []byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	return kr.current, kr.keys[kr.current], nil
+}
+
+func (kr *KeyRing) Key(id uint32) ([]byte, error) {
+	kr.mu.RLock()
+	defer kr.mu.RUnlock()
+	key, ok := kr.keys[id]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// Encryptor 日志记录加解密
+// nil 表示不加密
+type Encryptor struct {
+	cipher   Cipher
+	provider KeyProvider
+	mu       sync.RWMutex
+	aeads    map[uint32]cipher.AEAD // 按密钥编号缓存的 AEAD 实例
+}
+
+// NewEncryptor 创建日志记录加解密实例, c 为 nil 时使用 AES-GCM
+func NewEncryptor(c Cipher, provider KeyProvider) *Encryptor {
+	if c == nil {
+		c = AESGCM
+	}
+	return &Encryptor{
+		cipher:   c,
+		provider: provider,
+		aeads:    make(map[uint32]cipher.AEAD),
+	}
+}
+
+// EncodeLogRecord 对 LogRecord 实例编码, 并使用当前密钥加密 key 和 value
+func (e *Encryptor) EncodeLogRecord(logRecord *LogRecord) ([]byte, int64, error) {
+	return encodeLogRecord(logRecord, e)
+}
+
+// 获取当前用于加密的密钥编号和 AEAD 实例
+func (e *Encryptor) currentAEAD() (uint32, cipher.AEAD, error) {
+	id, _, err := e.provider.CurrentKey()
+	if err != nil {
+		return 0, nil, err
+	}
+	aead, err := e.getAEAD(id)
+	return id, aead, err
+}
+
+// 根据密钥编号获取 AEAD 实例
+func (e *Encryptor) getAEAD(id uint32) (cipher.AEAD, error) {
+	e.mu.RLock()
+	aead, ok := e.aeads[id]
+	e.mu.RUnlock()
+	if ok {
+		return aead, nil
+	}
+
+	key, err := e.provider.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err = e.cipher(key)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.aeads[id] = aead
+	e.mu.Unlock()
+	return aead, nil
+}
+
+// 加密后相对明文增加的长度
+func sealOverhead(aead cipher.AEAD) int {
+	return aead.NonceSize() + aead.Overhead()
+}
+
+// 加密, 将随机生成的 nonce 写入 dst 头部, 密文紧随其后
+// dst 长度需为明文长度加 sealOverhead
+func seal(aead cipher.AEAD, dst, plaintext, additionalData []byte) error {
+	nonce := dst[:aead.NonceSize()]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	aead.Seal(dst[len(nonce):len(nonce)], nonce, plaintext, additionalData)
+	return nil
+}
+
+// 解密 seal 生成的数据
+func (e *Encryptor) open(id uint32, buf, additionalData []byte) ([]byte, error) {
+	aead, err := e.getAEAD(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < sealOverhead(aead) {
+		return nil, ErrDecryptFailed
+	}
+	nonce := buf[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, buf[len(nonce):], additionalData)
+	if err != nil {
+		return nil, ErrDecryptFailed
+	}
+	return plaintext, nil
+}
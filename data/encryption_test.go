@@ -0,0 +1,66 @@
+package data
+
+import (
+	"bytes"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+// 读取加密的日志记录
+func TestDataFile_ReadLogRecord_Encryption(t *testing.T) {
+	dir := os.TempDir()
+	keyRing := NewKeyRing(1, bytes.Repeat([]byte("k"), 32))
+	encryptor := NewEncryptor(nil, keyRing)
+	dataFile, err := OpenDataFile(dir, 6668, fio.StandardFIO, encryptor)
+	assert.Nil(t, err)
+	assert.NotNil(t, dataFile)
+	defer func() {
+		_ = dataFile.Close()
+		_ = os.Remove(GetDataFileName(dir, 6668))
+	}()
+
+	// 1. 加密写入后正常读取, 文件中不包含明文
+	rec1 := &LogRecord{Key: []byte("name"), Value: []byte("bitcask kv go"), LogSeqNo: 1}
+	res1, size1, err := encryptor.EncodeLogRecord(rec1)
+	assert.Nil(t, err)
+	assert.Equal(t, logRecordFlagEncrypted, res1[4]&logRecordFlagEncrypted)
+	assert.False(t, bytes.Contains(res1, rec1.Key))
+	assert.False(t, bytes.Contains(res1, rec1.Value))
+	err = dataFile.Write(res1)
+	assert.Nil(t, err)
+	readRec1, readSize1, err := dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1, readRec1)
+	assert.Equal(t, size1, readSize1)
+
+	// 2. 轮换密钥后新旧记录均可读取
+	keyRing.Rotate(2, bytes.Repeat([]byte("n"), 32))
+	rec2 := &LogRecord{Key: []byte("name"), Value: bytes.Repeat([]byte("a new value "), 20), Compression: Flate}
+	res2, size2, err := encryptor.EncodeLogRecord(rec2)
+	assert.Nil(t, err)
+	err = dataFile.Write(res2)
+	assert.Nil(t, err)
+	readRec2, readSize2, err := dataFile.ReadLogRecord(size1)
+	assert.Nil(t, err)
+	assert.Equal(t, rec2, readRec2)
+	assert.Equal(t, size2, readSize2)
+	readRec1, _, err = dataFile.ReadLogRecord(0)
+	assert.Nil(t, err)
+	assert.Equal(t, rec1.Value, readRec1.Value)
+
+	// 3. 密钥错误或未配置密钥时读取失败
+	wrongFile, err := OpenDataFile(dir, 6668, fio.StandardFIO, NewEncryptor(nil, NewKeyRing(1, bytes.Repeat([]byte("x"), 32))))
+	assert.Nil(t, err)
+	_, _, err = wrongFile.ReadLogRecord(0)
+	assert.Equal(t, ErrDecryptFailed, err)
+	_, _, err = wrongFile.ReadLogRecord(size1)
+	assert.Equal(t, ErrEncryptionKeyNotFound, err)
+	_ = wrongFile.Close()
+	plainFile, err := OpenDataFile(dir, 6668, fio.StandardFIO, nil)
+	assert.Nil(t, err)
+	_, _, err = plainFile.ReadLogRecord(0)
+	assert.Equal(t, ErrEncryptorRequired, err)
+	_ = plainFile.Close()
+}
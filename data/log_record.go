@@ -1,6 +1,7 @@
 package data
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
 	"hash/crc32"
 )
@@ -17,17 +18,42 @@ const (
 	LogRecordTxnFinished
 )
 
+// 日志记录类型字节中的类型与标识位掩码
+// 低 2 位存放 LogRecordType, 高 6 位存放可选字段标识, 旧版本日志记录标识位均为 0
+const (
+	logRecordTypeMask byte = 0x03
+	// 携带过期时间
+	logRecordFlagExpire byte = 0x80
+	// 携带日志序列号
+	logRecordFlagLogSeqNo byte = 0x40
+	// value 已压缩
+	logRecordFlagCompressed byte = 0x20
+	// key 和 value 已加密
+	logRecordFlagEncrypted byte = 0x10
+	// 属于非默认 bucket
+	logRecordFlagBucket byte = 0x08
+	// value 为指向 value log 的位置信息
+	logRecordFlagValuePointer byte = 0x04
+)
+
 // 日志记录头部最大长度
-// crc(4) + type(1) + keySize(max[5]) + valueSize(max[5]) = 15
-const maxLogRecordHeaderSize = binary.MaxVarintLen32*2 + 5
+// crc(4) + type(1) + keySize(max[5]) + valueSize(max[5]) + expire(max[10]) + logSeqNo(max[10]) + keyId(max[5]) + bucket(max[5]) = 45
+const maxLogRecordHeaderSize = binary.MaxVarintLen32*4 + binary.MaxVarintLen64*2 + 5
 
 // LogRecord 日志记录数据内容
 // 以追加形式写入, 故称为日志记录
 // todo 优化点：日志记录组织形式改为block
 type LogRecord struct {
-	Key   []byte
-	Value []byte
-	Type  LogRecordType
+	Key      []byte
+	Value    []byte
+	Type     LogRecordType
+	Expire   int64  // 过期时间, 单位纳秒时间戳, 0 表示永不过期
+	LogSeqNo uint64 // 日志序列号, 全局单调递增, 0 表示未设置
+	Bucket   uint32 // 所属 bucket 编号, 0 表示默认 bucket
+	// 编码时尝试使用的压缩算法, 解码时为实际使用的压缩算法
+	Compression CompressionType
+	// value 已分离存储到 value log, Value 为 EncodeLogRecordPos 编码的位置信息
+	ValuePointer bool
 }
 
 // 日志记录头部
@@ -36,6 +62,13 @@ type logRecordHeader struct {
 	recordType LogRecordType // LogRecord 类型
 	keySize    uint32        // key 长度
 	valueSize  uint32        // value 长度
+	expire     int64         // 过期时间
+	logSeqNo   uint64        // 日志序列号
+	compressed bool          // value 是否已压缩
+	encrypted  bool          // key 和 value 是否已加密
+	pointer    bool          // value 是否为指向 value log 的位置信息
+	keyId      uint32        // 加密使用的密钥编号
+	bucket     uint32        // 所属 bucket 编号
 }
 
 // LogRecordPos 数据内存索引, 描述日志记录在磁盘的位置
@@ -43,6 +76,7 @@ type LogRecordPos struct {
 	Fid    uint32 // 文件id, 定位日志记录所在文件
 	Offset int64  // 偏移量, 定位日志记录在文件中的位置
 	Size   uint32 // 日志记录占用字节数大小
+	Expire int64  // 过期时间, 0 表示永不过期
 }
 
 // TransactionRecords 事务相关的暂存数据
@@ -51,46 +85,134 @@ type TransactionRecords struct {
 	Pos    *LogRecordPos
 }
 
+// IsExpired 判断日志记录在指定时刻是否已过期
+func (lr *LogRecord) IsExpired(now int64) bool {
+	return lr.Expire > 0 && lr.Expire <= now
+}
+
+// IsExpired 判断索引指向的日志记录在指定时刻是否已过期
+func (pos *LogRecordPos) IsExpired(now int64) bool {
+	return pos.Expire > 0 && pos.Expire <= now
+}
+
 // EncodeLogRecord 对 LogRecord 实例编码
 // 返回编码后包含完日志记录的字节数组和数组长度
+// 仅当设置过期时间、日志序列号、非默认 bucket 时写入对应字段, 并在 type 中设置对应标识位
+// value 分离存储时同样在 type 中设置标识位, value 部分为指向 value log 的位置信息
+// 当设置压缩算法且压缩有收益时, value 部分为首字节标识算法的压缩数据
 //
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	| crc 校验值  |  type 类型   |    key size |   value size |      key    |      value   |
-//	+-------------+-------------+-------------+--------------+-------------+--------------+
-//	    4字节          1字节        变长（最大5）   变长（最大5）     变长           变长
+//	+-------------+-------------+-------------+--------------+--------------+--------------+-------------+-------------+-------------+--------------+
+//	| crc 校验值  |  type 类型   |    key size |   value size |    expire    |   log seq no |    key id   |    bucket   |      key    |      value   |
+//	+-------------+-------------+-------------+--------------+--------------+--------------+-------------+-------------+-------------+--------------+
+//	    4字节          1字节        变长（最大5）   变长（最大5）  可选变长（最大10） 可选变长（最大10） 可选变长（最大5） 可选变长（最大5）    变长           变长
 func EncodeLogRecord(logRecord *LogRecord) ([]byte, int64) {
+	encBytes, size, _ := encodeLogRecord(logRecord, nil)
+	return encBytes, size
+}
+
+// 对 LogRecord 实例编码, encryptor 不为 nil 时加密 key 和 value
+// 加密时 value size 包含加密增加的长度, key 和 value 部分整体为 nonce + 密文
+// 头部除 crc 外的部分作为附加数据参与认证
+func encodeLogRecord(logRecord *LogRecord, encryptor *Encryptor) ([]byte, int64, error) {
+	// 尝试压缩 value
+	value := logRecord.Value
+	compressed, ok := compressValue(logRecord.Compression, value)
+	if ok {
+		value = compressed
+	}
+
+	// 获取当前密钥
+	var keyId uint32
+	var aead cipher.AEAD
+	var valueSize = len(value)
+	if encryptor != nil {
+		var err error
+		keyId, aead, err = encryptor.currentAEAD()
+		if err != nil {
+			return nil, 0, err
+		}
+		valueSize += sealOverhead(aead)
+	}
+
 	// 按最大长度初始化头部的字节数组
 	header := make([]byte, maxLogRecordHeaderSize)
 	// 写入 type
 	header[4] = logRecord.Type
+	if ok {
+		header[4] |= logRecordFlagCompressed
+	}
+	if logRecord.Expire != 0 {
+		header[4] |= logRecordFlagExpire
+	}
+	if logRecord.LogSeqNo != 0 {
+		header[4] |= logRecordFlagLogSeqNo
+	}
+	if aead != nil {
+		header[4] |= logRecordFlagEncrypted
+	}
+	if logRecord.Bucket != 0 {
+		header[4] |= logRecordFlagBucket
+	}
+	if logRecord.ValuePointer {
+		header[4] |= logRecordFlagValuePointer
+	}
 	var index = 5
 	// 写入 key size + value size, 使用变长类型节省空间
 	index += binary.PutVarint(header[index:], int64(len(logRecord.Key)))
-	index += binary.PutVarint(header[index:], int64(len(logRecord.Value)))
+	index += binary.PutVarint(header[index:], int64(valueSize))
+	// 写入过期时间
+	if logRecord.Expire != 0 {
+		index += binary.PutVarint(header[index:], logRecord.Expire)
+	}
+	// 写入日志序列号
+	if logRecord.LogSeqNo != 0 {
+		index += binary.PutUvarint(header[index:], logRecord.LogSeqNo)
+	}
+	// 写入密钥编号
+	if aead != nil {
+		index += binary.PutUvarint(header[index:], uint64(keyId))
+	}
+	// 写入 bucket 编号
+	if logRecord.Bucket != 0 {
+		index += binary.PutUvarint(header[index:], uint64(logRecord.Bucket))
+	}
 	// 计算日志记录总长度, 创建对应长度的字节数组
-	var size = index + len(logRecord.Key) + len(logRecord.Value)
+	var size = index + len(logRecord.Key) + valueSize
 	encBytes := make([]byte, size)
 	// 拷贝 header、key、value, 得到完整日志记录的字节数组
 	copy(encBytes[:index], header[:index])
-	copy(encBytes[index:], logRecord.Key)
-	copy(encBytes[index+len(logRecord.Key):], logRecord.Value)
+	if aead != nil {
+		plaintext := make([]byte, len(logRecord.Key)+len(value))
+		copy(plaintext, logRecord.Key)
+		copy(plaintext[len(logRecord.Key):], value)
+		if err := seal(aead, encBytes[index:], plaintext, encBytes[4:index]); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		copy(encBytes[index:], logRecord.Key)
+		copy(encBytes[index+len(logRecord.Key):], value)
+	}
 	// 写入 crc 校验值, 按小端序编码
 	crc := crc32.ChecksumIEEE(encBytes[4:])
 	binary.LittleEndian.PutUint32(encBytes[:4], crc)
 
-	return encBytes, int64(size)
+	return encBytes, int64(size), nil
 }
 
 // EncodeLogRecordPos 对索引位置信息实例编码
 // 返回编码后的字节数组
+// 仅当设置过期时间时在末尾追加 expire 字段, 兼容旧版本编码
 func EncodeLogRecordPos(pos *LogRecordPos) []byte {
 	// 按可能的最大长度创建字节数组
-	buf := make([]byte, 2*binary.MaxVarintLen32+binary.MaxVarintLen64)
+	buf := make([]byte, 2*binary.MaxVarintLen32+2*binary.MaxVarintLen64)
 	var index = 0
 	// 使用变长类型, 节省空间
 	index += binary.PutVarint(buf[index:], int64(pos.Fid))
 	index += binary.PutVarint(buf[index:], pos.Offset)
 	index += binary.PutVarint(buf[index:], int64(pos.Size))
+	if pos.Expire != 0 {
+		index += binary.PutVarint(buf[index:], pos.Expire)
+	}
 	// 返回实际长度的字节数组
 	return buf[:index]
 }
@@ -103,7 +225,13 @@ func DecodeLogRecordPos(buf []byte) *LogRecordPos {
 	offset, n := binary.Varint(buf[index:])
 	index += n
 	size, n := binary.Varint(buf[index:])
-	return &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	index += n
+	pos := &LogRecordPos{Fid: uint32(fileId), Offset: offset, Size: uint32(size)}
+	// 存在可选的过期时间字段
+	if index < len(buf) {
+		pos.Expire, _ = binary.Varint(buf[index:])
+	}
+	return pos
 }
 
 // decodeLogRecordHeader 解码为header头部
@@ -116,8 +244,12 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 
 	header := &logRecordHeader{
 		crc:        binary.LittleEndian.Uint32(buf[:4]), // 按小端序解码
-		recordType: buf[4],
+		recordType: buf[4] & logRecordTypeMask,
 	}
+	flags := buf[4] &^ logRecordTypeMask
+	header.compressed = flags&logRecordFlagCompressed != 0
+	header.encrypted = flags&logRecordFlagEncrypted != 0
+	header.pointer = flags&logRecordFlagValuePointer != 0
 	var index = 5
 	// 获取实际 key size
 	keySize, n := binary.Varint(buf[index:])
@@ -128,6 +260,34 @@ func decodeLogRecordHeader(buf []byte) (*logRecordHeader, int64) {
 	header.valueSize = uint32(valueSize)
 	index += n
 
+	// 获取可选的过期时间
+	if flags&logRecordFlagExpire != 0 {
+		expire, n := binary.Varint(buf[index:])
+		header.expire = expire
+		index += n
+	}
+
+	// 获取可选的日志序列号
+	if flags&logRecordFlagLogSeqNo != 0 {
+		logSeqNo, n := binary.Uvarint(buf[index:])
+		header.logSeqNo = logSeqNo
+		index += n
+	}
+
+	// 获取可选的密钥编号
+	if header.encrypted {
+		keyId, n := binary.Uvarint(buf[index:])
+		header.keyId = uint32(keyId)
+		index += n
+	}
+
+	// 获取可选的 bucket 编号
+	if flags&logRecordFlagBucket != 0 {
+		bucket, n := binary.Uvarint(buf[index:])
+		header.bucket = uint32(bucket)
+		index += n
+	}
+
 	return header, int64(index)
 }
 
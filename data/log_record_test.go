@@ -101,3 +101,92 @@ func Test_getLogRecordCRC(t *testing.T) {
 	crc3 := getLogRecordCRC(rec3, headerBuf3[crc32.Size:])
 	assert.Equal(t, uint32(290887979), crc3)
 }
+
+// 携带过期时间的日志记录编解码
+func TestEncodeLogRecord_Expire(t *testing.T) {
+	rec := &LogRecord{
+		Key:    []byte("name"),
+		Value:  []byte("bitcask-go"),
+		Type:   LogRecordNormal,
+		Expire: 1700000000000000000,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.NotNil(t, res)
+
+	// 类型字节中设置标识位, 解码时还原为原类型
+	assert.Equal(t, logRecordFlagExpire, res[4]&logRecordFlagExpire)
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, rec.Expire, header.expire)
+	assert.Equal(t, n, headerSize+int64(header.keySize)+int64(header.valueSize))
+
+	// 未设置过期时间时编码与旧版本一致
+	res2, n2 := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask-go")})
+	assert.Equal(t, []byte{104, 82, 240, 150, 0, 8, 20}, res2[:7])
+	assert.Equal(t, n-int64(len(res)-len(res2)), n2)
+
+	// 索引位置信息编解码
+	pos := &LogRecordPos{Fid: 1, Offset: 100, Size: 20, Expire: rec.Expire}
+	assert.Equal(t, pos, DecodeLogRecordPos(EncodeLogRecordPos(pos)))
+	pos2 := &LogRecordPos{Fid: 1, Offset: 100, Size: 20}
+	assert.Equal(t, pos2, DecodeLogRecordPos(EncodeLogRecordPos(pos2)))
+}
+
+// 携带 bucket 编号的日志记录编解码
+func TestEncodeLogRecord_Bucket(t *testing.T) {
+	rec := &LogRecord{
+		Key:      []byte("name"),
+		Value:    []byte("bitcask-go"),
+		Type:     LogRecordDeleted,
+		LogSeqNo: 10,
+		Bucket:   300,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.NotNil(t, res)
+
+	// 类型字节中设置标识位, 解码时还原为原类型
+	assert.Equal(t, logRecordFlagBucket, res[4]&logRecordFlagBucket)
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.Equal(t, LogRecordDeleted, header.recordType)
+	assert.Equal(t, rec.LogSeqNo, header.logSeqNo)
+	assert.Equal(t, rec.Bucket, header.bucket)
+	assert.Equal(t, n, headerSize+int64(header.keySize)+int64(header.valueSize))
+
+	// 默认 bucket 不写入 bucket 编号
+	res2, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Value: []byte("bitcask-go"), Type: LogRecordTxnFinished})
+	header2, _ := decodeLogRecordHeader(res2)
+	assert.Equal(t, byte(0), res2[4]&logRecordFlagBucket)
+	assert.Equal(t, LogRecordTxnFinished, header2.recordType)
+	assert.Equal(t, uint32(0), header2.bucket)
+}
+
+// value 分离存储的日志记录编解码
+func TestEncodeLogRecord_ValuePointer(t *testing.T) {
+	pos := &LogRecordPos{Fid: 3, Offset: 4096, Size: 1 << 20}
+	rec := &LogRecord{
+		Key:          []byte("name"),
+		Value:        EncodeLogRecordPos(pos),
+		Type:         LogRecordNormal,
+		Bucket:       2,
+		ValuePointer: true,
+	}
+	res, n := EncodeLogRecord(rec)
+	assert.NotNil(t, res)
+
+	// 类型字节中设置标识位, 解码时还原为原类型
+	assert.Equal(t, logRecordFlagValuePointer, res[4]&logRecordFlagValuePointer)
+	header, headerSize := decodeLogRecordHeader(res)
+	assert.NotNil(t, header)
+	assert.True(t, header.pointer)
+	assert.Equal(t, LogRecordNormal, header.recordType)
+	assert.Equal(t, rec.Bucket, header.bucket)
+	assert.Equal(t, n, headerSize+int64(header.keySize)+int64(header.valueSize))
+
+	// 未分离存储的日志记录不设置标识位, 已删除类型不受影响
+	res2, _ := EncodeLogRecord(&LogRecord{Key: []byte("name"), Type: LogRecordDeleted})
+	header2, _ := decodeLogRecordHeader(res2)
+	assert.False(t, header2.pointer)
+	assert.Equal(t, LogRecordDeleted, header2.recordType)
+}
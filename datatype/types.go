@@ -28,6 +28,11 @@ type DataTypeService struct {
 	db *bitcask.DB
 }
 
+// 数据读取接口, 由 DB 和事务客户端 WriteBatch 共同实现
+type reader interface {
+	Get(key []byte) ([]byte, error)
+}
+
 // NewDataTypeService 创建数据类型服务实例
 func NewDataTypeService(options bitcask.Options) (*DataTypeService, error) {
 	db, err := bitcask.Open(options)
@@ -99,37 +104,38 @@ func (dts *DataTypeService) Get(key []byte) ([]byte, error) {
 // ========================= Hash 数据类型 ========================
 
 func (dts *DataTypeService) HSet(key, field, value []byte) (bool, error) {
-	// 获取元数据
-	meta, err := dts.findMetadata(key, Hash)
-	if err != nil {
-		return false, err
-	}
-
-	// 构造数据部分key实例并编码
-	hk := &hashInternalKey{
-		key:     key,
-		version: meta.version,
-		field:   field,
-	}
-	encKey := hk.encode()
+	var exist bool
+	// 涉及读取元数据、更新数据和元数据多步操作, 在事务中执行保证原子性和隔离性
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		// 获取元数据
+		meta, err := dts.findMetadata(wb, key, Hash)
+		if err != nil {
+			return err
+		}
 
-	// 判断数据部分key是否存在
-	var exist = true
-	if _, err = dts.db.Get(encKey); err == bitcask.ErrKeyNotFound {
-		exist = false
-	}
+		// 构造数据部分key实例并编码
+		hk := &hashInternalKey{
+			key:     key,
+			version: meta.version,
+			field:   field,
+		}
+		encKey := hk.encode()
 
-	// 涉及更新数据和元数据两步操作, 需保证原子性
-	wb := dts.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
-	// 不存在则更新元数据
-	if !exist {
-		meta.size++
-		_ = wb.Put(key, meta.encode())
-	}
-	// 不存在则新增, 已存在则覆盖
-	_ = wb.Put(encKey, value)
+		// 判断数据部分key是否存在
+		exist = true
+		if _, err = wb.Get(encKey); err == bitcask.ErrKeyNotFound {
+			exist = false
+		}
 
-	if err = wb.Commit(); err != nil {
+		// 不存在则更新元数据
+		if !exist {
+			meta.size++
+			_ = wb.Put(key, meta.encode())
+		}
+		// 不存在则新增, 已存在则覆盖
+		return wb.Put(encKey, value)
+	})
+	if err != nil {
 		return false, err
 	}
 	return !exist, nil
@@ -137,7 +143,7 @@ func (dts *DataTypeService) HSet(key, field, value []byte) (bool, error) {
 
 func (dts *DataTypeService) HGet(key, field []byte) ([]byte, error) {
 	// 查询元数据信息
-	meta, err := dts.findMetadata(key, Hash)
+	meta, err := dts.findMetadata(dts.db, key, Hash)
 	if err != nil {
 		return nil, err
 	}
@@ -155,46 +161,49 @@ func (dts *DataTypeService) HGet(key, field []byte) ([]byte, error) {
 }
 
 func (dts *DataTypeService) HDel(key, field []byte) (bool, error) {
-	// 查询元数据信息
-	meta, err := dts.findMetadata(key, Hash)
-	if err != nil {
-		return false, err
-	}
-	// 无数据直接返回
-	if meta.size == 0 {
-		return false, nil
-	}
-	// 构造数据部分key
-	hk := &hashInternalKey{
-		key:     key,
-		version: meta.version,
-		field:   field,
-	}
-	encKey := hk.encode()
+	var exist bool
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		// 查询元数据信息
+		meta, err := dts.findMetadata(wb, key, Hash)
+		if err != nil {
+			return err
+		}
+		// 无数据直接返回
+		if meta.size == 0 {
+			exist = false
+			return nil
+		}
+		// 构造数据部分key
+		hk := &hashInternalKey{
+			key:     key,
+			version: meta.version,
+			field:   field,
+		}
+		encKey := hk.encode()
 
-	var exist = true
-	if _, err = dts.db.Get(encKey); err == bitcask.ErrKeyNotFound {
-		exist = false
-	}
+		exist = true
+		if _, err = wb.Get(encKey); err == bitcask.ErrKeyNotFound {
+			exist = false
+		}
 
-	// 当field存在时进行删除
-	if exist {
-		// 涉及更新数据和元数据两步操作, 需保证原子性
-		wb := dts.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
-		meta.size--
-		_ = wb.Put(key, meta.encode())
-		_ = wb.Delete(encKey)
-		if err = wb.Commit(); err != nil {
-			return false, err
+		// 当field存在时进行删除
+		if exist {
+			meta.size--
+			_ = wb.Put(key, meta.encode())
+			return wb.Delete(encKey)
 		}
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-
 	return exist, nil
 }
 
 // 根据key获取元数据
-func (dts *DataTypeService) findMetadata(key []byte, dt dataType) (*metadata, error) {
-	metaBuf, err := dts.db.Get(key)
+// 通过 r 读取, 允许在事务中读取
+func (dts *DataTypeService) findMetadata(r reader, key []byte, dt dataType) (*metadata, error) {
+	metaBuf, err := r.Get(key)
 	if err != nil && err != bitcask.ErrKeyNotFound {
 		return nil, err
 	}
@@ -238,37 +247,38 @@ func (dts *DataTypeService) findMetadata(key []byte, dt dataType) (*metadata, er
 
 // SAdd 新增 member 到集合
 func (dts *DataTypeService) SAdd(key, member []byte) (bool, error) {
-	meta, err := dts.findMetadata(key, Set)
-	if err != nil {
-		return false, err
-	}
-	// 构造数据部分 key 实例
-	sk := &setInternalKey{
-		key:     key,
-		version: meta.version,
-		member:  member,
-	}
 	var ok bool
-	// 当 member 不存在时新增
-	if _, err = dts.db.Get(sk.encode()); err == bitcask.ErrKeyNotFound {
-		// 涉及更新数据和元数据两步操作, 需保证原子性
-		wb := dts.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
-		meta.size++
-		_ = wb.Put(key, meta.encode())
-		// value 为 nil
-		_ = wb.Put(sk.encode(), nil)
-		if err = wb.Commit(); err != nil {
-			return false, err
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		meta, err := dts.findMetadata(wb, key, Set)
+		if err != nil {
+			return err
 		}
-		ok = true
+		// 构造数据部分 key 实例
+		sk := &setInternalKey{
+			key:     key,
+			version: meta.version,
+			member:  member,
+		}
+		ok = false
+		// 当 member 不存在时新增
+		if _, err = wb.Get(sk.encode()); err == bitcask.ErrKeyNotFound {
+			meta.size++
+			_ = wb.Put(key, meta.encode())
+			// value 为 nil
+			_ = wb.Put(sk.encode(), nil)
+			ok = true
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
 	}
-
 	return ok, nil
 }
 
 // SIsMember 判断 member 是否在集合中存在
 func (dts *DataTypeService) SIsMember(key, member []byte) (bool, error) {
-	meta, err := dts.findMetadata(key, Set)
+	meta, err := dts.findMetadata(dts.db, key, Set)
 	if err != nil {
 		return false, err
 	}
@@ -295,34 +305,37 @@ func (dts *DataTypeService) SIsMember(key, member []byte) (bool, error) {
 
 // SRem 从集合中删除 member
 func (dts *DataTypeService) SRem(key, member []byte) (bool, error) {
-	meta, err := dts.findMetadata(key, Set)
-	if err != nil {
-		return false, err
-	}
-	if meta.size == 0 {
-		return false, nil
-	}
+	var ok bool
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		meta, err := dts.findMetadata(wb, key, Set)
+		if err != nil {
+			return err
+		}
+		ok = false
+		if meta.size == 0 {
+			return nil
+		}
 
-	// 构造数据部分 key 实例
-	sk := &setInternalKey{
-		key:     key,
-		version: meta.version,
-		member:  member,
-	}
+		// 构造数据部分 key 实例
+		sk := &setInternalKey{
+			key:     key,
+			version: meta.version,
+			member:  member,
+		}
 
-	if _, err = dts.db.Get(sk.encode()); err == bitcask.ErrKeyNotFound {
-		return false, nil
-	}
+		if _, err = wb.Get(sk.encode()); err == bitcask.ErrKeyNotFound {
+			return nil
+		}
 
-	// 涉及更新数据和元数据两步操作, 需保证原子性
-	wb := dts.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
-	meta.size--
-	_ = wb.Put(key, meta.encode())
-	_ = wb.Delete(sk.encode())
-	if err = wb.Commit(); err != nil {
+		meta.size--
+		_ = wb.Put(key, meta.encode())
+		ok = true
+		return wb.Delete(sk.encode())
+	})
+	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return ok, nil
 }
 
 // ======================= List 数据结构 =======================
@@ -349,79 +362,86 @@ func (dts *DataTypeService) RPop(key []byte) ([]byte, error) {
 
 // 入队操作
 func (dts *DataTypeService) pushInner(key, element []byte, isLeft bool) (uint32, error) {
-	// 查询元数据信息
-	meta, err := dts.findMetadata(key, List)
-	if err != nil {
-		return 0, err
-	}
+	var size uint32
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		// 查询元数据信息
+		meta, err := dts.findMetadata(wb, key, List)
+		if err != nil {
+			return err
+		}
 
-	// 构造数据部分 key 实例
-	lk := &listInternalKey{
-		key:     key,
-		version: meta.version,
-	}
-	// 确定入队元素的下标
-	if isLeft {
-		lk.index = meta.head - 1
-	} else {
-		lk.index = meta.tail
-	}
+		// 构造数据部分 key 实例
+		lk := &listInternalKey{
+			key:     key,
+			version: meta.version,
+		}
+		// 确定入队元素的下标
+		if isLeft {
+			lk.index = meta.head - 1
+		} else {
+			lk.index = meta.tail
+		}
 
-	// 涉及更新数据和元数据两步操作, 需保证原子性
-	wb := dts.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
-	meta.size++
-	if isLeft {
-		meta.head--
-	} else {
-		meta.tail++
-	}
-	_ = wb.Put(key, meta.encode())
-	_ = wb.Put(lk.encode(), element)
-	if err = wb.Commit(); err != nil {
+		meta.size++
+		if isLeft {
+			meta.head--
+		} else {
+			meta.tail++
+		}
+		_ = wb.Put(key, meta.encode())
+		size = meta.size
+		return wb.Put(lk.encode(), element)
+	})
+	if err != nil {
 		return 0, err
 	}
 
-	return meta.size, nil
+	return size, nil
 }
 
 // 出队操作
 func (dts *DataTypeService) popInner(key []byte, isLeft bool) ([]byte, error) {
-	// 查询元数据信息
-	meta, err := dts.findMetadata(key, List)
-	if err != nil {
-		return nil, err
-	}
-	if meta.size == 0 {
-		return nil, nil
-	}
+	var element []byte
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		// 查询元数据信息
+		meta, err := dts.findMetadata(wb, key, List)
+		if err != nil {
+			return err
+		}
+		element = nil
+		if meta.size == 0 {
+			return nil
+		}
 
-	// 构造数据部分 key 实例
-	lk := &listInternalKey{
-		key:     key,
-		version: meta.version,
-	}
-	// 确定出队元素的下标
-	if isLeft {
-		lk.index = meta.head
-	} else {
-		lk.index = meta.tail - 1
-	}
+		// 构造数据部分 key 实例
+		lk := &listInternalKey{
+			key:     key,
+			version: meta.version,
+		}
+		// 确定出队元素的下标
+		if isLeft {
+			lk.index = meta.head
+		} else {
+			lk.index = meta.tail - 1
+		}
 
-	// 获取出队元素进行返回
-	element, err := dts.db.Get(lk.encode())
-	if err != nil {
-		return nil, err
-	}
+		// 获取出队元素进行返回
+		element, err = wb.Get(lk.encode())
+		if err != nil {
+			return err
+		}
 
-	// 仅更新元数据即可
-	// todo 未释放删除元素占用内存
-	meta.size--
-	if isLeft {
-		meta.head++
-	} else {
-		meta.tail--
-	}
-	if err = dts.db.Put(key, meta.encode()); err != nil {
+		// 仅更新元数据即可
+		// todo 未释放删除元素占用内存
+		meta.size--
+		if isLeft {
+			meta.head++
+		} else {
+			meta.tail--
+		}
+		return wb.Put(key, meta.encode())
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -432,56 +452,57 @@ func (dts *DataTypeService) popInner(key []byte, isLeft bool) ([]byte, error) {
 
 // ZAdd 集合新增元素
 func (dts *DataTypeService) ZAdd(key []byte, score float64, member []byte) (bool, error) {
-	// 查询元数据信息
-	meta, err := dts.findMetadata(key, ZSet)
-	if err != nil {
-		return false, err
-	}
-
-	// 构造数据部分 key 实例
-	zk := &zsetInternalKey{
-		key:     key,
-		version: meta.version,
-		score:   score,
-		member:  member,
-	}
-
-	var exist = true
-	// 查询是否已存在
-	value, err := dts.db.Get(zk.encodeWithMember())
-	if err != nil && err != bitcask.ErrKeyNotFound {
-		return false, err
-	}
-	if err == bitcask.ErrKeyNotFound {
-		exist = false
-	}
-	if exist {
-		if score == utils.FloatFromBytes(value) {
-			return false, nil
+	var exist bool
+	err := dts.db.Update(func(wb *bitcask.WriteBatch) error {
+		// 查询元数据信息
+		meta, err := dts.findMetadata(wb, key, ZSet)
+		if err != nil {
+			return err
 		}
-	}
 
-	// 涉及更新数据和元数据两步操作, 需保证原子性
-	wb := dts.db.NewWriteBatch(bitcask.DefaultWriteBatchOptions)
-	if !exist {
-		// 元素不存在进行新增, 更新元数据
-		meta.size++
-		_ = wb.Put(key, meta.encode())
-	}
-	if exist {
-		// 元素已存在时需进行覆盖, 删除原元素
-		oldKey := &zsetInternalKey{
+		// 构造数据部分 key 实例
+		zk := &zsetInternalKey{
 			key:     key,
 			version: meta.version,
+			score:   score,
 			member:  member,
-			score:   utils.FloatFromBytes(value),
 		}
-		_ = wb.Delete(oldKey.encodeWithScore())
-	}
-	// 新增元素
-	_ = wb.Put(zk.encodeWithMember(), utils.Float64ToBytes(score))
-	_ = wb.Put(zk.encodeWithScore(), nil)
-	if err = wb.Commit(); err != nil {
+
+		exist = true
+		// 查询是否已存在
+		value, err := wb.Get(zk.encodeWithMember())
+		if err != nil && err != bitcask.ErrKeyNotFound {
+			return err
+		}
+		if err == bitcask.ErrKeyNotFound {
+			exist = false
+		}
+		if exist {
+			if score == utils.FloatFromBytes(value) {
+				return nil
+			}
+		}
+
+		if !exist {
+			// 元素不存在进行新增, 更新元数据
+			meta.size++
+			_ = wb.Put(key, meta.encode())
+		}
+		if exist {
+			// 元素已存在时需进行覆盖, 删除原元素
+			oldKey := &zsetInternalKey{
+				key:     key,
+				version: meta.version,
+				member:  member,
+				score:   utils.FloatFromBytes(value),
+			}
+			_ = wb.Delete(oldKey.encodeWithScore())
+		}
+		// 新增元素
+		_ = wb.Put(zk.encodeWithMember(), utils.Float64ToBytes(score))
+		return wb.Put(zk.encodeWithScore(), nil)
+	})
+	if err != nil {
 		return false, err
 	}
 
@@ -491,7 +512,7 @@ func (dts *DataTypeService) ZAdd(key []byte, score float64, member []byte) (bool
 // ZScore 查询指定元素的 score 值
 func (dts *DataTypeService) ZScore(key []byte, member []byte) (float64, error) {
 	// 查询元数据信息
-	meta, err := dts.findMetadata(key, ZSet)
+	meta, err := dts.findMetadata(dts.db, key, ZSet)
 	// todo 暂时仅支持 score 为非负数
 	if err != nil {
 		return -1, err
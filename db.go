@@ -7,20 +7,25 @@ import (
 	"github.com/XiXi-2024/xixi-kv/data"
 	"github.com/XiXi-2024/xixi-kv/fio"
 	"github.com/XiXi-2024/xixi-kv/index"
-	"github.com/XiXi-2024/xixi-kv/utils"
 	"github.com/gofrs/flock"
 	"io"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
 	// 事务序列号文件存放数据 Key
 	seqNoKey = "seq.no"
+	// 事务序列号临时文件名称, 写入并持久化后重命名为事务序列号文件
+	seqNoTempFileName = data.SeqNoFileName + ".tmp"
+	// 旧版本的事务序列号文件名称, 与 merge 完成标识文件重名且以追加方式写入, 仅用于兼容读取
+	legacySeqNoFileName = data.MergeFinishedFileName
 	// 文件锁名称
 	fileLockName = "flock"
 )
@@ -29,75 +34,134 @@ const (
 type DB struct {
 	options    Options // 用户配置项
 	mu         *sync.RWMutex
-	activeFile *data.DataFile            // 当前活跃文件, 允许读写
-	olderFiles map[uint32]*data.DataFile // 旧数据文件, 只读
-	index      index.Indexer             // 内存索引
-	seqNo      uint64                    // 事务id
-	isMerging  bool                      // merge 执行状态标识
-	// todo 优化点：省略
-	seqNoFileExists bool          // 事务序列号文件存在标识
-	isInitial       bool          // 首次初始化数据目录标识
-	fileLock        *flock.Flock  // 文件锁
-	bytesWrite      uint          // 自上次持久化后累计写入数据量, 单位字节
-	reclaimSize     int64         // 无效数据量, 单位字节
-	totalSize       int64         // 数据文件总数据量, 单位字节
-	closedChan      chan struct{} // 用于控制后台持久化协程关闭的通道
+	activeFile *data.DataFile // 当前活跃文件, 允许读写
+	// 旧数据文件, 只读, 写时复制后原子发布, 发布后的映射不再修改
+	olderFiles atomic.Pointer[map[uint32]*data.DataFile]
+	// 无锁读取旧数据文件的读取者持有读锁, 关闭或替换旧数据文件前需确认不存在读取者
+	readers   sync.RWMutex
+	index     index.Indexer  // 内存索引
+	seqNo     uint64         // 事务id
+	logSeqNo  uint64         // 日志序列号, 每条写入的日志记录自增
+	isMerging bool           // merge 执行状态标识
+	merges    sync.WaitGroup // 正在执行的 merge, 关闭时等待其结束
+	mergeStat MergeStat      // merge 执行统计信息
+	hintMu    sync.Mutex     // 串行化 hint 文件写入
+	hints     sync.WaitGroup // 正在写入的 hint 文件, 关闭时等待其写入完成
+	openStat  OpenStat       // 打开数据库的耗时统计
+	// 后台写入索引检查点的协程, 关闭时等待其结束
+	indexCheckpoints sync.WaitGroup
+	// B+ 树索引中持久化的事务序列号上限, 已分配的事务序列号均不超过该值
+	seqNoLimit   uint64
+	seqNoMu      sync.Mutex             // 串行化事务序列号上限的持久化
+	fileLock     *flock.Flock           // 文件锁
+	bytesWrite   uint                   // 自上次持久化后累计写入数据量, 单位字节
+	writtenBytes atomic.Uint64          // 自打开起累计写入数据文件的数据量, 单调递增, 单位字节
+	reclaimSize  atomic.Int64           // 无效数据量, 单位字节
+	totalSize    atomic.Int64           // 数据文件总数据量, 单位字节
+	fileSizes    sync.Map               // 各数据文件的数据量和无效数据量, map[uint32]*dataFileSize
+	closedChan   chan struct{}          // 用于控制后台持久化协程关闭的通道
+	snapshots    map[*Snapshot]struct{} // 未关闭的快照
+	retiredFiles []*data.DataFile       // merge 替换后仍被快照引用的旧数据文件
+	watchMu      *sync.Mutex            // 变更订阅者锁
+	watchers     map[*Watcher]struct{}  // 变更订阅者
+	encryptor    *data.Encryptor        // 日志记录加解密, nil 表示不加密
+	checkReport  *CheckReport           // 完整性检查结果, 仅用于离线检查
+	// 加载索引后仍未读取到完成标识的事务记录, 供复制时继续应用
+	pendingTxns map[uint64][]*data.TransactionRecords
+	readOnly    bool               // 只读标识, 作为复制从节点时不允许写入
+	follower    *follower          // 复制从节点状态, 非从节点时为 nil
+	appended    appendNotifier     // 日志追加通知, 供复制会话等待新写入
+	hintInfo    os.FileInfo        // 只读模式下加载时的 hint 文件信息, 用于判断是否已执行 merge
+	buckets     map[string]*Bucket // 已命名的 bucket
+	bucketIds   map[uint32]*Bucket // 全部 bucket, 包含元数据 bucket, 不包含默认 bucket
+	commits     *commitQueue       // 写入队列, 串行化全部追加写入并合并并发写入
+	bucketMu    sync.Mutex         // bucket 创建锁
+	vlog        *valueLog          // value log, 存放分离存储的 value
 }
 
 // Stat 实时统计信息
 // todo 扩展点：后续进行维护和利用
 type Stat struct {
-	KeyNum          uint  // 当前 key 的数量
-	DataFileNum     uint  // 当前数据文件数量
-	ReclaimableSize int64 // 当前 merge 可回收的数据量, 单位字节
-	DiskSize        int64 // 数据目录的磁盘占用空间大小
+	KeyNum          uint                    // 默认 bucket 中当前 key 的数量
+	DataFileNum     uint                    // 当前数据文件数量
+	ReclaimableSize int64                   // 当前 merge 可回收的数据量, 单位字节
+	DiskSize        int64                   // 数据目录的磁盘占用空间大小
+	Buckets         map[string]BucketStat   // 各命名 bucket 的统计信息
+	ValueLogSize    int64                   // value log 文件的磁盘占用空间大小
+	DataFiles       map[uint32]DataFileStat // 各数据文件的统计信息
+	Merge           MergeStat               // merge 执行统计信息
+	Replication     ReplicationStat         // 复制从节点的同步统计信息
+}
+
+// OpenStat 打开数据库的耗时统计, 通过 Options.OnOpen 回调获取
+type OpenStat struct {
+	Duration          time.Duration // 打开数据库的总耗时
+	LoadIndexDuration time.Duration // 加载内存索引的耗时
+	HintFileNum       int           // 通过 hint 文件加载索引的数据文件数量
+	DataFileNum       int           // 读取日志记录加载索引的数据文件数量
+	Parallelism       int           // 加载索引的并发度
+	IndexCheckpoint   bool          // 是否通过索引检查点加载索引
+}
+
+// DataFileStat 数据文件统计信息, 有效数据量为 DiskSize - ReclaimableSize
+type DataFileStat struct {
+	ReclaimableSize int64 // merge 可回收的数据量, 单位字节
+	DiskSize        int64 // 数据量, 单位字节
 }
 
 // Stat 获取当前时刻数据库统计信息
 func (db *DB) Stat() *Stat {
+	// 数据量统计均为原子变量, 仅读取活跃文件和 bucket 时持有读锁, 不阻塞写入
 	db.mu.RLock()
 	defer db.mu.RUnlock()
 
-	var dataFileCount = uint(len(db.olderFiles))
+	var dataFileCount = uint(len(db.getOlderFiles()))
 	if db.activeFile != nil {
 		dataFileCount += 1
 	}
 
+	// 读取文件大小失败时不影响其它统计信息
+	valueLogSize, _ := db.vlog.size()
 	return &Stat{
 		KeyNum:          uint(db.index.Size()),
 		DataFileNum:     dataFileCount,
-		ReclaimableSize: db.reclaimSize,
-		DiskSize:        db.totalSize,
+		ReclaimableSize: db.reclaimSize.Load(),
+		DiskSize:        db.totalSize.Load(),
+		Buckets:         db.bucketStats(),
+		ValueLogSize:    valueLogSize,
+		DataFiles:       db.dataFileStats(),
+		Merge:           db.mergeStat,
+		Replication:     db.replicationStat(),
 	}
 }
 
 // Open 客户端初始化
-func Open(options Options) (*DB, error) {
+// 使用完毕后需调用 Close, 停止后台 merge 和 hint 文件写入等协程并释放文件锁
+func Open(options Options) (db *DB, err error) {
 	// 校验配置项
 	if err := checkOptions(options); err != nil {
 		return nil, err
 	}
-
-	// 是否为首次加载标识
-	var isInitial bool
+	// 打开成功后回调耗时统计
+	start := time.Now()
+	defer func() {
+		if err == nil && options.OnOpen != nil {
+			db.openStat.Duration = time.Since(start)
+			options.OnOpen(db.openStat)
+		}
+	}()
+	// 只读模式不获取文件锁, 不修改数据目录
+	if options.ReadOnly {
+		return openReadOnly(options)
+	}
 
 	// 数据目录不存在则创建
 	if _, err := os.Stat(options.DirPath); os.IsNotExist(err) {
-		isInitial = true
 		if err := os.MkdirAll(options.DirPath, os.ModePerm); err != nil {
 			return nil, err
 		}
 	}
 
-	entries, err := os.ReadDir(options.DirPath)
-	if err != nil {
-		return nil, err
-	}
-	// 数据目录为空
-	if len(entries) == 0 {
-		isInitial = true
-	}
-
 	// 尝试获取文件锁
 	// 通过文件锁确保多进程下同一数据目录的 DB 实例唯一
 	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
@@ -109,16 +173,34 @@ func Open(options Options) (*DB, error) {
 		return nil, ErrDatabaseIsUsing
 	}
 
+	// B+ 树索引文件不存在时需读取数据文件重建索引, 如从备份恢复的数据目录
+	_, statErr := os.Stat(filepath.Join(options.DirPath, index.BPTreeIndexFileName))
+	rebuildIndex := options.IndexType == index.BPTree && os.IsNotExist(statErr)
+
 	syncWrites := options.SyncStrategy == Always
 	// 初始化 DB 实例
-	db := &DB{
+	db = &DB{
 		options:    options,
 		mu:         new(sync.RWMutex),
-		olderFiles: make(map[uint32]*data.DataFile),
 		index:      index.NewIndexer(options.IndexType, options.DirPath, syncWrites),
-		isInitial:  isInitial,
 		fileLock:   fileLock,
 		closedChan: make(chan struct{}),
+		snapshots:  make(map[*Snapshot]struct{}),
+		watchMu:    new(sync.Mutex),
+		watchers:   make(map[*Watcher]struct{}),
+		commits:    newCommitQueue(),
+		vlog:       newValueLog(false),
+	}
+	// 加载失败时释放已打开的文件和文件锁, 便于修正配置后重新打开
+	defer func(db *DB) {
+		if err != nil {
+			db.releaseOnOpenFailure()
+		}
+	}(db)
+
+	// 配置密钥提供者时启用加密
+	if options.KeyProvider != nil {
+		db.encryptor = data.NewEncryptor(options.Cipher, options.KeyProvider)
 	}
 
 	// 尝试加载 merge 临时目录中的数据文件
@@ -133,11 +215,24 @@ func Open(options Options) (*DB, error) {
 	if err != nil {
 		return nil, err
 	}
+	if err := db.loadValueLog(); err != nil {
+		return nil, err
+	}
 
-	// 索引实现选择可持久化 B+ 树, 无需加载索引到内存
+	// 索引实现选择可持久化 B+ 树, 无需加载索引到内存, 仅索引文件不存在时读取数据文件重建
 	if options.IndexType == index.BPTree {
-		// 从文件中加载事务 id
-		if err := db.loadSeqNo(); err != nil {
+		if rebuildIndex {
+			if err := db.loadIndexFromDataFiles(files, 0, 0); err != nil {
+				return nil, err
+			}
+			db.discardPendingTxns()
+		}
+		// 从最新的数据文件中加载日志序列号
+		if err := db.loadLogSeqNo(files); err != nil {
+			return nil, err
+		}
+		// 从索引文件或事务序列号文件中加载事务 id
+		if err := db.loadSeqNo(files); err != nil {
 			return nil, err
 		}
 		// 更新活跃文件偏移量
@@ -153,51 +248,52 @@ func Open(options Options) (*DB, error) {
 	}
 
 	// 如果 merge 成功, 尝试使用 hint 文件快速加载索引
+	// 否则尝试加载索引检查点, 仅需读取检查点之后写入的日志记录
+	var offset int64 = 0
 	if nonMergeFileId > 0 {
+		hintStart := time.Now()
 		maxFileId, err := db.loadIndexFromHintFile()
 		if err != nil {
 			return nil, err
 		}
 		nonMergeFileId = min(maxFileId, nonMergeFileId)
+		db.openStat.LoadIndexDuration += time.Since(hintStart)
+	} else if fileId, ckptOffset, ok := db.loadIndexCheckpoint(files); ok {
+		nonMergeFileId, offset = fileId, ckptOffset
 	}
 
 	// 加载索引
-	if err := db.loadIndexFromDataFiles(files, nonMergeFileId); err != nil {
+	if err := db.loadIndexFromDataFiles(files, nonMergeFileId, offset); err != nil {
 		return nil, err
 	}
+	db.discardPendingTxns()
 
+	// 后台按调度策略执行 merge
 	if db.options.EnableBackgroundMerge {
-		go func() {
-			var flushes uint = 0
-			ticker := time.NewTicker(time.Second)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-ticker.C:
-					if flushes == db.bytesWrite {
-						continue
-					}
-					if err := db.Merge(); err != nil {
-						// 记录错误日志
-						fmt.Printf("failed to merge db: %v\n", err)
-					}
-					flushes = db.bytesWrite
-				case <-db.closedChan:
-					return
-				}
-			}
-		}()
+		go db.backgroundMerge()
+	}
+	// 后台定时写入索引检查点
+	if db.options.IndexCheckpointInterval > 0 && db.indexCheckpointEnabled() {
+		db.indexCheckpoints.Add(1)
+		go db.backgroundIndexCheckpoint()
 	}
 
 	return db, nil
 }
 
-// Backup 数据库备份
-func (db *DB) Backup(dir string) error {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	// 将数据目录中的数据文件拷贝到指定目录中
-	return utils.CopyDir(db.options.DirPath, dir, []string{fileLockName})
+// 释放打开失败的 DB 实例占用的资源
+func (db *DB) releaseOnOpenFailure() {
+	_ = db.index.Close()
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.getOlderFiles() {
+		_ = file.Close()
+	}
+	_ = db.vlog.close()
+	if db.fileLock != nil {
+		_ = db.fileLock.Unlock()
+	}
 }
 
 // Put 新增元素
@@ -207,44 +303,93 @@ func (db *DB) Put(key []byte, value []byte) error {
 		return ErrKeyIsEmpty
 	}
 
-	// 构造日志记录实例
-	logRecord := &data.LogRecord{
-		Key:   logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Value: value,
-		Type:  data.LogRecordNormal,
-	}
+	return db.put(defaultBucketId, key, value, 0)
+}
 
-	// 将日志记录追加到当前活跃文件
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
+// 向指定 bucket 新增元素, expire 为 0 表示永不过期, 调用方不能持有锁
+func (db *DB) put(bucketId uint32, key []byte, value []byte, expire int64) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
 	}
+	return db.submit(db.putRequest(bucketId, key, value, expire))
+}
 
-	// 更新索引, 并维护无效数据量
-	if oldPos := db.index.Put(key, pos); oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
+// 构造新增元素的写入请求, 写入成功后更新索引并通知变更订阅者
+func (db *DB) putRequest(bucketId uint32, key []byte, value []byte, expire int64) *commitRequest {
+	// 构造日志记录实例
+	logRecord := &data.LogRecord{
+		Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Value:  value,
+		Type:   data.LogRecordNormal,
+		Expire: expire,
+		Bucket: bucketId,
+	}
+
+	// 将日志记录追加到当前活跃文件, 写入成功后更新索引
+	return &commitRequest{records: []*data.LogRecord{logRecord}, apply: func(positions []*data.LogRecordPos) error {
+		pos := positions[0]
+		// 更新索引, 并维护无效数据量
+		var reclaim int64 = 0
+		if oldPos := db.indexOf(bucketId).Put(key, pos); oldPos != nil {
+			reclaim = db.addFileReclaim(oldPos)
+		}
+		db.addBucketSize(bucketId, int64(pos.Size), reclaim)
 
-	return nil
+		// 写入成功后通知变更订阅者
+		db.publish(&ChangeEvent{Key: key, Value: value, SeqNo: logRecord.LogSeqNo, Bucket: db.bucketName(bucketId)})
+		return nil
+	}}
 }
 
 // Get 根据 key 读取数据
 func (db *DB) Get(key []byte) ([]byte, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
 	// 校验 key 是否为 nil
 	if len(key) == 0 {
 		return nil, ErrKeyIsEmpty
 	}
+	return db.get(defaultBucketId, key)
+}
 
+// 根据 key 读取指定 bucket 中的数据, 调用方不能持有锁
+// 仅查询内存索引时持有读锁, 位于旧数据文件的日志记录在释放锁后读取
+func (db *DB) get(bucketId uint32, key []byte) ([]byte, error) {
+	db.mu.RLock()
 	// 从内存中获取 key 对应的索引数据
-	logRecordPos := db.index.Get(key)
-	if logRecordPos == nil {
+	logRecordPos := db.indexOf(bucketId).Get(key)
+	// 已过期的 key 视为不存在
+	if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+		db.mu.RUnlock()
+		return nil, ErrKeyNotFound
+	}
+	// 位于活跃文件时持有锁读取
+	dataFile := db.getOlderFiles()[logRecordPos.Fid]
+	if dataFile == nil {
+		defer db.mu.RUnlock()
+		return db.getValueByPosition(logRecordPos)
+	}
+	// 释放锁前登记为读取者, 读取期间文件被替换时延迟关闭
+	db.readers.RLock()
+	db.mu.RUnlock()
+	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	db.readers.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type == data.LogRecordDeleted {
 		return nil, ErrKeyNotFound
 	}
 
-	// 获取 value 并返回
-	return db.getValueByPosition(logRecordPos)
+	// 分离存储的 value 所在文件可能已被 value log GC 回收, 持有锁重新读取
+	if logRecord.ValuePointer {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		logRecordPos = db.indexOf(bucketId).Get(key)
+		if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+			return nil, ErrKeyNotFound
+		}
+		return db.getValueByPosition(logRecordPos)
+	}
+	return logRecord.Value, nil
 }
 
 // Delete 根据 key 删除数据
@@ -254,32 +399,43 @@ func (db *DB) Delete(key []byte) error {
 		return ErrKeyIsEmpty
 	}
 
-	if pos := db.index.Get(key); pos == nil {
+	return db.delete(defaultBucketId, key)
+}
+
+// 根据 key 删除指定 bucket 中的数据, 调用方不能持有锁
+func (db *DB) delete(bucketId uint32, key []byte) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+
+	db.mu.RLock()
+	pos := db.indexOf(bucketId).Get(key)
+	db.mu.RUnlock()
+	if pos == nil {
 		return nil
 	}
 
 	// 构造 LogRecord 设置删除状态, 作为墓碑值追加到数据文件中
 	logRecord := &data.LogRecord{
-		Key:  logRecordKeyWithSeq(key, nonTransactionSeqNo),
-		Type: data.LogRecordDeleted,
-	}
-	pos, err := db.appendLogRecordWithLock(logRecord)
-	if err != nil {
-		return err
-	}
-	// 墓碑值本身可视为无效数据
-	db.reclaimSize += int64(pos.Size)
-
-	// 更新索引信息
-	oldPos, ok := db.index.Delete(key)
-	if !ok {
-		return ErrIndexUpdateFailed
-	}
-	if oldPos != nil {
-		db.reclaimSize += int64(oldPos.Size)
-	}
+		Key:    logRecordKeyWithSeq(key, nonTransactionSeqNo),
+		Type:   data.LogRecordDeleted,
+		Bucket: bucketId,
+	}
+	return db.submit(&commitRequest{records: []*data.LogRecord{logRecord}, apply: func(positions []*data.LogRecordPos) error {
+		pos := positions[0]
+		// 墓碑值本身可视为无效数据
+		reclaim := db.addFileReclaim(pos)
+
+		// 更新索引信息, key 可能已被并发的删除操作删除, 此时墓碑值仅计入无效数据
+		if oldPos, _ := db.indexOf(bucketId).Delete(key); oldPos != nil {
+			reclaim += db.addFileReclaim(oldPos)
+		}
+		db.addBucketSize(bucketId, int64(pos.Size), reclaim)
 
-	return nil
+		// 写入成功后通知变更订阅者
+		db.publish(&ChangeEvent{Key: key, Deleted: true, SeqNo: logRecord.LogSeqNo, Bucket: db.bucketName(bucketId)})
+		return nil
+	}})
 }
 
 // ListKeys 获取数据库中的所有 key
@@ -288,12 +444,17 @@ func (db *DB) ListKeys() [][]byte {
 	defer iterator.Close()
 	keys := make([][]byte, db.index.Size())
 	var idx int
+	now := time.Now().UnixNano()
 	// 直接通过迭代器遍历获取所有 key
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		// 跳过已过期的 key
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
 		keys[idx] = iterator.Key()
 		idx++
 	}
-	return keys
+	return keys[:idx]
 }
 
 // Fold 对数据库所有项执行自定义操作, 项改变不会同步数据库
@@ -305,7 +466,12 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 	iterator := db.index.Iterator(false)
 	// 使用完成后必须关闭, 否则可能导致 B+ 树索引的读写事务互斥阻塞
 	defer iterator.Close()
+	now := time.Now().UnixNano()
 	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		// 跳过已过期的 key
+		if iterator.Value().IsExpired(now) {
+			continue
+		}
 		value, err := db.getValueByPosition(iterator.Value())
 		if err != nil {
 			return err
@@ -322,15 +488,24 @@ func (db *DB) Fold(fn func(key []byte, value []byte) bool) error {
 
 // Close 关闭数据库
 func (db *DB) Close() error {
-	// 释放文件锁
+	// 释放文件锁, 只读模式下未持有文件锁
 	defer func() {
+		if db.fileLock == nil {
+			return
+		}
 		if err := db.fileLock.Unlock(); err != nil {
 			panic(fmt.Sprintf("failed to unlock the directory, %v", err))
 		}
 	}()
 
-	// 关闭后台 merge 协程
-	if db.options.EnableBackgroundMerge && db.closedChan != nil {
+	// 停止复制, 从节点不再应用新的日志记录
+	db.stopFollower()
+
+	// 关闭所有变更订阅
+	db.closeWatchers()
+
+	// 关闭后台 merge 协程和复制会话, 并取消正在执行的 merge
+	if db.closedChan != nil {
 		// 安全关闭
 		select {
 		case <-db.closedChan:
@@ -338,71 +513,126 @@ func (db *DB) Close() error {
 			close(db.closedChan)
 		}
 	}
+	// 加锁保证此后开始的 merge 和 hint 文件写入均能观察到数据库已关闭, 再等待正在执行的协程结束
+	// 未写入完成的 hint 文件被删除, 下次启动改为读取对应的数据文件
+	db.mu.Lock()
+	db.mu.Unlock()
+	db.merges.Wait()
+	db.hints.Wait()
+	db.indexCheckpoints.Wait()
+
+	// 持久化内存索引, 下次启动仅需读取之后写入的日志记录
+	// 写入失败不影响数据, 下次启动改为读取数据文件加载索引
+	_ = db.checkpointIndex()
 
 	if db.activeFile == nil {
-		return nil
+		return db.vlog.close()
 	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
+	// 等待正在无锁读取旧数据文件的读取者结束, 持有写锁时不会出现新的读取者
+	db.readers.Lock()
+	db.readers.Unlock()
+
+	// 关闭 value log 文件
+	if err := db.vlog.close(); err != nil {
+		return err
+	}
 
 	// B+树索引实例实际是 DB 实例需要同步关闭, 否则下次重复打开导致报错
 	if err := db.index.Close(); err != nil {
 		return err
 	}
+	for _, b := range db.bucketIds {
+		if err := b.index.Close(); err != nil {
+			return err
+		}
+	}
 
 	// 如果选择 B+ 树索引实现, 不存在索引加载流程, 无法借此获得事务id
-	// 需要在关闭数据库时将当前最新事务 id 持久化
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
-	if err != nil {
+	// 需要在关闭数据库时将当前最新事务 id 持久化, 只读模式下不修改数据目录
+	if !db.options.ReadOnly {
+		if err := db.writeSeqNoFile(); err != nil {
+			return err
+		}
+	}
+
+	// 关闭当前活跃文件, 自动持久化
+	if err := db.activeFile.Close(); err != nil {
 		return err
 	}
+
+	// 关闭旧的数据文件
+	for _, file := range db.getOlderFiles() {
+		if err := file.Close(); err != nil {
+			return err
+		}
+	}
+
+	// 关闭仍被快照引用的旧数据文件
+	return db.closeRetiredFiles()
+}
+
+// 将当前事务 id 写入事务序列号文件
+// 先写入临时文件并持久化再重命名替换, 写入中断时原文件不受影响
+func (db *DB) writeSeqNoFile() (err error) {
 	record := &data.LogRecord{
 		Key:   []byte(seqNoKey),
 		Value: []byte(strconv.FormatUint(db.seqNo, 10)),
 	}
-	encRecord, _ := data.EncodeLogRecord(record)
-	if err := seqNoFile.Write(encRecord); err != nil {
-		return err
-	}
-	if err := seqNoFile.Close(); err != nil {
+	encRecord, _, err := db.encryptor.EncodeLogRecord(record)
+	if err != nil {
 		return err
 	}
 
-	// 关闭当前活跃文件, 自动持久化
-	if err := db.activeFile.Close(); err != nil {
+	tmpPath := filepath.Join(db.options.DirPath, seqNoTempFileName)
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fio.DataFilePerm)
+	if err != nil {
 		return err
 	}
-
-	// 关闭旧的数据文件
-	for _, file := range db.olderFiles {
-		if err := file.Close(); err != nil {
-			return err
+	defer func() {
+		if err != nil {
+			_ = tmpFile.Close()
+			_ = os.Remove(tmpPath)
 		}
+	}()
+	if _, err = tmpFile.Write(encRecord); err != nil {
+		return err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filepath.Join(db.options.DirPath, data.SeqNoFileName)); err != nil {
+		return err
 	}
 
-	return nil
+	// 旧版本的事务序列号文件已过期
+	if err = os.Remove(filepath.Join(db.options.DirPath, legacySeqNoFileName)); os.IsNotExist(err) {
+		err = nil
+	}
+	return err
 }
 
 // Sync 数据持久化
 func (db *DB) Sync() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
 	if db.activeFile == nil {
 		return nil
 	}
-	db.mu.Lock()
-	defer db.mu.Unlock()
 
+	// 先持久化 value log, 避免数据文件中的位置信息指向未持久化的 value
+	if err := db.syncValueLog(); err != nil {
+		return err
+	}
 	// 仅持久化当前活跃文件
 	return db.activeFile.Sync()
 }
 
-// 将日志记录追加到当前活跃文件, 加锁
-func (db *DB) appendLogRecordWithLock(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
-	db.mu.RLock()
-	defer db.mu.RUnlock()
-	return db.appendLogRecord(logRecord)
-}
-
-// 将日志记录追加到当前活跃文件
+// 将日志记录追加到当前活跃文件, 仅用于 merge 重写, 在线写入均通过写入队列追加
 func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
 	// 如果数据库为空, 先创建数据文件并设置为活跃文件
 	if db.activeFile == nil {
@@ -411,11 +641,16 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		}
 	}
 
-	// 编码
-	encRecord, size := data.EncodeLogRecord(logRecord)
+	// 编码, 按当前配置压缩 value
+	// merge 重写时同样使用当前配置重新压缩
+	logRecord.Compression = db.options.Compression
+	encRecord, size, err := db.encryptor.EncodeLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
 
 	// 维护总数据量
-	db.totalSize += size
+	db.totalSize.Add(size)
 
 	// 活跃文件剩余空间不足, 新建数据文件作为新的活跃文件
 	if db.activeFile.WriteOff+size > db.options.DataFileSize {
@@ -433,6 +668,7 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 
 	// 维护累计写入数据量
 	db.bytesWrite += uint(size)
+	db.writtenBytes.Add(uint64(size))
 
 	// 执行配置的持久化策略
 	syncStrategy := db.options.SyncStrategy
@@ -445,27 +681,46 @@ func (db *DB) appendLogRecord(logRecord *data.LogRecord) (*data.LogRecordPos, er
 		db.bytesWrite = 0
 	}
 	// 构造内存索引信息返回
-	pos := &data.LogRecordPos{Fid: db.activeFile.FileId, Offset: writeOff, Size: uint32(size)}
+	pos := &data.LogRecordPos{
+		Fid:    db.activeFile.FileId,
+		Offset: writeOff,
+		Size:   uint32(size),
+		Expire: logRecord.Expire,
+	}
 	return pos, nil
 }
 
 // 持久化并设置新活跃文件
 func (db *DB) sync() error {
+	sealedFile, err := db.sealActiveFile()
+	if err != nil {
+		return err
+	}
+
+	// 为封存的数据文件写入 hint 文件, 供启动时快速加载索引
+	db.scheduleFileHint(sealedFile)
+	return nil
+}
+
+// 封存活跃文件并设置新的活跃文件, 返回封存的数据文件, 不写入 hint 文件, 调用方需持有写锁
+func (db *DB) sealActiveFile() (*data.DataFile, error) {
 	// 持久化原活跃文件
 	if err := db.activeFile.Sync(); err != nil {
 		db.bytesWrite = 0
-		return err
+		return nil, err
 	}
 
 	// 将原活跃文件转换为旧数据文件
-	db.olderFiles[db.activeFile.FileId] = db.activeFile
+	sealedFile := db.activeFile
+	db.updateOlderFiles(func(files map[uint32]*data.DataFile) {
+		files[sealedFile.FileId] = sealedFile
+	})
 
 	// 设置新的活跃文件
 	if err := db.setActiveDataFile(); err != nil {
-		return err
+		return nil, err
 	}
-
-	return nil
+	return sealedFile, nil
 }
 
 // 创建并设置新活跃文件
@@ -476,7 +731,7 @@ func (db *DB) setActiveDataFile() error {
 		initialFileId = db.activeFile.FileId + 1
 	}
 	// 创建并打开新的数据文件
-	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, db.options.FileIOType)
+	dataFile, err := data.OpenDataFile(db.options.DirPath, initialFileId, db.options.FileIOType, db.encryptor)
 	if err != nil {
 		return err
 	}
@@ -487,14 +742,73 @@ func (db *DB) setActiveDataFile() error {
 
 // 从磁盘中加载数据文件
 func (db *DB) loadDataFiles() ([]uint32, error) {
-	dirEntries, err := os.ReadDir(db.options.DirPath)
+	fileIds, err := db.dataFileIds()
+	if err != nil {
+		return nil, err
+	}
+
+	// 按文件 id 从小到大加载, 保证最终得到最新数据
+	olderFiles := make(map[uint32]*data.DataFile, len(fileIds))
+	for i, fid := range fileIds {
+		dataFile, err := db.openDataFile(fid)
+		if err != nil {
+			return nil, err
+		}
+		// id 最大的文件视为最新文件, 作为活跃文件
+		if i == len(fileIds)-1 {
+			db.activeFile = dataFile
+		} else {
+			olderFiles[fid] = dataFile
+		}
+	}
+	db.olderFiles.Store(&olderFiles)
+
+	return fileIds, nil
+}
+
+// 获取旧数据文件, 返回的映射不可修改, 无需持有锁
+func (db *DB) getOlderFiles() map[uint32]*data.DataFile {
+	if files := db.olderFiles.Load(); files != nil {
+		return *files
+	}
+	return nil
+}
+
+// 复制旧数据文件映射并由 fn 修改后原子发布, 调用方需持有写锁
+func (db *DB) updateOlderFiles(fn func(files map[uint32]*data.DataFile)) {
+	older := db.getOlderFiles()
+	files := make(map[uint32]*data.DataFile, len(older)+1)
+	for fileId, dataFile := range older {
+		files[fileId] = dataFile
+	}
+	fn(files)
+	db.olderFiles.Store(&files)
+}
+
+// 打开已存在的数据文件, 只读模式下以只读方式打开
+func (db *DB) openDataFile(fileId uint32) (*data.DataFile, error) {
+	if db.options.ReadOnly {
+		return data.OpenDataFileReadOnly(db.options.DirPath, fileId, db.encryptor)
+	}
+	return data.OpenDataFile(db.options.DirPath, fileId, db.options.FileIOType, db.encryptor)
+}
+
+// 获取数据目录中的数据文件 id
+// 由于 ReadDir 方法底层已按文件名进行排序, 按顺序遍历得到的文件 id 已有序
+func (db *DB) dataFileIds() ([]uint32, error) {
+	return fileIdsWithSuffix(db.options.DirPath, data.DataFileNameSuffix)
+}
+
+// 获取目录中指定后缀的文件 id, 按文件 id 从小到大排列
+func fileIdsWithSuffix(dirPath string, suffix string) ([]uint32, error) {
+	dirEntries, err := os.ReadDir(dirPath)
 	if err != nil {
 		return nil, err
 	}
 	fileIds := make([]uint32, 0, len(dirEntries))
 	// 遍历目录, 筛取数据文件
 	for _, entry := range dirEntries {
-		if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) {
+		if !strings.HasSuffix(entry.Name(), suffix) {
 			continue
 		}
 		// 解析文件名称
@@ -506,129 +820,312 @@ func (db *DB) loadDataFiles() ([]uint32, error) {
 		}
 		fileIds = append(fileIds, uint32(fileId))
 	}
+	return fileIds, nil
+}
 
-	// 按文件 id 从小到大加载, 保证最终得到最新数据
-	// 由于 ReadDir 方法底层已按文件名进行排序, 按顺序遍历得到的文件 id 已有序
-	for i, fid := range fileIds {
-		dataFile, err := data.OpenDataFile(db.options.DirPath, fid, db.options.FileIOType)
-		if err != nil {
-			return nil, err
+// 索引构建器, 按写入顺序应用日志记录更新内存索引
+// 事务的日志记录暂存至读取到对应的事务完成标识后统一生效
+type indexBuilder struct {
+	db                 *DB
+	now                int64                                 // 判断数据是否过期的时刻
+	transactionRecords map[uint64][]*data.TransactionRecords // 属于事务提交的记录的相关暂存数据
+	seqNo              uint64                                // 最大事务序列号
+	logSeqNo           uint64                                // 最大日志序列号
+}
+
+func (db *DB) newIndexBuilder() *indexBuilder {
+	transactionRecords := db.pendingTxns
+	if transactionRecords == nil {
+		transactionRecords = make(map[uint64][]*data.TransactionRecords)
+	}
+	return &indexBuilder{
+		db:                 db,
+		now:                time.Now().UnixNano(),
+		transactionRecords: transactionRecords,
+		seqNo:              db.seqNo,
+		logSeqNo:           db.logSeqNo,
+	}
+}
+
+// 应用一条日志记录
+func (b *indexBuilder) apply(logRecord *data.LogRecord, logRecordPos *data.LogRecordPos) {
+	// 解析 key, 提取真实 key 和 seq 事务前缀
+	realKey, seqNo := parseLogRecordKey(logRecord.Key)
+
+	// todo 未知：hint文件加载时未更新事务 id, 可能存在问题？
+	// 判断当前日志记录是否属于事务提交
+	if seqNo == nonTransactionSeqNo {
+		// 日志记录属于非事务提交, 直接更新索引
+		// 索引存放的 key 是真实 key
+		b.updateIndex(logRecord.Bucket, realKey, logRecord.Type, logRecordPos)
+		// 元数据 bucket 的日志记录同时注册对应的 bucket
+		if logRecord.Bucket == metaBucketId && logRecord.Type == data.LogRecordNormal {
+			b.db.loadBucketMeta(realKey, logRecord.Value)
 		}
-		// id 最大的文件视为最新文件, 作为活跃文件
-		if i == len(fileIds)-1 {
-			db.activeFile = dataFile
+	} else {
+		// 日志记录属于事务提交
+		// 读取到带事务完成标识的记录时再统一更新索引
+		if logRecord.Type == data.LogRecordTxnFinished {
+			// 更新相同事务 id 的所有数据对应的索引信息
+			for _, txnRecord := range b.transactionRecords[seqNo] {
+				b.updateIndex(txnRecord.Record.Bucket, txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
+			}
+			delete(b.transactionRecords, seqNo)
 		} else {
-			db.olderFiles[fid] = dataFile
+			logRecord.Key = realKey
+			// 暂存用于后续更新索引的相关数据
+			b.transactionRecords[seqNo] = append(b.transactionRecords[seqNo], &data.TransactionRecords{
+				Record: logRecord,
+				Pos:    logRecordPos,
+			})
 		}
 	}
 
-	return fileIds, nil
+	// 顺便更新序列号, 从而获取最大序列号
+	b.seqNo = max(b.seqNo, seqNo)
+	b.logSeqNo = max(b.logSeqNo, logRecord.LogSeqNo)
+}
+
+// 更新 bucket 的索引, 并维护总数据量和无效数据量
+func (b *indexBuilder) updateIndex(bucketId uint32, key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
+	db := b.db
+	idx := db.indexOf(bucketId)
+
+	// 维护总数据量和无效数据量
+	db.addFileSize(pos.Fid, int64(pos.Size))
+	var oldPos *data.LogRecordPos
+	var reclaim int64 = 0
+	// 发现墓碑值或已过期的数据同样删除对应的索引信息
+	if typ == data.LogRecordDeleted || pos.IsExpired(b.now) {
+		oldPos, _ = idx.Delete(key)
+		reclaim += db.addFileReclaim(pos)
+	} else {
+		oldPos = idx.Put(key, pos)
+	}
+	if oldPos != nil {
+		reclaim += db.addFileReclaim(oldPos)
+	}
+	db.addBucketSize(bucketId, int64(pos.Size), reclaim)
+}
+
+// 应用完成, 更新事务 id 和日志序列号, 确保后续自增获取的新序列号唯一
+func (b *indexBuilder) finish() {
+	b.db.seqNo = b.seqNo
+	b.db.logSeqNo = b.logSeqNo
+	b.db.pendingTxns = b.transactionRecords
+}
+
+// 单个数据文件中读取到的日志记录, 用于并发加载索引
+type fileRecords struct {
+	records   []*data.LogRecord
+	positions []*data.LogRecordPos
+	offset    int64 // 读取结束的位置
+	err       error // 读取到的损坏日志记录等错误, 读取到文件末尾时为 nil
+	hinted    bool  // 是否通过 hint 文件读取
 }
 
 // 从数据文件中加载索引
-func (db *DB) loadIndexFromDataFiles(fileIds []uint32, nonMergeFileId uint32) error {
+// 多个协程并发读取数据文件, 再按文件 id 从小到大依次应用, 保证最终索引记录最新数据且事务按完成标识生效
+// 从文件 id 为 fromFileId 的数据文件的 offset 位置开始读取, 之前的数据已通过 hint 文件或索引检查点加载
+func (db *DB) loadIndexFromDataFiles(fileIds []uint32, fromFileId uint32, offset int64) error {
 	// 数据库为空
 	if len(fileIds) == 0 {
 		return nil
 	}
+	start := time.Now()
 
-	// 更新索引逻辑封装为局部函数实现复用
-	updateIndex := func(key []byte, typ data.LogRecordType, pos *data.LogRecordPos) {
-		// 维护总数据量
-		db.totalSize += int64(pos.Size)
+	// 已通过 hint 文件或索引检查点加载的数据文件无需重复加载
+	var dataFiles []*data.DataFile
+	for _, fileId := range fileIds {
+		if fileId < fromFileId {
+			continue
+		}
+		if fileId == db.activeFile.FileId {
+			dataFiles = append(dataFiles, db.activeFile)
+		} else {
+			dataFiles = append(dataFiles, db.getOlderFiles()[fileId])
+		}
+	}
+
+	// 至多 parallelism 个数据文件已读取或正在读取而尚未应用, 限制内存占用
+	parallelism := db.loadIndexParallelism()
+	results := make([]chan *fileRecords, len(dataFiles))
+	for i := range results {
+		results[i] = make(chan *fileRecords, 1)
+	}
+	tokens := make(chan struct{}, parallelism)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(done)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i, dataFile := range dataFiles {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			// 旧数据文件优先通过 hint 文件读取, 完整性检查时需读取数据文件
+			var start int64 = 0
+			if dataFile.FileId == fromFileId {
+				start = offset
+			}
+			useHint := i < len(dataFiles)-1 && db.checkReport == nil && start == 0
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i] <- db.readFileRecords(dataFile, start, useHint)
+			}()
+		}
+	}()
+
+	builder := db.newIndexBuilder()
+	for i, dataFile := range dataFiles {
+		res := <-results[i]
+		for j, logRecord := range res.records {
+			builder.apply(logRecord, res.positions[j])
+		}
+		isNewest := i == len(dataFiles)-1
+		offset := res.offset
+		// 读取到损坏的日志记录时, 由当前协程按配置的策略处理并继续顺序读取
+		if res.err != nil {
+			var err error
+			if offset, err = db.replayDataFile(builder, dataFile, offset, isNewest); err != nil {
+				return err
+			}
+		}
+		<-tokens
 
-		var oldPos *data.LogRecordPos
-		// 发现墓碑值同样删除对应的索引信息
-		if typ == data.LogRecordDeleted {
-			oldPos, _ = db.index.Delete(key)
-			db.reclaimSize += int64(pos.Size)
+		if res.hinted {
+			db.openStat.HintFileNum++
 		} else {
-			oldPos = db.index.Put(key, pos)
+			db.openStat.DataFileNum++
 		}
-		if oldPos != nil {
-			db.reclaimSize += int64(oldPos.Size)
+		// 当前为活跃文件时需更新文件实例的 WriteOff, 供之后追加写入
+		if isNewest {
+			db.activeFile.WriteOff = offset
 		}
 	}
+	builder.finish()
+	db.openStat.Parallelism = parallelism
+	db.openStat.LoadIndexDuration += time.Since(start)
 
-	// 属于事务提交的记录的相关暂存数据
-	transactionRecords := make(map[uint64][]*data.TransactionRecords)
-	// 临时事务序列号, 更新获取最大值
-	var currentSeqNo uint64 = nonTransactionSeqNo
+	// 完整性检查时记录缺少事务完成标识的事务
+	if db.checkReport != nil {
+		for seqNo, records := range db.pendingTxns {
+			db.checkReport.UnfinishedTxns[seqNo] = len(records)
+		}
+	}
 
-	// 从小到大遍历数据文件 id 顺序更新索引, 保证最终索引记录最新数据信息
-	for i, fileId := range fileIds {
-		// 已通过 hint 文件加载, 无需重复加载
-		if fileId < nonMergeFileId {
-			continue
+	return nil
+}
+
+// 读取数据文件中 offset 位置之后的全部日志记录, 读取到损坏的日志记录时停止, 由调用方处理
+// 除元数据 bucket 外不保留 value, 加载索引无需 value
+func (db *DB) readFileRecords(dataFile *data.DataFile, offset int64, useHint bool) *fileRecords {
+	if useHint {
+		if res := db.readFileHintRecords(dataFile); res != nil {
+			return res
 		}
-		// 获取文件 id 对应的 DataFile 实例
-		var dataFile *data.DataFile
-		if fileId == db.activeFile.FileId {
-			dataFile = db.activeFile
-		} else {
-			dataFile = db.olderFiles[fileId]
+	}
+	res := &fileRecords{offset: offset}
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(res.offset)
+		if err != nil {
+			if err != io.EOF {
+				res.err = err
+			}
+			return res
+		}
+		if logRecord.Bucket != metaBucketId {
+			logRecord.Value = nil
 		}
+		res.records = append(res.records, logRecord)
+		res.positions = append(res.positions, &data.LogRecordPos{
+			Fid:    dataFile.FileId,
+			Offset: res.offset,
+			Size:   uint32(size),
+			Expire: logRecord.Expire,
+		})
+		res.offset += size
+	}
+}
 
-		// 通过 DataFile 实例顺序读取文件的日志记录
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
+// 加载索引的并发度
+func (db *DB) loadIndexParallelism() int {
+	if db.options.LoadIndexParallelism > 0 {
+		return db.options.LoadIndexParallelism
+	}
+	return runtime.NumCPU()
+}
+
+// 从 offset 开始顺序读取数据文件中的日志记录并应用, 返回读取结束的位置
+// isNewest 标识是否为最新的数据文件
+func (db *DB) replayDataFile(builder *indexBuilder, dataFile *data.DataFile, offset int64, isNewest bool) (int64, error) {
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			// 按配置的策略处理损坏的日志记录
+			skip, err := db.recoverCorruptedRecord(dataFile, offset, size, isNewest, err)
 			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
+				return 0, err
 			}
-
-			// 构建内存索引信息并保存
-			logRecordPos := &data.LogRecordPos{Fid: fileId, Offset: offset, Size: uint32(size)}
-
-			// 解析 key, 提取真实 key 和 seq 事务前缀
-			realKey, seqNo := parseLogRecordKey(logRecord.Key)
-
-			// todo 未知：hint文件加载时未更新事务 id, 可能存在问题？
-			// 判断当前日志记录是否属于事务提交
-			if seqNo == nonTransactionSeqNo {
-				// 日志记录属于非事务提交, 直接更新索引
-				// 索引存放的 key 是真实 key
-				updateIndex(realKey, logRecord.Type, logRecordPos)
-			} else {
-				// 日志记录属于事务提交
-				// 读取到带事务完成标识的记录时再统一更新索引
-				if logRecord.Type == data.LogRecordTxnFinished {
-					// 更新相同事务 id 的所有数据对应的索引信息
-					for _, txnRecord := range transactionRecords[seqNo] {
-						updateIndex(txnRecord.Record.Key, txnRecord.Record.Type, txnRecord.Pos)
-					}
-					delete(transactionRecords, seqNo)
-				} else {
-					logRecord.Key = realKey
-					// 暂存用于后续更新索引的相关数据
-					transactionRecords[seqNo] = append(transactionRecords[seqNo], &data.TransactionRecords{
-						Record: logRecord,
-						Pos:    logRecordPos,
-					})
-				}
+			if skip == 0 {
+				return offset, nil
 			}
+			offset += skip
+			continue
+		}
 
-			// 顺便更新序列号, 从而获取最大序列号
-			if seqNo > currentSeqNo {
-				currentSeqNo = seqNo
-			}
+		// 构建内存索引信息并应用
+		builder.apply(logRecord, &data.LogRecordPos{
+			Fid:    dataFile.FileId,
+			Offset: offset,
+			Size:   uint32(size),
+			Expire: logRecord.Expire,
+		})
 
-			// 更新已读取位置偏移
-			offset += size
-		}
+		// 更新已读取位置偏移
+		offset += size
+	}
+}
 
-		// 当前为活跃文件时需更新文件实例的 WriteOff, 供之后追加写入
-		if i == len(fileIds)-1 {
-			db.activeFile.WriteOff = offset
+// 释放全部数据文件并清空内存索引, 用于重新加载数据目录, 调用方需持有写锁
+// 仍被快照引用的文件延迟到快照全部关闭后再关闭
+func (db *DB) resetDataFiles() error {
+	olderFiles := db.getOlderFiles()
+	dataFiles := make([]*data.DataFile, 0, len(olderFiles)+1)
+	for _, dataFile := range olderFiles {
+		dataFiles = append(dataFiles, dataFile)
+	}
+	if db.activeFile != nil {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+	db.olderFiles.Store(nil)
+	db.activeFile = nil
+	for _, dataFile := range dataFiles {
+		if err := db.retireFile(dataFile); err != nil {
+			return err
 		}
 	}
 
-	// 更新事务 id, 确保后续自增获取的新事务 id 唯一
-	db.seqNo = currentSeqNo
-
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	db.index = index.NewIndexer(db.options.IndexType, db.options.DirPath, false)
+	if err := db.resetBuckets(); err != nil {
+		return err
+	}
+	db.seqNo, db.logSeqNo = 0, 0
+	db.totalSize.Store(0)
+	db.reclaimSize.Store(0)
+	db.fileSizes.Clear()
+	db.pendingTxns = nil
 	return nil
 }
 
@@ -644,6 +1141,18 @@ func checkOptions(options Options) error {
 	if options.DataFileMergeRatio < 0 || options.DataFileMergeRatio > 1 {
 		return errors.New("invalid merge ratio, must between 0 and 1")
 	}
+	if options.MergeBytesPerRun < 0 {
+		return errors.New("merge bytes per run must not be negative")
+	}
+	if options.MergeBytesPerSecond < 0 {
+		return errors.New("merge bytes per second must not be negative")
+	}
+	if options.LoadIndexParallelism < 0 {
+		return errors.New("load index parallelism must not be negative")
+	}
+	if options.IndexCheckpointInterval < 0 {
+		return errors.New("index checkpoint interval must not be negative")
+	}
 	if options.FileIOType == fio.MemoryMap && options.DataFileSize > 512*1024*1024 {
 		return errors.New("memory map datafile size should not exceed 512MB")
 	}
@@ -653,17 +1162,35 @@ func checkOptions(options Options) error {
 	if options.SyncStrategy == Threshold && options.BytesPerSync == 0 {
 		return errors.New("SyncStrategy should not never be 0")
 	}
+	if options.ValueThreshold < 0 {
+		return errors.New("value threshold must not be negative")
+	}
+	if options.ValueLogGCRatio < 0 || options.ValueLogGCRatio > 1 {
+		return errors.New("invalid value log gc ratio, must between 0 and 1")
+	}
+	if options.Compression > data.Zlib {
+		return data.ErrUnsupportedCompression
+	}
 	return nil
 }
 
-// 根据索引信息获取 value
+// 根据索引信息获取 value, 分离存储的 value 从 value log 中读取
 func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	logRecord, err := db.readLogRecord(logRecordPos)
+	if err != nil {
+		return nil, err
+	}
+	return db.valueOf(logRecord)
+}
+
+// 根据索引信息读取日志记录, 调用方需持有锁
+func (db *DB) readLogRecord(logRecordPos *data.LogRecordPos) (*data.LogRecord, error) {
 	// 根据文件 id 找到对应的数据文件
 	var dataFile *data.DataFile
 	if db.activeFile.FileId == logRecordPos.Fid {
 		dataFile = db.activeFile
 	} else {
-		dataFile = db.olderFiles[logRecordPos.Fid]
+		dataFile = db.getOlderFiles()[logRecordPos.Fid]
 	}
 	if dataFile == nil {
 		return nil, ErrDataFileNotFound
@@ -681,7 +1208,7 @@ func (db *DB) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error
 		return nil, ErrKeyNotFound
 	}
 
-	return logRecord.Value, nil
+	return logRecord, nil
 }
 
 // 解析 key, 提取真实 key 和 seq 事务前缀
@@ -691,31 +1218,163 @@ func parseLogRecordKey(key []byte) ([]byte, uint64) {
 	return realKey, seqNo
 }
 
-// 加载事务id
-func (db *DB) loadSeqNo() error {
-	// 判断是否存在事务id文件
-	fileName := filepath.Join(db.options.DirPath, data.SeqNoFileName)
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return nil
-	}
-
-	// 打开文件
-	seqNoFile, err := data.OpenSeqNoFile(db.options.DirPath)
+// 加载事务id, 仅用于 B+ 树索引
+// 优先读取索引文件中持久化的事务序列号上限, 以及关闭时写入的事务序列号文件
+// 索引文件中不存在事务序列号上限时为旧版本数据目录, 事务序列号文件可能已过期, 同时读取全部数据文件取最大事务序列号
+func (db *DB) loadSeqNo(fileIds []uint32) error {
+	seqNoLimit, ok, err := db.index.(*index.BPlusTreeIndex).SeqNo()
 	if err != nil {
 		return err
 	}
+	db.seqNo, db.seqNoLimit = seqNoLimit, seqNoLimit
 
-	// 读取事务id
-	record, _, err := seqNoFile.ReadLogRecord(0)
-	if err != nil {
-		return err
+	// 读取事务序列号文件, 同时兼容旧版本的文件名称
+	for _, fileName := range []string{data.SeqNoFileName, legacySeqNoFileName} {
+		seqNo, err := db.readSeqNoFile(fileName)
+		if err != nil {
+			return err
+		}
+		db.seqNo = max(db.seqNo, seqNo)
+	}
+
+	// 索引文件未持久化事务序列号上限时, 事务序列号文件可能为更早关闭时写入的过期值
+	if !ok {
+		return db.loadSeqNoFromDataFiles(fileIds)
 	}
-	seqNo, err := strconv.ParseUint(string(record.Value), 10, 64)
+	return nil
+}
+
+// 读取事务序列号文件中的最大事务序列号, 文件不存在时返回 0
+// 旧版本的事务序列号文件以追加方式写入, 读取全部记录, 尾部未写入完整的记录被忽略
+func (db *DB) readSeqNoFile(fileName string) (uint64, error) {
+	if _, err := os.Stat(filepath.Join(db.options.DirPath, fileName)); os.IsNotExist(err) {
+		return 0, nil
+	}
+	seqNoFile, err := data.OpenSeqNoFileReadOnly(db.options.DirPath, fileName, db.encryptor)
 	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = seqNoFile.Close()
+	}()
+
+	var seqNo uint64 = 0
+	var offset int64 = 0
+	for {
+		record, size, err := seqNoFile.ReadLogRecord(offset)
+		if err == io.EOF || err != nil && offset > 0 {
+			return seqNo, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		offset += size
+		// 旧版本文件名称与 merge 完成标识文件相同, 仅处理事务序列号记录
+		if string(record.Key) != seqNoKey {
+			continue
+		}
+		value, err := strconv.ParseUint(string(record.Value), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		seqNo = max(seqNo, value)
+	}
+}
+
+// 读取全部数据文件, 获取最大的事务序列号
+// 加载日志序列号时已处理最新数据文件尾部损坏的日志记录, 读取到其余损坏的日志记录时返回错误
+func (db *DB) loadSeqNoFromDataFiles(fileIds []uint32) error {
+	for _, fileId := range fileIds {
+		dataFile := db.getOlderFiles()[fileId]
+		if fileId == db.activeFile.FileId {
+			dataFile = db.activeFile
+		}
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			_, seqNo := parseLogRecordKey(logRecord.Key)
+			db.seqNo = max(db.seqNo, seqNo)
+			offset += size
+		}
+	}
+	return nil
+}
+
+// 预分配事务序列号, 超过已持久化的上限时将新的上限持久化到 B+ 树索引中
+// B+ 树索引不读取数据文件加载索引, 崩溃后从上限继续分配, 保证事务序列号不重复
+func (db *DB) reserveSeqNo(seqNo uint64) error {
+	if db.options.IndexType != index.BPTree {
+		return nil
+	}
+	db.seqNoMu.Lock()
+	defer db.seqNoMu.Unlock()
+	if seqNo <= db.seqNoLimit {
+		return nil
+	}
+	seqNoLimit := seqNo + seqNoReserveSize
+	if err := db.index.(*index.BPlusTreeIndex).SetSeqNo(seqNoLimit); err != nil {
 		return err
 	}
+	db.seqNoLimit = seqNoLimit
+	return nil
+}
 
-	db.seqNo = seqNo
-	db.seqNoFileExists = true
+// 丢弃加载索引后仍未读取到完成标识的事务记录, 仅用于可写入的实例
+// 这些事务在崩溃前未完成提交, 此后不会再写入其完成标识, 其日志记录计入无效数据量, 由 merge 回收
+func (db *DB) discardPendingTxns() {
+	for _, records := range db.pendingTxns {
+		for _, txnRecord := range records {
+			pos := txnRecord.Pos
+			db.addFileSize(pos.Fid, int64(pos.Size))
+			reclaim := db.addFileReclaim(pos)
+			db.addBucketSize(txnRecord.Record.Bucket, int64(pos.Size), reclaim)
+		}
+	}
+	db.pendingTxns = nil
+}
+
+// 加载日志序列号
+// 日志序列号随文件 id 单调递增, 从最新的数据文件开始倒序查找首个包含日志序列号的文件即可
+// 最新的数据文件总是被完整读取, 同时按配置的策略处理尾部损坏的日志记录
+func (db *DB) loadLogSeqNo(fileIds []uint32) error {
+	for i := len(fileIds) - 1; i >= 0; i-- {
+		var dataFile *data.DataFile
+		if fileIds[i] == db.activeFile.FileId {
+			dataFile = db.activeFile
+		} else {
+			dataFile = db.getOlderFiles()[fileIds[i]]
+		}
+
+		var offset int64 = 0
+		for {
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				// 按配置的策略处理损坏的日志记录
+				skip, err := db.recoverCorruptedRecord(dataFile, offset, size, i == len(fileIds)-1, err)
+				if err != nil {
+					return err
+				}
+				if skip == 0 {
+					break
+				}
+				offset += skip
+				continue
+			}
+			db.logSeqNo = max(db.logSeqNo, logRecord.LogSeqNo)
+			offset += size
+		}
+		if db.logSeqNo > 0 {
+			return nil
+		}
+	}
 	return nil
 }
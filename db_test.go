@@ -1,14 +1,17 @@
 package xixi_kv
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
 	"github.com/XiXi-2024/xixi-kv/utils"
 	"github.com/gofrs/flock"
 	"github.com/stretchr/testify/assert"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestOpen(t *testing.T) {
@@ -73,7 +76,7 @@ func TestDB_Put(t *testing.T) {
 		assert.Nil(t, err)
 		values = append(values, string(value))
 	}
-	assert.Equal(t, 2, len(db.olderFiles)+1)
+	assert.Equal(t, 2, len(db.getOlderFiles())+1)
 	for i := 0; i < n; i++ {
 		value, err := db.Get(utils.GetTestKey(i))
 		assert.Nil(t, err)
@@ -355,13 +358,75 @@ func TestDB_Backup(t *testing.T) {
 	}
 }
 
+// 备份期间持续写入, 备份为备份时刻的一致性检查点
+func TestDB_Backup2(t *testing.T) {
+	for _, indexType := range []index.IndexType{index.BTree, index.BPTree} {
+		opts := DefaultOptions
+		dir, _ := os.MkdirTemp("", "bitcask-go-backup2")
+		opts.DirPath = dir
+		opts.DataFileSize = 64 * 1024
+		opts.EnableBackgroundMerge = false
+		opts.IndexType = indexType
+		db, err := Open(opts)
+		assert.Nil(t, err)
+		assert.NotNil(t, db)
+
+		for i := 0; i < 1000; i++ {
+			err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			assert.Nil(t, err)
+		}
+
+		// 备份期间并发写入
+		stop := make(chan struct{})
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 1000; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				_ = db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+			}
+		}()
+		backupDir, _ := os.MkdirTemp("", "bitcask-go-backup2-dest")
+		err = db.Backup(backupDir)
+		assert.Nil(t, err)
+		close(stop)
+		<-done
+
+		// 备份目录可直接打开, 包含备份前的全部数据
+		backupOpts := opts
+		backupOpts.DirPath = backupDir
+		backupDB, err := Open(backupOpts)
+		assert.Nil(t, err)
+		for i := 0; i < 1000; i++ {
+			_, err := backupDB.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+		keyNum := len(backupDB.ListKeys())
+		assert.True(t, keyNum >= 1000 && keyNum <= len(db.ListKeys()))
+
+		// 备份之后的写入不影响备份目录
+		err = db.Put([]byte("after-backup"), []byte("value"))
+		assert.Nil(t, err)
+		_, err = backupDB.Get([]byte("after-backup"))
+		assert.Equal(t, ErrKeyNotFound, err)
+
+		_ = backupDB.Close()
+		_ = os.RemoveAll(backupDir)
+		destroyDB(db)
+	}
+}
+
 // 测试完成之后销毁 DB 数据目录
 func destroyDB(db *DB) {
 	if db != nil {
 		if db.activeFile != nil {
 			_ = db.Close()
 		}
-		for _, of := range db.olderFiles {
+		for _, of := range db.getOlderFiles() {
 			if of != nil {
 				_ = of.Close()
 			}
@@ -425,3 +490,322 @@ func BenchmarkDB_Delete(b *testing.B) {
 		_ = db.Delete(keys[i])
 	}
 }
+
+func TestDB_Compression(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-compression")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	opts.DataFileMergeRatio = 0
+	opts.Compression = data.Flate
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1. 压缩写入后正常读取, 磁盘占用小于原始数据
+	value := bytes.Repeat([]byte("xixi-kv compression "), 50)
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), value)
+		assert.Nil(t, err)
+	}
+	assert.True(t, db.Stat().DiskSize < int64(100*len(value)))
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// 2. 关闭压缩后重启, 已压缩的数据仍可读取
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.Compression = data.NoCompression
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(100), value)
+	assert.Nil(t, err)
+	for i := 0; i <= 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	// 3. merge 时按当前配置重新压缩
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.Compression = data.Zlib
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		pos := db.index.Get(iterator.Key())
+		assert.True(t, pos.Size < uint32(len(value)))
+		val, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	iterator.Close()
+	// 关闭最后打开的实例, 等待 merge 后的 hint 文件写入完成再删除数据目录
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 4. 不支持的压缩算法
+	opts.Compression = 100
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+func TestDB_Encryption(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-encryption")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	opts.DataFileMergeRatio = 0
+	oldKey := bytes.Repeat([]byte("o"), 32)
+	keyRing := data.NewKeyRing(1, oldKey)
+	opts.KeyProvider = keyRing
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1. 加密写入后正常读取, 磁盘文件中不包含明文
+	value := []byte("xixi-kv plaintext value")
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), value)
+		assert.Nil(t, err)
+	}
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+	err = db.Close()
+	assert.Nil(t, err)
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err)
+		assert.False(t, bytes.Contains(content, value))
+		assert.False(t, bytes.Contains(content, utils.GetTestKey(10)))
+	}
+
+	// 2. 未配置密钥时无法打开
+	opts.KeyProvider = nil
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+
+	// 3. 轮换密钥并 merge 后, 仅使用新密钥即可读取全部数据
+	opts.KeyProvider = keyRing
+	keyRing.Rotate(2, bytes.Repeat([]byte("n"), 32))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	err = db.Merge()
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	opts.KeyProvider = data.NewKeyRing(2, bytes.Repeat([]byte("n"), 32))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, len(db.ListKeys()))
+	for i := 0; i < 100; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+// 轮换密钥和修改压缩配置后, 无效数据占比未达到阈值时通过 MergeAll 重写全部数据
+func TestDB_MergeAll(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-all")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.EnableBackgroundMerge = false
+	opts.MergeBytesPerRun = 1024
+	keyRing := data.NewKeyRing(1, bytes.Repeat([]byte("o"), 32))
+	opts.KeyProvider = keyRing
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	value := bytes.Repeat([]byte("xixi-kv merge all "), 20)
+	for i := 0; i < 200; i++ {
+		err := db.Put(utils.GetTestKey(i), value)
+		assert.Nil(t, err)
+	}
+	assert.Greater(t, len(db.getOlderFiles()), 1)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 1. 不存在无效数据, merge 跳过
+	keyRing.Rotate(2, bytes.Repeat([]byte("n"), 32))
+	opts.Compression = data.Flate
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+	diskSize := db.Stat().DiskSize
+
+	// 2. 重写全部数据文件, 不受单次重写数据量限制
+	err = db.MergeAll()
+	assert.Nil(t, err)
+	assert.Less(t, db.Stat().DiskSize, diskSize)
+	err = db.Close()
+	assert.Nil(t, err)
+
+	// 3. 仅使用新密钥即可读取全部数据
+	opts.KeyProvider = data.NewKeyRing(2, bytes.Repeat([]byte("n"), 32))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, len(db.ListKeys()))
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+func TestDB_LoadIndexParallel(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-load-parallel")
+	opts.DirPath = dir
+	opts.DataFileSize = 16 * 1024
+	opts.EnableBackgroundMerge = false
+	// 不写入索引检查点, 每次打开均读取数据文件加载索引
+	opts.EnableIndexCheckpoint = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 覆盖写入、删除、跨越多个数据文件的事务和 bucket 数据
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 300; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+			assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(32)))
+		}
+		wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+		assert.Nil(t, err)
+		for i := 0; i < 500; i++ {
+			assert.Nil(t, wb.Put(utils.GetTestKey(1000+i), utils.RandomValue(32)))
+		}
+		assert.Nil(t, wb.Commit())
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	fileIds, err := db.dataFileIds()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	for _, fid := range fileIds {
+		assert.Nil(t, os.RemoveAll(data.GetHintFileName(dir, fid)))
+	}
+
+	// 按文件 id 顺序应用各协程的读取结果, 不同并发度加载得到的数据一致
+	load := func(parallelism int) (*Stat, map[string][]byte, OpenStat) {
+		var openStat OpenStat
+		loadOpts := opts
+		loadOpts.LoadIndexParallelism = parallelism
+		loadOpts.OnOpen = func(stat OpenStat) {
+			openStat = stat
+		}
+		db, err := Open(loadOpts)
+		assert.Nil(t, err)
+		values := make(map[string][]byte)
+		assert.Nil(t, db.Fold(func(key []byte, value []byte) bool {
+			values[string(key)] = value
+			return true
+		}))
+		users, err := db.Bucket("users")
+		assert.Nil(t, err)
+		val, err := users.Get(utils.GetTestKey(0))
+		assert.Nil(t, err)
+		values["users"] = val
+		stat := db.Stat()
+		assert.Nil(t, db.Close())
+		return stat, values, openStat
+	}
+	stat, values, openStat := load(1)
+	assert.Equal(t, 1, openStat.Parallelism)
+	assert.Equal(t, len(fileIds), openStat.DataFileNum)
+	assert.Equal(t, uint(700), stat.KeyNum)
+
+	parallelStat, parallelValues, openStat := load(8)
+	assert.Equal(t, stat, parallelStat)
+	assert.Equal(t, values, parallelValues)
+	assert.Equal(t, 8, openStat.Parallelism)
+	assert.Equal(t, len(fileIds), openStat.DataFileNum)
+	assert.Greater(t, openStat.Duration, time.Duration(0))
+	assert.Greater(t, openStat.LoadIndexDuration, time.Duration(0))
+
+	// 关闭时未写入 hint 文件, 加载结果同样与按 hint 文件加载一致
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for _, fid := range fileIds[:len(fileIds)-1] {
+		db.mu.Lock()
+		db.scheduleFileHint(db.getOlderFiles()[fid])
+		db.mu.Unlock()
+	}
+	assert.Nil(t, db.Close())
+	hintStat, hintValues, openStat := load(0)
+	assert.Equal(t, stat, hintStat)
+	assert.Equal(t, values, hintValues)
+	assert.Equal(t, len(fileIds)-1, openStat.HintFileNum)
+	assert.Equal(t, 1, openStat.DataFileNum)
+}
+
+// 写入备份目录不影响原数据文件
+func TestDB_Backup3(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-backup3")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	// 封存活跃文件, 备份中 id 最大的文件为已封存的数据文件
+	db.mu.Lock()
+	err = db.sync()
+	db.mu.Unlock()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), db.activeFile.WriteOff)
+
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-backup3-dest")
+	defer func() {
+		_ = os.RemoveAll(backupDir)
+	}()
+	err = db.Backup(backupDir)
+	assert.Nil(t, err)
+
+	contents := make(map[string][]byte)
+	names, err := filepath.Glob(filepath.Join(dir, "*"+data.DataFileNameSuffix))
+	assert.Nil(t, err)
+	for _, name := range names {
+		contents[name], err = os.ReadFile(name)
+		assert.Nil(t, err)
+	}
+
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		err := backupDB.Put(utils.GetTestKey(i), []byte("backup"))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, backupDB.Close())
+
+	for name, content := range contents {
+		actual, err := os.ReadFile(name)
+		assert.Nil(t, err)
+		assert.Equal(t, content, actual)
+	}
+}
@@ -2,17 +2,50 @@ package xixi_kv
 
 import (
 	"errors"
+	"fmt"
 )
 
 var (
-	ErrKeyIsEmpty             = errors.New("the key is empty")
-	ErrIndexUpdateFailed      = errors.New("failed to update index")
-	ErrKeyNotFound            = errors.New("key not found in database")
-	ErrDataFileNotFound       = errors.New("data file is not found")
-	ErrDataDirectoryCorrupted = errors.New("the database directory maybe corrupted")
-	ErrExceedMaxBatchNum      = errors.New("exceed the max batch num")
-	ErrMergeIsProgress        = errors.New("merge is in progress, try again later")
-	ErrDatabaseIsUsing        = errors.New("the database directory is used by another process")
-	ErrMergeRatioUnreached    = errors.New("the merge ratio do not reach the option")
-	ErrNoEnoughSpaceForMerge  = errors.New("no enough disk space for merge")
+	ErrKeyIsEmpty               = errors.New("the key is empty")
+	ErrIndexUpdateFailed        = errors.New("failed to update index")
+	ErrKeyNotFound              = errors.New("key not found in database")
+	ErrDataFileNotFound         = errors.New("data file is not found")
+	ErrDataDirectoryCorrupted   = errors.New("the database directory maybe corrupted")
+	ErrExceedMaxBatchNum        = errors.New("exceed the max batch num")
+	ErrMergeIsProgress          = errors.New("merge is in progress, try again later")
+	ErrDatabaseIsUsing          = errors.New("the database directory is used by another process")
+	ErrMergeRatioUnreached      = errors.New("the merge ratio do not reach the option")
+	ErrNoEnoughSpaceForMerge    = errors.New("no enough disk space for merge")
+	ErrInvalidTTL               = errors.New("the ttl must be greater than 0")
+	ErrTxnConflict              = errors.New("transaction conflict, keys read have been modified")
+	ErrTxnDiscarded             = errors.New("transaction has been discarded")
+	ErrSnapshotClosed           = errors.New("the snapshot has been closed")
+	ErrWatcherLagged            = errors.New("the watcher falls too far behind, resume from the last seq no")
+	ErrDirectoryNotEmpty        = errors.New("the target directory is not empty")
+	ErrBackupNotFound           = errors.New("no backup found in the backup directory")
+	ErrBackupCorrupted          = errors.New("the backup is corrupted")
+	ErrDatabaseReadOnly         = errors.New("the database is read-only")
+	ErrReplicationDiverged      = errors.New("the replication stream does not match the local data files")
+	ErrFollowerIndexUnsupported = errors.New("the follower does not support the B+ tree index")
+	ErrBucketNameIsEmpty        = errors.New("the bucket name is empty")
+	ErrBucketNotFound           = errors.New("bucket is not found in database")
+	ErrBucketIndexUnsupported   = errors.New("buckets do not support the B+ tree index")
+	ErrValueLogGCIsProgress     = errors.New("value log gc is in progress, try again later")
+	ErrValueLogUnsupported      = errors.New("replication does not support the value log")
+	ErrDatabaseClosed           = errors.New("the database has been closed")
 )
+
+// CorruptionError 数据文件中存在损坏的日志记录
+type CorruptionError struct {
+	FileId uint32 // 数据文件 id
+	Offset int64  // 损坏的日志记录起始偏移量
+	Err    error  // 读取失败原因
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("data file %09d is corrupted at offset %d: %v", e.FileId, e.Offset, e.Err)
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
@@ -20,6 +20,15 @@ func NewFileIO(fileName string) (*FileIO, error) {
 	return &FileIO{fd: fd}, nil
 }
 
+// NewReadOnlyFileIO 以只读方式打开已存在的文件, 不存在时返回错误
+func NewReadOnlyFileIO(fileName string) (*FileIO, error) {
+	fd, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &FileIO{fd: fd}, nil
+}
+
 func (fio *FileIO) Read(b []byte, offset int64) (int, error) {
 	return fio.fd.ReadAt(b, offset)
 }
@@ -36,6 +45,10 @@ func (fio *FileIO) Close() error {
 	return fio.fd.Close()
 }
 
+func (fio *FileIO) Truncate(size int64) error {
+	return fio.fd.Truncate(size)
+}
+
 func (fio *FileIO) Size() (int64, error) {
 	stat, err := fio.fd.Stat()
 	if err != nil {
@@ -104,6 +104,62 @@ func TestFileIO_Sync(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+// 截断
+func TestFileIO_Truncate(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "a.data")
+	fio, err := NewFileIO(path)
+	defer destroyFile(path)
+	assert.Nil(t, err)
+	assert.NotNil(t, fio)
+
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	err = fio.Truncate(3)
+	assert.Nil(t, err)
+	size, err := fio.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), size)
+
+	// 截断后继续追加写入
+	_, err = fio.Write([]byte("-b"))
+	assert.Nil(t, err)
+	b := make([]byte, 5)
+	_, err = fio.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), b)
+
+	err = fio.Close()
+	assert.Nil(t, err)
+}
+
+func TestNewReadOnlyFileIO(t *testing.T) {
+	path := filepath.Join(os.TempDir(), "a.data")
+	defer destroyFile(path)
+
+	// 文件不存在时不创建
+	_, err := NewReadOnlyFileIO(path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+
+	fio, err := NewFileIO(path)
+	assert.Nil(t, err)
+	_, err = fio.Write([]byte("key-a"))
+	assert.Nil(t, err)
+
+	readOnly, err := NewReadOnlyFileIO(path)
+	assert.Nil(t, err)
+	b := make([]byte, 5)
+	_, err = readOnly.Read(b, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-a"), b)
+	_, err = readOnly.Write([]byte("key-b"))
+	assert.NotNil(t, err)
+
+	assert.Nil(t, readOnly.Close())
+	assert.Nil(t, fio.Close())
+}
+
 // 清除生成的临时文件, 避免影响后续测试结果
 func destroyFile(path string) {
 	if err := os.RemoveAll(path); err != nil {
@@ -5,6 +5,7 @@ import (
 	"github.com/edsrzf/mmap-go"
 	"io"
 	"os"
+	"sync/atomic"
 )
 
 var ErrFileHasBeenClosed = errors.New("file has been closed")
@@ -19,7 +20,7 @@ const dataFileSize = 512 * 1024 * 1024
 type MMap struct {
 	file   *os.File
 	data   mmap.MMap
-	offset int64
+	offset atomic.Int64 // 写入偏移量, 读取活跃文件时与写入并发访问
 }
 
 func NewMMap(fileName string) (*MMap, error) {
@@ -42,10 +43,10 @@ func NewMMap(fileName string) (*MMap, error) {
 	}
 	data, err := mmap.Map(fd, mmap.RDWR, 0)
 	m := &MMap{
-		file:   fd,
-		data:   data,
-		offset: offset,
+		file: fd,
+		data: data,
 	}
+	m.offset.Store(offset)
 	return m, err
 }
 
@@ -54,7 +55,7 @@ func (mmap *MMap) Read(b []byte, offset int64) (int, error) {
 		return 0, ErrFileHasBeenClosed
 	}
 	// 计算实际可读取的字节数
-	bytes := min(len(b), int(mmap.offset-offset))
+	bytes := min(len(b), int(mmap.offset.Load()-offset))
 	if bytes == 0 {
 		return 0, io.EOF
 	}
@@ -66,8 +67,10 @@ func (mmap *MMap) Write(b []byte) (int, error) {
 	if mmap.file == nil {
 		return 0, ErrFileHasBeenClosed
 	}
-	copy(mmap.data[mmap.offset:], b)
-	mmap.offset += int64(len(b))
+	// 先写入数据再更新偏移量, 保证并发读取时不会读取到未写入完成的数据
+	offset := mmap.offset.Load()
+	copy(mmap.data[offset:], b)
+	mmap.offset.Store(offset + int64(len(b)))
 	return len(b), nil
 }
 
@@ -92,7 +95,7 @@ func (mmap *MMap) Close() error {
 		return err
 	}
 	// 关闭文件前将其大小修改为真实大小
-	err = mmap.file.Truncate(mmap.offset)
+	err = mmap.file.Truncate(mmap.offset.Load())
 	if err != nil {
 		return err
 	}
@@ -100,10 +103,22 @@ func (mmap *MMap) Close() error {
 	return err
 }
 
+func (mmap *MMap) Truncate(size int64) error {
+	if mmap.file == nil {
+		return ErrFileHasBeenClosed
+	}
+	// 映射空间大小固定, 仅需清空被截断的数据并回退 offset
+	if offset := mmap.offset.Load(); size < offset {
+		clear(mmap.data[size:offset])
+		mmap.offset.Store(size)
+	}
+	return nil
+}
+
 func (mmap *MMap) Size() (int64, error) {
 	if mmap.file == nil {
 		return 0, ErrFileHasBeenClosed
 	}
 	// 通过维护 offset 实现, 故不允许运行中更换 IO 实现
-	return mmap.offset, nil
+	return mmap.offset.Load(), nil
 }
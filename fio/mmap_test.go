@@ -29,13 +29,13 @@ func TestMMap_Read(t *testing.T) {
 	assert.Nil(t, err)
 	n, err := fio.Write([]byte("aa"))
 	assert.Nil(t, err)
-	mmapIO.offset += int64(n)
+	mmapIO.offset.Add(int64(n))
 	n, err = fio.Write([]byte("bb"))
 	assert.Nil(t, err)
-	mmapIO.offset += int64(n)
+	mmapIO.offset.Add(int64(n))
 	n, err = fio.Write([]byte("cc"))
 	assert.Nil(t, err)
-	mmapIO.offset += int64(n)
+	mmapIO.offset.Add(int64(n))
 
 	size, err := mmapIO.Size()
 	assert.Nil(t, err)
@@ -129,3 +129,26 @@ func TestMMap_Size(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, int64(9), size)
 }
+
+func TestMMap_Truncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mmap_truncate.txt")
+	mmapIO, err := NewMMap(path)
+	assert.Nil(t, err)
+
+	_, err = mmapIO.Write([]byte("key-a"))
+	assert.Nil(t, err)
+	err = mmapIO.Truncate(3)
+	assert.Nil(t, err)
+	size, err := mmapIO.Size()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), size)
+
+	// 截断后继续写入, 关闭后文件大小为真实大小
+	_, err = mmapIO.Write([]byte("-b"))
+	assert.Nil(t, err)
+	err = mmapIO.Close()
+	assert.Nil(t, err)
+	content, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("key-b"), content)
+}
@@ -26,6 +26,8 @@ type ReadWriter interface {
 	Close() error
 
 	Size() (int64, error)
+
+	Truncate(int64) error
 }
 
 // NewReadWriter 根据配置创建具体的文件 IO 实现
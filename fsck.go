@@ -0,0 +1,233 @@
+package xixi_kv
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/gofrs/flock"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CheckReport 数据目录完整性检查结果
+type CheckReport struct {
+	Stat                              // 按当前数据文件打开后 DB.Stat 返回的统计信息
+	Corruptions    []*CorruptionError // 损坏的日志记录
+	HintErrors     []error            // hint 文件中与数据文件不一致的索引信息
+	UnfinishedTxns map[uint64]int     // 缺少事务完成标识的事务 id 及其日志记录数量
+	MergeDir       string             // 残留的 merge 临时目录, 为空表示不存在
+	MergeFinished  bool               // 残留的 merge 是否已完成, 已完成时下次打开会安装 merge 结果
+}
+
+// Healthy 数据目录是否不存在任何问题
+func (r *CheckReport) Healthy() bool {
+	return len(r.Corruptions) == 0 && len(r.HintErrors) == 0 &&
+		len(r.UnfinishedTxns) == 0 && r.MergeDir == ""
+}
+
+// Check 离线检查数据目录的完整性, 不修改任何数据文件
+// 逐条读取并校验日志记录, 校验 hint 文件索引信息, 并检查未完成的事务和残留的 merge 临时目录
+func Check(options Options) (*CheckReport, error) {
+	db, err := openForCheck(options)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeForCheck()
+	return db.checkReport, nil
+}
+
+// Repair 将数据目录中全部有效数据重写到新的目录 targetDir, 并返回原数据目录的检查结果
+// 损坏的日志记录、未完成的事务和残留的 merge 临时目录均被丢弃, 目标目录需不存在或为空
+func Repair(options Options, targetDir string) (*CheckReport, error) {
+	if entries, err := os.ReadDir(targetDir); err == nil && len(entries) > 0 {
+		return nil, ErrDirectoryNotEmpty
+	}
+
+	db, err := openForCheck(options)
+	if err != nil {
+		return nil, err
+	}
+	defer db.closeForCheck()
+
+	targetOptions := options
+	targetOptions.DirPath = targetDir
+	targetOptions.EnableBackgroundMerge = false
+	target, err := Open(targetOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// 依次重写默认 bucket 和各命名 bucket 的最新数据
+	if err := repairIndex(db, target, db.index, defaultBucketId); err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	for name, b := range db.buckets {
+		targetBucket, err := target.Bucket(name)
+		if err == nil {
+			err = repairIndex(db, target, b.index, targetBucket.id)
+		}
+		if err != nil {
+			_ = target.Close()
+			return nil, err
+		}
+	}
+	if err := target.Sync(); err != nil {
+		_ = target.Close()
+		return nil, err
+	}
+	return db.checkReport, target.Close()
+}
+
+// 按索引顺序将最新数据重写到目标数据库的 bucket 中, 保留过期时间
+func repairIndex(db, target *DB, idx index.Indexer, bucketId uint32) error {
+	now := time.Now().UnixNano()
+	iterator := idx.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		pos := iterator.Value()
+		if pos.IsExpired(now) {
+			continue
+		}
+		value, err := db.getValueByPosition(pos)
+		if err != nil {
+			return err
+		}
+		if err := target.put(bucketId, iterator.Key(), value, pos.Expire); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 以只读方式加载数据目录, 构建内存索引并记录检查结果
+func openForCheck(options Options) (*DB, error) {
+	if err := checkOptions(options); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(options.DirPath); err != nil {
+		return nil, err
+	}
+	// 内存映射 IO 打开时会扩展文件大小, 固定使用标准文件 IO
+	options.FileIOType = fio.StandardFIO
+
+	// 获取共享文件锁, 避免检查过程中数据目录被写入
+	fileLock := flock.New(filepath.Join(options.DirPath, fileLockName))
+	hold, err := fileLock.TryRLock()
+	if err != nil {
+		return nil, err
+	}
+	if !hold {
+		return nil, ErrDatabaseIsUsing
+	}
+
+	// 固定使用内存索引, 避免创建 B+ 树索引文件
+	options.IndexType = index.BTree
+	db := &DB{
+		options:  options,
+		mu:       new(sync.RWMutex),
+		index:    index.NewIndexer(options.IndexType, options.DirPath, false),
+		fileLock: fileLock,
+		vlog:     newValueLog(true),
+		checkReport: &CheckReport{
+			UnfinishedTxns: make(map[uint64]int),
+		},
+	}
+	if options.KeyProvider != nil {
+		db.encryptor = data.NewEncryptor(options.Cipher, options.KeyProvider)
+	}
+
+	files, err := db.loadDataFiles()
+	if err == nil {
+		err = db.loadIndexFromDataFiles(files, 0, 0)
+	}
+	if err == nil {
+		err = db.checkHintFile()
+	}
+	if err != nil {
+		db.closeForCheck()
+		return nil, err
+	}
+
+	// 检查残留的 merge 临时目录
+	if _, err := os.Stat(db.getMergePath()); err == nil {
+		db.checkReport.MergeDir = db.getMergePath()
+		_, err := os.Stat(filepath.Join(db.getMergePath(), data.MergeFinishedFileName))
+		db.checkReport.MergeFinished = err == nil
+	}
+
+	db.checkReport.Stat = *db.Stat()
+	return db, nil
+}
+
+// 校验 hint 文件中的索引信息是否指向对应 key 的日志记录
+func (db *DB) checkHintFile() error {
+	hintPath := filepath.Join(db.options.DirPath, data.HintFileName)
+	if _, err := os.Stat(hintPath); os.IsNotExist(err) {
+		return nil
+	}
+	hintFile, err := data.OpenHintFile(db.options.DirPath, db.encryptor)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	report := db.checkReport
+	var offset int64 = 0
+	for {
+		hintRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err != nil {
+			if err != io.EOF {
+				report.HintErrors = append(report.HintErrors,
+					fmt.Errorf("hint file is corrupted at offset %d: %w", offset, err))
+			}
+			return nil
+		}
+		offset += size
+
+		pos := data.DecodeLogRecordPos(hintRecord.Value)
+		var dataFile *data.DataFile
+		if db.activeFile != nil && db.activeFile.FileId == pos.Fid {
+			dataFile = db.activeFile
+		} else {
+			dataFile = db.getOlderFiles()[pos.Fid]
+		}
+		if dataFile == nil {
+			report.HintErrors = append(report.HintErrors,
+				fmt.Errorf("hint of key %q points to missing data file %09d", hintRecord.Key, pos.Fid))
+			continue
+		}
+		logRecord, recordSize, err := dataFile.ReadLogRecord(pos.Offset)
+		if err != nil {
+			report.HintErrors = append(report.HintErrors,
+				fmt.Errorf("hint of key %q points to unreadable record in data file %09d at offset %d: %w",
+					hintRecord.Key, pos.Fid, pos.Offset, err))
+			continue
+		}
+		realKey, _ := parseLogRecordKey(logRecord.Key)
+		if !bytes.Equal(realKey, hintRecord.Key) || logRecord.Bucket != hintRecord.Bucket || recordSize != int64(pos.Size) {
+			report.HintErrors = append(report.HintErrors,
+				fmt.Errorf("hint of key %q mismatches record in data file %09d at offset %d",
+					hintRecord.Key, pos.Fid, pos.Offset))
+		}
+	}
+}
+
+// 关闭离线检查打开的数据文件并释放文件锁
+func (db *DB) closeForCheck() {
+	if db.activeFile != nil {
+		_ = db.activeFile.Close()
+	}
+	for _, file := range db.getOlderFiles() {
+		_ = file.Close()
+	}
+	_ = db.vlog.close()
+	_ = db.fileLock.Unlock()
+}
@@ -0,0 +1,117 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-check")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 20; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	err = db.Merge()
+	assert.Nil(t, err)
+	for i := 20; i < 30; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+	}
+	stat := db.Stat()
+	// merge 执行统计信息不持久化
+	stat.Merge = MergeStat{}
+
+	// 1. 数据库打开时无法检查
+	_, err = Check(opts)
+	assert.Equal(t, ErrDatabaseIsUsing, err)
+
+	// 2. 正常数据目录检查通过, 统计信息与 Stat 一致
+	err = db.Close()
+	assert.Nil(t, err)
+	report, err := Check(opts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	assert.Equal(t, *stat, report.Stat)
+
+	// 3. 存在损坏的日志记录、未完成的事务和残留的 merge 临时目录
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	pos := db.index.Get(utils.GetTestKey(50))
+	_, err = db.appendLogRecord(&data.LogRecord{
+		Key:   logRecordKeyWithSeq(utils.GetTestKey(200), 99),
+		Value: utils.RandomValue(24),
+		Type:  data.LogRecordNormal,
+	})
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	fileName := data.GetDataFileName(dir, pos.Fid)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[pos.Offset+int64(pos.Size)-1] ^= 0xff
+	err = os.WriteFile(fileName, content, 0644)
+	assert.Nil(t, err)
+	err = os.MkdirAll(db.getMergePath(), os.ModePerm)
+	assert.Nil(t, err)
+	defer func() {
+		_ = os.RemoveAll(db.getMergePath())
+	}()
+
+	report, err = Check(opts)
+	assert.Nil(t, err)
+	assert.False(t, report.Healthy())
+	assert.Equal(t, 1, len(report.Corruptions))
+	assert.Equal(t, pos.Fid, report.Corruptions[0].FileId)
+	assert.Equal(t, pos.Offset, report.Corruptions[0].Offset)
+	assert.Equal(t, 1, report.UnfinishedTxns[99])
+	assert.Equal(t, db.getMergePath(), report.MergeDir)
+	assert.False(t, report.MergeFinished)
+	// hint 文件中对应的索引信息指向损坏的日志记录
+	assert.Equal(t, 1, len(report.HintErrors))
+	// 检查不修改数据文件
+	after, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, content, after)
+
+	// 4. 修复后新目录中仅包含有效数据
+	target, _ := os.MkdirTemp("", "bitcask-go-repair")
+	defer func() {
+		_ = os.RemoveAll(target)
+	}()
+	_, err = Repair(opts, target)
+	assert.Nil(t, err)
+	targetOpts := opts
+	targetOpts.DirPath = target
+	report, err = Check(targetOpts)
+	assert.Nil(t, err)
+	assert.True(t, report.Healthy())
+	assert.Equal(t, uint(79), report.KeyNum)
+	repaired, err := Open(targetOpts)
+	assert.Nil(t, err)
+	_, err = repaired.Get(utils.GetTestKey(50))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = repaired.Get(utils.GetTestKey(51))
+	assert.Nil(t, err)
+	err = repaired.Close()
+	assert.Nil(t, err)
+
+	// 目标目录非空
+	_, err = Repair(opts, target)
+	assert.Equal(t, ErrDirectoryNotEmpty, err)
+}
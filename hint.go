@@ -0,0 +1,286 @@
+package xixi_kv
+
+import (
+	"encoding/binary"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+const (
+	// hint 文件尾部记录的 key
+	hintTrailerKey = "hint.trailer"
+
+	// 计算数据文件尾部校验值时读取的最大长度
+	hintTailSize = 4096
+
+	// 写入 hint 文件时的缓冲区大小
+	hintBufferSize = 64 * 1024
+)
+
+// hint 文件尾部记录, 用于判断 hint 文件是否完整且与数据文件一致
+// 数据文件被 merge 重写或截断后, 原 hint 文件视为过期
+type hintTrailer struct {
+	fileSize int64  // 数据文件大小
+	count    uint64 // hint 记录数量
+	tailCRC  uint32 // 数据文件末尾至多 hintTailSize 字节的校验值
+}
+
+// 数据文件封存后在后台为其写入 hint 文件, 调用方需持有写锁
+// 只读实例、离线检查和 B+ 树索引无需从数据文件加载索引, 不写入
+// 写入协程随数据库关闭而退出, Close 等待其结束
+func (db *DB) scheduleFileHint(dataFile *data.DataFile) {
+	if db.readOnly || db.checkReport != nil || db.options.IndexType == index.BPTree {
+		return
+	}
+	select {
+	case <-db.closedChan:
+		return
+	default:
+	}
+	// 通过快照持有数据文件, 避免写入期间被 merge 关闭
+	snap := db.newFileSnapshot()
+	db.hints.Add(1)
+	go func() {
+		defer db.hints.Done()
+		defer func() {
+			_ = snap.Close()
+		}()
+		// 串行写入, 同一文件 id 的 hint 文件不会被同时写入
+		db.hintMu.Lock()
+		defer db.hintMu.Unlock()
+		// 写入失败不影响数据, 启动时改为读取数据文件加载索引
+		_ = db.writeFileHint(dataFile)
+	}()
+}
+
+// 读取已封存的数据文件, 写入对应的 hint 文件
+// 每条日志记录对应一条 hint 记录, 包含 key、位置信息、类型、日志序列号和所属 bucket
+func (db *DB) writeFileHint(dataFile *data.DataFile) (err error) {
+	// 数据文件已被 merge 替换时无需写入, 避免删除为重写后的文件写入的 hint 文件
+	if !db.isOlderFile(dataFile) {
+		return ErrDataFileNotFound
+	}
+	dirPath := db.options.DirPath
+	fileName := data.GetHintFileName(dirPath, dataFile.FileId)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	hintFile, err := data.OpenDataHintFile(dirPath, dataFile.FileId, db.encryptor)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = hintFile.Close()
+		if err != nil {
+			_ = os.Remove(fileName)
+		}
+	}()
+
+	var offset int64 = 0
+	var count uint64 = 0
+	buf := make([]byte, 0, hintBufferSize)
+	for {
+		logRecord, size, err := dataFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		encRecord, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+			Key: logRecord.Key,
+			Value: data.EncodeLogRecordPos(&data.LogRecordPos{
+				Fid:    dataFile.FileId,
+				Offset: offset,
+				Size:   uint32(size),
+				Expire: logRecord.Expire,
+			}),
+			Type:     logRecord.Type,
+			LogSeqNo: logRecord.LogSeqNo,
+			Bucket:   logRecord.Bucket,
+		})
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encRecord...)
+		if len(buf) >= hintBufferSize {
+			// 数据库已关闭时放弃写入, 删除未完成的 hint 文件
+			select {
+			case <-db.closedChan:
+				return ErrDatabaseClosed
+			default:
+			}
+			if err := hintFile.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		offset += size
+		count++
+	}
+
+	tailCRC, err := dataFileTailCRC(dataFile, offset)
+	if err != nil {
+		return err
+	}
+	trailer := &hintTrailer{fileSize: offset, count: count, tailCRC: tailCRC}
+	encTrailer, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(hintTrailerKey),
+		Value: trailer.encode(),
+	})
+	if err != nil {
+		return err
+	}
+	if err := hintFile.Write(buf); err != nil {
+		return err
+	}
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
+
+	// 持有锁时写入尾部记录, 保证此时数据文件未被 merge 替换, 此后替换时由 merge 删除 hint 文件
+	db.mu.RLock()
+	if db.getOlderFiles()[dataFile.FileId] != dataFile {
+		db.mu.RUnlock()
+		return ErrDataFileNotFound
+	}
+	err = hintFile.Write(encTrailer)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return hintFile.Sync()
+}
+
+// 判断数据文件是否仍为当前的旧数据文件
+func (db *DB) isOlderFile(dataFile *data.DataFile) bool {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.getOlderFiles()[dataFile.FileId] == dataFile
+}
+
+// 通过 hint 文件读取数据文件中的日志记录, hint 文件不可用时返回 nil, 调用方需改为读取数据文件
+func (db *DB) readFileHintRecords(dataFile *data.DataFile) *fileRecords {
+	hints := db.readFileHint(dataFile)
+	if hints == nil {
+		return nil
+	}
+	res := &fileRecords{hinted: true}
+	for _, hint := range hints {
+		pos := data.DecodeLogRecordPos(hint.Value)
+		logRecord := &data.LogRecord{
+			Key:      hint.Key,
+			Type:     hint.Type,
+			Expire:   pos.Expire,
+			LogSeqNo: hint.LogSeqNo,
+			Bucket:   hint.Bucket,
+		}
+		// 元数据 bucket 的日志记录需读取 value 注册 bucket, 读取失败时改为读取数据文件
+		if hint.Bucket == metaBucketId {
+			var err error
+			if logRecord, _, err = dataFile.ReadLogRecord(pos.Offset); err != nil {
+				return nil
+			}
+		}
+		res.records = append(res.records, logRecord)
+		res.positions = append(res.positions, pos)
+	}
+	return res
+}
+
+// 读取数据文件对应的 hint 文件, 返回不包含尾部记录的全部 hint 记录
+// hint 文件不存在、不完整、已损坏或与数据文件不一致时返回 nil
+func (db *DB) readFileHint(dataFile *data.DataFile) []*data.LogRecord {
+	dirPath := db.options.DirPath
+	if _, err := os.Stat(data.GetHintFileName(dirPath, dataFile.FileId)); err != nil {
+		return nil
+	}
+	hintFile, err := data.OpenDataHintFileReadOnly(dirPath, dataFile.FileId, db.encryptor)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = hintFile.Close()
+	}()
+
+	var hints []*data.LogRecord
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		hints = append(hints, logRecord)
+		offset += size
+	}
+
+	// 最后一条记录为尾部记录
+	if len(hints) == 0 || string(hints[len(hints)-1].Key) != hintTrailerKey {
+		return nil
+	}
+	trailer := decodeHintTrailer(hints[len(hints)-1].Value)
+	hints = hints[:len(hints)-1]
+	if trailer == nil || trailer.count != uint64(len(hints)) {
+		return nil
+	}
+	fileSize, err := dataFile.ReadWriter.Size()
+	if err != nil || fileSize != trailer.fileSize {
+		return nil
+	}
+	tailCRC, err := dataFileTailCRC(dataFile, fileSize)
+	if err != nil || tailCRC != trailer.tailCRC {
+		return nil
+	}
+	return hints
+}
+
+// 删除数据文件对应的 hint 文件
+func removeFileHint(dirPath string, fileId uint32) error {
+	if err := os.Remove(data.GetHintFileName(dirPath, fileId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 计算数据文件末尾至多 hintTailSize 字节的校验值
+func dataFileTailCRC(dataFile *data.DataFile, fileSize int64) (uint32, error) {
+	n := min(fileSize, hintTailSize)
+	buf := make([]byte, n)
+	if n > 0 {
+		if _, err := dataFile.ReadWriter.Read(buf, fileSize-n); err != nil {
+			return 0, err
+		}
+	}
+	return crc32.ChecksumIEEE(buf), nil
+}
+
+// 编码尾部记录
+func (t *hintTrailer) encode() []byte {
+	buf := binary.AppendVarint(nil, t.fileSize)
+	buf = binary.AppendUvarint(buf, t.count)
+	return binary.LittleEndian.AppendUint32(buf, t.tailCRC)
+}
+
+// 解码尾部记录, 格式不合法时返回 nil
+func decodeHintTrailer(buf []byte) *hintTrailer {
+	fileSize, n := binary.Varint(buf)
+	if n <= 0 {
+		return nil
+	}
+	buf = buf[n:]
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || len(buf[n:]) != 4 {
+		return nil
+	}
+	return &hintTrailer{
+		fileSize: fileSize,
+		count:    count,
+		tailCRC:  binary.LittleEndian.Uint32(buf[n:]),
+	}
+}
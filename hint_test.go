@@ -0,0 +1,191 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_FileHint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	// 不写入索引检查点, 每次打开均通过 hint 文件或数据文件加载索引
+	opts.EnableIndexCheckpoint = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 写入普通数据、删除、过期数据、事务和 bucket 数据
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1000), utils.RandomValue(64), time.Hour))
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(2000+i), utils.RandomValue(64)))
+	}
+	assert.Greater(t, db.Stat().DataFileNum, uint(3))
+	activeFid := db.activeFile.FileId
+	assert.Nil(t, db.Close())
+
+	// 1. 关闭时等待 hint 文件写入完成, 每个旧数据文件均有对应的 hint 文件
+	for fid := uint32(0); fid < activeFid; fid++ {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+	_, err = os.Stat(data.GetHintFileName(dir, activeFid))
+	assert.True(t, os.IsNotExist(err))
+
+	// 暂时移除 hint 文件, 读取数据文件加载索引作为对照
+	for fid := uint32(0); fid < activeFid; fid++ {
+		assert.Nil(t, os.Rename(data.GetHintFileName(dir, fid), data.GetHintFileName(dir, fid)+".bak"))
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	stat := db.Stat()
+	assert.Nil(t, db.Close())
+	for fid := uint32(0); fid < activeFid; fid++ {
+		assert.Nil(t, os.Rename(data.GetHintFileName(dir, fid)+".bak", data.GetHintFileName(dir, fid)))
+	}
+
+	// 2. 通过 hint 文件加载索引, 统计信息与读取数据文件一致
+	// 损坏旧数据文件中的 value, hint 可用时不读取数据文件, 可正常打开
+	corruptFile(t, data.GetDataFileName(dir, 1), 100)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, stat, db.Stat())
+	assert.Nil(t, db.Close())
+	corruptFile(t, data.GetDataFileName(dir, 1), 100)
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i := 100; i < 600; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	_, err = db.Get(utils.GetTestKey(50))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.NotZero(t, db.index.Get(utils.GetTestKey(1000)).Expire)
+	users, err = db.Bucket("users")
+	assert.Nil(t, err)
+	_, err = users.Get(utils.GetTestKey(50))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// 3. hint 文件不完整或与数据文件不一致时忽略, 读取数据文件加载索引
+	hint, _ := os.ReadFile(data.GetHintFileName(dir, 2))
+	assert.Nil(t, os.WriteFile(data.GetHintFileName(dir, 2), hint[:len(hint)-1], os.ModePerm))
+	other, _ := os.ReadFile(data.GetHintFileName(dir, 4))
+	assert.Nil(t, os.WriteFile(data.GetHintFileName(dir, 3), other, os.ModePerm))
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, stat, db.Stat())
+	assert.Nil(t, db.Close())
+
+	// 数据文件尾部已变化时同样忽略 hint 文件, 尾部损坏的旧数据文件按恢复策略打开失败
+	fileInfo, _ := os.Stat(data.GetDataFileName(dir, 1))
+	corruptFile(t, data.GetDataFileName(dir, 1), fileInfo.Size()-1)
+	db, err = Open(opts)
+	assert.ErrorIs(t, err, data.ErrInvalidCRC)
+}
+
+func TestDB_FileHint_Merge(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hint-merge")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 300; i++ {
+			values[i] = utils.RandomValue(64)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+
+	// merge 复用被替换文件的 id, 原 hint 文件被删除并为重写后的文件重新写入
+	assert.Nil(t, db.Merge())
+	for i := 0; i < 300; i++ {
+		values[i] = utils.RandomValue(64)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	fileIds, err := db.dataFileIds()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+	for _, fid := range fileIds[:len(fileIds)-1] {
+		_, err := os.Stat(data.GetHintFileName(dir, fid))
+		assert.Nil(t, err)
+	}
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+}
+
+// 翻转文件中指定位置的字节
+func corruptFile(t *testing.T, fileName string, offset int64) {
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	buf[offset] ^= 0xff
+	assert.Nil(t, os.WriteFile(fileName, buf, os.ModePerm))
+}
+
+// 数据库关闭后不再写入 hint 文件, 正在写入的 hint 文件被放弃
+func TestDB_FileHint_Close(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-hint-close")
+	opts.DirPath = dir
+	opts.DataFileSize = 256 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 12000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(16)))
+	}
+	db.hints.Wait()
+	db.mu.RLock()
+	sealedFile := db.getOlderFiles()[0]
+	db.mu.RUnlock()
+	assert.NotNil(t, sealedFile)
+	hintFileName := data.GetHintFileName(dir, sealedFile.FileId)
+	assert.Nil(t, os.Remove(hintFileName))
+
+	close(db.closedChan)
+	db.mu.Lock()
+	db.scheduleFileHint(sealedFile)
+	db.mu.Unlock()
+	db.hints.Wait()
+	_, err = os.Stat(hintFileName)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, ErrDatabaseClosed, db.writeFileHint(sealedFile))
+	_, err = os.Stat(hintFileName)
+	assert.True(t, os.IsNotExist(err))
+}
@@ -1,17 +1,25 @@
 package index
 
 import (
+	"encoding/binary"
 	"github.com/XiXi-2024/xixi-kv/data"
 	"go.etcd.io/bbolt"
+	"io"
 	"path/filepath"
 )
 
-// 索引文件全名
-const bptreeIndexFileName = "bptree-index"
+// BPTreeIndexFileName 索引文件全名
+const BPTreeIndexFileName = "bptree-index"
 
 // Bucket 名称
 var indexBucketName = []byte("bitcask-index")
 
+// 元数据 Bucket 名称, 与索引分开存放, 不影响索引的遍历和计数
+var metaBucketName = []byte("bitcask-meta")
+
+// 事务序列号在元数据 Bucket 中的 key
+var seqNoKey = []byte("seq-no")
+
 // BPlusTreeIndex 可持久化 B+ 树索引实现
 // 底层库支持并发访问, 无需加锁
 // https://github.com/etcd-io/bbolt
@@ -26,7 +34,7 @@ func NewBPlusTree(dirPath string, syncWrites bool) *BPlusTreeIndex {
 	// 可自定义配置项
 	opts.NoSync = !syncWrites
 	// 打开索引文件并创建索引实例, 后续将索引持久化到磁盘中
-	bptree, err := bbolt.Open(filepath.Join(dirPath, bptreeIndexFileName), 0644, opts)
+	bptree, err := bbolt.Open(filepath.Join(dirPath, BPTreeIndexFileName), 0644, opts)
 	if err != nil {
 		panic("failed to open bptree")
 	}
@@ -103,6 +111,66 @@ func (bpt *BPlusTreeIndex) Size() int {
 	return size
 }
 
+// SeqNo 获取持久化在索引文件中的事务序列号, 未持久化时 ok 为 false
+func (bpt *BPlusTreeIndex) SeqNo() (seqNo uint64, ok bool, err error) {
+	err = bpt.tree.View(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(metaBucketName)
+		if bucket == nil {
+			return nil
+		}
+		if value := bucket.Get(seqNoKey); len(value) == 8 {
+			seqNo, ok = binary.BigEndian.Uint64(value), true
+		}
+		return nil
+	})
+	return seqNo, ok, err
+}
+
+// SetSeqNo 将事务序列号持久化到索引文件中
+func (bpt *BPlusTreeIndex) SetSeqNo(seqNo uint64) error {
+	return bpt.tree.Update(func(tx *bbolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(metaBucketName)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(seqNoKey, binary.BigEndian.AppendUint64(nil, seqNo))
+	})
+}
+
+// BPTreeBackup B+ 树索引在某一时刻的只读副本
+type BPTreeBackup struct {
+	tx *bbolt.Tx
+}
+
+// BeginBackup 开启只读事务, 获取当前时刻的索引副本, 使用完成后必须关闭
+func (bpt *BPlusTreeIndex) BeginBackup() (*BPTreeBackup, error) {
+	tx, err := bpt.tree.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &BPTreeBackup{tx: tx}, nil
+}
+
+// FileName 索引文件名称
+func (b *BPTreeBackup) FileName() string {
+	return BPTreeIndexFileName
+}
+
+// Size 索引副本大小
+func (b *BPTreeBackup) Size() int64 {
+	return b.tx.Size()
+}
+
+// WriteTo 将索引副本写入 w
+func (b *BPTreeBackup) WriteTo(w io.Writer) (int64, error) {
+	return b.tx.WriteTo(w)
+}
+
+// Close 结束只读事务
+func (b *BPTreeBackup) Close() error {
+	return b.tx.Rollback()
+}
+
 func (bpt *BPlusTreeIndex) Close() error {
 	return bpt.tree.Close()
 }
@@ -59,9 +59,22 @@ func (bt *BTreeIndex) Delete(key []byte) (*data.LogRecordPos, bool) {
 }
 
 func (bt *BTreeIndex) Size() int {
+	bt.lock.RLock()
+	defer bt.lock.RUnlock()
 	return bt.tree.Len()
 }
 
+// Clone 复制索引, 复制后两者互不影响
+// 底层以写时复制的方式共享节点, 复制本身仅为常数开销
+func (bt *BTreeIndex) Clone() *BTreeIndex {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	return &BTreeIndex{
+		tree: bt.tree.Clone(),
+		lock: new(sync.RWMutex),
+	}
+}
+
 func (bt *BTreeIndex) Close() error {
 	return nil
 }
@@ -104,3 +104,25 @@ func TestBTree_Iterator(t *testing.T) {
 		assert.NotNil(t, iter5.Key())
 	}
 }
+
+// 复制
+func TestBTree_Clone(t *testing.T) {
+	bt := NewBTree()
+	bt.Put([]byte("a"), &data.LogRecordPos{Fid: 1, Offset: 1})
+	bt.Put([]byte("b"), &data.LogRecordPos{Fid: 1, Offset: 2})
+
+	clone := bt.Clone()
+	assert.Equal(t, 2, clone.Size())
+
+	// 复制后两者的修改互不影响
+	bt.Put([]byte("a"), &data.LogRecordPos{Fid: 2, Offset: 10})
+	bt.Delete([]byte("b"))
+	clone.Put([]byte("c"), &data.LogRecordPos{Fid: 3, Offset: 3})
+
+	assert.Equal(t, int64(1), clone.Get([]byte("a")).Offset)
+	assert.NotNil(t, clone.Get([]byte("b")))
+	assert.Nil(t, bt.Get([]byte("c")))
+	assert.Equal(t, int64(10), bt.Get([]byte("a")).Offset)
+	assert.Equal(t, 1, bt.Size())
+	assert.Equal(t, 3, clone.Size())
+}
@@ -0,0 +1,507 @@
+package xixi_kv
+
+import (
+	"encoding/binary"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// 索引检查点首条记录的 key
+	indexCheckpointHeaderKey = "checkpoint.header"
+
+	// 索引检查点尾部记录的 key
+	indexCheckpointTrailerKey = "checkpoint.trailer"
+)
+
+// 索引检查点, 持久化内存索引及加载索引时维护的统计信息
+// 记录覆盖到的最新数据文件 id 和位置, 启动时加载检查点后仅需读取之后写入的日志记录
+// 覆盖的数据文件被 merge 替换、截断或修改后, 检查点视为过期
+type indexCheckpoint struct {
+	fileId      uint32                   // 覆盖的最新数据文件 id
+	offset      int64                    // 覆盖到该数据文件中的位置
+	seqNo       uint64                   // 事务序列号
+	logSeqNo    uint64                   // 日志序列号
+	totalSize   int64                    // 数据文件总数据量, 单位字节
+	reclaimSize int64                    // 无效数据量, 单位字节
+	files       []indexCheckpointFile    // 覆盖的全部数据文件, 按文件 id 从小到大排列
+	buckets     []indexCheckpointBucket  // 全部 bucket, 包含元数据 bucket, 不包含默认 bucket
+	entries     []indexCheckpointEntry   // 全部 bucket 的索引信息
+	dataFiles   []*data.DataFile         // 覆盖的数据文件实例, 与 files 一一对应, 仅用于写入
+	indexes     map[uint32]index.Indexer // 全部 bucket 内存索引的副本, 仅用于写入
+}
+
+// 索引检查点覆盖的数据文件
+type indexCheckpointFile struct {
+	fileId      uint32
+	size        int64  // 文件大小, 最新数据文件为覆盖到的位置
+	tailCRC     uint32 // 文件 size 位置前至多 hintTailSize 字节的校验值
+	totalSize   int64  // 数据量, 单位字节
+	reclaimSize int64  // 无效数据量, 单位字节
+}
+
+// 索引检查点中的 bucket
+type indexCheckpointBucket struct {
+	id          uint32
+	name        string // bucket 名称, 元数据损坏的 bucket 为空
+	totalSize   int64  // 数据量, 单位字节
+	reclaimSize int64  // 无效数据量, 单位字节
+}
+
+// 索引检查点中的一条索引信息
+type indexCheckpointEntry struct {
+	bucketId uint32
+	key      []byte
+	pos      *data.LogRecordPos
+}
+
+// 是否写入和加载索引检查点
+// 只读实例不修改数据目录, 复制从节点的未完成事务不在 DB 中暂存, 离线检查需读取全部数据文件, B+ 树索引本身已持久化
+func (db *DB) indexCheckpointEnabled() bool {
+	return db.options.EnableIndexCheckpoint && !db.readOnly && db.checkReport == nil &&
+		db.options.IndexType != index.BPTree
+}
+
+// 后台按配置的间隔写入索引检查点, 缩短崩溃后重启时加载索引的耗时
+func (db *DB) backgroundIndexCheckpoint() {
+	defer db.indexCheckpoints.Done()
+	ticker := time.NewTicker(db.options.IndexCheckpointInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closedChan:
+			return
+		case <-ticker.C:
+			// 写入失败不影响数据, 启动时改为读取数据文件加载索引
+			_ = db.checkpointIndex()
+		}
+	}
+}
+
+// 写入索引检查点
+// 仅在暂停写入并持有读锁期间复制索引和获取文件引用, 之后的遍历、编码和写入不阻塞读写
+func (db *DB) checkpointIndex() error {
+	if !db.indexCheckpointEnabled() {
+		return nil
+	}
+	db.commits.pause()
+	db.mu.RLock()
+	if db.activeFile == nil {
+		db.mu.RUnlock()
+		db.commits.resume()
+		return nil
+	}
+	// 通过快照持有数据文件, 避免写入期间被 merge 关闭
+	snap := db.newFileSnapshot()
+	ckpt := db.newIndexCheckpoint()
+	db.mu.RUnlock()
+	db.commits.resume()
+	defer func() {
+		_ = snap.Close()
+	}()
+	ckpt.collectEntries()
+	return db.writeIndexCheckpoint(ckpt)
+}
+
+// 获取当前时刻的索引检查点, 调用方需持有写锁, 或持有读锁并已暂停写入
+// 仅复制内存索引, 由 collectEntries 在释放锁后遍历副本生成索引信息
+func (db *DB) newIndexCheckpoint() *indexCheckpoint {
+	ckpt := &indexCheckpoint{
+		fileId:      db.activeFile.FileId,
+		offset:      db.activeFile.WriteOff,
+		seqNo:       db.seqNo,
+		logSeqNo:    atomic.LoadUint64(&db.logSeqNo),
+		totalSize:   db.totalSize.Load(),
+		reclaimSize: db.reclaimSize.Load(),
+	}
+
+	ckpt.dataFiles = append(ckpt.dataFiles, db.activeFile)
+	for _, dataFile := range db.getOlderFiles() {
+		ckpt.dataFiles = append(ckpt.dataFiles, dataFile)
+	}
+	sort.Slice(ckpt.dataFiles, func(i, j int) bool { return ckpt.dataFiles[i].FileId < ckpt.dataFiles[j].FileId })
+	for _, dataFile := range ckpt.dataFiles {
+		file := indexCheckpointFile{fileId: dataFile.FileId}
+		if size := db.fileSize(dataFile.FileId); size != nil {
+			file.totalSize, file.reclaimSize = size.totalSize.Load(), size.reclaimSize.Load()
+		}
+		ckpt.files = append(ckpt.files, file)
+	}
+
+	for id, b := range db.bucketIds {
+		ckpt.buckets = append(ckpt.buckets, indexCheckpointBucket{
+			id:          id,
+			name:        b.name,
+			totalSize:   b.totalSize.Load(),
+			reclaimSize: b.reclaimSize.Load(),
+		})
+	}
+
+	ckpt.indexes = make(map[uint32]index.Indexer)
+	for bucketId, idx := range db.bucketIndexes() {
+		ckpt.indexes[bucketId] = cloneIndex(idx)
+	}
+	return ckpt
+}
+
+// 遍历内存索引副本生成索引信息, 索引位置信息创建后不再修改, 可直接共享
+func (ckpt *indexCheckpoint) collectEntries() {
+	for bucketId, idx := range ckpt.indexes {
+		iterator := idx.Iterator(false)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			ckpt.entries = append(ckpt.entries, indexCheckpointEntry{
+				bucketId: bucketId,
+				key:      iterator.Key(),
+				pos:      iterator.Value(),
+			})
+		}
+		iterator.Close()
+	}
+	ckpt.indexes = nil
+}
+
+// 将索引检查点写入数据目录, 替换原检查点
+// 首条记录为头部记录, 之后每条索引信息对应一条记录, 最后为记录索引信息数量的尾部记录
+func (db *DB) writeIndexCheckpoint(ckpt *indexCheckpoint) (err error) {
+	// 记录覆盖的数据文件大小和末尾校验值, 用于启动时判断数据文件是否被修改
+	for i, dataFile := range ckpt.dataFiles {
+		size := ckpt.offset
+		if dataFile.FileId != ckpt.fileId {
+			if size, err = dataFile.ReadWriter.Size(); err != nil {
+				return err
+			}
+		}
+		if ckpt.files[i].tailCRC, err = dataFileTailCRC(dataFile, size); err != nil {
+			return err
+		}
+		ckpt.files[i].size = size
+	}
+
+	dirPath := db.options.DirPath
+	fileName := filepath.Join(dirPath, data.IndexCheckpointFileName)
+	if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	ckptFile, err := data.OpenIndexCheckpointFile(dirPath, db.encryptor)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ckptFile.Close()
+		if err != nil {
+			_ = os.Remove(fileName)
+		}
+	}()
+
+	buf, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(indexCheckpointHeaderKey),
+		Value: ckpt.encode(),
+	})
+	if err != nil {
+		return err
+	}
+	for _, entry := range ckpt.entries {
+		encRecord, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+			Key:    entry.key,
+			Value:  data.EncodeLogRecordPos(entry.pos),
+			Bucket: entry.bucketId,
+		})
+		if err != nil {
+			return err
+		}
+		buf = append(buf, encRecord...)
+		if len(buf) >= hintBufferSize {
+			if err := ckptFile.Write(buf); err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+	}
+	encTrailer, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+		Key:   []byte(indexCheckpointTrailerKey),
+		Value: binary.AppendUvarint(nil, uint64(len(ckpt.entries))),
+	})
+	if err != nil {
+		return err
+	}
+	if err := ckptFile.Write(buf); err != nil {
+		return err
+	}
+	if err := ckptFile.Sync(); err != nil {
+		return err
+	}
+
+	// 持有锁时写入尾部记录, 保证此时覆盖的数据文件未被 merge 替换, 此后替换时由 merge 删除检查点
+	db.mu.RLock()
+	for _, dataFile := range ckpt.dataFiles {
+		if db.getOlderFiles()[dataFile.FileId] != dataFile && db.activeFile != dataFile {
+			db.mu.RUnlock()
+			return ErrDataFileNotFound
+		}
+	}
+	err = ckptFile.Write(encTrailer)
+	db.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	return ckptFile.Sync()
+}
+
+// 加载索引检查点, 返回覆盖的最新数据文件 id 和位置, 调用方需从该位置继续加载索引
+// 检查点不存在、不完整、已损坏或与数据文件不一致时返回 false, 且不修改内存索引
+func (db *DB) loadIndexCheckpoint(fileIds []uint32) (uint32, int64, bool) {
+	if !db.indexCheckpointEnabled() {
+		return 0, 0, false
+	}
+	start := time.Now()
+	ckpt := db.readIndexCheckpoint()
+	if ckpt == nil || !db.checkIndexCheckpoint(ckpt, fileIds) {
+		return 0, 0, false
+	}
+
+	db.seqNo, db.logSeqNo = ckpt.seqNo, ckpt.logSeqNo
+	db.totalSize.Store(ckpt.totalSize)
+	db.reclaimSize.Store(ckpt.reclaimSize)
+	for _, file := range ckpt.files {
+		// 与读取数据文件加载时一致, 不包含日志记录的数据文件无统计信息
+		if file.totalSize == 0 && file.reclaimSize == 0 {
+			continue
+		}
+		size := db.fileSizeOf(file.fileId)
+		size.totalSize.Store(file.totalSize)
+		size.reclaimSize.Store(file.reclaimSize)
+	}
+	for _, bucket := range ckpt.buckets {
+		b := db.bucketOf(bucket.id)
+		if bucket.name != "" {
+			db.registerBucket(bucket.name, bucket.id)
+		}
+		b.totalSize.Store(bucket.totalSize)
+		b.reclaimSize.Store(bucket.reclaimSize)
+	}
+
+	// 写入检查点后过期的数据同样删除对应的索引信息
+	now := time.Now().UnixNano()
+	for _, entry := range ckpt.entries {
+		if entry.pos.IsExpired(now) {
+			db.addBucketSize(entry.bucketId, 0, db.addFileReclaim(entry.pos))
+			continue
+		}
+		db.indexOf(entry.bucketId).Put(entry.key, entry.pos)
+	}
+
+	db.openStat.IndexCheckpoint = true
+	db.openStat.LoadIndexDuration += time.Since(start)
+	return ckpt.fileId, ckpt.offset, true
+}
+
+// 读取索引检查点, 检查点不存在、不完整或已损坏时返回 nil
+func (db *DB) readIndexCheckpoint() *indexCheckpoint {
+	dirPath := db.options.DirPath
+	if _, err := os.Stat(filepath.Join(dirPath, data.IndexCheckpointFileName)); err != nil {
+		return nil
+	}
+	ckptFile, err := data.OpenIndexCheckpointFileReadOnly(dirPath, db.encryptor)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = ckptFile.Close()
+	}()
+
+	var records []*data.LogRecord
+	var offset int64 = 0
+	for {
+		logRecord, size, err := ckptFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil
+		}
+		records = append(records, logRecord)
+		offset += size
+	}
+
+	// 首条记录为头部记录, 最后一条记录为尾部记录
+	if len(records) < 2 || string(records[0].Key) != indexCheckpointHeaderKey ||
+		string(records[len(records)-1].Key) != indexCheckpointTrailerKey {
+		return nil
+	}
+	ckpt := decodeIndexCheckpoint(records[0].Value)
+	count, n := binary.Uvarint(records[len(records)-1].Value)
+	records = records[1 : len(records)-1]
+	if ckpt == nil || n <= 0 || count != uint64(len(records)) {
+		return nil
+	}
+	ckpt.entries = make([]indexCheckpointEntry, 0, len(records))
+	for _, record := range records {
+		ckpt.entries = append(ckpt.entries, indexCheckpointEntry{
+			bucketId: record.Bucket,
+			key:      record.Key,
+			pos:      data.DecodeLogRecordPos(record.Value),
+		})
+	}
+	return ckpt
+}
+
+// 判断索引检查点覆盖的数据文件是否未被修改
+// 不大于覆盖的最新数据文件 id 的数据文件需与检查点一一对应, 且大小和末尾校验值一致
+// 覆盖的最新数据文件在之后可能继续追加写入, 仅需包含覆盖的部分
+func (db *DB) checkIndexCheckpoint(ckpt *indexCheckpoint, fileIds []uint32) bool {
+	var i = 0
+	for _, fileId := range fileIds {
+		if fileId > ckpt.fileId {
+			break
+		}
+		if i >= len(ckpt.files) || ckpt.files[i].fileId != fileId {
+			return false
+		}
+		file := ckpt.files[i]
+		i++
+
+		dataFile := db.getOlderFiles()[fileId]
+		if fileId == db.activeFile.FileId {
+			dataFile = db.activeFile
+		}
+		size, err := dataFile.ReadWriter.Size()
+		if err != nil || size < file.size || fileId != ckpt.fileId && size != file.size {
+			return false
+		}
+		tailCRC, err := dataFileTailCRC(dataFile, file.size)
+		if err != nil || tailCRC != file.tailCRC {
+			return false
+		}
+	}
+	// 覆盖的最新数据文件需存在
+	return i == len(ckpt.files) && i > 0 && ckpt.files[i-1].fileId == ckpt.fileId
+}
+
+// 删除索引检查点, 覆盖的数据文件被替换时调用
+func removeIndexCheckpoint(dirPath string) error {
+	if err := os.Remove(filepath.Join(dirPath, data.IndexCheckpointFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 编码头部记录, 不包含索引信息
+func (ckpt *indexCheckpoint) encode() []byte {
+	buf := binary.AppendUvarint(nil, uint64(ckpt.fileId))
+	buf = binary.AppendVarint(buf, ckpt.offset)
+	buf = binary.AppendUvarint(buf, ckpt.seqNo)
+	buf = binary.AppendUvarint(buf, ckpt.logSeqNo)
+	buf = binary.AppendVarint(buf, ckpt.totalSize)
+	buf = binary.AppendVarint(buf, ckpt.reclaimSize)
+	buf = binary.AppendUvarint(buf, uint64(len(ckpt.files)))
+	for _, file := range ckpt.files {
+		buf = binary.AppendUvarint(buf, uint64(file.fileId))
+		buf = binary.AppendVarint(buf, file.size)
+		buf = binary.AppendUvarint(buf, uint64(file.tailCRC))
+		buf = binary.AppendVarint(buf, file.totalSize)
+		buf = binary.AppendVarint(buf, file.reclaimSize)
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(ckpt.buckets)))
+	for _, bucket := range ckpt.buckets {
+		buf = binary.AppendUvarint(buf, uint64(bucket.id))
+		buf = binary.AppendUvarint(buf, uint64(len(bucket.name)))
+		buf = append(buf, bucket.name...)
+		buf = binary.AppendVarint(buf, bucket.totalSize)
+		buf = binary.AppendVarint(buf, bucket.reclaimSize)
+	}
+	return buf
+}
+
+// 解码头部记录, 格式不合法时返回 nil
+func decodeIndexCheckpoint(buf []byte) *indexCheckpoint {
+	d := &checkpointDecoder{buf: buf}
+	ckpt := &indexCheckpoint{
+		fileId:      d.uint32(),
+		offset:      d.varint(),
+		seqNo:       d.uvarint(),
+		logSeqNo:    d.uvarint(),
+		totalSize:   d.varint(),
+		reclaimSize: d.varint(),
+	}
+	for n := d.count(); n > 0 && !d.failed; n-- {
+		ckpt.files = append(ckpt.files, indexCheckpointFile{
+			fileId:      d.uint32(),
+			size:        d.varint(),
+			tailCRC:     d.uint32(),
+			totalSize:   d.varint(),
+			reclaimSize: d.varint(),
+		})
+	}
+	for n := d.count(); n > 0 && !d.failed; n-- {
+		ckpt.buckets = append(ckpt.buckets, indexCheckpointBucket{
+			id:          d.uint32(),
+			name:        string(d.bytes()),
+			totalSize:   d.varint(),
+			reclaimSize: d.varint(),
+		})
+	}
+	if d.failed || len(d.buf) != 0 {
+		return nil
+	}
+	return ckpt
+}
+
+// 按顺序解码头部记录中的字段, 任一字段不合法时标记失败
+type checkpointDecoder struct {
+	buf    []byte
+	failed bool
+}
+
+func (d *checkpointDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.failed = true
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *checkpointDecoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.failed = true
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *checkpointDecoder) uint32() uint32 {
+	v := d.uvarint()
+	if v > uint64(^uint32(0)) {
+		d.failed = true
+	}
+	return uint32(v)
+}
+
+// 解码元素数量, 每个元素至少占用一个字节, 超过剩余长度时标记失败
+func (d *checkpointDecoder) count() uint64 {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		d.failed = true
+		return 0
+	}
+	return n
+}
+
+func (d *checkpointDecoder) bytes() []byte {
+	n := d.count()
+	if d.failed {
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
@@ -0,0 +1,195 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDB_IndexCheckpoint(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-checkpoint")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 写入普通数据、删除、过期数据、事务和 bucket 数据
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		assert.Nil(t, users.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1000), utils.RandomValue(64), time.Hour))
+	assert.Nil(t, db.PutWithTTL(utils.GetTestKey(1001), utils.RandomValue(64), 200*time.Millisecond))
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	assert.Nil(t, wb.Commit())
+	assert.Greater(t, db.Stat().DataFileNum, uint(3))
+	assert.Nil(t, db.Close())
+	_, err = os.Stat(filepath.Join(dir, data.IndexCheckpointFileName))
+	assert.Nil(t, err)
+
+	// 读取数据文件加载索引作为对照
+	scanOpts := opts
+	scanOpts.EnableIndexCheckpoint = false
+	db, err = Open(scanOpts)
+	assert.Nil(t, err)
+	keys := db.ListKeys()
+	usersKeyNum := db.Stat().Buckets["users"].KeyNum
+	assert.Nil(t, db.Close())
+
+	// 1. 通过索引检查点加载索引, 仅读取检查点之后写入的日志记录
+	var openStat OpenStat
+	opts.OnOpen = func(stat OpenStat) {
+		openStat = stat
+	}
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, openStat.IndexCheckpoint)
+	assert.Equal(t, 0, openStat.HintFileNum)
+	assert.Equal(t, 1, openStat.DataFileNum)
+	assert.Equal(t, keys, db.ListKeys())
+	stat := db.Stat()
+	assert.Equal(t, usersKeyNum, stat.Buckets["users"].KeyNum)
+	users, err = db.Bucket("users")
+	assert.Nil(t, err)
+	_, err = users.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(50))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, db.Close())
+
+	// 写入检查点后过期的数据同样被删除, 并计入无效数据量
+	time.Sleep(200 * time.Millisecond)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, openStat.IndexCheckpoint)
+	_, err = db.Get(utils.GetTestKey(1001))
+	assert.Equal(t, ErrKeyNotFound, err)
+	expiredStat := db.Stat()
+	assert.Equal(t, stat.KeyNum-1, expiredStat.KeyNum)
+	assert.Greater(t, expiredStat.ReclaimableSize, stat.ReclaimableSize)
+
+	// 2. 未写入检查点时崩溃, 加载原检查点并读取之后写入的全部日志记录
+	users, err = db.Bucket("users")
+	assert.Nil(t, err)
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(3000+i), utils.RandomValue(64)))
+		assert.Nil(t, users.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(200)))
+	keys = db.ListKeys()
+	stat = db.Stat()
+	db.options.EnableIndexCheckpoint = false
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, openStat.IndexCheckpoint)
+	assert.Greater(t, openStat.HintFileNum, 0)
+	assert.Equal(t, keys, db.ListKeys())
+	assert.Equal(t, stat, db.Stat())
+	assert.Nil(t, db.Close())
+
+	// 3. 检查点已损坏或覆盖的数据文件被修改时忽略, 改为读取数据文件加载索引
+	ckptFileName := filepath.Join(dir, data.IndexCheckpointFileName)
+	corruptFile(t, ckptFileName, 20)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.False(t, openStat.IndexCheckpoint)
+	assert.Equal(t, keys, db.ListKeys())
+	assert.Nil(t, db.Close())
+
+	fileName := data.GetDataFileName(dir, 0)
+	buf, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	corruptFile(t, fileName, int64(len(buf)-1))
+	db, err = Open(opts)
+	assert.NotNil(t, err)
+	corruptFile(t, fileName, int64(len(buf)-1))
+
+	// 4. merge 替换数据文件后删除检查点
+	opts.DataFileMergeRatio = 0
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, openStat.IndexCheckpoint)
+	assert.Nil(t, db.Merge())
+	_, err = os.Stat(ckptFileName)
+	assert.True(t, os.IsNotExist(err))
+	assert.Nil(t, db.Close())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.True(t, openStat.IndexCheckpoint)
+	assert.Equal(t, keys, db.ListKeys())
+}
+
+func TestDB_IndexCheckpoint_Interval(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-checkpoint-interval")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	opts.IndexCheckpointInterval = 50 * time.Millisecond
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	ckptFileName := filepath.Join(dir, data.IndexCheckpointFileName)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(ckptFileName)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	opts.IndexCheckpointInterval = -1
+	_, err = Open(opts)
+	assert.NotNil(t, err)
+}
+
+// 写入索引检查点仅需读锁, 持有读锁期间即可完成复制和写入
+func TestDB_IndexCheckpoint_ReadLock(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-index-checkpoint-rlock")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+
+	// 释放快照时需持有写锁, 检查点写入完成后再释放读锁
+	db.mu.RLock()
+	done := make(chan error)
+	go func() {
+		done <- db.checkpointIndex()
+	}()
+	var ckpt *indexCheckpoint
+	assert.Eventually(t, func() bool {
+		ckpt = db.readIndexCheckpoint()
+		return ckpt != nil
+	}, time.Second, 10*time.Millisecond)
+	db.mu.RUnlock()
+	assert.Nil(t, <-done)
+	if assert.NotNil(t, ckpt) {
+		assert.Equal(t, 100, len(ckpt.entries))
+	}
+}
@@ -3,20 +3,28 @@ package xixi_kv
 import (
 	"bytes"
 	"github.com/XiXi-2024/xixi-kv/index"
+	"time"
 )
 
 // Iterator 索引迭代器, 面向用户
 type Iterator struct {
 	indexIter index.Iterator  // 索引迭代器, 遍历 key
 	db        *DB             // DB 实例, 用于获取 value
+	index     index.Indexer   // 遍历的内存索引, 用于获取最新的索引位置
+	snapshot  *Snapshot       // 快照实例, 非 nil 时从快照中获取 value
 	options   IteratorOptions // 用户配置项
 }
 
 func (db *DB) NewIterator(opts IteratorOptions) *Iterator {
-	indexIter := db.index.Iterator(opts.Reverse)
+	return db.newIterator(db.index, opts)
+}
+
+// 创建遍历指定内存索引的迭代器
+func (db *DB) newIterator(idx index.Indexer, opts IteratorOptions) *Iterator {
 	return &Iterator{
 		db:        db,
-		indexIter: indexIter,
+		index:     idx,
+		indexIter: idx.Iterator(opts.Reverse),
 		options:   opts,
 	}
 }
@@ -51,9 +59,23 @@ func (it *Iterator) Key() []byte {
 
 // Value 返回当前位置 key 对应的实际 value
 func (it *Iterator) Value() ([]byte, error) {
-	logRecordPos := it.indexIter.Value()
-	it.db.mu.Lock()
-	defer it.db.mu.Unlock()
+	// 快照迭代器直接读取快照持有的数据文件
+	if it.snapshot != nil {
+		it.snapshot.mu.RLock()
+		defer it.snapshot.mu.RUnlock()
+		if it.snapshot.closed {
+			return nil, ErrSnapshotClosed
+		}
+		return it.snapshot.getValueByPosition(it.indexIter.Value())
+	}
+
+	it.db.mu.RLock()
+	defer it.db.mu.RUnlock()
+	// 迭代器创建后 merge 可能已重写数据文件, 故以内存索引中的最新位置为准
+	logRecordPos := it.index.Get(it.Key())
+	if logRecordPos == nil {
+		return nil, ErrKeyNotFound
+	}
 	return it.db.getValueByPosition(logRecordPos)
 }
 
@@ -65,16 +87,21 @@ func (it *Iterator) Close() {
 // 跳转到下一个满足条件的元素
 func (it *Iterator) skipToNext() {
 	prefixLen := len(it.options.Prefix)
-	// 未指定前缀 直接返回
-	if prefixLen == 0 {
-		return
+	now := time.Now().UnixNano()
+	// 快照迭代器以快照创建时刻判断是否过期
+	if it.snapshot != nil {
+		now = it.snapshot.timestamp
 	}
 
-	// 仅遍历 key 前缀满足条件的元素
+	// 仅遍历 key 前缀满足条件且未过期的元素
 	for ; it.indexIter.Valid(); it.indexIter.Next() {
 		key := it.indexIter.Key()
-		if prefixLen <= len(key) && bytes.Compare(it.options.Prefix, key[:prefixLen]) == 0 {
-			break
+		if prefixLen > 0 && (prefixLen > len(key) || bytes.Compare(it.options.Prefix, key[:prefixLen]) != 0) {
+			continue
+		}
+		if it.indexIter.Value().IsExpired(now) {
+			continue
 		}
+		break
 	}
 }
@@ -1,12 +1,20 @@
 package xixi_kv
 
 import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/binary"
 	"github.com/XiXi-2024/xixi-kv/data"
 	"github.com/XiXi-2024/xixi-kv/utils"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,46 +23,189 @@ const (
 
 	// merge完成标识文件中的未参与 merge 的最近文件key
 	mergeFinishedKey = "merge.finished"
+
+	// merge完成标识文件中的重写数据文件数量key, 仅旧版本标识文件包含
+	mergeFileNumKey = "merge.file.num"
+
+	// merge完成标识文件中被替换的数据文件 id key
+	mergeFileIdsKey = "merge.file.ids"
+
+	// merge完成标识文件中重写得到的数据文件 id key
+	mergeNewFileIdsKey = "merge.new.file.ids"
+
+	// merge 限速时的最短等待时间, 避免频繁创建定时器
+	mergeThrottleInterval = 10 * time.Millisecond
+
+	// 合并 hint 索引文件时写入的临时文件名称, 位于 merge 临时目录中
+	mergeHintTempFileName = data.HintFileName + ".tmp"
 )
 
-// Merge 立即执行 Merge 过程
-// todo 扩展点：新增定时任务和清除策略配置项, 监控数据状态, 进行自动清理
-// todo 优化点：使用性能更高的 merge 方法
+// merge 过程中被重写的日志记录, 写入重写记录文件, 用于安装时更新内存索引
+type mergedRecord struct {
+	bucket  uint32 // 所属 bucket 编号
+	key     []byte
+	oldPos  *data.LogRecordPos // 重写前的位置, 为 nil 表示重写前已是无效数据
+	newPos  *data.LogRecordPos // 重写后的位置, 为 nil 表示已过期被丢弃
+	garbage bool               // 重写后即为无效数据, 如保留的墓碑值
+}
+
+// 重写记录的标识位
+const (
+	mergedRecordOldPos  byte = 1 << iota // 包含重写前的位置
+	mergedRecordNewPos                   // 包含重写后的位置
+	mergedRecordGarbage                  // 重写后即为无效数据
+)
+
+// merge 前后 bucket 的数据量, 用于安装时维护 bucket 统计信息
+type mergedBucketSize struct {
+	oldSize  int64 // 参与 merge 的文件中的数据量
+	newSize  int64 // 重写后的数据量
+	liveSize int64 // 重写前仍有效的数据量
+	deadSize int64 // 重写后已失效的数据量
+}
+
+// merge 结果, 记录在 merge 完成标识文件中
+type mergeResult struct {
+	nonMergeFileId uint32   // 未参与 merge 的最近数据文件 id
+	fileIds        []uint32 // 被替换的数据文件 id
+	newFileIds     []uint32 // 重写得到的数据文件 id, 均为被替换的数据文件 id
+}
+
+// 数据文件的数据量统计, 用于选择参与 merge 的数据文件
+type dataFileSize struct {
+	totalSize   atomic.Int64 // 数据量, 单位字节
+	reclaimSize atomic.Int64 // 无效数据量, 单位字节
+}
+
+// 一组 id 连续的参与 merge 的数据文件, 其间不存在未参与 merge 的数据文件
+type mergeRun struct {
+	files       []*data.DataFile
+	keepGarbage bool // 存在 id 更小的未参与 merge 的数据文件
+}
+
+// merge 重写数据的写入器
+// 依次使用一组连续参与 merge 的文件 id 创建重写后的数据文件, 重写后的日志记录仍位于原文件 id 范围内
+// 保证重启加载时与未参与 merge 的数据文件间的先后顺序不变
+type mergeWriter struct {
+	db         *DB
+	dirPath    string
+	fileIds    []uint32       // 可使用的文件 id, 从小到大排列
+	activeFile *data.DataFile // 当前写入的文件
+	newFileIds []uint32       // 已创建的文件 id
+}
+
+// merge 读取数据文件的限速器
+type mergeLimiter struct {
+	bytesPerSecond int64     // 每秒最多读取的数据量, 0 表示不限制
+	start          time.Time // 开始读取的时刻
+	bytes          int64     // 已读取的数据量
+}
+
+// Merge 立即执行 Merge 过程, 等价于 MergeContext(context.Background())
 func (db *DB) Merge() error {
+	return db.MergeContext(context.Background())
+}
+
+// MergeContext 立即执行 Merge 过程, ctx 取消或数据库关闭时中止并丢弃已重写的数据, 数据库状态不变
+// 仅重写无效数据占比达到 DataFileMergeRatio 的数据文件, 单次重写的数据量受 MergeBytesPerRun 限制
+// 读取数据文件的速率受 MergeBytesPerSecond 限制, 避免影响前台读写
+// 重写完成后在线安装 merge 结果, 无需等待下次启动
+// 执行结果记录到 Stat 并通知 OnMerge 回调, 未满足 merge 条件而跳过时不记录
+// todo 优化点：使用性能更高的 merge 方法
+func (db *DB) MergeContext(ctx context.Context) error {
+	return db.mergeWithOutcome(ctx, false)
+}
+
+// MergeAll 立即重写全部数据文件, 等价于 MergeAllContext(context.Background())
+func (db *DB) MergeAll() error {
+	return db.MergeAllContext(context.Background())
+}
+
+// MergeAllContext 立即重写全部数据文件, 不受 DataFileMergeRatio 和 MergeBytesPerRun 限制, 其余同 MergeContext
+// 用于轮换密钥或修改压缩配置后, 使用当前密钥和压缩配置重写已写入的数据
+func (db *DB) MergeAllContext(ctx context.Context) error {
+	return db.mergeWithOutcome(ctx, true)
+}
+
+// 执行 merge 并记录执行结果, force 为 true 时重写全部数据文件
+func (db *DB) mergeWithOutcome(ctx context.Context, force bool) error {
+	outcome := MergeOutcome{Start: time.Now()}
+	err := db.merge(ctx, &outcome, force)
+	outcome.Duration = time.Since(outcome.Start)
+	outcome.Err = err
+	if err == nil && outcome.FilesRewritten > 0 || err != nil && !isMergeSkipped(err) {
+		db.reportMerge(outcome)
+	}
+	return err
+}
+
+// 执行 merge, 成功时将重写的文件数量和回收的数据量记录到 outcome
+func (db *DB) merge(ctx context.Context, outcome *MergeOutcome, force bool) error {
+	// 只读实例的数据文件与主节点保持一致, 不允许重写
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	// 方法仅部分逻辑需加锁, 不应 defer
+	db.mu.Lock()
+
+	// 数据库已关闭
+	select {
+	case <-db.closedChan:
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	default:
+	}
+
 	// 校验数据是否为空
 	if db.activeFile == nil {
+		db.mu.Unlock()
 		return nil
 	}
 
-	// 校验是否满足 merge 条件
-	if err := db.mergeCheck(); err != nil {
+	// 校验是否满足 merge 条件, 并选择参与 merge 的数据文件
+	mergeFiles, err := db.mergeCheck(force)
+	if err != nil {
+		db.mu.Unlock()
 		return err
 	}
 
-	// 方法仅部分逻辑需加锁, 不应 defer
-	db.mu.Lock()
-
-	// 更新 merge 状态
+	// 更新 merge 状态, 关闭数据库时等待 merge 结束
 	db.isMerging = true
+	db.merges.Add(1)
 	defer func() {
+		db.mu.Lock()
 		db.isMerging = false
+		db.mu.Unlock()
+		db.merges.Done()
 	}()
 
-	// 当前活跃文件同样加入参与 merge 的集合
-	if err := db.sync(); err != nil {
-		db.mu.Unlock()
-		return err
+	// 数据库关闭时取消 merge
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-db.closedChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	// 当前活跃文件参与 merge 时先将其封存
+	if slices.Contains(mergeFiles, db.activeFile) {
+		if err := db.sync(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
 	}
 
 	// 记录未参与 merge 的最近文件 id
 	nonMergeFileId := db.activeFile.FileId
 
-	// 存放参与 merge 的数据文件
-	var mergeFiles []*data.DataFile
-	// 将所有旧数据文件加入参与 merge 的集合
-	for _, file := range db.olderFiles {
-		mergeFiles = append(mergeFiles, file)
-	}
+	// 按文件 id 从小到大划分参与 merge 的数据文件, 保证重写后的日志记录仍按日志序列号有序
+	runs := db.mergeRuns(mergeFiles)
+
+	// 获取全部 bucket 的内存索引, merge 期间新建的 bucket 不包含在参与 merge 的文件中
+	indexes := db.bucketIndexes()
 
 	// 由于采用操作临时目录方式, 故允许提前释放锁
 	db.mu.Unlock()
@@ -72,115 +223,586 @@ func (db *DB) Merge() error {
 	if err := os.MkdirAll(mergePath, os.ModePerm); err != nil {
 		return err
 	}
-
-	// 创建新临时 DB 实例操作临时目录, 避免并发冲突
-	// 实际仅需要保证 appendLogRecord 方法的执行, 可简化初始化流程
-	mergeOptions := db.options
-	mergeOptions.DirPath = mergePath
-	mergeOptions.SyncStrategy = No // 加快 merge 速度
-	mergeDB := &DB{
-		options:    mergeOptions,
-		olderFiles: make(map[uint32]*data.DataFile),
-	}
+	// 写入完成标识前中止时删除临时目录, 不留下部分重写的数据
+	var finished bool
+	defer func() {
+		if !finished {
+			_ = os.RemoveAll(mergePath)
+		}
+	}()
 
 	// 在 merge 临时目录创建并打开 hint 索引文件
-	hintFile, err := data.OpenHintFile(mergePath)
+	hintFile, err := data.OpenHintFile(mergePath, db.encryptor)
+	if err != nil {
+		return err
+	}
+	// 被重写的日志记录写入重写记录文件, 安装时依次读取, 避免在内存中保存全部日志记录
+	recordsFile, err := data.OpenMergeRecordsFile(mergePath, db.encryptor)
 	if err != nil {
+		_ = hintFile.Close()
 		return err
 	}
+	var writer *mergeWriter
+	defer func() {
+		_ = hintFile.Close()
+		_ = recordsFile.Close()
+		if writer != nil {
+			_ = writer.close()
+		}
+	}()
 
 	// 执行 merge
 	// 依次读取每个数据文件, 解析得到日志记录并写入新 merge 目录
-	for _, dataFile := range mergeFiles {
-		var offset int64 = 0
-		for {
-			logRecord, size, err := dataFile.ReadLogRecord(offset)
-			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				return err
-			}
-			// 解析得到真实key
-			realKey, _ := parseLogRecordKey(logRecord.Key)
-			logRecordPos := db.index.Get(realKey)
-			// 与内存中的最新数据比较, 判断是否为有效数据
-			if logRecordPos != nil &&
-				logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset {
-				// 对于有效数据, 无论是否携带事务标记都表示事务已成功, 直接清除
-				logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
-				// 将数据重写到 merge 临时目录中
-				pos, err := mergeDB.appendLogRecord(logRecord)
+	result := &mergeResult{nonMergeFileId: nonMergeFileId}
+	// 各 bucket 在参与 merge 的文件中的数据量, 用于安装时维护 bucket 统计信息
+	mergedSizes := make(map[uint32]int64)
+	now := time.Now().UnixNano()
+	limiter := &mergeLimiter{bytesPerSecond: db.options.MergeBytesPerSecond, start: time.Now()}
+	for _, run := range runs {
+		writer = &mergeWriter{db: db, dirPath: mergePath}
+		for _, dataFile := range run.files {
+			writer.fileIds = append(writer.fileIds, dataFile.FileId)
+		}
+		for _, dataFile := range run.files {
+			var offset int64 = 0
+			for {
+				logRecord, size, err := dataFile.ReadLogRecord(offset)
 				if err != nil {
+					if err == io.EOF {
+						break
+					}
 					return err
 				}
-				// merge的过程中顺便将构建索引所需信息写入 Hint 文件中, 用于后续重启时加速构建索引
-				if err := hintFile.WriteHintRecord(realKey, pos); err != nil {
+				// 按配置限速, 同时响应取消
+				if err := limiter.wait(ctx, size); err != nil {
 					return err
 				}
+				mergedSizes[logRecord.Bucket] += size
+				// 解析得到真实key
+				realKey, _ := parseLogRecordKey(logRecord.Key)
+				var logRecordPos *data.LogRecordPos
+				if idx := indexes[logRecord.Bucket]; idx != nil {
+					logRecordPos = idx.Get(realKey)
+				}
+				// 与内存中的最新数据比较, 判断是否为有效数据
+				live := logRecordPos != nil &&
+					logRecordPos.Fid == dataFile.FileId && logRecordPos.Offset == offset
+				expired := live && logRecord.IsExpired(now)
+				// 存在 id 更小的未参与 merge 的文件时, 需保留墓碑值、事务完成标识和已过期的数据, 避免其中的旧数据在重启后生效
+				keep := run.keepGarbage &&
+					(expired || logRecord.Type == data.LogRecordDeleted || logRecord.Type == data.LogRecordTxnFinished)
+				if expired && !keep {
+					// 已过期的数据直接丢弃, 安装时从索引中删除
+					if err := db.writeMergedRecord(recordsFile, &mergedRecord{
+						bucket: logRecord.Bucket,
+						key:    realKey,
+						oldPos: logRecordPos,
+					}); err != nil {
+						return err
+					}
+				}
+				if (live && !expired) || keep {
+					// 对于有效数据, 无论是否携带事务标记都表示事务已成功, 直接清除
+					if live {
+						logRecord.Key = logRecordKeyWithSeq(realKey, nonTransactionSeqNo)
+					}
+					// 将数据重写到 merge 临时目录中
+					pos, err := writer.append(logRecord)
+					if err != nil {
+						return err
+					}
+					record := &mergedRecord{
+						bucket:  logRecord.Bucket,
+						key:     realKey,
+						newPos:  pos,
+						garbage: keep,
+					}
+					if live {
+						record.oldPos = logRecordPos
+					}
+					// merge的过程中顺便将构建索引所需信息写入 Hint 文件中, 用于后续重启时加速构建索引
+					if !keep {
+						if err := hintFile.WriteHintRecord(realKey, pos, logRecord.LogSeqNo, logRecord.Bucket); err != nil {
+							return err
+						}
+					}
+					if err := db.writeMergedRecord(recordsFile, record); err != nil {
+						return err
+					}
+				}
+				offset += size
 			}
-			offset += size
+			result.fileIds = append(result.fileIds, dataFile.FileId)
+		}
+		// 将重写的数据文件持久化
+		if err := writer.close(); err != nil {
+			return err
 		}
+		result.newFileIds = append(result.newFileIds, writer.newFileIds...)
 	}
 
-	// 将重写的数据文件和 hint 文件持久化
+	// 将 hint 文件持久化
+	if err := hintFile.Sync(); err != nil {
+		return err
+	}
 	if err := hintFile.Close(); err != nil {
 		return err
 	}
-	if mergeDB.activeFile != nil {
-		if err := mergeDB.activeFile.Close(); err != nil {
-			return err
+	if err := recordsFile.Close(); err != nil {
+		return err
+	}
+
+	// 在 merge 临时目录写入 merge 完成标识文件, 此后不再响应取消
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := db.writeMergeResult(mergePath, result); err != nil {
+		return err
+	}
+	finished = true
+
+	// 在线安装 merge 结果
+	reclaimed, err := db.installMergeFiles(result, mergedSizes)
+	if err != nil {
+		return err
+	}
+	outcome.FilesRewritten = len(result.fileIds)
+	outcome.BytesReclaimed = reclaimed
+	return nil
+}
+
+// 记录读取的数据量, 超过限速时等待, ctx 取消时返回对应错误
+func (l *mergeLimiter) wait(ctx context.Context, n int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if l.bytesPerSecond <= 0 {
+		return nil
+	}
+	l.bytes += n
+	expected := time.Duration(float64(l.bytes) / float64(l.bytesPerSecond) * float64(time.Second))
+	delay := expected - time.Since(l.start)
+	if delay < mergeThrottleInterval {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// 将日志记录追加到重写后的数据文件中
+func (w *mergeWriter) append(logRecord *data.LogRecord) (*data.LogRecordPos, error) {
+	// 编码, 按当前配置压缩 value, 并使用当前密钥加密, 完成密钥轮换
+	logRecord.Compression = w.db.options.Compression
+	encRecord, size, err := w.db.encryptor.EncodeLogRecord(logRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	// 当前文件剩余空间不足时使用下一个文件 id
+	// 重写后的数据量通常不超过原文件, 可用 id 耗尽时继续写入最后一个文件
+	if w.activeFile == nil ||
+		w.activeFile.WriteOff+size > w.db.options.DataFileSize && len(w.newFileIds) < len(w.fileIds) {
+		if err := w.rotate(); err != nil {
+			return nil, err
 		}
 	}
 
-	// 在 merge 临时目录创建并打开 merge 完成标识文件
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath)
+	pos := &data.LogRecordPos{
+		Fid:    w.activeFile.FileId,
+		Offset: w.activeFile.WriteOff,
+		Size:   uint32(size),
+		Expire: logRecord.Expire,
+	}
+	if err := w.activeFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	return pos, nil
+}
+
+// 持久化当前文件并使用下一个文件 id 创建新文件
+func (w *mergeWriter) rotate() error {
+	if err := w.close(); err != nil {
+		return err
+	}
+	fileId := w.fileIds[len(w.newFileIds)]
+	dataFile, err := data.OpenDataFile(w.dirPath, fileId, w.db.options.FileIOType, w.db.encryptor)
 	if err != nil {
 		return err
 	}
-	// 向文件写入未参与该次 merge 的最近数据文件id
-	mergeFinRecord := &data.LogRecord{
-		Key:   []byte(mergeFinishedKey),
-		Value: []byte(strconv.Itoa(int(nonMergeFileId))),
+	w.activeFile = dataFile
+	w.newFileIds = append(w.newFileIds, fileId)
+	return nil
+}
+
+// 持久化并关闭当前文件
+func (w *mergeWriter) close() error {
+	if w.activeFile == nil {
+		return nil
 	}
-	encRecord, _ := data.EncodeLogRecord(mergeFinRecord)
-	if err := mergeFinishedFile.Write(encRecord); err != nil {
+	dataFile := w.activeFile
+	w.activeFile = nil
+	if err := dataFile.Sync(); err != nil {
+		_ = dataFile.Close()
 		return err
 	}
-	if err := mergeFinishedFile.Close(); err != nil {
+	return dataFile.Close()
+}
+
+// 在线安装 merge 结果
+// 替换参与 merge 的旧数据文件, 并将内存索引指向重写后的位置
+// mergedSizes 为各 bucket 在参与 merge 的文件中的数据量, 被重写的日志记录从 merge 临时目录的重写记录文件中依次读取
+// 返回回收的数据量, 即被替换文件与重写后文件的数据量之差
+func (db *DB) installMergeFiles(result *mergeResult, mergedSizes map[uint32]int64) (int64, error) {
+	recordsFile, err := data.OpenMergeRecordsFile(db.getMergePath(), db.encryptor)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = recordsFile.Close()
+	}()
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 关闭被替换的数据文件, 并移除其统计信息
+	var oldSize, oldReclaim int64 = 0, 0
+	olderFiles := db.getOlderFiles()
+	db.updateOlderFiles(func(files map[uint32]*data.DataFile) {
+		for _, fileId := range result.fileIds {
+			delete(files, fileId)
+		}
+	})
+	for _, fileId := range result.fileIds {
+		if size := db.fileSize(fileId); size != nil {
+			oldSize += size.totalSize.Load()
+			oldReclaim += size.reclaimSize.Load()
+			db.fileSizes.Delete(fileId)
+		}
+		dataFile := olderFiles[fileId]
+		if dataFile == nil {
+			continue
+		}
+		// 删除或覆盖文件不影响已打开的文件描述符, 快照和无锁读取者仍可正常读取
+		if err := db.retireFile(dataFile); err != nil {
+			return 0, err
+		}
+	}
+
+	// 删除旧数据文件并移动重写后的文件到数据目录
+	if err := db.moveMergeFiles(result); err != nil {
+		return 0, err
+	}
+
+	// 打开重写后的数据文件作为旧数据文件
+	var newSize int64 = 0
+	for _, fileId := range result.newFileIds {
+		dataFile, err := data.OpenDataFile(db.options.DirPath, fileId, db.options.FileIOType, db.encryptor)
+		if err != nil {
+			return 0, err
+		}
+		size, err := dataFile.ReadWriter.Size()
+		if err != nil {
+			return 0, err
+		}
+		dataFile.WriteOff = size
+		newSize += size
+		db.fileSizeOf(fileId).totalSize.Store(size)
+		db.updateOlderFiles(func(files map[uint32]*data.DataFile) {
+			files[fileId] = dataFile
+		})
+		db.scheduleFileHint(dataFile)
+	}
+
+	// 更新内存索引
+	// 仅当索引仍指向重写前的位置时更新, 否则说明 merge 期间已有新数据写入
+	var newReclaim int64 = 0
+	bucketSizes := make(map[uint32]*mergedBucketSize)
+	for id, size := range mergedSizes {
+		bucketSizes[id] = &mergedBucketSize{oldSize: size}
+	}
+	var recordOffset int64 = 0
+	for {
+		record, recordSize, err := db.readMergedRecord(recordsFile, recordOffset)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		recordOffset += recordSize
+		idx := db.indexOf(record.bucket)
+		bucketSize := bucketSizes[record.bucket]
+		var unchanged bool
+		if record.oldPos != nil {
+			pos := idx.Get(record.key)
+			unchanged = pos != nil && pos.Fid == record.oldPos.Fid && pos.Offset == record.oldPos.Offset
+		}
+		// 已过期的数据, 删除对应索引
+		if record.newPos == nil || record.garbage {
+			if unchanged {
+				idx.Delete(record.key)
+			}
+			if record.newPos == nil {
+				continue
+			}
+		}
+		size := int64(record.newPos.Size)
+		bucketSize.newSize += size
+		if unchanged && !record.garbage {
+			idx.Put(record.key, record.newPos)
+			bucketSize.liveSize += int64(record.oldPos.Size)
+		} else {
+			// 重写后的数据已失效或本身为无效数据, 计入无效数据量
+			db.fileSizeOf(record.newPos.Fid).reclaimSize.Add(size)
+			newReclaim += size
+			bucketSize.deadSize += size
+		}
+	}
+
+	// 维护总数据量和无效数据量
+	// 被替换的数据文件中的无效数据已全部回收
+	db.totalSize.Add(newSize - oldSize)
+	db.reclaimSize.Store(max(db.reclaimSize.Load()+newReclaim-oldReclaim, 0))
+	for id, size := range bucketSizes {
+		if b := db.bucketOf(id); b != nil {
+			b.totalSize.Add(size.newSize - size.oldSize)
+			b.reclaimSize.Store(max(b.reclaimSize.Load()+size.deadSize-(size.oldSize-size.liveSize), 0))
+		}
+	}
+
+	// 关闭此前因存在无锁读取者而延迟关闭的文件
+	if len(db.snapshots) == 0 {
+		if err := db.closeRetiredFiles(); err != nil {
+			return 0, err
+		}
+	}
+
+	// 安装完成, 删除 merge 临时目录
+	return oldSize - newSize, os.RemoveAll(db.getMergePath())
+}
+
+// 将被重写的日志记录追加到重写记录文件
+func (db *DB) writeMergedRecord(recordsFile *data.DataFile, record *mergedRecord) error {
+	buf := []byte{0}
+	if record.oldPos != nil {
+		buf[0] |= mergedRecordOldPos
+		oldPos := data.EncodeLogRecordPos(record.oldPos)
+		buf = binary.AppendUvarint(buf, uint64(len(oldPos)))
+		buf = append(buf, oldPos...)
+	}
+	if record.newPos != nil {
+		buf[0] |= mergedRecordNewPos
+		buf = append(buf, data.EncodeLogRecordPos(record.newPos)...)
+	}
+	if record.garbage {
+		buf[0] |= mergedRecordGarbage
+	}
+	encRecord, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+		Key:    record.key,
+		Value:  buf,
+		Bucket: record.bucket,
+	})
+	if err != nil {
 		return err
 	}
+	return recordsFile.Write(encRecord)
+}
 
-	return nil
+// 读取重写记录文件中位于 offset 的记录, 返回记录及其长度
+func (db *DB) readMergedRecord(recordsFile *data.DataFile, offset int64) (*mergedRecord, int64, error) {
+	logRecord, size, err := recordsFile.ReadLogRecord(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	buf := logRecord.Value
+	if len(buf) == 0 {
+		return nil, 0, ErrDataDirectoryCorrupted
+	}
+	flags := buf[0]
+	buf = buf[1:]
+	record := &mergedRecord{
+		bucket:  logRecord.Bucket,
+		key:     logRecord.Key,
+		garbage: flags&mergedRecordGarbage != 0,
+	}
+	if flags&mergedRecordOldPos != 0 {
+		n, l := binary.Uvarint(buf)
+		if l <= 0 || uint64(len(buf)-l) < n {
+			return nil, 0, ErrDataDirectoryCorrupted
+		}
+		record.oldPos = data.DecodeLogRecordPos(buf[l : l+int(n)])
+		buf = buf[l+int(n):]
+	}
+	if flags&mergedRecordNewPos != 0 {
+		record.newPos = data.DecodeLogRecordPos(buf)
+	}
+	return record, size, nil
 }
 
-// merge 执行时机校验
-func (db *DB) mergeCheck() error {
+// merge 执行时机校验, 返回参与 merge 的数据文件, 调用方需持有锁
+func (db *DB) mergeCheck(force bool) ([]*data.DataFile, error) {
 	// 校验是否正在进行 merge
 	// 由于 merge 过程中会提前释放锁, 故存在同时尝试进行 merge 的情况
 	if db.isMerging {
-		return ErrMergeIsProgress
+		return nil, ErrMergeIsProgress
 	}
 
-	// 校验无效数据占比是否达到阈值
-	// 同时总数据量需达到 256MB, 避免小的无效数据过于影响比值
-	if db.totalSize > 256*1024*1024 &&
-		float32(db.reclaimSize)/float32(db.totalSize) < db.options.DataFileMergeRatio {
-		return ErrMergeRatioUnreached
+	// 校验是否存在无效数据占比达到阈值的数据文件
+	mergeFiles := db.selectMergeFiles(force)
+	if len(mergeFiles) == 0 {
+		return nil, ErrMergeRatioUnreached
 	}
 
-	// 校验数据目录所在磁盘剩余空间是否能容纳 merge 后的数据量
+	// 校验数据目录所在磁盘剩余空间是否能容纳重写后的数据量
+	var liveSize int64 = 0
+	for _, dataFile := range mergeFiles {
+		if size := db.fileSize(dataFile.FileId); size != nil {
+			liveSize += max(size.totalSize.Load()-size.reclaimSize.Load(), 0)
+		}
+	}
 	availableDiskSize, err := utils.AvailableDiskSize(db.options.DirPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	if uint64(db.totalSize-db.reclaimSize) >= availableDiskSize {
-		return ErrNoEnoughSpaceForMerge
+	if uint64(liveSize) >= availableDiskSize {
+		return nil, ErrNoEnoughSpaceForMerge
 	}
 
+	return mergeFiles, nil
+}
+
+// 选择参与 merge 的数据文件, 调用方需持有锁
+// 无效数据占比达到 DataFileMergeRatio 的文件按占比从高到低选择, 总数据量不超过 MergeBytesPerRun, 至少选择一个文件
+// 活跃文件同样参与选择, 未写入数据时跳过, force 为 true 时选择全部数据文件
+func (db *DB) selectMergeFiles(force bool) []*data.DataFile {
+	type candidate struct {
+		dataFile *data.DataFile
+		size     int64
+		ratio    float32
+	}
+	dataFiles := make([]*data.DataFile, 0, len(db.getOlderFiles())+1)
+	for _, dataFile := range db.getOlderFiles() {
+		dataFiles = append(dataFiles, dataFile)
+	}
+	if db.activeFile.WriteOff > 0 {
+		dataFiles = append(dataFiles, db.activeFile)
+	}
+
+	var candidates []candidate
+	for _, dataFile := range dataFiles {
+		c := candidate{dataFile: dataFile}
+		if size := db.fileSize(dataFile.FileId); size != nil && size.totalSize.Load() > 0 {
+			c.size = size.totalSize.Load()
+			c.ratio = float32(size.reclaimSize.Load()) / float32(c.size)
+		}
+		if force || c.ratio >= db.options.DataFileMergeRatio {
+			candidates = append(candidates, c)
+		}
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		if a.ratio != b.ratio {
+			return cmp.Compare(b.ratio, a.ratio)
+		}
+		return cmp.Compare(a.dataFile.FileId, b.dataFile.FileId)
+	})
+
+	var mergeFiles []*data.DataFile
+	var mergeSize int64 = 0
+	for _, c := range candidates {
+		budget := db.options.MergeBytesPerRun
+		if !force && budget > 0 && len(mergeFiles) > 0 && mergeSize+c.size > budget {
+			continue
+		}
+		mergeFiles = append(mergeFiles, c.dataFile)
+		mergeSize += c.size
+	}
+	return mergeFiles
+}
+
+// 将参与 merge 的数据文件按 id 划分为连续的若干组, 调用方需持有锁
+func (db *DB) mergeRuns(mergeFiles []*data.DataFile) []*mergeRun {
+	selected := make(map[uint32]struct{}, len(mergeFiles))
+	for _, dataFile := range mergeFiles {
+		selected[dataFile.FileId] = struct{}{}
+	}
+	fileIds := make([]uint32, 0, len(db.getOlderFiles()))
+	for fileId := range db.getOlderFiles() {
+		fileIds = append(fileIds, fileId)
+	}
+	slices.Sort(fileIds)
+
+	var runs []*mergeRun
+	var run *mergeRun
+	var skipped bool
+	for _, fileId := range fileIds {
+		if _, ok := selected[fileId]; !ok {
+			run, skipped = nil, true
+			continue
+		}
+		if run == nil {
+			run = &mergeRun{keepGarbage: skipped}
+			runs = append(runs, run)
+		}
+		run.files = append(run.files, db.getOlderFiles()[fileId])
+	}
+	return runs
+}
+
+// 获取数据文件的数据量统计, 不存在时创建
+func (db *DB) fileSizeOf(fileId uint32) *dataFileSize {
+	if size := db.fileSize(fileId); size != nil {
+		return size
+	}
+	size, _ := db.fileSizes.LoadOrStore(fileId, &dataFileSize{})
+	return size.(*dataFileSize)
+}
+
+// 获取数据文件的数据量统计, 不存在时返回 nil
+func (db *DB) fileSize(fileId uint32) *dataFileSize {
+	if size, ok := db.fileSizes.Load(fileId); ok {
+		return size.(*dataFileSize)
+	}
 	return nil
 }
 
+// 维护数据文件的数据量和总数据量
+func (db *DB) addFileSize(fileId uint32, size int64) {
+	db.totalSize.Add(size)
+	db.fileSizeOf(fileId).totalSize.Add(size)
+}
+
+// 维护数据文件的无效数据量和总无效数据量
+func (db *DB) addReclaimSize(fileId uint32, size int64) {
+	db.reclaimSize.Add(size)
+	db.fileSizeOf(fileId).reclaimSize.Add(size)
+}
+
+// 将日志记录计入所在数据文件的无效数据量, 返回计入的数据量
+func (db *DB) addFileReclaim(pos *data.LogRecordPos) int64 {
+	size := int64(pos.Size)
+	db.addReclaimSize(pos.Fid, size)
+	return size
+}
+
+// 获取各数据文件的统计信息, 无需持有锁
+func (db *DB) dataFileStats() map[uint32]DataFileStat {
+	stats := make(map[uint32]DataFileStat)
+	db.fileSizes.Range(func(fileId, size any) bool {
+		stats[fileId.(uint32)] = DataFileStat{
+			ReclaimableSize: size.(*dataFileSize).reclaimSize.Load(),
+			DiskSize:        size.(*dataFileSize).totalSize.Load(),
+		}
+		return true
+	})
+	return stats
+}
+
 // 获取 merge 临时目录路径, 与数据目录同级
 func (db *DB) getMergePath() string {
 	// 获取数据目录的父目录路径
@@ -191,6 +813,8 @@ func (db *DB) getMergePath() string {
 }
 
 // 尝试加载 merge 临时目录
+// 用于启动时完成上次未安装的 merge 结果
+// 全部旧数据文件均参与 merge 时返回未参与 merge 的最近数据文件 id, 供通过 hint 文件加载索引, 否则返回 0
 func (db *DB) loadMergeFiles() (uint32, error) {
 	mergePath := db.getMergePath()
 	// 未进行过 merge
@@ -203,82 +827,302 @@ func (db *DB) loadMergeFiles() (uint32, error) {
 		_ = os.RemoveAll(mergePath)
 	}()
 
+	// 判断是否存在 merge 完成文件标识
+	if _, err := os.Stat(filepath.Join(mergePath, data.MergeFinishedFileName)); os.IsNotExist(err) {
+		// merge 未完成
+		return 0, nil
+	}
+
+	// 从标识文件中取出 merge 结果
+	result, err := db.readMergeResult()
+	if err != nil {
+		return 0, err
+	}
+
+	if err := db.moveMergeFiles(result); err != nil {
+		return 0, err
+	}
+
+	// 存在未参与 merge 的旧数据文件时, hint 文件不包含其索引信息
+	fileIds, err := db.dataFileIds()
+	if err != nil {
+		return 0, err
+	}
+	for _, fileId := range fileIds {
+		if fileId < result.nonMergeFileId && !slices.Contains(result.fileIds, fileId) {
+			return 0, nil
+		}
+	}
+	return result.nonMergeFileId, nil
+}
+
+// 删除被替换的数据文件, 并将重写的数据文件和 hint 文件移动到数据目录中, 调用方需保证被替换的数据文件已关闭
+// 重写的数据文件直接覆盖同 id 的被替换文件, 安装中断后重复执行结果不变
+func (db *DB) moveMergeFiles(result *mergeResult) error {
+	mergePath := db.getMergePath()
+
 	// 读取目录中所有文件
 	dirEntries, err := os.ReadDir(mergePath)
 	if err != nil {
-		return 0, err
+		return err
+	}
+
+	// 索引检查点中的位置信息指向被替换的文件, 已过期
+	if err := removeIndexCheckpoint(db.options.DirPath); err != nil {
+		return err
 	}
 
-	// 是否存在 merge 完成文件标识
-	var mergeFinished bool
-	// 参与 merge 的数据文件、Hint文件的名称集合
-	var mergeFileNames []string
+	// 删除未被重写数据文件覆盖的被替换文件, 被替换文件的 hint 文件均已过期
+	for _, fileId := range result.fileIds {
+		if err := removeFileHint(db.options.DirPath, fileId); err != nil {
+			return err
+		}
+		if slices.Contains(result.newFileIds, fileId) {
+			continue
+		}
+		fileName := data.GetDataFileName(db.options.DirPath, fileId)
+		if err := os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// 将重写得到的 hint 记录合并到数据目录的 hint 索引文件中
+	if err := db.mergeHintFile(result); err != nil {
+		return err
+	}
+
+	// 将重写的数据文件和单个数据文件的 hint 文件移动到数据目录中
+	// 已不在临时目录中的重写数据文件为已移动的文件
 	for _, entry := range dirEntries {
-		if entry.Name() == data.MergeFinishedFileName {
-			mergeFinished = true
+		// 过滤 merge 完成标识文件和事务 id 文件, 其中包含的事务 id 非最新, 加载无意义
+		if entry.Name() == data.MergeFinishedFileName || entry.Name() == data.SeqNoFileName {
+			continue
 		}
-		// 过滤事务 id 文件, 其中包含的事务 id 非最新, 加载无意义
-		if entry.Name() == data.SeqNoFileName {
+		// 过滤已合并的 hint 索引文件和仅供安装使用的重写记录文件
+		if entry.Name() == data.HintFileName || entry.Name() == mergeHintTempFileName ||
+			entry.Name() == data.MergeRecordsFileName {
 			continue
 		}
 		// 过滤文件锁文件
 		if entry.Name() == fileLockName {
 			continue
 		}
-		mergeFileNames = append(mergeFileNames, entry.Name())
+		srcPath := filepath.Join(mergePath, entry.Name())
+		destPath := filepath.Join(db.options.DirPath, entry.Name())
+		if err := os.Rename(srcPath, destPath); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// merge 未完成
-	if !mergeFinished {
-		return 0, nil
+// 合并 merge 临时目录与数据目录中的 hint 索引文件
+// 保留数据目录中未被替换的数据文件的 hint 记录, 并追加重写得到的 hint 记录, 逐条读写避免全部加载到内存
+// 先写入临时文件再替换, 安装中断后重复执行结果不变
+func (db *DB) mergeHintFile(result *mergeResult) (err error) {
+	mergePath := db.getMergePath()
+	srcPath := filepath.Join(mergePath, data.HintFileName)
+	if _, err := os.Stat(srcPath); os.IsNotExist(err) {
+		// 已合并完成
+		return nil
 	}
-
-	// 从标识文件中取出未参与 merge 的最近数据文件 id
-	nonMergeFileId, err := db.getNonMergeFileId()
+	tmpPath := filepath.Join(mergePath, mergeHintTempFileName)
+	tmpFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		return 0, err
+		return err
 	}
+	defer func() {
+		_ = tmpFile.Close()
+		if err != nil {
+			_ = os.Remove(tmpPath)
+		}
+	}()
+	w := bufio.NewWriterSize(tmpFile, hintBufferSize)
 
-	// 数据目录中删除参与 merge 的旧数据文件
-	var fileId uint32 = 0
-	for ; fileId < nonMergeFileId; fileId++ {
-		// 获取完整数据文件名称
-		fileName := data.GetDataFileName(db.options.DirPath, fileId)
-		// 如果存在则删除
-		if _, err := os.Stat(fileName); err == nil {
-			if err := os.Remove(fileName); err != nil {
-				return 0, err
-			}
+	// 保留未被替换的数据文件的 hint 记录
+	destPath := filepath.Join(db.options.DirPath, data.HintFileName)
+	if _, err := os.Stat(destPath); err == nil {
+		hintFile, err := data.OpenHintFile(db.options.DirPath, db.encryptor)
+		if err != nil {
+			return err
+		}
+		err = db.copyHintRecords(w, hintFile, result.fileIds)
+		_ = hintFile.Close()
+		if err != nil {
+			return err
 		}
 	}
 
-	// 将重写的数据文件和 hint 文件移动到数据目录中
-	for _, fileName := range mergeFileNames {
-		srcPath := filepath.Join(mergePath, fileName)
-		destPath := filepath.Join(db.options.DirPath, fileName)
-		if err := os.Rename(srcPath, destPath); err != nil {
-			return 0, err
-		}
+	// 追加重写得到的 hint 记录, 编码方式相同, 直接复制
+	srcFile, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, srcFile)
+	_ = srcFile.Close()
+	if err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := tmpFile.Sync(); err != nil {
+		return err
 	}
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return err
+	}
+	return os.Remove(srcPath)
+}
 
-	return nonMergeFileId, nil
+// 将 hint 索引文件中不属于被替换数据文件的 hint 记录写入 w
+func (db *DB) copyHintRecords(w io.Writer, hintFile *data.DataFile, replacedFileIds []uint32) error {
+	var offset int64 = 0
+	for {
+		logRecord, size, err := hintFile.ReadLogRecord(offset)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		offset += size
+		pos := data.DecodeLogRecordPos(logRecord.Value)
+		if slices.Contains(replacedFileIds, pos.Fid) {
+			continue
+		}
+		encRecord, _, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+			Key:      logRecord.Key,
+			Value:    logRecord.Value,
+			LogSeqNo: logRecord.LogSeqNo,
+			Bucket:   logRecord.Bucket,
+		})
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(encRecord); err != nil {
+			return err
+		}
+	}
 }
 
-// 获取 merge 完成标识文件中保存的未参与 merge 的最近数据文件id
-func (db *DB) getNonMergeFileId() (uint32, error) {
-	mergeFinishedFile, err := data.OpenMergeFinishedFile(db.getMergePath())
+// 在 merge 临时目录写入 merge 完成标识文件
+func (db *DB) writeMergeResult(mergePath string, result *mergeResult) error {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(mergePath, db.encryptor)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	record, _, err := mergeFinishedFile.ReadLogRecord(0)
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+
+	records := []*data.LogRecord{
+		// 未参与该次 merge 的最近数据文件 id
+		{Key: []byte(mergeFinishedKey), Value: []byte(strconv.Itoa(int(result.nonMergeFileId)))},
+		// 被替换和重写得到的数据文件 id, 用于安装中断后判断哪些数据文件仍需删除或移动
+		{Key: []byte(mergeFileIdsKey), Value: []byte(joinFileIds(result.fileIds))},
+		{Key: []byte(mergeNewFileIdsKey), Value: []byte(joinFileIds(result.newFileIds))},
+	}
+	for _, record := range records {
+		encRecord, _, err := db.encryptor.EncodeLogRecord(record)
+		if err != nil {
+			return err
+		}
+		if err := mergeFinishedFile.Write(encRecord); err != nil {
+			return err
+		}
+	}
+	return mergeFinishedFile.Sync()
+}
+
+// 读取 merge 完成标识文件中的 merge 结果
+// 旧版本标识文件不包含数据文件 id, 此时 id 小于未参与 merge 的最近文件 id 的数据文件均被替换
+func (db *DB) readMergeResult() (*mergeResult, error) {
+	mergeFinishedFile, err := data.OpenMergeFinishedFile(db.getMergePath(), db.encryptor)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	nonMergeFileId, err := strconv.Atoi(string(record.Value))
+	defer func() {
+		_ = mergeFinishedFile.Close()
+	}()
+
+	values := make(map[string]string)
+	var offset int64 = 0
+	for {
+		record, size, err := mergeFinishedFile.ReadLogRecord(offset)
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		values[string(record.Key)] = string(record.Value)
+		offset += size
+	}
+
+	nonMergeFileId, err := strconv.Atoi(values[mergeFinishedKey])
 	if err != nil {
-		return 0, err
+		return nil, err
+	}
+	result := &mergeResult{nonMergeFileId: uint32(nonMergeFileId)}
+	if fileIds, ok := values[mergeFileIdsKey]; ok {
+		if result.fileIds, err = parseFileIds(fileIds); err != nil {
+			return nil, err
+		}
+		if result.newFileIds, err = parseFileIds(values[mergeNewFileIdsKey]); err != nil {
+			return nil, err
+		}
+		return result, nil
 	}
-	return uint32(nonMergeFileId), nil
+
+	// 旧版本标识文件, 重写得到的数据文件 id 从 0 开始连续编号
+	for fileId := uint32(0); fileId < result.nonMergeFileId; fileId++ {
+		result.fileIds = append(result.fileIds, fileId)
+	}
+	mergeFileNum := 0
+	if value, ok := values[mergeFileNumKey]; ok {
+		if mergeFileNum, err = strconv.Atoi(value); err != nil {
+			return nil, err
+		}
+	}
+	if mergeFileNum == 0 {
+		// 不包含重写数据文件数量的标识文件, 视为全部重写文件均未移动
+		result.newFileIds, err = fileIdsWithSuffix(db.getMergePath(), data.DataFileNameSuffix)
+		if err != nil {
+			return nil, err
+		}
+		return result, nil
+	}
+	for fileId := uint32(0); fileId < uint32(mergeFileNum); fileId++ {
+		result.newFileIds = append(result.newFileIds, fileId)
+	}
+	return result, nil
+}
+
+// 将数据文件 id 编码为以逗号分隔的字符串
+func joinFileIds(fileIds []uint32) string {
+	values := make([]string, len(fileIds))
+	for i, fileId := range fileIds {
+		values[i] = strconv.FormatUint(uint64(fileId), 10)
+	}
+	return strings.Join(values, ",")
+}
+
+// 解析以逗号分隔的数据文件 id
+func parseFileIds(value string) ([]uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	values := strings.Split(value, ",")
+	fileIds := make([]uint32, len(values))
+	for i, v := range values {
+		fileId, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, ErrDataDirectoryCorrupted
+		}
+		fileIds[i] = uint32(fileId)
+	}
+	return fileIds, nil
 }
 
 // 尝试通过 hint 文件加载索引
@@ -286,7 +1130,7 @@ func (db *DB) loadIndexFromHintFile() (uint32, error) {
 	// 打开 hint 文件
 	// 调用该方法说明 merge 必然成功, hint 文件必然存在
 	// 如果手动删去 hint 文件, 会自动创建新的空文件进行读取
-	hintFile, err := data.OpenHintFile(db.options.DirPath)
+	hintFile, err := data.OpenHintFile(db.options.DirPath, db.encryptor)
 	if err != nil {
 		return 0, err
 	}
@@ -296,6 +1140,7 @@ func (db *DB) loadIndexFromHintFile() (uint32, error) {
 	var maxFileId uint32 = 0
 
 	var offset int64 = 0
+	now := time.Now().UnixNano()
 	for {
 		logRecord, size, err := hintFile.ReadLogRecord(offset)
 		if err != nil {
@@ -305,13 +1150,30 @@ func (db *DB) loadIndexFromHintFile() (uint32, error) {
 			return 0, err
 		}
 
-		// 快速加载索引
+		// 快速加载索引, 已过期的数据视为无效数据
 		pos := data.DecodeLogRecordPos(logRecord.Value)
-		db.index.Put(logRecord.Key, pos)
+		db.addFileSize(pos.Fid, int64(pos.Size))
+		var reclaim int64 = 0
+		if pos.IsExpired(now) {
+			reclaim = db.addFileReclaim(pos)
+		} else {
+			db.indexOf(logRecord.Bucket).Put(logRecord.Key, pos)
+		}
 		offset += size
 
-		// 统计总数据量
-		db.totalSize += int64(pos.Size)
+		// 元数据 bucket 的 hint 记录不包含 bucket 编号, 需从数据文件中读取
+		if logRecord.Bucket == metaBucketId {
+			value, err := db.getValueByPosition(pos)
+			if err != nil {
+				return 0, err
+			}
+			db.loadBucketMeta(logRecord.Key, value)
+		}
+
+		// 统计 bucket 的数据量和无效数据量
+		db.addBucketSize(logRecord.Bucket, int64(pos.Size), reclaim)
+		// 恢复最大日志序列号
+		db.logSeqNo = max(db.logSeqNo, logRecord.LogSeqNo)
 
 		maxFileId = max(maxFileId, pos.Fid)
 	}
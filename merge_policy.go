@@ -0,0 +1,155 @@
+package xixi_kv
+
+import (
+	"errors"
+	"time"
+)
+
+// MergePolicy 后台 merge 调度策略, 后台协程每秒根据当前统计信息判断是否执行 merge
+// 触发后仍仅重写无效数据占比达到 DataFileMergeRatio 的数据文件
+type MergePolicy interface {
+	// ShouldMerge 返回当前时刻是否执行 merge
+	ShouldMerge(now time.Time, stat *Stat) bool
+}
+
+// RatioMergePolicy 存在无效数据占比达到 Ratio 的数据文件时触发 merge
+type RatioMergePolicy struct {
+	Ratio float32
+}
+
+// ReclaimableBytesMergePolicy 可回收的数据量达到 MinBytes 时触发 merge
+type ReclaimableBytesMergePolicy struct {
+	MinBytes int64
+}
+
+// TimeWindowMergePolicy 仅在每天 [Start, End) 时间段内按 Policy 触发 merge
+// Start 和 End 为相对于当天零点的时长, Start 大于 End 时表示跨越零点
+// Policy 为 nil 时时间段内存在可回收数据即触发
+type TimeWindowMergePolicy struct {
+	Start  time.Duration
+	End    time.Duration
+	Policy MergePolicy
+}
+
+// ManualMergePolicy 从不自动触发 merge, 仅由用户调用 Merge 执行
+type ManualMergePolicy struct{}
+
+// MergeOutcome 单次 merge 的执行结果
+type MergeOutcome struct {
+	Start          time.Time     // 开始时刻
+	Duration       time.Duration // 耗时
+	FilesRewritten int           // 重写的数据文件数量
+	BytesReclaimed int64         // 回收的数据量, 单位字节
+	Err            error         // 执行失败或被取消时的错误
+	// 是否为后台 value log GC 的执行结果, 后台 value log GC 仅在执行失败时通知
+	ValueLogGC bool
+}
+
+// MergeStat 自打开数据库起的 merge 执行统计信息, 不持久化
+type MergeStat struct {
+	RunNum        uint          // 已执行的 merge 次数, 包含失败的次数
+	FailedNum     uint          // 执行失败或被取消的次数
+	ReclaimedSize int64         // 累计回收的数据量, 单位字节
+	Last          *MergeOutcome // 最近一次 merge 的执行结果, 未执行时为 nil
+	// 后台 value log GC 执行失败的次数
+	ValueLogGCFailedNum uint
+	// 最近一次执行失败的后台 value log GC 结果, 未失败时为 nil
+	LastValueLogGC *MergeOutcome
+}
+
+func (p RatioMergePolicy) ShouldMerge(_ time.Time, stat *Stat) bool {
+	for _, file := range stat.DataFiles {
+		if file.ReclaimableSize > 0 && float32(file.ReclaimableSize)/float32(file.DiskSize) >= p.Ratio {
+			return true
+		}
+	}
+	return false
+}
+
+func (p ReclaimableBytesMergePolicy) ShouldMerge(_ time.Time, stat *Stat) bool {
+	return stat.ReclaimableSize > 0 && stat.ReclaimableSize >= p.MinBytes
+}
+
+func (p TimeWindowMergePolicy) ShouldMerge(now time.Time, stat *Stat) bool {
+	year, month, day := now.Date()
+	offset := now.Sub(time.Date(year, month, day, 0, 0, 0, 0, now.Location()))
+	var inWindow bool
+	if p.Start <= p.End {
+		inWindow = offset >= p.Start && offset < p.End
+	} else {
+		inWindow = offset >= p.Start || offset < p.End
+	}
+	if !inWindow {
+		return false
+	}
+	if p.Policy == nil {
+		return stat.ReclaimableSize > 0
+	}
+	return p.Policy.ShouldMerge(now, stat)
+}
+
+func (ManualMergePolicy) ShouldMerge(time.Time, *Stat) bool {
+	return false
+}
+
+// 后台定时任务, 按 merge 调度策略执行 merge, 并在有新写入时回收 value log
+func (db *DB) backgroundMerge() {
+	policy := db.options.MergePolicy
+	if policy == nil {
+		policy = RatioMergePolicy{Ratio: db.options.DataFileMergeRatio}
+	}
+	// 上次 value log GC 时的累计写入数据量
+	var lastWritten uint64 = 0
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			// 执行结果记录到 Stat 并通知 OnMerge 回调, 关闭时取消正在执行的 merge
+			if policy.ShouldMerge(now, db.Stat()) {
+				_ = db.Merge()
+			}
+
+			// 持久化时重置的 bytesWrite 无法反映是否有新写入, 使用单调递增的累计写入数据量
+			written := db.writtenBytes.Load()
+			if written == lastWritten {
+				continue
+			}
+			// value log 独立于 merge 回收, 执行失败时同样记录到 Stat 并通知 OnMerge 回调
+			start := time.Now()
+			if err := db.ValueLogGC(); err != nil && !errors.Is(err, ErrValueLogGCIsProgress) && !isMergeSkipped(err) {
+				db.reportMerge(MergeOutcome{Start: start, Duration: time.Since(start), Err: err, ValueLogGC: true})
+			}
+			lastWritten = written
+		case <-db.closedChan:
+			return
+		}
+	}
+}
+
+// 记录 merge 或后台 value log GC 的执行结果并通知回调
+func (db *DB) reportMerge(outcome MergeOutcome) {
+	db.mu.Lock()
+	if outcome.ValueLogGC {
+		db.mergeStat.ValueLogGCFailedNum++
+		db.mergeStat.LastValueLogGC = &outcome
+	} else {
+		db.mergeStat.RunNum++
+		if outcome.Err != nil {
+			db.mergeStat.FailedNum++
+		}
+		db.mergeStat.ReclaimedSize += outcome.BytesReclaimed
+		db.mergeStat.Last = &outcome
+	}
+	db.mu.Unlock()
+
+	if db.options.OnMerge != nil {
+		db.options.OnMerge(outcome)
+	}
+}
+
+// 未满足 merge 条件而跳过, 不视为一次 merge
+func isMergeSkipped(err error) bool {
+	return errors.Is(err, ErrMergeIsProgress) || errors.Is(err, ErrMergeRatioUnreached) ||
+		errors.Is(err, ErrDatabaseReadOnly) || errors.Is(err, ErrDatabaseClosed)
+}
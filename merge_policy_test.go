@@ -0,0 +1,168 @@
+package xixi_kv
+
+import (
+	"context"
+	"errors"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestMergePolicy_ShouldMerge(t *testing.T) {
+	stat := &Stat{
+		ReclaimableSize: 300,
+		DiskSize:        1000,
+		DataFiles: map[uint32]DataFileStat{
+			0: {ReclaimableSize: 100, DiskSize: 500},
+			1: {ReclaimableSize: 200, DiskSize: 500},
+		},
+	}
+	now := time.Date(2024, 1, 1, 3, 0, 0, 0, time.Local)
+
+	// 1. 按单个数据文件的无效数据占比触发
+	assert.True(t, RatioMergePolicy{Ratio: 0.4}.ShouldMerge(now, stat))
+	assert.False(t, RatioMergePolicy{Ratio: 0.5}.ShouldMerge(now, stat))
+	assert.False(t, RatioMergePolicy{Ratio: 0}.ShouldMerge(now, &Stat{}))
+
+	// 2. 按可回收数据量触发
+	assert.True(t, ReclaimableBytesMergePolicy{MinBytes: 300}.ShouldMerge(now, stat))
+	assert.False(t, ReclaimableBytesMergePolicy{MinBytes: 301}.ShouldMerge(now, stat))
+
+	// 3. 仅在时间段内触发, 支持跨越零点
+	window := TimeWindowMergePolicy{Start: 2 * time.Hour, End: 5 * time.Hour}
+	assert.True(t, window.ShouldMerge(now, stat))
+	assert.False(t, window.ShouldMerge(now.Add(2*time.Hour), stat))
+	assert.False(t, window.ShouldMerge(now, &Stat{}))
+	window.Policy = ReclaimableBytesMergePolicy{MinBytes: 1000}
+	assert.False(t, window.ShouldMerge(now, stat))
+	overnight := TimeWindowMergePolicy{Start: 23 * time.Hour, End: 4 * time.Hour}
+	assert.True(t, overnight.ShouldMerge(now, stat))
+	assert.True(t, overnight.ShouldMerge(now.Add(20*time.Hour+30*time.Minute), stat))
+	assert.False(t, overnight.ShouldMerge(now.Add(2*time.Hour), stat))
+
+	// 4. 从不自动触发
+	assert.False(t, ManualMergePolicy{}.ShouldMerge(now, stat))
+}
+
+func TestDB_MergePolicy(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-policy")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MergePolicy = ReclaimableBytesMergePolicy{MinBytes: 64 * 1024}
+	outcomes := make(chan MergeOutcome, 16)
+	opts.OnMerge = func(outcome MergeOutcome) {
+		outcomes <- outcome
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1. 可回收数据量达到阈值后由后台协程执行 merge
+	for n := 0; n < 3; n++ {
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+		}
+	}
+	select {
+	case outcome := <-outcomes:
+		assert.Nil(t, outcome.Err)
+		assert.Greater(t, outcome.FilesRewritten, 0)
+		assert.Greater(t, outcome.BytesReclaimed, int64(0))
+		assert.Greater(t, outcome.Duration, time.Duration(0))
+		stat := db.Stat()
+		assert.Equal(t, uint(1), stat.Merge.RunNum)
+		assert.Equal(t, outcome.BytesReclaimed, stat.Merge.ReclaimedSize)
+		assert.Equal(t, outcome.Start, stat.Merge.Last.Start)
+	case <-time.After(5 * time.Second):
+		t.Fatal("background merge was not triggered")
+	}
+
+	// 2. 未满足 merge 条件时不记录执行结果
+	assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+	assert.Equal(t, uint(1), db.Stat().Merge.RunNum)
+
+	// 3. 被取消的 merge 记录为失败
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.MergeContext(ctx))
+	outcome := <-outcomes
+	assert.Equal(t, context.Canceled, outcome.Err)
+	assert.Equal(t, 0, outcome.FilesRewritten)
+	stat := db.Stat()
+	assert.Equal(t, uint(2), stat.Merge.RunNum)
+	assert.Equal(t, uint(1), stat.Merge.FailedNum)
+}
+
+// 获取文件大小失败的 IO 实现, 用于模拟 value log GC 失败
+type failSizeReadWriter struct {
+	fio.ReadWriter
+}
+
+func (rw *failSizeReadWriter) Size() (int64, error) {
+	return 0, errSizeFailed
+}
+
+var errSizeFailed = errors.New("size failed")
+
+// 每次写入均持久化时后台 value log GC 同样执行
+func TestDB_ValueLogGCFailure(t *testing.T) {
+	for _, strategy := range []SyncStrategy{No, Always} {
+		t.Run(strconv.Itoa(int(strategy)), func(t *testing.T) {
+			testValueLogGCFailure(t, strategy)
+		})
+	}
+}
+
+func testValueLogGCFailure(t *testing.T, strategy SyncStrategy) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog-gc-failure")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.SyncStrategy = strategy
+	opts.ValueThreshold = 64
+	opts.MergePolicy = ManualMergePolicy{}
+	outcomes := make(chan MergeOutcome, 16)
+	opts.OnMerge = func(outcome MergeOutcome) {
+		select {
+		case outcomes <- outcome:
+		default:
+		}
+	}
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	// 已封存的 value log 文件无法读取
+	vlog := db.vlog
+	vlog.mu.Lock()
+	assert.NotEmpty(t, vlog.olderFiles)
+	for _, valueFile := range vlog.olderFiles {
+		valueFile.ReadWriter = &failSizeReadWriter{ReadWriter: valueFile.ReadWriter}
+	}
+	vlog.mu.Unlock()
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(1024)))
+
+	// 后台 value log GC 的错误记录到 Stat 并通知 OnMerge 回调, 不计入 merge 次数
+	select {
+	case outcome := <-outcomes:
+		assert.True(t, outcome.ValueLogGC)
+		assert.ErrorIs(t, outcome.Err, errSizeFailed)
+		stat := db.Stat()
+		assert.GreaterOrEqual(t, stat.Merge.ValueLogGCFailedNum, uint(1))
+		assert.ErrorIs(t, stat.Merge.LastValueLogGC.Err, errSizeFailed)
+		assert.Equal(t, uint(0), stat.Merge.RunNum)
+	case <-time.After(5 * time.Second):
+		t.Fatal("value log gc failure was not reported")
+	}
+}
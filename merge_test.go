@@ -1,11 +1,15 @@
 package xixi_kv
 
 import (
+	"context"
+	"github.com/XiXi-2024/xixi-kv/data"
 	"github.com/XiXi-2024/xixi-kv/utils"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"os"
 	"sync"
 	"testing"
+	"time"
 )
 
 // 没有任何数据的情况下进行 merge
@@ -179,10 +183,297 @@ func TestDB_Merge5(t *testing.T) {
 	_ = db2.Close()
 }
 
+// merge 完成后无需重启即可生效
+func TestDB_Merge6(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-6")
+	db, err := newTestMergeDB(dir)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 50000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(1024))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 40000; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 40000; i < 45000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value in merge"))
+		assert.Nil(t, err)
+	}
+	before := db.Stat()
+	assert.True(t, before.ReclaimableSize > 0)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+
+	// 临时目录已删除, 旧数据文件已被替换
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	after := db.Stat()
+	assert.Equal(t, int64(0), after.ReclaimableSize)
+	assert.True(t, after.DiskSize < before.DiskSize)
+	assert.Equal(t, uint(10000), after.KeyNum)
+
+	for i := 0; i < 40000; i++ {
+		_, err := db.Get(utils.GetTestKey(i))
+		assert.Equal(t, ErrKeyNotFound, err)
+	}
+	for i := 40000; i < 45000; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new value in merge"), val)
+	}
+
+	// merge 后继续写入并重启校验
+	for i := 45000; i < 46000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("value after merge"))
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+
+	db2, err := newTestMergeDB(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 10000, len(db2.ListKeys()))
+	for i := 45000; i < 46000; i++ {
+		val, err := db2.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("value after merge"), val)
+	}
+	_ = db2.Close()
+}
+
+// 仅重写无效数据占比达到阈值的数据文件
+func TestDB_Merge7(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-7")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+	}
+	// 删除最早文件中的 key, 墓碑值位于写满无效数据的文件中
+	for i := 0; i < 2000; i++ {
+		if i == 1000 {
+			assert.Nil(t, db.Delete(utils.GetTestKey(5)))
+		}
+		assert.Nil(t, db.Put(utils.GetTestKey(999), utils.RandomValue(64)))
+	}
+
+	// 1. 统计各数据文件的数据量
+	before := db.Stat()
+	var diskSize, reclaimableSize int64
+	for _, stat := range before.DataFiles {
+		diskSize += stat.DiskSize
+		reclaimableSize += stat.ReclaimableSize
+	}
+	assert.Equal(t, before.DiskSize, diskSize)
+	assert.Equal(t, before.ReclaimableSize, reclaimableSize)
+	first := before.DataFiles[0]
+	assert.Less(t, first.ReclaimableSize*2, first.DiskSize)
+
+	// 2. 仅重写无效数据占比达到阈值的文件
+	assert.Nil(t, db.Merge())
+	after := db.Stat()
+	assert.Equal(t, first, after.DataFiles[0])
+	assert.Less(t, after.DiskSize, before.DiskSize)
+	assert.Less(t, after.DataFileNum, before.DataFileNum)
+	for fileId, stat := range after.DataFiles {
+		if stat.DiskSize > 0 && fileId != 0 {
+			assert.Less(t, stat.ReclaimableSize*2, stat.DiskSize)
+		}
+	}
+	assert.Equal(t, ErrMergeRatioUnreached, db.Merge())
+
+	// 3. 重启后被删除的 key 不会恢复
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = db.Get(utils.GetTestKey(5))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 999, len(db.ListKeys()))
+	for i := 0; i < 1000; i++ {
+		if i != 5 {
+			_, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+		}
+	}
+}
+
+// 单次 merge 重写的数据量受限
+func TestDB_Merge8(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-8")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.MergeBytesPerRun = 32 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for n := 0; n < 4; n++ {
+		for i := 0; i < 300; i++ {
+			assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(64)))
+		}
+	}
+
+	// 每次仅重写一个数据文件
+	var merges int
+	for {
+		before := db.Stat()
+		err := db.Merge()
+		if err == ErrMergeRatioUnreached {
+			break
+		}
+		assert.Nil(t, err)
+		merges++
+		assert.Less(t, db.Stat().ReclaimableSize, before.ReclaimableSize)
+	}
+	assert.Greater(t, merges, 1)
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(db.ListKeys()))
+}
+
 func newTestMergeDB(path string) (*DB, error) {
 	opts := DefaultOptions
 	opts.DataFileSize = 32 * 1024 * 1024
 	opts.DataFileMergeRatio = 0
 	opts.DirPath = path
+	// 关闭后台 merge, 避免与测试中手动执行的 merge 冲突
+	opts.EnableBackgroundMerge = false
 	return Open(opts)
 }
+
+// merge 限速、取消以及关闭数据库时中止 merge
+func TestDB_MergeContext(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-context")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.MergeBytesPerSecond = 1024 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for n := 0; n < 2; n++ {
+		for i := 0; i < 200; i++ {
+			values[i] = utils.RandomValue(1024)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+	checkValues := func(db *DB) {
+		for i, value := range values {
+			val, err := db.Get(utils.GetTestKey(i))
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		}
+	}
+
+	// 1. 取消的 merge 不留下临时目录, 数据不变
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	err = db.MergeContext(ctx)
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	checkValues(db)
+
+	// 2. 按配置限速, 约 400KB 数据在 1MB/s 下耗时不低于 200ms
+	start := time.Now()
+	assert.Nil(t, db.Merge())
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+	checkValues(db)
+
+	// 3. 关闭数据库时取消正在执行的 merge 并等待其结束
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(1024)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+	opts.MergeBytesPerSecond = 64 * 1024
+	db.options.MergeBytesPerSecond = opts.MergeBytesPerSecond
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- db.Merge()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	assert.Nil(t, db.Close())
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, context.Canceled, <-errCh)
+	assert.Equal(t, ErrDatabaseClosed, db.Merge())
+
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	_, err = os.Stat(db.getMergePath())
+	assert.True(t, os.IsNotExist(err))
+	checkValues(db)
+}
+
+// 仅重写部分数据文件时, hint 索引文件保留未参与 merge 的数据文件的 hint 记录
+func TestDB_MergeHintFile(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-merge-hint-file")
+	opts.DirPath = dir
+	opts.DataFileSize = 32 * 1024
+	opts.DataFileMergeRatio = 0
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 300; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	assert.Nil(t, db.Merge())
+	hintKeys := func() map[string]struct{} {
+		hintFile, err := data.OpenHintFile(dir, nil)
+		assert.Nil(t, err)
+		defer hintFile.Close()
+		keys := make(map[string]struct{})
+		var offset int64 = 0
+		for {
+			logRecord, size, err := hintFile.ReadLogRecord(offset)
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			keys[string(logRecord.Key)] = struct{}{}
+			offset += size
+		}
+		return keys
+	}
+	assert.Equal(t, 300, len(hintKeys()))
+
+	// 覆盖第一个数据文件中的数据, 仅重写该文件
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(1024)))
+	}
+	db.options.MergeBytesPerRun = 1
+	assert.Nil(t, db.Merge())
+	keys := hintKeys()
+	for i := 20; i < 300; i++ {
+		_, ok := keys[string(utils.GetTestKey(i))]
+		assert.True(t, ok)
+	}
+
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(db.ListKeys()))
+	assert.Nil(t, db.Close())
+}
@@ -1,9 +1,11 @@
 package xixi_kv
 
 import (
+	"github.com/XiXi-2024/xixi-kv/data"
 	"github.com/XiXi-2024/xixi-kv/fio"
 	"github.com/XiXi-2024/xixi-kv/index"
 	"os"
+	"time"
 )
 
 type SyncStrategy byte
@@ -16,6 +18,17 @@ const (
 	Threshold // 新写入数据量达到阈值持久化
 )
 
+// RecoveryPolicy 加载数据文件时读取到损坏日志记录的处理策略
+type RecoveryPolicy byte
+
+const (
+	RecoveryFail RecoveryPolicy = iota // 打开失败
+
+	RecoveryTruncateTail // 截断最新数据文件尾部损坏的日志记录, 其余位置损坏时打开失败
+
+	RecoverySkip // 跳过损坏的日志记录, 无法确定长度时截断文件尾部
+)
+
 // Options 用户配置项
 type Options struct {
 	DirPath               string          // 数据目录
@@ -25,7 +38,47 @@ type Options struct {
 	IndexType             index.IndexType // 索引类型
 	FileIOType            fio.FileIOType  // 文件 IO 类型
 	EnableBackgroundMerge bool            // 是否启用后台定时 merge
-	DataFileMergeRatio    float32         // 执行 merge 的无效数据占比阈值
+	// 后台 merge 调度策略, 为 nil 时使用阈值为 DataFileMergeRatio 的 RatioMergePolicy
+	MergePolicy MergePolicy
+	// 每次 merge 执行完成、失败或被取消后调用, 包括用户调用的 Merge, 后台 value log GC 执行失败时同样调用
+	OnMerge            func(MergeOutcome)
+	DataFileMergeRatio float32 // 数据文件参与 merge 的无效数据占比阈值, 按文件计算
+	// 单次 merge 最多重写的数据文件数据量, 单位字节, 0 表示不限制
+	// 超过时仅重写无效数据占比最高的部分文件, 其余文件留待下次 merge
+	MergeBytesPerRun int64
+	// merge 读取数据文件的速率上限, 单位字节/秒, 0 表示不限制
+	MergeBytesPerSecond int64
+	// value 压缩算法, 仅对之后写入和 merge 重写的数据生效, 已写入的数据始终可读
+	// 修改后可通过 DB.MergeAll 按新配置重写全部数据
+	Compression data.CompressionType
+	// 密钥提供者, 不为 nil 时加密数据文件、Hint 文件、merge 完成标识文件和事务序列号文件
+	// 轮换密钥后, 已写入的数据在 merge 重写时使用新密钥加密, 可通过 DB.MergeAll 重写全部数据
+	// 注意 B+ 树索引文件中保存的 key 不加密
+	KeyProvider data.KeyProvider
+	// 加密算法, 为 nil 时使用 AES-GCM
+	Cipher data.Cipher
+	// 读取到损坏日志记录的处理策略
+	RecoveryPolicy RecoveryPolicy
+	// value 长度超过该值时分离存储到 value log, 数据文件中仅保存指向 value log 的位置信息
+	// merge 无需重写分离存储的 value, value log 由 ValueLogGC 独立回收, 0 表示不分离存储
+	ValueThreshold int
+	// 执行 value log GC 的无效数据占比阈值, 按文件计算
+	ValueLogGCRatio float32
+	// 打开数据库时并发读取数据文件加载索引的协程数量, 0 表示使用 CPU 核数
+	LoadIndexParallelism int
+	// 打开数据库成功后调用, 获取加载索引等耗时统计
+	OnOpen func(OpenStat)
+	// 关闭数据库时将内存索引持久化为索引检查点, 下次打开时加载检查点并仅读取之后写入的日志记录
+	// B+ 树索引本身已持久化, 不写入检查点
+	EnableIndexCheckpoint bool
+	// 后台写入索引检查点的间隔, 缩短崩溃后重启的耗时, 0 表示仅在关闭数据库时写入
+	IndexCheckpointInterval time.Duration
+	// 作为复制从节点时, 每次复制会话失败后调用, 之后按退避间隔自动重连
+	OnReplicationError func(error)
+	// 只读模式, 不获取文件锁, 可与写入进程同时打开同一数据目录
+	// 不创建和修改任何文件, 写入和 merge 返回 ErrDatabaseReadOnly, 通过 Refresh 加载新写入的数据
+	// B+ 树索引文件由写入进程独占, 只读模式下改为从数据文件构建内存索引
+	ReadOnly bool
 }
 
 // IteratorOptions 索引迭代器配置项
@@ -51,9 +104,18 @@ var DefaultOptions = Options{
 	SyncStrategy:          Threshold,
 	BytesPerSync:          1024 * 1024,
 	EnableBackgroundMerge: true,
+	MergePolicy:           nil,
 	IndexType:             index.BTree,
 	FileIOType:            fio.StandardFIO,
 	DataFileMergeRatio:    0.5,
+	MergeBytesPerRun:      0,
+	MergeBytesPerSecond:   0,
+	Compression:           data.NoCompression,
+	RecoveryPolicy:        RecoveryTruncateTail,
+	ValueThreshold:        0,
+	ValueLogGCRatio:       0.5,
+	LoadIndexParallelism:  0,
+	EnableIndexCheckpoint: true,
 }
 
 // DefaultIteratorOptions 默认迭代器Options, 供测试使用
@@ -0,0 +1,130 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// 以只读模式打开数据库
+// 不获取文件锁, 从数据文件构建内存索引, 不处理 merge 临时目录
+func openReadOnly(options Options) (*DB, error) {
+	// 数据目录不存在时不创建
+	if _, err := os.Stat(options.DirPath); err != nil {
+		return nil, err
+	}
+	options.IndexType = index.BTree
+	options.EnableBackgroundMerge = false
+
+	db := &DB{
+		options:    options,
+		mu:         new(sync.RWMutex),
+		index:      index.NewIndexer(options.IndexType, options.DirPath, false),
+		closedChan: make(chan struct{}),
+		snapshots:  make(map[*Snapshot]struct{}),
+		watchMu:    new(sync.Mutex),
+		watchers:   make(map[*Watcher]struct{}),
+		readOnly:   true,
+		vlog:       newValueLog(true),
+	}
+	if options.KeyProvider != nil {
+		db.encryptor = data.NewEncryptor(options.Cipher, options.KeyProvider)
+	}
+
+	if err := db.reload(); err != nil {
+		db.releaseOnOpenFailure()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Refresh 只读模式下加载写入进程新追加的日志记录和新创建的数据文件
+// 写入进程执行 merge 后重新加载全部数据文件, 非只读模式下无需刷新
+func (db *DB) Refresh() error {
+	if !db.options.ReadOnly {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// merge 安装时替换 hint 文件, 以此判断数据文件是否已被重写
+	hintInfo, err := statHintFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	if (hintInfo == nil) != (db.hintInfo == nil) || hintInfo != nil && !os.SameFile(hintInfo, db.hintInfo) {
+		return db.reload()
+	}
+
+	fileIds, err := db.dataFileIds()
+	if err != nil {
+		return err
+	}
+	// 跳过已加载的数据文件
+	var newFileIds []uint32
+	for _, fileId := range fileIds {
+		if db.activeFile == nil || fileId > db.activeFile.FileId {
+			newFileIds = append(newFileIds, fileId)
+		}
+	}
+
+	builder := db.newIndexBuilder()
+	defer builder.finish()
+	// 继续读取活跃文件中新追加的日志记录
+	if db.activeFile != nil {
+		offset, err := db.replayDataFile(builder, db.activeFile, db.activeFile.WriteOff, len(newFileIds) == 0)
+		if err != nil {
+			return err
+		}
+		db.activeFile.WriteOff = offset
+	}
+	// 依次加载新创建的数据文件, id 最大的文件作为活跃文件
+	for i, fileId := range newFileIds {
+		dataFile, err := db.openDataFile(fileId)
+		if err != nil {
+			return err
+		}
+		if db.activeFile != nil {
+			sealedFile := db.activeFile
+			db.updateOlderFiles(func(files map[uint32]*data.DataFile) {
+				files[sealedFile.FileId] = sealedFile
+			})
+		}
+		db.activeFile = dataFile
+		offset, err := db.replayDataFile(builder, dataFile, 0, i == len(newFileIds)-1)
+		if err != nil {
+			return err
+		}
+		dataFile.WriteOff = offset
+	}
+	return nil
+}
+
+// 重新加载全部数据文件并重建内存索引, 调用方需持有写锁
+func (db *DB) reload() error {
+	if err := db.resetDataFiles(); err != nil {
+		return err
+	}
+	hintInfo, err := statHintFile(db.options.DirPath)
+	if err != nil {
+		return err
+	}
+	db.hintInfo = hintInfo
+
+	fileIds, err := db.loadDataFiles()
+	if err != nil {
+		return err
+	}
+	return db.loadIndexFromDataFiles(fileIds, 0, 0)
+}
+
+// 获取 hint 文件信息, 不存在时返回 nil
+func statHintFile(dirPath string) (os.FileInfo, error) {
+	info, err := os.Stat(filepath.Join(dirPath, data.HintFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return info, err
+}
@@ -0,0 +1,120 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ReadOnly(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+
+	// 1. 写入进程运行期间以只读模式打开
+	roOpts := opts
+	roOpts.ReadOnly = true
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(500), ro.Stat().KeyNum)
+	expected, _ := db.Get(utils.GetTestKey(10))
+	val, err := ro.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, val)
+
+	// 2. 不允许写入
+	assert.Equal(t, ErrDatabaseReadOnly, ro.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Equal(t, ErrDatabaseReadOnly, ro.Delete(utils.GetTestKey(1)))
+	wb, err := ro.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Equal(t, ErrDatabaseReadOnly, wb.Commit())
+	assert.Equal(t, ErrDatabaseReadOnly, ro.Merge())
+	assert.Equal(t, ErrDatabaseReadOnly, ro.BackupTo(io.Discard))
+
+	// 3. 刷新后读取新追加的日志记录和新创建的数据文件
+	fileNum := ro.Stat().DataFileNum
+	for i := 500; i < 1000; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, db.Delete(utils.GetTestKey(0)))
+	_, err = ro.Get(utils.GetTestKey(900))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Nil(t, ro.Refresh())
+	assert.Equal(t, uint(999), ro.Stat().KeyNum)
+	assert.Greater(t, ro.Stat().DataFileNum, fileNum)
+	expected, _ = db.Get(utils.GetTestKey(900))
+	val, err = ro.Get(utils.GetTestKey(900))
+	assert.Nil(t, err)
+	assert.Equal(t, expected, val)
+
+	// 4. 写入进程 merge 后重新加载
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.Put(utils.GetTestKey(2000), utils.RandomValue(128)))
+	assert.Nil(t, ro.Refresh())
+	assert.Equal(t, uint(501), ro.Stat().KeyNum)
+	_, err = ro.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = ro.Get(utils.GetTestKey(2000))
+	assert.Nil(t, err)
+
+	// 5. 关闭时不写入事务序列号文件
+	assert.Nil(t, ro.Close())
+	_, err = os.Stat(filepath.Join(dir, data.SeqNoFileName))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestDB_ReadOnly2(t *testing.T) {
+	// 1. 数据目录不存在时不创建
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-readonly2")
+	opts.DirPath = filepath.Join(dir, "not-exist")
+	opts.ReadOnly = true
+	_, err := Open(opts)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(opts.DirPath)
+	assert.True(t, os.IsNotExist(err))
+	_ = os.RemoveAll(dir)
+
+	// 2. 尾部不完整的日志记录视为写入中, 不截断文件
+	opts = DefaultOptions
+	dir, _ = os.MkdirTemp("", "bitcask-go-readonly2")
+	opts.DirPath = dir
+	opts.IndexType = index.BPTree
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, db.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	record, _ := data.EncodeLogRecord(&data.LogRecord{Key: []byte("torn"), Value: utils.RandomValue(128)})
+	assert.Nil(t, db.activeFile.Write(record[:len(record)/2]))
+	size, _ := db.activeFile.ReadWriter.Size()
+
+	roOpts := opts
+	roOpts.ReadOnly = true
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(100), ro.Stat().KeyNum)
+	actual, _ := db.activeFile.ReadWriter.Size()
+	assert.Equal(t, size, actual)
+	assert.Nil(t, ro.Close())
+}
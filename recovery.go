@@ -0,0 +1,63 @@
+package xixi_kv
+
+import (
+	"errors"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"io"
+)
+
+// 按配置的策略处理加载数据文件时读取到的损坏日志记录
+// size 为头部记录的日志记录长度, 无法确定时为 0, isNewest 标识是否为最新的数据文件
+// 返回需跳过的长度, 为 0 表示已截断文件尾部, 应停止读取该文件
+func (db *DB) recoverCorruptedRecord(dataFile *data.DataFile, offset, size int64, isNewest bool, cause error) (int64, error) {
+	// 仅处理校验失败和不完整的日志记录, 其余错误如密钥错误等直接返回, 避免误删数据
+	if !errors.Is(cause, data.ErrInvalidCRC) && !errors.Is(cause, io.ErrUnexpectedEOF) {
+		return 0, cause
+	}
+	corruption := &CorruptionError{FileId: dataFile.FileId, Offset: offset, Err: cause}
+
+	fileSize, err := dataFile.ReadWriter.Size()
+	if err != nil {
+		return 0, err
+	}
+	// 损坏的日志记录延伸至文件末尾
+	atTail := size == 0 || offset+size >= fileSize
+
+	// 离线检查时仅记录, 不修改数据文件
+	if db.checkReport != nil {
+		db.checkReport.Corruptions = append(db.checkReport.Corruptions, corruption)
+		if atTail {
+			return 0, nil
+		}
+		return size, nil
+	}
+
+	// 只读模式下不修改数据文件, 最新数据文件尾部可能为写入进程正在写入的日志记录, 停止读取即可
+	if db.options.ReadOnly {
+		if atTail && (isNewest || db.options.RecoveryPolicy == RecoverySkip) {
+			return 0, nil
+		}
+		if db.options.RecoveryPolicy == RecoverySkip {
+			db.addFileSize(dataFile.FileId, size)
+			db.addReclaimSize(dataFile.FileId, size)
+			return size, nil
+		}
+		return 0, corruption
+	}
+
+	switch db.options.RecoveryPolicy {
+	case RecoveryTruncateTail:
+		if isNewest && atTail {
+			return 0, dataFile.Truncate(offset)
+		}
+	case RecoverySkip:
+		if !atTail {
+			// 跳过的数据计入无效数据量, 由 merge 回收
+			db.addFileSize(dataFile.FileId, size)
+			db.addReclaimSize(dataFile.FileId, size)
+			return size, nil
+		}
+		return 0, dataFile.Truncate(offset)
+	}
+	return 0, corruption
+}
@@ -0,0 +1,148 @@
+package xixi_kv
+
+import (
+	"errors"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"testing"
+)
+
+// 写入测试数据后关闭, 返回各条日志记录的起始偏移量
+func prepareRecoveryDB(t *testing.T, opts Options) []int64 {
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	var offsets []int64
+	for i := 0; i < 10; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(24))
+		assert.Nil(t, err)
+		offsets = append(offsets, db.index.Get(utils.GetTestKey(i)).Offset)
+	}
+	err = db.Close()
+	assert.Nil(t, err)
+	return offsets
+}
+
+func TestOpen_TornTail(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-tail")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	prepareRecoveryDB(t, opts)
+
+	// 模拟写入过程中崩溃, 活跃文件尾部存在不完整的日志记录
+	fileName := data.GetDataFileName(dir, 0)
+	stat, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{1, 2, 3, 4, 0, 8, 40, 'k', 'e'})
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	// 1. fail 策略打开失败, 返回详细错误
+	opts.RecoveryPolicy = RecoveryFail
+	_, err = Open(opts)
+	var corruption *CorruptionError
+	assert.True(t, errors.As(err, &corruption))
+	assert.Equal(t, uint32(0), corruption.FileId)
+	assert.Equal(t, stat.Size(), corruption.Offset)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+
+	// 2. truncate tail 策略截断尾部后正常打开
+	opts.RecoveryPolicy = RecoveryTruncateTail
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 10, len(db.ListKeys()))
+	assert.Equal(t, stat.Size(), db.activeFile.WriteOff)
+
+	// 截断后继续写入, 重启后数据完整
+	err = db.Put(utils.GetTestKey(10), utils.RandomValue(24))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 11, len(db.ListKeys()))
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestOpen_CorruptedRecord(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-middle")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	offsets := prepareRecoveryDB(t, opts)
+
+	// 破坏中间一条日志记录的 value
+	fileName := data.GetDataFileName(dir, 0)
+	content, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	content[offsets[6]-1] ^= 0xff
+	err = os.WriteFile(fileName, content, 0644)
+	assert.Nil(t, err)
+
+	// 1. truncate tail 策略不处理中间位置的损坏
+	opts.RecoveryPolicy = RecoveryTruncateTail
+	_, err = Open(opts)
+	var corruption *CorruptionError
+	assert.True(t, errors.As(err, &corruption))
+	assert.Equal(t, uint32(0), corruption.FileId)
+	assert.Equal(t, offsets[5], corruption.Offset)
+	assert.True(t, errors.Is(err, data.ErrInvalidCRC))
+
+	// 2. skip 策略跳过损坏的日志记录
+	opts.RecoveryPolicy = RecoverySkip
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, 9, len(db.ListKeys()))
+	_, err = db.Get(utils.GetTestKey(5))
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.Get(utils.GetTestKey(6))
+	assert.Nil(t, err)
+	assert.True(t, db.Stat().ReclaimableSize > 0)
+	err = db.Close()
+	assert.Nil(t, err)
+}
+
+func TestOpen_TornTail_BPTree(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-recovery-bptree")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	opts.IndexType = index.BPTree
+	defer func() {
+		_ = os.RemoveAll(dir)
+	}()
+	prepareRecoveryDB(t, opts)
+
+	fileName := data.GetDataFileName(dir, 0)
+	stat, err := os.Stat(fileName)
+	assert.Nil(t, err)
+	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.Nil(t, err)
+	_, err = file.Write([]byte{1, 2, 3, 4, 0, 8, 40, 'k', 'e'})
+	assert.Nil(t, err)
+	_ = file.Close()
+
+	db, err := Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, stat.Size(), db.activeFile.WriteOff)
+	err = db.Put(utils.GetTestKey(10), utils.RandomValue(24))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(10))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+	err = db.Close()
+	assert.Nil(t, err)
+}
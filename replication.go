@@ -0,0 +1,784 @@
+package xixi_kv
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"hash/crc32"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 复制协议消息类型
+const (
+	replMsgSubscribe byte = iota + 1 // 从节点订阅, 携带最近应用的日志记录位置和 crc 校验值
+	replMsgRecords                   // 日志记录原始数据, 携带所在文件 id 和起始偏移量
+	replMsgHeartbeat                 // 心跳, 无新写入时定期发送
+	replMsgBootstrap                 // 检查点数据块, 长度为 0 表示检查点结束
+)
+
+const (
+	// 复制消息头部长度, type(1) + fid(4) + offset(8) + length(4)
+	replHeaderSize = 17
+	// 单条复制消息的最大长度
+	maxReplPayloadSize = 1 << 30
+	// 单次发送的日志记录数据量, 至少包含一条完整的日志记录
+	replBatchSize = 1024 * 1024
+	// 无新写入时的心跳间隔
+	replHeartbeatInterval = time.Second
+	// 从节点等待消息的超时时间, 超时视为连接断开
+	replReadTimeout = 5 * replHeartbeatInterval
+	// 建立连接和发送消息的超时时间
+	replWriteTimeout = 10 * time.Second
+	// 从节点重连的最小和最大等待间隔
+	minReplRetryInterval = 100 * time.Millisecond
+	maxReplRetryInterval = 5 * time.Second
+	// 从节点接收检查点的临时目录名称, 位于数据目录中
+	replBootstrapDirName = "replica-bootstrap"
+)
+
+// 复制消息头部
+type replHeader struct {
+	typ    byte
+	fid    uint32
+	offset int64
+	length uint32
+}
+
+// 复制位置, 描述从节点最近应用的日志记录
+type replPosition struct {
+	fid    uint32
+	offset int64
+	crc    uint32
+}
+
+// 日志追加通知, 供复制会话等待新写入
+type appendNotifier struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// 获取下次追加日志记录时关闭的通道
+func (n *appendNotifier) wait() <-chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch == nil {
+		n.ch = make(chan struct{})
+	}
+	return n.ch
+}
+
+// 唤醒全部等待者
+func (n *appendNotifier) notify() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.ch != nil {
+		close(n.ch)
+		n.ch = nil
+	}
+}
+
+// ServeReplication 作为复制主节点在 listener 上接受从节点连接
+// 按数据文件 id 和偏移量顺序发送日志记录的原始数据, 从节点请求的位置已被 merge 重写时发送一致性检查点
+// 阻塞直至 listener 关闭, 数据库关闭时自动关闭 listener
+func (db *DB) ServeReplication(listener net.Listener) error {
+	// 复制仅发送数据文件, 从节点无法读取分离存储的 value
+	if db.options.ValueThreshold > 0 || len(db.vlog.files()) > 0 {
+		return ErrValueLogUnsupported
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-db.closedChan:
+			_ = listener.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case <-db.closedChan:
+				return nil
+			default:
+				return err
+			}
+		}
+		go func() {
+			defer func() {
+				_ = conn.Close()
+			}()
+			_ = db.serveFollower(conn)
+		}()
+	}
+}
+
+// 处理单个从节点的复制会话
+func (db *DB) serveFollower(conn net.Conn) error {
+	_ = conn.SetReadDeadline(time.Now().Add(replWriteTimeout))
+	header, payload, err := readReplMessage(conn)
+	if err != nil {
+		return err
+	}
+	if header.typ != replMsgSubscribe {
+		return fmt.Errorf("unexpected replication message type %d", header.typ)
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+
+	var last *replPosition
+	if len(payload) == crc32.Size {
+		last = &replPosition{fid: header.fid, offset: header.offset, crc: binary.LittleEndian.Uint32(payload)}
+	}
+	fid, offset, ok, err := db.locateReplication(last)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return db.sendBootstrap(conn)
+	}
+	return db.streamLog(conn, fid, offset)
+}
+
+// 定位从节点最近应用的日志记录之后的位置
+// 对应位置的日志记录不存在或不一致时返回 false, 表示该文件已被 merge 重写, 需要发送检查点
+func (db *DB) locateReplication(last *replPosition) (uint32, int64, bool, error) {
+	// 从节点最近应用的日志记录已写入完成, 读锁即可避免读取期间文件被 merge 关闭
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// 本地无数据时从 id 最小的数据文件开始发送, 当前数据文件即可还原全部数据
+	if last == nil {
+		fileIds := db.sortedFileIds()
+		if len(fileIds) == 0 {
+			return 0, 0, true, nil
+		}
+		return fileIds[0], 0, true, nil
+	}
+
+	// 比较 crc 校验值, 确认对应文件未被 merge 重写
+	dataFile := db.dataFileOf(last.fid)
+	if dataFile == nil {
+		return 0, 0, false, nil
+	}
+	_, size, err := dataFile.ReadLogRecord(last.offset)
+	if err != nil {
+		return 0, 0, false, nil
+	}
+	crc, err := readRecordCRC(dataFile, last.offset)
+	if err != nil || crc != last.crc {
+		return 0, 0, false, nil
+	}
+	return last.fid, last.offset + size, true, nil
+}
+
+// 从指定位置开始持续发送日志记录, 无新写入时发送心跳
+// 正在发送的文件被 merge 重写时结束会话, 由从节点重新订阅
+func (db *DB) streamLog(conn net.Conn, fid uint32, offset int64) error {
+	var current *data.DataFile
+	for {
+		// 暂停写入并持有读锁, 保证活跃文件的写入偏移不包含写入中的日志记录, 且不阻塞读取
+		db.commits.pause()
+		db.mu.RLock()
+		dataFile := db.dataFileOf(fid)
+		if dataFile == nil && db.activeFile != nil || current != nil && dataFile != current {
+			db.mu.RUnlock()
+			db.commits.resume()
+			return ErrReplicationDiverged
+		}
+		var limit int64
+		var sealed bool
+		var nextFid uint32
+		if dataFile != nil {
+			current = dataFile
+			limit = dataFile.WriteOff
+			if sealed = dataFile != db.activeFile; sealed {
+				size, err := dataFile.ReadWriter.Size()
+				if err != nil {
+					db.mu.RUnlock()
+					db.commits.resume()
+					return err
+				}
+				limit = size
+				nextFid = db.activeFile.FileId
+				for fileId := range db.getOlderFiles() {
+					if fileId > fid && fileId < nextFid {
+						nextFid = fileId
+					}
+				}
+			}
+		}
+		// 暂停写入期间获取通知通道, 避免遗漏之后的写入
+		appended := db.appended.wait()
+		db.mu.RUnlock()
+		db.commits.resume()
+
+		switch {
+		case offset < limit:
+			buf, err := db.readReplBatch(dataFile, offset, limit)
+			if err != nil {
+				return err
+			}
+			if err := sendReplMessage(conn, replMsgRecords, fid, offset, buf); err != nil {
+				return err
+			}
+			offset += int64(len(buf))
+		case offset > limit:
+			return ErrReplicationDiverged
+		case sealed:
+			fid, offset, current = nextFid, 0, nil
+		default:
+			select {
+			case <-appended:
+			case <-time.After(replHeartbeatInterval):
+				if err := sendReplMessage(conn, replMsgHeartbeat, 0, 0, nil); err != nil {
+					return err
+				}
+			case <-db.closedChan:
+				return nil
+			}
+		}
+	}
+}
+
+// 读取 [offset, limit) 范围内的完整日志记录, 单次读取量不超过 replBatchSize
+func (db *DB) readReplBatch(dataFile *data.DataFile, offset, limit int64) ([]byte, error) {
+	// 持有读锁, 避免读取期间文件被 merge 关闭
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.dataFileOf(dataFile.FileId) != dataFile {
+		return nil, ErrReplicationDiverged
+	}
+
+	end := offset
+	for end < limit && end-offset < replBatchSize {
+		_, size, err := dataFile.ReadLogRecord(end)
+		if err != nil {
+			return nil, err
+		}
+		end += size
+	}
+	buf := make([]byte, end-offset)
+	if _, err := dataFile.ReadWriter.Read(buf, offset); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// 将一致性检查点以数据块的形式发送给从节点
+func (db *DB) sendBootstrap(conn net.Conn) error {
+	w := bufio.NewWriterSize(&replChunkWriter{conn: conn}, replBatchSize)
+	if err := db.BackupTo(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return sendReplMessage(conn, replMsgBootstrap, 0, 0, nil)
+}
+
+// OpenFollower 以只读的复制从节点打开数据库, 持续从 leaderAddr 的主节点同步日志记录
+// 从节点的数据文件与主节点保持一致, 日志记录按加载索引的流程应用, 写入和 merge 返回 ErrDatabaseReadOnly
+// 连接断开后自动重连, 从最近应用的日志记录之后继续同步, 所需数据已被主节点 merge 重写时同步检查点重建数据
+// 从节点仅支持内存索引, 关闭时与普通实例相同写入事务序列号文件, 重新打开后事务序列号不回退
+// 未完成的事务记录由复制流程暂存, 从节点不写入索引检查点, 重新打开时读取数据文件加载索引
+func OpenFollower(options Options, leaderAddr string) (*DB, error) {
+	if options.IndexType == index.BPTree {
+		return nil, ErrFollowerIndexUnsupported
+	}
+	if options.ValueThreshold > 0 {
+		return nil, ErrValueLogUnsupported
+	}
+	// 从节点需写入同步的日志记录, 不能以只读模式打开
+	options.ReadOnly = false
+	options.EnableBackgroundMerge = false
+	db, err := Open(options)
+	if err != nil {
+		return nil, err
+	}
+	db.readOnly = true
+
+	f := &follower{
+		db:      db,
+		addr:    leaderAddr,
+		builder: db.newIndexBuilder(),
+		mu:      new(sync.Mutex),
+		done:    make(chan struct{}),
+		wg:      new(sync.WaitGroup),
+	}
+	if f.last, err = db.lastReplPosition(); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	db.follower = f
+
+	f.wg.Add(1)
+	go f.run()
+	return db, nil
+}
+
+// ReplicationStat 复制从节点自打开起的同步统计信息, 不持久化, 非从节点时为零值
+type ReplicationStat struct {
+	FailedNum   uint      // 复制会话失败的次数
+	LastErr     error     // 最近一次复制会话失败的错误, 未失败时为 nil
+	LastErrTime time.Time // 最近一次复制会话失败的时刻
+}
+
+// 复制从节点状态
+type follower struct {
+	db      *DB
+	addr    string        // 主节点地址
+	builder *indexBuilder // 索引构建器, 保留跨消息的未完成事务
+	last    *replPosition // 最近应用的日志记录, 为 nil 表示本地无日志记录
+	mu      *sync.Mutex
+	conn    net.Conn      // 当前连接
+	done    chan struct{} // 用于通知复制协程退出
+	wg      *sync.WaitGroup
+	stat    ReplicationStat // 同步统计信息
+}
+
+// 复制协程, 断开后按指数退避重连
+func (f *follower) run() {
+	defer f.wg.Done()
+	retry := minReplRetryInterval
+	for {
+		connected, err := f.session()
+		select {
+		case <-f.done:
+			return
+		default:
+		}
+		if connected {
+			retry = minReplRetryInterval
+		}
+		// 同步检查点后立即重新订阅
+		if err == nil {
+			continue
+		}
+		f.reportError(err)
+		select {
+		case <-f.done:
+			return
+		case <-time.After(retry):
+		}
+		retry = min(retry*2, maxReplRetryInterval)
+	}
+}
+
+// 单次复制会话, 订阅后持续应用主节点发送的日志记录
+func (f *follower) session() (bool, error) {
+	conn, err := net.DialTimeout("tcp", f.addr, replWriteTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+	if !f.setConn(conn) {
+		return false, nil
+	}
+	defer f.setConn(nil)
+
+	// 发送最近应用的日志记录位置
+	f.db.mu.RLock()
+	last := f.last
+	f.db.mu.RUnlock()
+	var fid uint32
+	var offset int64
+	var payload []byte
+	if last != nil {
+		fid, offset = last.fid, last.offset
+		payload = binary.LittleEndian.AppendUint32(nil, last.crc)
+	}
+	if err := sendReplMessage(conn, replMsgSubscribe, fid, offset, payload); err != nil {
+		return false, err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(replReadTimeout))
+		header, payload, err := readReplMessage(r)
+		if err != nil {
+			return true, err
+		}
+		switch header.typ {
+		case replMsgRecords:
+			if err := f.apply(header.fid, header.offset, payload); err != nil {
+				return true, err
+			}
+		case replMsgHeartbeat:
+		case replMsgBootstrap:
+			return true, f.bootstrap(&replChunkReader{conn: conn, r: r, buf: payload, done: len(payload) == 0})
+		default:
+			return true, fmt.Errorf("unexpected replication message type %d", header.typ)
+		}
+	}
+}
+
+// 记录复制会话失败的错误并通知回调
+func (f *follower) reportError(err error) {
+	err = fmt.Errorf("failed to replicate from %s: %w", f.addr, err)
+	f.mu.Lock()
+	f.stat.FailedNum++
+	f.stat.LastErr = err
+	f.stat.LastErrTime = time.Now()
+	f.mu.Unlock()
+
+	if f.db.options.OnReplicationError != nil {
+		f.db.options.OnReplicationError(err)
+	}
+}
+
+// 获取复制从节点的同步统计信息
+func (db *DB) replicationStat() ReplicationStat {
+	f := db.follower
+	if f == nil {
+		return ReplicationStat{}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.stat
+}
+
+// 设置当前连接, 复制已停止时返回 false
+func (f *follower) setConn(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	select {
+	case <-f.done:
+		return false
+	default:
+	}
+	f.conn = conn
+	return true
+}
+
+// 将主节点发送的日志记录追加到对应的数据文件, 并按加载索引的流程应用
+func (f *follower) apply(fid uint32, offset int64, payload []byte) error {
+	db := f.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	dataFile, err := db.replicaDataFile(fid, offset)
+	if err != nil {
+		return err
+	}
+	if err := dataFile.Write(payload); err != nil {
+		return err
+	}
+
+	// 先解码全部日志记录, 数据不完整时撤销本次写入
+	end := offset + int64(len(payload))
+	var records []*data.LogRecord
+	var positions []*data.LogRecordPos
+	for off := offset; off < end; {
+		logRecord, size, err := dataFile.ReadLogRecord(off)
+		if err == nil && off+size > end {
+			err = ErrReplicationDiverged
+		}
+		if err != nil {
+			_ = dataFile.Truncate(offset)
+			return err
+		}
+		records = append(records, logRecord)
+		positions = append(positions, &data.LogRecordPos{
+			Fid:    fid,
+			Offset: off,
+			Size:   uint32(size),
+			Expire: logRecord.Expire,
+		})
+		off += size
+	}
+
+	// 执行配置的持久化策略
+	db.bytesWrite += uint(len(payload))
+	syncStrategy := db.options.SyncStrategy
+	if syncStrategy == Always || (syncStrategy == Threshold && db.bytesWrite >= db.options.BytesPerSync) {
+		if err := dataFile.Sync(); err != nil {
+			return err
+		}
+		db.bytesWrite = 0
+	}
+
+	f.builder.now = time.Now().UnixNano()
+	for i, logRecord := range records {
+		f.builder.apply(logRecord, positions[i])
+	}
+	f.builder.finish()
+
+	lastPos := positions[len(positions)-1]
+	f.last = &replPosition{
+		fid:    fid,
+		offset: lastPos.Offset,
+		crc:    binary.LittleEndian.Uint32(payload[lastPos.Offset-offset:]),
+	}
+	db.appended.notify()
+	return nil
+}
+
+// 获取日志记录写入的数据文件, 写入位置必须为对应文件的末尾, 调用方需持有写锁
+// 文件不存在时创建并设置为新的活跃文件
+func (db *DB) replicaDataFile(fid uint32, offset int64) (*data.DataFile, error) {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		if offset != db.activeFile.WriteOff {
+			return nil, ErrReplicationDiverged
+		}
+		return db.activeFile, nil
+	}
+	if dataFile := db.getOlderFiles()[fid]; dataFile != nil {
+		size, err := dataFile.ReadWriter.Size()
+		if err != nil {
+			return nil, err
+		}
+		if offset != size {
+			return nil, ErrReplicationDiverged
+		}
+		return dataFile, nil
+	}
+	if offset != 0 || db.activeFile != nil && fid < db.activeFile.FileId {
+		return nil, ErrReplicationDiverged
+	}
+
+	dataFile, err := data.OpenDataFile(db.options.DirPath, fid, db.options.FileIOType, db.encryptor)
+	if err != nil {
+		return nil, err
+	}
+	if db.activeFile != nil {
+		if err := db.activeFile.Sync(); err != nil {
+			return nil, err
+		}
+		sealedFile := db.activeFile
+		db.updateOlderFiles(func(files map[uint32]*data.DataFile) {
+			files[sealedFile.FileId] = sealedFile
+		})
+	}
+	db.activeFile = dataFile
+	return dataFile, nil
+}
+
+// 使用主节点发送的检查点替换全部数据文件, 并重新加载索引
+func (f *follower) bootstrap(r io.Reader) error {
+	db := f.db
+	tempDir := filepath.Join(db.options.DirPath, replBootstrapDirName)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tempDir)
+	}()
+	// 接收并校验完成后再替换, 避免接收失败时丢失原数据
+	if err := RestoreFrom(r, tempDir); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// 释放原数据文件并清空内存索引
+	if err := db.resetDataFiles(); err != nil {
+		return err
+	}
+
+	// 删除原数据文件, 移入检查点中的数据文件
+	for _, dir := range []string{db.options.DirPath, tempDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			// 原数据文件的 hint 文件一并删除
+			if !strings.HasSuffix(entry.Name(), data.DataFileNameSuffix) && !strings.HasSuffix(entry.Name(), data.HintFileNameSuffix) {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			if dir == tempDir {
+				err = os.Rename(path, filepath.Join(db.options.DirPath, entry.Name()))
+			} else {
+				err = os.Remove(path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// 原数据文件的索引检查点已过期
+	if err := removeIndexCheckpoint(db.options.DirPath); err != nil {
+		return err
+	}
+
+	// 重新加载索引
+	fileIds, err := db.loadDataFiles()
+	if err != nil {
+		return err
+	}
+	if err := db.loadIndexFromDataFiles(fileIds, 0, 0); err != nil {
+		return err
+	}
+	f.builder = db.newIndexBuilder()
+	f.last, err = db.lastReplPosition()
+	db.appended.notify()
+	return err
+}
+
+// 停止复制, 等待复制协程退出
+func (db *DB) stopFollower() {
+	f := db.follower
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	select {
+	case <-f.done:
+	default:
+		close(f.done)
+	}
+	if f.conn != nil {
+		_ = f.conn.Close()
+	}
+	f.mu.Unlock()
+	f.wg.Wait()
+}
+
+// 查找本地最近写入的日志记录, 从 id 最大的数据文件开始倒序查找
+func (db *DB) lastReplPosition() (*replPosition, error) {
+	fileIds := db.sortedFileIds()
+	for i := len(fileIds) - 1; i >= 0; i-- {
+		dataFile := db.dataFileOf(fileIds[i])
+		var offset, last int64 = 0, -1
+		for {
+			_, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				break
+			}
+			last = offset
+			offset += size
+		}
+		if last < 0 {
+			continue
+		}
+		crc, err := readRecordCRC(dataFile, last)
+		if err != nil {
+			return nil, err
+		}
+		return &replPosition{fid: fileIds[i], offset: last, crc: crc}, nil
+	}
+	return nil, nil
+}
+
+// 获取文件 id 对应的数据文件, 不存在时返回 nil, 调用方需持有锁
+func (db *DB) dataFileOf(fid uint32) *data.DataFile {
+	if db.activeFile != nil && db.activeFile.FileId == fid {
+		return db.activeFile
+	}
+	return db.getOlderFiles()[fid]
+}
+
+// 获取全部数据文件 id, 从小到大排列, 调用方需持有锁
+func (db *DB) sortedFileIds() []uint32 {
+	fileIds := make([]uint32, 0, len(db.getOlderFiles())+1)
+	for fileId := range db.getOlderFiles() {
+		fileIds = append(fileIds, fileId)
+	}
+	if db.activeFile != nil {
+		fileIds = append(fileIds, db.activeFile.FileId)
+	}
+	sort.Slice(fileIds, func(i, j int) bool { return fileIds[i] < fileIds[j] })
+	return fileIds
+}
+
+// 读取日志记录头部的 crc 校验值
+func readRecordCRC(dataFile *data.DataFile, offset int64) (uint32, error) {
+	buf := make([]byte, crc32.Size)
+	if _, err := dataFile.ReadWriter.Read(buf, offset); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(buf), nil
+}
+
+// 发送复制消息, 超时视为连接断开
+func sendReplMessage(conn net.Conn, typ byte, fid uint32, offset int64, payload []byte) error {
+	_ = conn.SetWriteDeadline(time.Now().Add(replWriteTimeout))
+	buf := make([]byte, replHeaderSize+len(payload))
+	buf[0] = typ
+	binary.LittleEndian.PutUint32(buf[1:5], fid)
+	binary.LittleEndian.PutUint64(buf[5:13], uint64(offset))
+	binary.LittleEndian.PutUint32(buf[13:17], uint32(len(payload)))
+	copy(buf[replHeaderSize:], payload)
+	_, err := conn.Write(buf)
+	return err
+}
+
+// 读取一条复制消息
+func readReplMessage(r io.Reader) (*replHeader, []byte, error) {
+	buf := make([]byte, replHeaderSize)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+	header := &replHeader{
+		typ:    buf[0],
+		fid:    binary.LittleEndian.Uint32(buf[1:5]),
+		offset: int64(binary.LittleEndian.Uint64(buf[5:13])),
+		length: binary.LittleEndian.Uint32(buf[13:17]),
+	}
+	if header.length > maxReplPayloadSize {
+		return nil, nil, fmt.Errorf("replication message too large: %d bytes", header.length)
+	}
+	payload := make([]byte, header.length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, nil, err
+	}
+	return header, payload, nil
+}
+
+// 将写入的数据作为检查点数据块发送
+type replChunkWriter struct {
+	conn net.Conn
+}
+
+func (cw *replChunkWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := sendReplMessage(cw.conn, replMsgBootstrap, 0, 0, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// 按顺序读取检查点数据块
+type replChunkReader struct {
+	conn net.Conn
+	r    io.Reader
+	buf  []byte // 当前数据块的剩余数据
+	done bool   // 已读取到检查点结束标识
+}
+
+func (cr *replChunkReader) Read(p []byte) (int, error) {
+	for len(cr.buf) == 0 {
+		if cr.done {
+			return 0, io.EOF
+		}
+		_ = cr.conn.SetReadDeadline(time.Now().Add(replReadTimeout))
+		header, payload, err := readReplMessage(cr.r)
+		if err != nil {
+			return 0, err
+		}
+		if header.typ != replMsgBootstrap {
+			return 0, fmt.Errorf("unexpected replication message type %d", header.typ)
+		}
+		cr.buf, cr.done = payload, len(payload) == 0
+	}
+	n := copy(p, cr.buf)
+	cr.buf = cr.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,254 @@
+package xixi_kv
+
+import (
+	"bytes"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func startReplication(t *testing.T, db *DB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go func() {
+		_ = db.ServeReplication(listener)
+	}()
+	return listener.Addr().String()
+}
+
+// 等待从节点数据与主节点一致
+func assertReplicated(t *testing.T, leader, follower *DB) {
+	assert.Eventually(t, func() bool {
+		if follower.Stat().KeyNum != leader.Stat().KeyNum {
+			return false
+		}
+		equal := true
+		_ = leader.Fold(func(key []byte, value []byte) bool {
+			actual, err := follower.Get(key)
+			equal = err == nil && bytes.Equal(actual, value)
+			return equal
+		})
+		return equal
+	}, 10*time.Second, 20*time.Millisecond)
+}
+
+func openReplicationPair(t *testing.T) (*DB, Options) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-replication-leader")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.EnableBackgroundMerge = false
+	leader, err := Open(opts)
+	assert.Nil(t, err)
+
+	followerOpts := opts
+	followerDir, _ := os.MkdirTemp("", "bitcask-go-replication-follower")
+	followerOpts.DirPath = followerDir
+	return leader, followerOpts
+}
+
+func TestReplication(t *testing.T) {
+	leader, followerOpts := openReplicationPair(t)
+	defer destroyDB(leader)
+
+	// 1. 订阅前已存在的数据, 包括事务和删除
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	wb, err := leader.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, wb.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, wb.Commit())
+	for i := 0; i < 100; i++ {
+		assert.Nil(t, leader.Delete(utils.GetTestKey(i)))
+	}
+
+	addr := startReplication(t, leader)
+	follower, err := OpenFollower(followerOpts, addr)
+	defer destroyDB(follower)
+	assert.Nil(t, err)
+	assertReplicated(t, leader, follower)
+
+	// 2. 实时同步新写入
+	for i := 600; i < 1000; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assert.Nil(t, leader.Delete(utils.GetTestKey(700)))
+	assertReplicated(t, leader, follower)
+	_, err = follower.Get(utils.GetTestKey(700))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 3. 从节点只读
+	assert.Equal(t, ErrDatabaseReadOnly, follower.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Equal(t, ErrDatabaseReadOnly, follower.Delete(utils.GetTestKey(200)))
+	wb, err = follower.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	assert.Nil(t, wb.Put(utils.GetTestKey(1), utils.RandomValue(10)))
+	assert.Equal(t, ErrDatabaseReadOnly, wb.Commit())
+	assert.Equal(t, ErrDatabaseReadOnly, follower.Merge())
+
+	// 4. 不支持 B+ 树索引
+	bptreeOpts := followerOpts
+	bptreeOpts.IndexType = index.BPTree
+	_, err = OpenFollower(bptreeOpts, addr)
+	assert.Equal(t, ErrFollowerIndexUnsupported, err)
+}
+
+func TestReplication_CatchUp(t *testing.T) {
+	leader, followerOpts := openReplicationPair(t)
+	defer destroyDB(leader)
+	addr := startReplication(t, leader)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	follower, err := OpenFollower(followerOpts, addr)
+	assert.Nil(t, err)
+	assertReplicated(t, leader, follower)
+	assert.Nil(t, follower.Close())
+
+	// 断开期间的写入跨越多个数据文件
+	for i := 250; i < 1500; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	wb, err := leader.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	// 重新打开后从断开位置继续同步
+	follower, err = OpenFollower(followerOpts, addr)
+	defer destroyDB(follower)
+	assert.Nil(t, err)
+	assertReplicated(t, leader, follower)
+	assert.Greater(t, follower.Stat().DataFileNum, uint(1))
+}
+
+func TestReplication_Bootstrap(t *testing.T) {
+	leader, followerOpts := openReplicationPair(t)
+	defer destroyDB(leader)
+	addr := startReplication(t, leader)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	follower, err := OpenFollower(followerOpts, addr)
+	assert.Nil(t, err)
+	assertReplicated(t, leader, follower)
+	assert.Nil(t, follower.Close())
+
+	// 1. 断开期间从节点所需的数据文件被 merge 重写
+	for i := 0; i < 250; i++ {
+		assert.Nil(t, leader.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, leader.Merge())
+	for i := 500; i < 600; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+
+	// 发送检查点不封存主节点的活跃文件
+	fileNum := leader.Stat().DataFileNum
+	follower, err = OpenFollower(followerOpts, addr)
+	defer destroyDB(follower)
+	assert.Nil(t, err)
+	assertReplicated(t, leader, follower)
+	assert.Equal(t, fileNum, leader.Stat().DataFileNum)
+	_, err = follower.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2. 同步期间主节点执行 merge
+	for i := 250; i < 400; i++ {
+		assert.Nil(t, leader.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, leader.Merge())
+	for i := 600; i < 700; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	assertReplicated(t, leader, follower)
+	_, err = follower.Get(utils.GetTestKey(300))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// 从节点关闭后重新打开, 主节点不可用时仍可读取本地数据
+func TestReplication_Reopen(t *testing.T) {
+	leader, followerOpts := openReplicationPair(t)
+	addr := startReplication(t, leader)
+
+	for i := 0; i < 500; i++ {
+		assert.Nil(t, leader.Put(utils.GetTestKey(i), utils.RandomValue(128)))
+	}
+	wb, err := leader.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, wb.Delete(utils.GetTestKey(i)))
+	}
+	assert.Nil(t, wb.Commit())
+
+	follower, err := OpenFollower(followerOpts, addr)
+	assert.Nil(t, err)
+	assertReplicated(t, leader, follower)
+	seqNo := follower.seqNo
+	assert.Equal(t, leader.seqNo, seqNo)
+	assert.Nil(t, follower.Close())
+
+	// 关闭时写入事务序列号文件, 不写入索引检查点
+	_, err = os.Stat(filepath.Join(followerOpts.DirPath, data.SeqNoFileName))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(followerOpts.DirPath, data.IndexCheckpointFileName))
+	assert.True(t, os.IsNotExist(err))
+
+	keys := leader.ListKeys()
+	destroyDB(leader)
+	follower, err = OpenFollower(followerOpts, addr)
+	defer destroyDB(follower)
+	assert.Nil(t, err)
+	assert.Equal(t, seqNo, follower.seqNo)
+	assert.Equal(t, len(keys), len(follower.ListKeys()))
+	for _, key := range keys {
+		_, err := follower.Get(key)
+		assert.Nil(t, err)
+	}
+	_, err = follower.Get(utils.GetTestKey(10))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestReplication_Error(t *testing.T) {
+	leader, followerOpts := openReplicationPair(t)
+	destroyDB(leader)
+
+	// 主节点不可用时记录错误并通知回调
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	assert.Nil(t, listener.Close())
+	errCh := make(chan error, 1)
+	followerOpts.OnReplicationError = func(err error) {
+		select {
+		case errCh <- err:
+		default:
+		}
+	}
+	follower, err := OpenFollower(followerOpts, addr)
+	defer destroyDB(follower)
+	assert.Nil(t, err)
+
+	select {
+	case err := <-errCh:
+		assert.NotNil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replication error not reported")
+	}
+	stat := follower.Stat().Replication
+	assert.Greater(t, stat.FailedNum, uint(0))
+	assert.NotNil(t, stat.LastErr)
+}
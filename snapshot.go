@@ -0,0 +1,237 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/index"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Snapshot 只读快照, 提供创建时刻的一致性视图
+// 快照持有独立的内存索引副本和数据文件引用, 不受之后的写入和 merge 影响
+// 使用完成后必须关闭, 否则 merge 替换的旧数据文件无法释放
+type Snapshot struct {
+	db        *DB
+	mu        *sync.RWMutex
+	index     index.Indexer             // 创建时刻的内存索引副本
+	dataFiles map[uint32]*data.DataFile // 创建时刻的数据文件
+	// 创建时刻的 value log 文件, 只读实例按需打开的文件不包含在内
+	valueFiles map[uint32]*data.DataFile
+	seqNo      uint64 // 创建时刻的日志序列号, 快照包含不超过该序列号的全部写入
+	activeFid  uint32 // 创建时刻的活跃文件 id
+	activeOff  int64  // 创建时刻活跃文件的写入偏移, 之后追加的数据不属于快照
+	timestamp  int64  // 创建时刻, 用于判断 key 是否过期
+	closed     bool   // 快照已关闭标识
+}
+
+// Snapshot 创建当前时刻的只读快照
+// 复制期间暂停写入并持有读锁, 不阻塞读取, B 树索引以写时复制的方式复制, 暂停时间与数据量无关
+func (db *DB) Snapshot() *Snapshot {
+	db.commits.pause()
+	defer db.commits.resume()
+	// 持有读锁保证复制期间无 merge 安装
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.newSnapshot()
+}
+
+// 创建当前时刻的只读快照, 调用方需持有写锁, 或持有读锁并已暂停写入
+func (db *DB) newSnapshot() *Snapshot {
+	snap := db.newFileSnapshot()
+	snap.index = cloneIndex(db.index)
+	return snap
+}
+
+// 复制内存索引, B 树索引以写时复制的方式复制, 其余实现逐项复制到新的 B 树索引
+// 索引位置信息创建后不再修改, 可直接共享
+func cloneIndex(idx index.Indexer) index.Indexer {
+	if bt, ok := idx.(*index.BTreeIndex); ok {
+		return bt.Clone()
+	}
+	clone := index.NewBTree()
+	iterator := idx.Iterator(false)
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		clone.Put(iterator.Key(), iterator.Value())
+	}
+	iterator.Close()
+	return clone
+}
+
+// 创建仅持有数据文件引用的快照, 不复制内存索引, 用于按文件读取数据
+// 调用方需持有写锁, 或持有读锁并已暂停写入
+func (db *DB) newFileSnapshot() *Snapshot {
+	snap := &Snapshot{
+		db:         db,
+		mu:         new(sync.RWMutex),
+		dataFiles:  make(map[uint32]*data.DataFile, len(db.getOlderFiles())+1),
+		valueFiles: db.vlog.files(),
+		seqNo:      atomic.LoadUint64(&db.logSeqNo), // 写入队列在加锁前分配日志序列号
+		timestamp:  time.Now().UnixNano(),
+	}
+
+	// 记录数据文件引用
+	for fileId, dataFile := range db.getOlderFiles() {
+		snap.dataFiles[fileId] = dataFile
+	}
+	if db.activeFile != nil {
+		snap.dataFiles[db.activeFile.FileId] = db.activeFile
+		snap.activeFid = db.activeFile.FileId
+		snap.activeOff = db.activeFile.WriteOff
+	}
+
+	db.snapshots[snap] = struct{}{}
+	return snap
+}
+
+// SeqNo 获取快照创建时刻的日志序列号
+func (snap *Snapshot) SeqNo() uint64 {
+	return snap.seqNo
+}
+
+// Get 根据 key 读取快照中的数据
+func (snap *Snapshot) Get(key []byte) ([]byte, error) {
+	if len(key) == 0 {
+		return nil, ErrKeyIsEmpty
+	}
+
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.closed {
+		return nil, ErrSnapshotClosed
+	}
+
+	logRecordPos := snap.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(snap.timestamp) {
+		return nil, ErrKeyNotFound
+	}
+	return snap.getValueByPosition(logRecordPos)
+}
+
+// NewIterator 创建快照的迭代器, 快照已关闭时返回不包含任何元素的迭代器
+func (snap *Snapshot) NewIterator(opts IteratorOptions) *Iterator {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	idx := snap.index
+	if snap.closed {
+		idx = index.NewBTree()
+	}
+	return &Iterator{
+		db:        snap.db,
+		snapshot:  snap,
+		indexIter: idx.Iterator(opts.Reverse),
+		options:   opts,
+	}
+}
+
+// Fold 对快照所有项执行自定义操作
+func (snap *Snapshot) Fold(fn func(key []byte, value []byte) bool) error {
+	snap.mu.RLock()
+	defer snap.mu.RUnlock()
+	if snap.closed {
+		return ErrSnapshotClosed
+	}
+
+	iterator := snap.index.Iterator(false)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		// 跳过已过期的 key
+		if iterator.Value().IsExpired(snap.timestamp) {
+			continue
+		}
+		value, err := snap.getValueByPosition(iterator.Value())
+		if err != nil {
+			return err
+		}
+		if !fn(iterator.Key(), value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Close 关闭快照, 释放持有的数据文件
+func (snap *Snapshot) Close() error {
+	snap.mu.Lock()
+	defer snap.mu.Unlock()
+	if snap.closed {
+		return nil
+	}
+	snap.closed = true
+	snap.index = nil
+	snap.dataFiles = nil
+	snap.valueFiles = nil
+
+	db := snap.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	delete(db.snapshots, snap)
+
+	// 所有快照关闭后, 关闭 merge 期间被替换的旧数据文件
+	if len(db.snapshots) == 0 {
+		return db.closeRetiredFiles()
+	}
+	return nil
+}
+
+// 根据索引信息从快照持有的数据文件中获取 value
+func (snap *Snapshot) getValueByPosition(logRecordPos *data.LogRecordPos) ([]byte, error) {
+	dataFile := snap.dataFiles[logRecordPos.Fid]
+	if dataFile == nil {
+		return nil, ErrDataFileNotFound
+	}
+
+	logRecord, _, err := dataFile.ReadLogRecord(logRecordPos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	if logRecord.Type == data.LogRecordDeleted {
+		return nil, ErrKeyNotFound
+	}
+	return snap.valueOf(logRecord)
+}
+
+// 获取日志记录的 value, 分离存储时从快照持有的 value log 文件中读取
+func (snap *Snapshot) valueOf(logRecord *data.LogRecord) ([]byte, error) {
+	if !logRecord.ValuePointer {
+		return logRecord.Value, nil
+	}
+	pos := data.DecodeLogRecordPos(logRecord.Value)
+	if valueFile := snap.valueFiles[pos.Fid]; valueFile != nil {
+		return readValueLog(valueFile, pos)
+	}
+	return snap.db.valueOf(logRecord)
+}
+
+// 关闭 merge 或 value log GC 期间被替换但仍被快照引用的旧文件, 调用方需持有写锁
+// 存在无锁读取者时延迟到此后替换文件或关闭数据库时再关闭
+func (db *DB) closeRetiredFiles() error {
+	if db.hasReaders() {
+		return nil
+	}
+	for _, dataFile := range db.retiredFiles {
+		if err := dataFile.Close(); err != nil {
+			return err
+		}
+	}
+	db.retiredFiles = nil
+	return nil
+}
+
+// 关闭被替换的旧数据文件, 仍被快照引用或存在无锁读取者时延迟关闭, 调用方需持有写锁
+func (db *DB) retireFile(dataFile *data.DataFile) error {
+	if len(db.snapshots) > 0 || db.hasReaders() {
+		db.retiredFiles = append(db.retiredFiles, dataFile)
+		return nil
+	}
+	return dataFile.Close()
+}
+
+// 是否存在正在无锁读取旧数据文件的读取者, 调用方需持有写锁, 故此后不会出现新的读取者
+func (db *DB) hasReaders() bool {
+	if !db.readers.TryLock() {
+		return true
+	}
+	db.readers.Unlock()
+	return false
+}
@@ -0,0 +1,182 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/index"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Snapshot(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.Snapshot()
+
+	// 快照创建后的写入和删除不可见
+	for i := 0; i < 50; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 50; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value"))
+		assert.Nil(t, err)
+	}
+	err = db.Put(utils.GetTestKey(100), utils.GetTestKey(100))
+	assert.Nil(t, err)
+
+	for i := 0; i < 100; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+	_, err = snap.Get(utils.GetTestKey(100))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 迭代器遍历快照
+	iterator := snap.NewIterator(DefaultIteratorOptions)
+	var cnt int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		val, err := iterator.Value()
+		assert.Nil(t, err)
+		assert.Equal(t, iterator.Key(), val)
+		cnt++
+	}
+	iterator.Close()
+	assert.Equal(t, 100, cnt)
+
+	// Fold 遍历快照
+	cnt = 0
+	err = snap.Fold(func(key []byte, value []byte) bool {
+		cnt++
+		return true
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 100, cnt)
+
+	// 关闭后不允许读取
+	err = snap.Close()
+	assert.Nil(t, err)
+	_, err = snap.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrSnapshotClosed, err)
+	err = snap.Close()
+	assert.Nil(t, err)
+
+	// 关闭后创建的迭代器不包含任何元素
+	iterator = snap.NewIterator(DefaultIteratorOptions)
+	iterator.Rewind()
+	assert.False(t, iterator.Valid())
+	iterator.Close()
+}
+
+// 非 B 树索引逐项复制
+func TestDB_Snapshot_ART(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-art")
+	opts.DirPath = dir
+	opts.IndexType = index.ART
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.Snapshot()
+	defer snap.Close()
+	for i := 0; i < 100; i++ {
+		err := db.Delete(utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	for i := 0; i < 100; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+	}
+}
+
+// 创建快照仅需读锁, 不与持有读锁的操作互斥
+func TestDB_Snapshot_ReadLock(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-rlock")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	err = db.Put(utils.GetTestKey(1), utils.GetTestKey(1))
+	assert.Nil(t, err)
+
+	db.mu.RLock()
+	done := make(chan *Snapshot)
+	go func() {
+		done <- db.Snapshot()
+	}()
+	var snap *Snapshot
+	select {
+	case snap = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("snapshot blocked by read lock")
+	}
+	db.mu.RUnlock()
+
+	val, err := snap.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, utils.GetTestKey(1), val)
+	assert.Nil(t, snap.Close())
+}
+
+// 快照打开期间执行 merge
+func TestDB_Snapshot_Merge(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-snapshot-merge")
+	db, err := newTestMergeDB(dir)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.GetTestKey(i))
+		assert.Nil(t, err)
+	}
+	snap := db.Snapshot()
+	for i := 0; i < 10000; i++ {
+		err := db.Put(utils.GetTestKey(i), []byte("new value"))
+		assert.Nil(t, err)
+	}
+
+	// merge 删除的旧数据文件仍可被快照读取
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(db.retiredFiles))
+	for i := 0; i < 10000; i++ {
+		val, err := snap.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, utils.GetTestKey(i), val)
+
+		val, err = db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("new value"), val)
+	}
+
+	// 快照全部关闭后释放旧数据文件
+	err = snap.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(db.retiredFiles))
+}
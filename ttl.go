@@ -0,0 +1,105 @@
+package xixi_kv
+
+import (
+	"time"
+)
+
+// PutWithTTL 新增元素并设置生效时长, 到期后自动失效
+func (db *DB) PutWithTTL(key []byte, value []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	return db.put(defaultBucketId, key, value, time.Now().Add(ttl).UnixNano())
+}
+
+// Expire 为已存在的 key 设置生效时长
+// 过期时间保存在日志记录头部, 故需重写一条携带新过期时间的日志记录
+func (db *DB) Expire(key []byte, ttl time.Duration) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+
+	return db.rewrite(key, func(expire int64) (int64, bool) {
+		return time.Now().Add(ttl).UnixNano(), true
+	})
+}
+
+// TTL 获取 key 的剩余生效时长, 永不过期时返回 -1
+func (db *DB) TTL(key []byte) (time.Duration, error) {
+	if len(key) == 0 {
+		return 0, ErrKeyIsEmpty
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now().UnixNano()
+	logRecordPos := db.index.Get(key)
+	if logRecordPos == nil || logRecordPos.IsExpired(now) {
+		return 0, ErrKeyNotFound
+	}
+	if logRecordPos.Expire == 0 {
+		return -1, nil
+	}
+	return time.Duration(logRecordPos.Expire - now), nil
+}
+
+// Persist 移除 key 的过期时间, 使其永不过期
+func (db *DB) Persist(key []byte) error {
+	if len(key) == 0 {
+		return ErrKeyIsEmpty
+	}
+
+	return db.rewrite(key, func(expire int64) (int64, bool) {
+		// 本身永不过期, 无需重写
+		return 0, expire != 0
+	})
+}
+
+// 以新的过期时间重写 key 的最新数据, fn 根据原过期时间返回新过期时间及是否需要重写
+// 读取和重写之间 key 被并发修改时重新读取, 避免覆盖并发写入的新数据
+func (db *DB) rewrite(key []byte, fn func(expire int64) (int64, bool)) error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	for i := 0; i < maxUpdateRetries; i++ {
+		db.mu.RLock()
+		logRecordPos := db.index.Get(key)
+		if logRecordPos == nil || logRecordPos.IsExpired(time.Now().UnixNano()) {
+			db.mu.RUnlock()
+			return ErrKeyNotFound
+		}
+		expire, ok := fn(logRecordPos.Expire)
+		if !ok {
+			db.mu.RUnlock()
+			return nil
+		}
+		value, err := db.getValueByPosition(logRecordPos)
+		db.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+
+		req := db.putRequest(defaultBucketId, key, value, expire)
+		req.check = func() error {
+			curPos := db.index.Get(key)
+			if curPos == nil || curPos.Fid != logRecordPos.Fid || curPos.Offset != logRecordPos.Offset {
+				return ErrTxnConflict
+			}
+			return nil
+		}
+		err = db.submit(req)
+		if err == ErrTxnConflict {
+			continue
+		}
+		return err
+	}
+	return ErrTxnConflict
+}
@@ -0,0 +1,146 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_PutWithTTL(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-put")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1. ttl 不合法
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), 0)
+	assert.Equal(t, ErrInvalidTTL, err)
+
+	// 2. 未过期时正常读取
+	err = db.PutWithTTL(utils.GetTestKey(1), utils.RandomValue(24), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Put(utils.GetTestKey(2), utils.RandomValue(24))
+	assert.Nil(t, err)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.NotNil(t, val)
+
+	// 3. 过期后读取、遍历均不可见
+	time.Sleep(150 * time.Millisecond)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+	assert.Equal(t, 1, len(db.ListKeys()))
+	iterator := db.NewIterator(DefaultIteratorOptions)
+	var cnt int
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		assert.Equal(t, utils.GetTestKey(2), iterator.Key())
+		cnt++
+	}
+	iterator.Close()
+	assert.Equal(t, 1, cnt)
+
+	// 4. 重启后不加载已过期的 key
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1), db.Stat().KeyNum)
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+func TestDB_Expire(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-expire")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	// 1. key 不存在
+	err = db.Expire(utils.GetTestKey(1), time.Second)
+	assert.Equal(t, ErrKeyNotFound, err)
+	_, err = db.TTL(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+
+	// 2. 永不过期的 key
+	value := utils.RandomValue(24)
+	err = db.Put(utils.GetTestKey(1), value)
+	assert.Nil(t, err)
+	ttl, err := db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 3. 设置过期时间
+	err = db.Expire(utils.GetTestKey(1), time.Hour)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute && ttl <= time.Hour)
+	val, err := db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, value, val)
+
+	// 4. 移除过期时间, 重启后依然生效
+	err = db.Persist(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Equal(t, time.Duration(-1), ttl)
+
+	// 5. 过期时间重启后依然生效
+	err = db.Expire(utils.GetTestKey(1), 100*time.Millisecond)
+	assert.Nil(t, err)
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	ttl, err = db.TTL(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.True(t, ttl > 0)
+	time.Sleep(150 * time.Millisecond)
+	err = db.Persist(utils.GetTestKey(1))
+	assert.Equal(t, ErrKeyNotFound, err)
+}
+
+// merge 丢弃已过期的数据
+func TestDB_Merge_TTL(t *testing.T) {
+	dir, _ := os.MkdirTemp("", "bitcask-go-ttl-merge")
+	db, err := newTestMergeDB(dir)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 1000; i++ {
+		err := db.PutWithTTL(utils.GetTestKey(i), utils.RandomValue(128), 100*time.Millisecond)
+		assert.Nil(t, err)
+	}
+	for i := 1000; i < 2000; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(128))
+		assert.Nil(t, err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	err = db.Merge()
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1000), db.Stat().KeyNum)
+	assert.Equal(t, 1000, len(db.ListKeys()))
+
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = newTestMergeDB(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, uint(1000), db.Stat().KeyNum)
+}
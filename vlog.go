@@ -0,0 +1,474 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/fio"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// value log GC 单次重写提交的最大日志记录数量和数据量
+const (
+	valueLogGCBatchNum  = 64
+	valueLogGCBatchSize = 4 * 1024 * 1024
+)
+
+// value log, 存放与 key 分离存储的 value
+// 数据文件中仅保存指向 value log 的位置信息, merge 重写时无需复制 value, 由 ValueLogGC 独立回收
+// 打开时已存在的文件均作为旧文件, 首次分离存储 value 时创建新的活跃文件, 避免在损坏的文件尾部追加
+// value log 文件固定使用标准文件 IO
+type valueLog struct {
+	mu         sync.RWMutex              // 文件集合锁, 读取文件内容无需持有
+	writeMu    sync.Mutex                // 写入锁, 保护活跃文件的追加写入和持久化
+	activeFile *data.DataFile            // 当前活跃文件
+	olderFiles map[uint32]*data.DataFile // 旧文件, 只读
+	nextFileId uint32                    // 下一个活跃文件的 id
+	dirty      bool                      // 活跃文件存在未持久化的写入
+	lazy       bool                      // 读取时按需以只读方式打开文件, 用于只读实例和完整性检查
+	gcRunning  atomic.Bool               // GC 执行状态标识
+}
+
+func newValueLog(lazy bool) *valueLog {
+	return &valueLog{
+		olderFiles: make(map[uint32]*data.DataFile),
+		lazy:       lazy,
+	}
+}
+
+// 待 GC 重写的有效 value
+type valueLogEntry struct {
+	bucket uint32
+	key    []byte
+	value  []byte
+	keyPos *data.LogRecordPos // 数据文件中指向该 value 的日志记录位置
+}
+
+// 加载数据目录中已存在的 value log 文件, 全部作为旧文件
+func (db *DB) loadValueLog() error {
+	fileIds, err := fileIdsWithSuffix(db.options.DirPath, data.ValueLogFileNameSuffix)
+	if err != nil {
+		return err
+	}
+	for _, fileId := range fileIds {
+		valueFile, err := data.OpenValueLogFile(db.options.DirPath, fileId, fio.StandardFIO, db.encryptor)
+		if err != nil {
+			return err
+		}
+		db.vlog.olderFiles[fileId] = valueFile
+		db.vlog.nextFileId = fileId + 1
+	}
+	return nil
+}
+
+// 判断日志记录的 value 是否需要分离存储
+// 元数据 bucket 的 value 在加载索引时直接读取, 始终不分离存储
+func (db *DB) separable(logRecord *data.LogRecord) bool {
+	return db.options.ValueThreshold > 0 &&
+		logRecord.Type == data.LogRecordNormal &&
+		logRecord.Bucket != metaBucketId &&
+		len(logRecord.Value) > db.options.ValueThreshold
+}
+
+// 将 value 写入 value log, 返回写入数据文件的日志记录, value 替换为指向 value log 的位置信息
+// value log 中的日志记录保存真实 key 和所属 bucket, 供 GC 判断是否有效
+func (db *DB) writeValue(logRecord *data.LogRecord) (*data.LogRecord, error) {
+	realKey, _ := parseLogRecordKey(logRecord.Key)
+	encRecord, size, err := db.encryptor.EncodeLogRecord(&data.LogRecord{
+		Key:         realKey,
+		Value:       logRecord.Value,
+		LogSeqNo:    logRecord.LogSeqNo,
+		Bucket:      logRecord.Bucket,
+		Compression: logRecord.Compression,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	vlog := db.vlog
+	vlog.writeMu.Lock()
+	defer vlog.writeMu.Unlock()
+	// 活跃文件不存在或剩余空间不足, 创建新的活跃文件
+	if vlog.activeFile == nil || vlog.activeFile.WriteOff+size > db.options.DataFileSize {
+		if err := db.rotateValueLog(); err != nil {
+			return nil, err
+		}
+	}
+	pos := &data.LogRecordPos{
+		Fid:    vlog.activeFile.FileId,
+		Offset: vlog.activeFile.WriteOff,
+		Size:   uint32(size),
+	}
+	if err := vlog.activeFile.Write(encRecord); err != nil {
+		return nil, err
+	}
+	vlog.dirty = true
+
+	stored := *logRecord
+	stored.Value = data.EncodeLogRecordPos(pos)
+	stored.ValuePointer = true
+	return &stored, nil
+}
+
+// 持久化原活跃文件并创建新的活跃文件, 调用方需持有写入锁
+func (db *DB) rotateValueLog() error {
+	vlog := db.vlog
+	if vlog.activeFile != nil {
+		if err := vlog.activeFile.Sync(); err != nil {
+			return err
+		}
+		vlog.dirty = false
+	}
+	valueFile, err := data.OpenValueLogFile(db.options.DirPath, vlog.nextFileId, fio.StandardFIO, db.encryptor)
+	if err != nil {
+		return err
+	}
+
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	if vlog.activeFile != nil {
+		vlog.olderFiles[vlog.activeFile.FileId] = vlog.activeFile
+	}
+	vlog.activeFile = valueFile
+	vlog.nextFileId++
+	return nil
+}
+
+// 持久化 value log 活跃文件中尚未持久化的写入
+func (db *DB) syncValueLog() error {
+	vlog := db.vlog
+	vlog.writeMu.Lock()
+	defer vlog.writeMu.Unlock()
+	if !vlog.dirty {
+		return nil
+	}
+	if err := vlog.activeFile.Sync(); err != nil {
+		return err
+	}
+	vlog.dirty = false
+	return nil
+}
+
+// 获取 value log 文件, 按需打开时以只读方式打开写入进程创建的文件
+func (vlog *valueLog) file(db *DB, fileId uint32) (*data.DataFile, error) {
+	vlog.mu.RLock()
+	valueFile := vlog.fileOf(fileId)
+	vlog.mu.RUnlock()
+	if valueFile != nil {
+		return valueFile, nil
+	}
+	if !vlog.lazy {
+		return nil, ErrDataFileNotFound
+	}
+
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	if valueFile := vlog.fileOf(fileId); valueFile != nil {
+		return valueFile, nil
+	}
+	valueFile, err := data.OpenValueLogFileReadOnly(db.options.DirPath, fileId, db.encryptor)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrDataFileNotFound
+		}
+		return nil, err
+	}
+	vlog.olderFiles[fileId] = valueFile
+	return valueFile, nil
+}
+
+// 获取已打开的 value log 文件, 调用方需持有锁
+func (vlog *valueLog) fileOf(fileId uint32) *data.DataFile {
+	if vlog.activeFile != nil && vlog.activeFile.FileId == fileId {
+		return vlog.activeFile
+	}
+	return vlog.olderFiles[fileId]
+}
+
+// 获取全部已打开的 value log 文件
+func (vlog *valueLog) files() map[uint32]*data.DataFile {
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	files := make(map[uint32]*data.DataFile, len(vlog.olderFiles)+1)
+	for fileId, valueFile := range vlog.olderFiles {
+		files[fileId] = valueFile
+	}
+	if vlog.activeFile != nil {
+		files[vlog.activeFile.FileId] = vlog.activeFile
+	}
+	return files
+}
+
+// 获取各 value log 文件当前已写入的数据量, 持有写入锁保证不包含写入中的日志记录
+func (vlog *valueLog) sizes() (map[uint32]int64, error) {
+	vlog.writeMu.Lock()
+	defer vlog.writeMu.Unlock()
+	sizes := make(map[uint32]int64)
+	for fileId, valueFile := range vlog.files() {
+		size, err := valueFile.ReadWriter.Size()
+		if err != nil {
+			return nil, err
+		}
+		sizes[fileId] = size
+	}
+	return sizes, nil
+}
+
+// 判断 value log 文件是否为活跃文件
+func (vlog *valueLog) isActive(fileId uint32) bool {
+	vlog.mu.RLock()
+	defer vlog.mu.RUnlock()
+	return vlog.activeFile != nil && vlog.activeFile.FileId == fileId
+}
+
+// 获取 value log 文件的总大小
+func (vlog *valueLog) size() (int64, error) {
+	var size int64 = 0
+	for _, valueFile := range vlog.files() {
+		n, err := valueFile.ReadWriter.Size()
+		if err != nil {
+			return 0, err
+		}
+		size += n
+	}
+	return size, nil
+}
+
+// 关闭全部 value log 文件
+func (vlog *valueLog) close() error {
+	vlog.writeMu.Lock()
+	defer vlog.writeMu.Unlock()
+	vlog.mu.Lock()
+	defer vlog.mu.Unlock()
+	for fileId, valueFile := range vlog.olderFiles {
+		if err := valueFile.Close(); err != nil {
+			return err
+		}
+		delete(vlog.olderFiles, fileId)
+	}
+	if vlog.activeFile != nil {
+		if err := vlog.activeFile.Close(); err != nil {
+			return err
+		}
+		vlog.activeFile = nil
+	}
+	return nil
+}
+
+// 获取日志记录的 value, 分离存储时从 value log 中读取
+func (db *DB) valueOf(logRecord *data.LogRecord) ([]byte, error) {
+	if !logRecord.ValuePointer {
+		return logRecord.Value, nil
+	}
+	pos := data.DecodeLogRecordPos(logRecord.Value)
+	valueFile, err := db.vlog.file(db, pos.Fid)
+	if err != nil {
+		return nil, err
+	}
+	return readValueLog(valueFile, pos)
+}
+
+// 从 value log 文件中读取 value
+func readValueLog(valueFile *data.DataFile, pos *data.LogRecordPos) ([]byte, error) {
+	valueRecord, _, err := valueFile.ReadLogRecord(pos.Offset)
+	if err != nil {
+		return nil, err
+	}
+	return valueRecord.Value, nil
+}
+
+// ValueLogGC 回收 value log 中的无效数据, 与 merge 相互独立
+// 依次检查已封存的 value log 文件, 无效数据占比达到 ValueLogGCRatio 时将有效 value 重写到活跃文件并删除原文件
+func (db *DB) ValueLogGC() error {
+	if db.readOnly {
+		return ErrDatabaseReadOnly
+	}
+	vlog := db.vlog
+	if !vlog.gcRunning.CompareAndSwap(false, true) {
+		return ErrValueLogGCIsProgress
+	}
+	defer vlog.gcRunning.Store(false)
+
+	// 活跃文件仍在写入, 不参与 GC
+	vlog.mu.RLock()
+	valueFiles := make([]*data.DataFile, 0, len(vlog.olderFiles))
+	for _, valueFile := range vlog.olderFiles {
+		valueFiles = append(valueFiles, valueFile)
+	}
+	vlog.mu.RUnlock()
+	slices.SortFunc(valueFiles, func(a, b *data.DataFile) int {
+		return int(a.FileId) - int(b.FileId)
+	})
+
+	for _, valueFile := range valueFiles {
+		if err := db.gcValueLogFile(valueFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 回收单个 value log 文件
+func (db *DB) gcValueLogFile(valueFile *data.DataFile) error {
+	total, err := valueFile.ReadWriter.Size()
+	if err != nil {
+		return err
+	}
+	live, err := db.scanValueLogFile(valueFile, nil)
+	if err != nil {
+		return err
+	}
+	if total == 0 || live == total || float32(total-live)/float32(total) < db.options.ValueLogGCRatio {
+		return nil
+	}
+
+	// 分批重写有效 value
+	var batch []*valueLogEntry
+	var batchSize int
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := db.rewriteValues(batch)
+		batch, batchSize = nil, 0
+		return err
+	}
+	if _, err := db.scanValueLogFile(valueFile, func(entry *valueLogEntry) error {
+		batch = append(batch, entry)
+		batchSize += len(entry.value)
+		if len(batch) >= valueLogGCBatchNum || batchSize >= valueLogGCBatchSize {
+			return flush()
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+
+	// 重写的数据持久化后才能删除原文件
+	if err := db.Sync(); err != nil {
+		return err
+	}
+	// 重写期间 merge 可能已更新索引位置, 仍存在有效 value 时保留原文件, 由下次 GC 回收
+	if live, err = db.scanValueLogFile(valueFile, nil); err != nil || live > 0 {
+		return err
+	}
+	return db.removeValueLogFile(valueFile)
+}
+
+// 顺序读取 value log 文件, 对有效的 value 执行 fn, 返回有效数据量
+// fn 为 nil 时仅统计有效数据量
+func (db *DB) scanValueLogFile(valueFile *data.DataFile, fn func(entry *valueLogEntry) error) (int64, error) {
+	var live, offset int64 = 0, 0
+	for {
+		valueRecord, size, err := valueFile.ReadLogRecord(offset)
+		if err != nil {
+			// 写入过程中崩溃导致尾部不完整的日志记录同样视为无效数据
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return live, nil
+			}
+			return 0, &CorruptionError{FileId: valueFile.FileId, Offset: offset, Err: err}
+		}
+
+		keyPos, err := db.valueKeyPos(valueRecord, valueFile.FileId, offset)
+		if err != nil {
+			return 0, err
+		}
+		if keyPos != nil {
+			live += size
+			if fn != nil {
+				if err := fn(&valueLogEntry{
+					bucket: valueRecord.Bucket,
+					key:    valueRecord.Key,
+					value:  valueRecord.Value,
+					keyPos: keyPos,
+				}); err != nil {
+					return 0, err
+				}
+			}
+		}
+		offset += size
+	}
+}
+
+// 判断 value log 中的日志记录是否有效, 有效时返回数据文件中指向该 value 的日志记录位置
+func (db *DB) valueKeyPos(valueRecord *data.LogRecord, fileId uint32, offset int64) (*data.LogRecordPos, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	// 元数据损坏时 bucket 可能未注册, 视为无效数据
+	if valueRecord.Bucket != defaultBucketId && db.bucketIds[valueRecord.Bucket] == nil {
+		return nil, nil
+	}
+	keyPos := db.indexOf(valueRecord.Bucket).Get(valueRecord.Key)
+	if keyPos == nil || keyPos.IsExpired(time.Now().UnixNano()) {
+		return nil, nil
+	}
+	logRecord, err := db.readLogRecord(keyPos)
+	if err != nil {
+		return nil, err
+	}
+	if !logRecord.ValuePointer {
+		return nil, nil
+	}
+	pos := data.DecodeLogRecordPos(logRecord.Value)
+	if pos.Fid != fileId || pos.Offset != offset {
+		return nil, nil
+	}
+	return keyPos, nil
+}
+
+// 重写一批有效 value
+// 仅当索引仍指向原日志记录时更新索引, 否则说明重写期间已有新数据写入, 重写的数据计入无效数据量
+func (db *DB) rewriteValues(entries []*valueLogEntry) error {
+	records := make([]*data.LogRecord, len(entries))
+	for i, entry := range entries {
+		records[i] = &data.LogRecord{
+			Key:    logRecordKeyWithSeq(entry.key, nonTransactionSeqNo),
+			Value:  entry.value,
+			Type:   data.LogRecordNormal,
+			Expire: entry.keyPos.Expire,
+			Bucket: entry.bucket,
+		}
+	}
+	return db.submit(&commitRequest{records: records, apply: func(positions []*data.LogRecordPos) error {
+		for i, entry := range entries {
+			pos := positions[i]
+			idx := db.indexOf(entry.bucket)
+			var reclaim int64
+			if cur := idx.Get(entry.key); cur != nil && cur.Fid == entry.keyPos.Fid && cur.Offset == entry.keyPos.Offset {
+				idx.Put(entry.key, pos)
+				reclaim = db.addFileReclaim(entry.keyPos)
+			} else {
+				reclaim = db.addFileReclaim(pos)
+			}
+			db.addBucketSize(entry.bucket, int64(pos.Size), reclaim)
+		}
+		return nil
+	}})
+}
+
+// 删除已回收的 value log 文件
+// 读取 value 期间持有读锁, 故持有写锁删除即可保证无读取中的文件被关闭
+func (db *DB) removeValueLogFile(valueFile *data.DataFile) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	vlog := db.vlog
+	vlog.mu.Lock()
+	delete(vlog.olderFiles, valueFile.FileId)
+	vlog.mu.Unlock()
+
+	// 仍被快照引用的文件延迟到快照全部关闭后再关闭
+	if len(db.snapshots) > 0 {
+		db.retiredFiles = append(db.retiredFiles, valueFile)
+	} else if err := valueFile.Close(); err != nil {
+		return err
+	}
+	return os.Remove(data.GetValueLogFileName(db.options.DirPath, valueFile.FileId))
+}
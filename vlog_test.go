@@ -0,0 +1,206 @@
+package xixi_kv
+
+import (
+	"bytes"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDB_ValueLog(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 64
+	opts.EnableBackgroundMerge = false
+	opts.DataFileMergeRatio = 0
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 1. 超过阈值的 value 分离存储, 其余 value 仍写入数据文件
+	values := make(map[int][]byte)
+	for i := 0; i < 300; i++ {
+		value := utils.RandomValue(16)
+		if i%2 == 0 {
+			value = utils.RandomValue(1024)
+		}
+		values[i] = value
+		assert.Nil(t, db.Put(utils.GetTestKey(i), value))
+	}
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	valueFiles, _ := filepath.Glob(filepath.Join(dir, "*"+data.ValueLogFileNameSuffix))
+	assert.Greater(t, len(valueFiles), 1)
+	stat := db.Stat()
+	assert.Greater(t, stat.ValueLogSize, int64(150*1024))
+	assert.Less(t, stat.DiskSize, int64(150*1024))
+
+	// 2. 迭代器和快照读取分离存储的 value
+	snap := db.Snapshot()
+	assert.Nil(t, db.Put(utils.GetTestKey(0), utils.RandomValue(1024)))
+	val, err := snap.Get(utils.GetTestKey(0))
+	assert.Nil(t, err)
+	assert.Equal(t, values[0], val)
+	assert.Nil(t, snap.Close())
+	values[0], _ = db.Get(utils.GetTestKey(0))
+
+	it := db.NewIterator(DefaultIteratorOptions)
+	var count int
+	for it.Rewind(); it.Valid(); it.Next() {
+		val, err := it.Value()
+		assert.Nil(t, err)
+		assert.True(t, bytes.Equal(val, values[count]))
+		count++
+	}
+	it.Close()
+	assert.Equal(t, 300, count)
+
+	// 3. merge 仅重写位置信息, 不复制 value
+	vlogSize := db.Stat().ValueLogSize
+	assert.Nil(t, db.Merge())
+	assert.Equal(t, vlogSize, db.Stat().ValueLogSize)
+
+	// 4. 只读实例读取写入进程的 value log
+	roOpts := opts
+	roOpts.ReadOnly = true
+	ro, err := Open(roOpts)
+	assert.Nil(t, err)
+	val, err = ro.Get(utils.GetTestKey(2))
+	assert.Nil(t, err)
+	assert.Equal(t, values[2], val)
+	assert.Nil(t, ro.Close())
+
+	// 5. 重启后数据一致
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Nil(t, db.Put(utils.GetTestKey(1), utils.RandomValue(1024)))
+	_, err = db.Get(utils.GetTestKey(1))
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ValueLogGC(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog-gc")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 64
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	// 重复覆盖写入, 仅最后一次写入的 value 有效
+	values := make(map[int][]byte)
+	for n := 0; n < 4; n++ {
+		for i := 0; i < 200; i++ {
+			values[i] = utils.RandomValue(1024)
+			assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+		}
+	}
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, db.Delete(utils.GetTestKey(i)))
+		delete(values, i)
+	}
+
+	before := db.Stat().ValueLogSize
+	assert.Nil(t, db.ValueLogGC())
+	after := db.Stat().ValueLogSize
+	assert.Less(t, after, before/2)
+	for i := 0; i < 200; i++ {
+		val, err := db.Get(utils.GetTestKey(i))
+		if value, ok := values[i]; ok {
+			assert.Nil(t, err)
+			assert.Equal(t, value, val)
+		} else {
+			assert.Equal(t, ErrKeyNotFound, err)
+		}
+	}
+
+	// 重启后 GC 重写的 value 仍可读取
+	assert.Nil(t, db.Close())
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, after, db.Stat().ValueLogSize)
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+
+	// merge 后再次 GC, 数据不变
+	assert.Nil(t, db.Merge())
+	assert.Nil(t, db.ValueLogGC())
+	for i, value := range values {
+		val, err := db.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDB_ValueLogBackup(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-vlog-backup")
+	opts.DirPath = dir
+	opts.DataFileSize = 64 * 1024
+	opts.ValueThreshold = 64
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+
+	values := make(map[int][]byte)
+	for i := 0; i < 200; i++ {
+		values[i] = utils.RandomValue(1024)
+		assert.Nil(t, db.Put(utils.GetTestKey(i), values[i]))
+	}
+
+	// 1. 检查点包含 value log 文件
+	backupDir, _ := os.MkdirTemp("", "bitcask-go-vlog-backup-dest")
+	assert.Nil(t, db.Backup(backupDir))
+	backupOpts := opts
+	backupOpts.DirPath = backupDir
+	backupDB, err := Open(backupOpts)
+	assert.Nil(t, err)
+	for i, value := range values {
+		val, err := backupDB.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	destroyDB(backupDB)
+
+	// 2. 增量备份包含 value log 文件
+	incDir, _ := os.MkdirTemp("", "bitcask-go-vlog-backup-inc")
+	defer func() {
+		_ = os.RemoveAll(incDir)
+	}()
+	_, err = db.IncrementalBackup(incDir)
+	assert.Nil(t, err)
+	restoreDir, _ := os.MkdirTemp("", "bitcask-go-vlog-backup-restore")
+	assert.Nil(t, Restore(incDir, restoreDir, 0))
+	restoreOpts := opts
+	restoreOpts.DirPath = restoreDir
+	restoreDB, err := Open(restoreOpts)
+	assert.Nil(t, err)
+	for i, value := range values {
+		val, err := restoreDB.Get(utils.GetTestKey(i))
+		assert.Nil(t, err)
+		assert.Equal(t, value, val)
+	}
+	destroyDB(restoreDB)
+}
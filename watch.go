@@ -0,0 +1,309 @@
+package xixi_kv
+
+import (
+	"bytes"
+	"github.com/XiXi-2024/xixi-kv/data"
+	"io"
+	"slices"
+	"sync"
+)
+
+// 单个订阅者允许积压的最大事件数量, 超过后订阅被终止
+const maxWatchQueueSize = 64 * 1024
+
+// ChangeEvent 数据变更事件
+type ChangeEvent struct {
+	Key     []byte // 变更的 key
+	Value   []byte // 写入的 value, 删除时为 nil
+	Deleted bool   // 是否为删除操作
+	SeqNo   uint64 // 变更对应的日志序列号
+	InBatch bool   // 是否通过 WriteBatch 提交
+	Bucket  string // 变更所属的 bucket 名称, 默认 bucket 为空
+}
+
+// Watcher 数据变更订阅者
+// 事件按日志序列号顺序投递, 仅在写入和索引更新成功后投递
+type Watcher struct {
+	db       *DB
+	bucketId uint32            // 订阅的 bucket 编号
+	bucket   string            // 订阅的 bucket 名称, 默认 bucket 为空
+	prefix   []byte            // 订阅的 key 前缀, 为空表示订阅全部
+	events   chan *ChangeEvent // 面向用户的事件通道
+	mu       *sync.Mutex
+	cond     *sync.Cond
+	queue    []*ChangeEvent // 待投递的实时事件
+	closed   bool           // 订阅已关闭标识
+	err      error          // 订阅终止原因
+	done     chan struct{}  // 用于通知投递协程退出
+}
+
+// Watch 订阅默认 bucket 中指定前缀 key 的实时变更
+func (db *DB) Watch(prefix []byte) *Watcher {
+	return db.watch(defaultBucketId, "", prefix)
+}
+
+// WatchFrom 从指定日志序列号之后开始订阅默认 bucket 的变更
+// 先重放数据文件中序列号大于 seqNo 的日志记录, 再投递实时变更
+// 已被 merge 清除的历史变更无法重放, 未提交的事务记录不会投递
+func (db *DB) WatchFrom(prefix []byte, seqNo uint64) *Watcher {
+	return db.watchFrom(defaultBucketId, "", prefix, seqNo)
+}
+
+// Watch 订阅 bucket 中指定前缀 key 的实时变更
+func (b *Bucket) Watch(prefix []byte) *Watcher {
+	return b.db.watch(b.id, b.name, prefix)
+}
+
+// WatchFrom 从指定日志序列号之后开始订阅 bucket 的变更, 语义同 DB.WatchFrom
+func (b *Bucket) WatchFrom(prefix []byte, seqNo uint64) *Watcher {
+	return b.db.watchFrom(b.id, b.name, prefix, seqNo)
+}
+
+func (db *DB) watch(bucketId uint32, bucket string, prefix []byte) *Watcher {
+	w := db.newWatcher(bucketId, bucket, prefix)
+	db.watchMu.Lock()
+	db.watchers[w] = struct{}{}
+	db.watchMu.Unlock()
+
+	go w.run(nil, 0)
+	return w
+}
+
+func (db *DB) watchFrom(bucketId uint32, bucket string, prefix []byte, seqNo uint64) *Watcher {
+	w := db.newWatcher(bucketId, bucket, prefix)
+
+	// 创建快照和注册订阅者需在暂停写入期间完成, 保证重放与实时事件不重不漏
+	// 重放仅读取数据文件, 无需复制内存索引
+	db.commits.pause()
+	db.mu.RLock()
+	snap := db.newFileSnapshot()
+	db.watchMu.Lock()
+	db.watchers[w] = struct{}{}
+	db.watchMu.Unlock()
+	db.mu.RUnlock()
+	db.commits.resume()
+
+	go w.run(snap, seqNo)
+	return w
+}
+
+// Events 获取事件通道, 订阅关闭后通道关闭
+func (w *Watcher) Events() <-chan *ChangeEvent {
+	return w.events
+}
+
+// Err 获取订阅终止原因, 正常关闭时返回 nil
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close 关闭订阅
+func (w *Watcher) Close() {
+	w.db.watchMu.Lock()
+	delete(w.db.watchers, w)
+	w.db.watchMu.Unlock()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closeWithErr(nil)
+}
+
+func (db *DB) newWatcher(bucketId uint32, bucket string, prefix []byte) *Watcher {
+	w := &Watcher{
+		db:       db,
+		bucketId: bucketId,
+		bucket:   bucket,
+		prefix:   prefix,
+		events:   make(chan *ChangeEvent),
+		mu:       new(sync.Mutex),
+		done:     make(chan struct{}),
+	}
+	w.cond = sync.NewCond(w.mu)
+	return w
+}
+
+// 通知所有订阅者数据变更
+func (db *DB) publish(events ...*ChangeEvent) {
+	// 唤醒等待新写入的复制会话
+	db.appended.notify()
+
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	if len(db.watchers) == 0 {
+		return
+	}
+
+	for w := range db.watchers {
+		w.mu.Lock()
+		for _, event := range events {
+			if !w.match(event) {
+				continue
+			}
+			// 积压过多时终止订阅, 订阅者可通过 WatchFrom 从最后收到的序列号恢复
+			if len(w.queue) >= maxWatchQueueSize {
+				w.closeWithErr(ErrWatcherLagged)
+				delete(db.watchers, w)
+				break
+			}
+			w.queue = append(w.queue, event)
+		}
+		w.cond.Signal()
+		w.mu.Unlock()
+	}
+}
+
+// 投递协程, 先重放快照中的历史变更, 再投递实时变更
+func (w *Watcher) run(snap *Snapshot, seqNo uint64) {
+	defer close(w.events)
+
+	if snap != nil {
+		err := w.replay(snap, seqNo)
+		_ = snap.Close()
+		if err != nil {
+			w.mu.Lock()
+			w.closeWithErr(err)
+			w.mu.Unlock()
+			return
+		}
+	}
+
+	for {
+		w.mu.Lock()
+		for len(w.queue) == 0 && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+		event := w.queue[0]
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		w.mu.Unlock()
+
+		if !w.send(event) {
+			return
+		}
+	}
+}
+
+// 按文件 id 顺序重放快照数据文件中序列号大于 seqNo 的变更
+func (w *Watcher) replay(snap *Snapshot, seqNo uint64) error {
+	fileIds := make([]uint32, 0, len(snap.dataFiles))
+	for fileId := range snap.dataFiles {
+		fileIds = append(fileIds, fileId)
+	}
+	slices.Sort(fileIds)
+
+	// 暂存未读取到完成标识的事务记录
+	transactionEvents := make(map[uint64][]*ChangeEvent)
+	for _, fileId := range fileIds {
+		dataFile := snap.dataFiles[fileId]
+		var offset int64 = 0
+		for {
+			// 活跃文件仅读取到快照创建时刻的写入偏移, 避免读取到正在写入的数据
+			if fileId == snap.activeFid && offset >= snap.activeOff {
+				break
+			}
+			logRecord, size, err := dataFile.ReadLogRecord(offset)
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				return err
+			}
+			offset += size
+
+			// 仅重放快照创建前的变更, 之后的变更由实时事件投递
+			if logRecord.LogSeqNo <= seqNo || logRecord.LogSeqNo > snap.seqNo {
+				continue
+			}
+			// 仅重放订阅的 bucket 的变更
+			if logRecord.Bucket != w.bucketId {
+				continue
+			}
+
+			// 分离存储的 value 从 value log 中读取
+			if logRecord.Value, err = snap.valueOf(logRecord); err != nil {
+				return err
+			}
+			realKey, txnSeqNo := parseLogRecordKey(logRecord.Key)
+			if txnSeqNo == nonTransactionSeqNo {
+				event := w.newChangeEvent(realKey, logRecord, false)
+				if w.match(event) && !w.send(event) {
+					return nil
+				}
+				continue
+			}
+
+			// 事务记录在读取到完成标识后统一投递
+			if logRecord.Type == data.LogRecordTxnFinished {
+				for _, event := range transactionEvents[txnSeqNo] {
+					if w.match(event) && !w.send(event) {
+						return nil
+					}
+				}
+				delete(transactionEvents, txnSeqNo)
+			} else {
+				transactionEvents[txnSeqNo] = append(transactionEvents[txnSeqNo], w.newChangeEvent(realKey, logRecord, true))
+			}
+		}
+	}
+	return nil
+}
+
+// 根据日志记录构造变更事件
+func (w *Watcher) newChangeEvent(key []byte, logRecord *data.LogRecord, inBatch bool) *ChangeEvent {
+	event := &ChangeEvent{
+		Key:     key,
+		Deleted: logRecord.Type == data.LogRecordDeleted,
+		SeqNo:   logRecord.LogSeqNo,
+		InBatch: inBatch,
+		Bucket:  w.bucket,
+	}
+	if !event.Deleted {
+		event.Value = logRecord.Value
+	}
+	return event
+}
+
+// 向事件通道投递事件, 订阅关闭时返回 false
+func (w *Watcher) send(event *ChangeEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-w.done:
+		return false
+	}
+}
+
+// 判断事件是否属于订阅的 bucket 且 key 匹配订阅前缀
+func (w *Watcher) match(event *ChangeEvent) bool {
+	return event.Bucket == w.bucket && bytes.HasPrefix(event.Key, w.prefix)
+}
+
+// 关闭所有订阅者
+func (db *DB) closeWatchers() {
+	db.watchMu.Lock()
+	defer db.watchMu.Unlock()
+	for w := range db.watchers {
+		w.mu.Lock()
+		w.closeWithErr(nil)
+		w.mu.Unlock()
+		delete(db.watchers, w)
+	}
+}
+
+// 关闭订阅并记录终止原因, 调用方需持有订阅者锁
+func (w *Watcher) closeWithErr(err error) {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.err = err
+	w.queue = nil
+	close(w.done)
+	w.cond.Broadcast()
+}
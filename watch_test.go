@@ -0,0 +1,176 @@
+package xixi_kv
+
+import (
+	"github.com/XiXi-2024/xixi-kv/utils"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDB_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	w := db.Watch([]byte("user-"))
+
+	// 前缀不匹配的变更不投递
+	err = db.Put([]byte("order-1"), []byte("v"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("user-1"), []byte("v1"))
+	assert.Nil(t, err)
+	err = db.Delete([]byte("user-1"))
+	assert.Nil(t, err)
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Put([]byte("user-2"), []byte("v2"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	event := receiveEvent(t, w)
+	assert.Equal(t, []byte("user-1"), event.Key)
+	assert.Equal(t, []byte("v1"), event.Value)
+	assert.False(t, event.Deleted)
+	assert.False(t, event.InBatch)
+	assert.Equal(t, uint64(2), event.SeqNo)
+
+	event = receiveEvent(t, w)
+	assert.Equal(t, []byte("user-1"), event.Key)
+	assert.True(t, event.Deleted)
+	assert.Nil(t, event.Value)
+	assert.Equal(t, uint64(3), event.SeqNo)
+
+	event = receiveEvent(t, w)
+	assert.Equal(t, []byte("user-2"), event.Key)
+	assert.Equal(t, []byte("v2"), event.Value)
+	assert.True(t, event.InBatch)
+	assert.Equal(t, uint64(4), event.SeqNo)
+
+	// 关闭后通道关闭
+	w.Close()
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+	assert.Nil(t, w.Err())
+}
+
+func TestDB_WatchFrom(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-from")
+	opts.DirPath = dir
+	opts.DataFileSize = 4 * 1024
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	for i := 0; i < 100; i++ {
+		err := db.Put(utils.GetTestKey(i), utils.RandomValue(64))
+		assert.Nil(t, err)
+	}
+	wb, err := db.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Delete(utils.GetTestKey(0))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	// 重启后日志序列号不回退
+	err = db.Close()
+	assert.Nil(t, err)
+	db, err = Open(opts)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(102), db.logSeqNo)
+
+	// 先重放历史变更, 再投递实时变更
+	w := db.WatchFrom(nil, 90)
+	defer w.Close()
+	err = db.Put(utils.GetTestKey(100), []byte("live"))
+	assert.Nil(t, err)
+
+	for seqNo := uint64(91); seqNo <= 100; seqNo++ {
+		event := receiveEvent(t, w)
+		assert.Equal(t, seqNo, event.SeqNo)
+		assert.Equal(t, utils.GetTestKey(int(seqNo-1)), event.Key)
+	}
+	// 事务完成标识不投递
+	event := receiveEvent(t, w)
+	assert.Equal(t, uint64(101), event.SeqNo)
+	assert.True(t, event.Deleted)
+	assert.True(t, event.InBatch)
+	event = receiveEvent(t, w)
+	assert.Equal(t, uint64(103), event.SeqNo)
+	assert.Equal(t, []byte("live"), event.Value)
+	assert.Nil(t, db.Close())
+}
+
+func TestBucket_Watch(t *testing.T) {
+	opts := DefaultOptions
+	dir, _ := os.MkdirTemp("", "bitcask-go-watch-bucket")
+	opts.DirPath = dir
+	opts.EnableBackgroundMerge = false
+	db, err := Open(opts)
+	defer destroyDB(db)
+	assert.Nil(t, err)
+	assert.NotNil(t, db)
+
+	users, err := db.Bucket("users")
+	assert.Nil(t, err)
+	orders, err := db.Bucket("orders")
+	assert.Nil(t, err)
+	err = users.Put([]byte("k1"), []byte("v1"))
+	assert.Nil(t, err)
+
+	w := users.Watch(nil)
+	defer w.Close()
+	from := users.WatchFrom(nil, 0)
+	defer from.Close()
+	dw := db.Watch(nil)
+	defer dw.Close()
+
+	// 其它 bucket 的变更不投递
+	err = orders.Put([]byte("k1"), []byte("o1"))
+	assert.Nil(t, err)
+	err = db.Put([]byte("k1"), []byte("d1"))
+	assert.Nil(t, err)
+	wb, err := users.NewWriteBatch(DefaultWriteBatchOptions)
+	assert.Nil(t, err)
+	_ = wb.Delete([]byte("k1"))
+	err = wb.Commit()
+	assert.Nil(t, err)
+
+	event := receiveEvent(t, w)
+	assert.Equal(t, "users", event.Bucket)
+	assert.Equal(t, []byte("k1"), event.Key)
+	assert.True(t, event.Deleted)
+	assert.True(t, event.InBatch)
+
+	// 重放历史变更时同样填充 bucket 名称
+	event = receiveEvent(t, from)
+	assert.Equal(t, "users", event.Bucket)
+	assert.Equal(t, []byte("v1"), event.Value)
+	event = receiveEvent(t, from)
+	assert.Equal(t, "users", event.Bucket)
+	assert.True(t, event.Deleted)
+
+	event = receiveEvent(t, dw)
+	assert.Equal(t, "", event.Bucket)
+	assert.Equal(t, []byte("d1"), event.Value)
+}
+
+// 接收事件, 超时则测试失败
+func receiveEvent(t *testing.T, w *Watcher) *ChangeEvent {
+	select {
+	case event, ok := <-w.Events():
+		assert.True(t, ok)
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("receive change event timeout")
+		return nil
+	}
+}